@@ -0,0 +1,209 @@
+package admin
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/game"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 管理接口, 只应该监听本机地址, 每个请求都要带上 Authorization: Bearer <token>
+//
+//	GET  /connections                      列出所有连接
+//	GET  /games                            列出所有进行中的对局
+//	GET  /game?id=<对局id>                  查看对局的局面和着法
+//	POST /kick?conn=<连接id>                断开一个连接
+//	POST /abort?game=<对局id>               作废一局对局, 不影响等级分
+//	POST /adjudicate?game=<对局id>&winner=white|black|draw  裁定对局结果
+//	POST /broadcast                        请求体作为公告发给所有连接
+//	GET  /maintenance                      查看维护模式
+//	POST /maintenance?enabled=true|false   开关维护模式, 请求体作为说明发给所有连接
+type Handler struct {
+	token []byte
+	mux   *http.ServeMux
+}
+
+func NewHandler(token string) *Handler {
+	h := &Handler{token: []byte(token), mux: http.NewServeMux()}
+	h.mux.HandleFunc("/connections", h.get(h.listConnections))
+	h.mux.HandleFunc("/games", h.get(h.listGames))
+	h.mux.HandleFunc("/game", h.get(h.inspectGame))
+	h.mux.HandleFunc("/kick", h.post(h.kick))
+	h.mux.HandleFunc("/abort", h.post(h.abort))
+	h.mux.HandleFunc("/adjudicate", h.post(h.adjudicate))
+	h.mux.HandleFunc("/broadcast", h.post(h.broadcast))
+	h.mux.HandleFunc("/maintenance", h.maintenance)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) get(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (h *Handler) post(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// 没有找到对象的错误返回404, 其他返回500
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, map[string]bool{"ok": true})
+	case errors.Is(err, game.ErrGameNotFound), errors.Is(err, game.ErrConnNotFound):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func queryInt(r *http.Request, key string) (int64, error) {
+	value, err := strconv.ParseInt(r.URL.Query().Get(key), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid " + key)
+	}
+	return value, nil
+}
+
+// 请求体最多读这么多字节, 用作公告和维护说明
+const maxMessageBytes = 4096
+
+func readMessage(r *http.Request) (string, error) {
+	bs, err := io.ReadAll(io.LimitReader(r.Body, maxMessageBytes))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func (h *Handler) listConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, game.AdminListConns())
+}
+
+func (h *Handler) listGames(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, game.AdminListGames())
+}
+
+func (h *Handler) inspectGame(w http.ResponseWriter, r *http.Request) {
+	gameID, err := queryInt(r, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	detail, err := game.AdminInspectGame(gameID)
+	if err != nil {
+		writeResult(w, err)
+		return
+	}
+	writeJSON(w, detail)
+}
+
+func (h *Handler) kick(w http.ResponseWriter, r *http.Request) {
+	connID, err := queryInt(r, "conn")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeResult(w, game.AdminKick(int(connID)))
+}
+
+func (h *Handler) abort(w http.ResponseWriter, r *http.Request) {
+	gameID, err := queryInt(r, "game")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeResult(w, game.AdminEndGame(gameID, chess.SideBoth, true))
+}
+
+func (h *Handler) adjudicate(w http.ResponseWriter, r *http.Request) {
+	gameID, err := queryInt(r, "game")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var winnerSide chess.Side
+	switch r.URL.Query().Get("winner") {
+	case "white":
+		winnerSide = chess.SideWhite
+	case "black":
+		winnerSide = chess.SideBlack
+	case "draw":
+		winnerSide = chess.SideBoth
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid winner"))
+		return
+	}
+	writeResult(w, game.AdminEndGame(gameID, winnerSide, false))
+}
+
+func (h *Handler) broadcast(w http.ResponseWriter, r *http.Request) {
+	message, err := readMessage(r)
+	if err != nil || message == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty message"))
+		return
+	}
+	game.AdminBroadcast(message)
+	writeResult(w, nil)
+}
+
+func (h *Handler) maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		enabled, message := game.Maintenance()
+		writeJSON(w, map[string]interface{}{"enabled": enabled, "message": message})
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid enabled"))
+			return
+		}
+		message, err := readMessage(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		game.SetMaintenance(enabled, message)
+		writeResult(w, nil)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
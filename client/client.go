@@ -0,0 +1,338 @@
+// Go写的客户端用的SDK, 负责分包, 握手, 登录, 心跳和断线重连, 服务端发来的包通过Handler里的回调通知
+//
+//	c, err := client.Connect(client.Config{
+//		Addr: "127.0.0.1:8000",
+//		Handler: client.Handler{
+//			OnRemoteMove: func(p *packets.PacketServerNotifyRemoteMove) { ... },
+//			OnGameOver:   func(p *packets.PacketServerGameOver) { ... },
+//		},
+//	})
+//	c.StartMatch()
+package client
+
+import (
+	"bufio"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	packtool "chess-backend/tools/packet"
+)
+
+var ErrClosed = errors.New("client: closed")
+var ErrNotConnected = errors.New("client: not connected")
+
+// 连接, 握手和登录的超时时间
+const dialTimeout = 10 * time.Second
+
+type Config struct {
+	// 服务端的地址, 比如127.0.0.1:8000
+	Addr string
+	// 不为nil时使用TLS
+	TLSConfig *tls.Config
+	// 握手时请求二进制编码
+	Binary bool
+
+	// 不为空时连接之后登录, 重连之后也会重新登录
+	Name     string
+	Password string
+	// 账号不存在时注册
+	Register bool
+
+	// 断线之后每隔多久尝试重连一次, 为0时不重连
+	ReconnectInterval time.Duration
+
+	Handler Handler
+}
+
+type Client struct {
+	config Config
+
+	lock   sync.Mutex
+	conn   net.Conn
+	codec  packets.Codec
+	closed bool
+	// 下一步棋是否带上提和
+	offerDraw bool
+	// 登录之后的账号
+	accountID int64
+
+	// 写一个包需要持有, 避免多个协程同时写的包交错
+	writeLock sync.Mutex
+	done      chan struct{}
+}
+
+// 连接到服务端, 握手并且登录(设置了Name的话), 返回之后开始在后台收包和发送心跳
+// 第一次连接失败时直接返回错误, 不会重连
+func Connect(config Config) (*Client, error) {
+	c := &Client{config: config, done: make(chan struct{})}
+	conn, reader, codec, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.codec = codec
+
+	go c.readLoop(conn, reader, codec)
+	go c.heartbeatLoop()
+	return c, nil
+}
+
+// 登录之后的账号id, 没有登录时为0
+func (c *Client) AccountID() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.accountID
+}
+
+// 断开连接, 不再重连
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// 发送任意的包, 用来发SDK没有封装的包, 收到的回复通过Handler.OnPacket通知
+func (c *Client) Send(p packets.Packet) error {
+	c.lock.Lock()
+	conn, codec, closed := c.conn, c.codec, c.closed
+	c.lock.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return writePacket(&c.writeLock, conn, codec, p)
+}
+
+func writePacket(writeLock *sync.Mutex, conn net.Conn, codec packets.Codec, p packets.Packet) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	_, err := conn.Write(packtool.DoPackWith4BytesHeader(codec.MustMarshal(p)))
+	return err
+}
+
+// 读一个包, 解析不了的包(比如更新的服务端加的包)返回nil, 不当作错误
+// 长度头不合法时返回错误, 不按长度头去分配内存
+func readPacket(reader *bufio.Reader, codec packets.Codec) (packets.Packet, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > settings.MaxFrameSize {
+		return nil, fmt.Errorf("client: invalid packet length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	p, err := codec.ClientParse(body)
+	if err != nil {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// 建立连接, 握手, 登录, 这时还没有开始收包的协程, 所以直接在这里等回复
+// 返回的reader里可能已经缓存了登录回复之后的包, 之后在这个连接上收包都要用它
+func (c *Client) dial() (net.Conn, *bufio.Reader, packets.Codec, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if c.config.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.config.Addr, c.config.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.config.Addr)
+	}
+	if err != nil {
+		return nil, nil, packets.CodecJSON, err
+	}
+
+	reader := bufio.NewReader(conn)
+	codec, err := c.handshake(conn, reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, packets.CodecJSON, err
+	}
+	return conn, reader, codec, nil
+}
+
+func (c *Client) handshake(conn net.Conn, reader *bufio.Reader) (packets.Codec, error) {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var writeLock sync.Mutex
+	codec := packets.CodecJSON
+
+	hello := &packets.PacketClientHello{Version: packets.ProtocolVersion, Features: []string{}}
+	if c.config.Binary {
+		hello.Features = append(hello.Features, packets.FeatureBinaryCodec)
+	}
+	if err := writePacket(&writeLock, conn, codec, hello); err != nil {
+		return codec, err
+	}
+
+	// 握手之前服务端只会发心跳
+	for {
+		p, err := readPacket(reader, codec)
+		if err != nil {
+			return codec, err
+		}
+		welcome, ok := p.(*packets.PacketServerWelcome)
+		if !ok {
+			continue
+		}
+		if !welcome.OK {
+			return codec, fmt.Errorf("client: handshake rejected: %s", welcome.Message)
+		}
+		for _, feature := range welcome.Features {
+			if feature == packets.FeatureBinaryCodec {
+				codec = packets.CodecBinary
+			}
+		}
+		break
+	}
+
+	if c.config.Name == "" {
+		return codec, nil
+	}
+	login := &packets.PacketClientLogin{Name: c.config.Name, Password: c.config.Password, Register: c.config.Register}
+	if err := writePacket(&writeLock, conn, codec, login); err != nil {
+		return codec, err
+	}
+	for {
+		p, err := readPacket(reader, codec)
+		if err != nil {
+			return codec, err
+		}
+		resp, ok := p.(*packets.PacketServerLoginResp)
+		if !ok {
+			continue
+		}
+		if !resp.OK {
+			return codec, fmt.Errorf("client: login failed: %s", resp.Message)
+		}
+		c.lock.Lock()
+		c.accountID = resp.AccountID
+		c.lock.Unlock()
+		return codec, nil
+	}
+}
+
+// 收包, 连接断开之后按设置重连, 然后在新的连接上继续收包
+func (c *Client) readLoop(conn net.Conn, reader *bufio.Reader, codec packets.Codec) {
+	for {
+		err := c.readUntilError(conn, reader, codec)
+
+		c.lock.Lock()
+		closed := c.closed
+		if !closed {
+			c.conn = nil
+			c.offerDraw = false
+		}
+		c.lock.Unlock()
+		conn.Close()
+		if closed {
+			return
+		}
+
+		if c.config.Handler.OnDisconnect != nil {
+			c.config.Handler.OnDisconnect(err)
+		}
+		if c.config.ReconnectInterval == 0 {
+			return
+		}
+
+		conn, reader, codec = c.reconnect()
+		if conn == nil {
+			return
+		}
+		if c.config.Handler.OnReconnect != nil {
+			c.config.Handler.OnReconnect()
+		}
+	}
+}
+
+func (c *Client) readUntilError(conn net.Conn, reader *bufio.Reader, codec packets.Codec) error {
+	for {
+		// 收到任何包都说明连接还在
+		conn.SetReadDeadline(time.Now().Add(heartbeatTimeout))
+		p, err := readPacket(reader, codec)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			c.dispatch(p)
+		}
+	}
+}
+
+// 每隔ReconnectInterval重连一次, 直到成功或者Close, Close时返回nil
+func (c *Client) reconnect() (net.Conn, *bufio.Reader, packets.Codec) {
+	for {
+		select {
+		case <-c.done:
+			return nil, nil, packets.CodecJSON
+		case <-time.After(c.config.ReconnectInterval):
+		}
+
+		conn, reader, codec, err := c.dial()
+		if err != nil {
+			if c.config.Handler.OnReconnectFailed != nil {
+				c.config.Handler.OnReconnectFailed(err)
+			}
+			continue
+		}
+
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			conn.Close()
+			return nil, nil, packets.CodecJSON
+		}
+		c.conn = conn
+		c.codec = codec
+		c.lock.Unlock()
+		return conn, reader, codec
+	}
+}
+
+// 服务端超过这么久没有发来任何包就当作断线, 和服务端判定客户端断线的条件一样
+const heartbeatTimeout = time.Millisecond * settings.HeartbeatInterval * settings.MaxLoseHeartbeat
+
+// 按服务端的心跳频率发送心跳, 断线期间不发
+func (c *Client) heartbeatLoop() {
+	ticker := time.NewTicker(time.Millisecond * settings.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			err := c.Send(&packets.PacketHeartbeat{})
+			if err == ErrClosed {
+				return
+			}
+		}
+	}
+}
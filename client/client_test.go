@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+
+	packtool "chess-backend/tools/packet"
+)
+
+// 假的服务端, 回复握手和登录, 登录回复和继续对局的通知在同一次写里发出去
+func serveLoginThenResume(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expect := func(want packets.Packet) {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Error(err)
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := packets.CodecJSON.ServerParse(body); err != nil {
+			t.Errorf("parse %T: %v", want, err)
+		}
+	}
+	expect(&packets.PacketClientHello{})
+	conn.Write(packtool.DoPackWith4BytesHeader(packets.CodecJSON.MustMarshal(
+		&packets.PacketServerWelcome{OK: true, Version: packets.ProtocolVersion, Features: []string{}},
+	)))
+	expect(&packets.PacketClientLogin{})
+
+	var out bytes.Buffer
+	out.Write(packtool.DoPackWith4BytesHeader(packets.CodecJSON.MustMarshal(&packets.PacketServerLoginResp{OK: true, AccountID: 7})))
+	out.Write(packtool.DoPackWith4BytesHeader(packets.CodecJSON.MustMarshal(&packets.PacketServerGameResumed{GameID: 42})))
+	conn.Write(out.Bytes())
+
+	// 等客户端断开
+	reader.ReadByte()
+}
+
+// 握手时已经读进缓冲区的包不能丢, 要在之后收包时交给Handler
+func TestPacketsBufferedDuringHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveLoginThenResume(t, l)
+
+	resumed := make(chan *packets.PacketServerGameResumed, 1)
+	c, err := Connect(Config{
+		Addr:     l.Addr().String(),
+		Name:     "resume",
+		Password: "secret",
+		Handler: Handler{
+			OnGameResumed: func(p *packets.PacketServerGameResumed) { resumed <- p },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.AccountID() != 7 {
+		t.Errorf("got account %d, want 7", c.AccountID())
+	}
+	select {
+	case p := <-resumed:
+		if p.GameID != 42 {
+			t.Errorf("got %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("game resumed notification lost")
+	}
+}
+
+// 长度头为0或者超过MaxFrameSize时直接报错, 不按长度头分配内存
+func TestReadPacketLength(t *testing.T) {
+	heartbeat := packets.CodecJSON.MustMarshal(&packets.PacketHeartbeat{})
+	tests := []struct {
+		name   string
+		length uint32
+		body   []byte
+		ok     bool
+	}{
+		{"valid", uint32(len(heartbeat)), heartbeat, true},
+		{"empty", 0, nil, false},
+		{"too large", settings.MaxFrameSize + 1, heartbeat, false},
+		{"huge", 0xffffffff, heartbeat, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := binary.BigEndian.AppendUint32(nil, tt.length)
+			data = append(data, tt.body...)
+			p, err := readPacket(bufio.NewReader(bytes.NewReader(data)), packets.CodecJSON)
+			if tt.ok && (err != nil || p == nil) {
+				t.Errorf("got %v, %v", p, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("got %v, want an error", p)
+			}
+		})
+	}
+}
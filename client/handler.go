@@ -0,0 +1,134 @@
+package client
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+)
+
+// 事件回调, 没有设置的回调忽略对应的事件
+// 除了OnReconnectFailed, 回调都在同一个收包的协程里按收到的顺序调用, 回调里可以调用Client的方法,
+// 但是阻塞的话之后的包和心跳超时的检测都会被推迟
+type Handler struct {
+	// 匹配成功, 对局开始
+	OnMatched func(p *packets.PacketServerMatchedOK)
+	// 自己走棋的结果, MoveRespType为PacketTypeServerMoveRespTypePawnUpgrade时需要调用Promote
+	OnMoveResult func(p *packets.PacketServerMoveResp)
+	// 自己升变完成
+	OnUpgradeOK func(p *packets.PacketServerUpgradeOK)
+	// 对手走了一步棋, RemotePawnUpgrade为true时对手还要选择升变成什么, 之后会收到OnRemoteUpgrade
+	// RemoteRequestDraw为true时对手提和, 需要调用AnswerDraw
+	OnRemoteMove func(p *packets.PacketServerNotifyRemoteMove)
+	// 对手完成了升变
+	OnRemoteUpgrade func(p *packets.PacketServerRemoteUpgradeOK)
+	OnGameOver      func(p *packets.PacketServerGameOver)
+	// 对手断线, 对局已经结束
+	OnRemoteLoseConnection func()
+	// 服务端拒绝了自己发的包
+	OnError func(p *packets.PacketServerError)
+
+	// 服务端重启之后双方都重新登录了, 继续之前的对局
+	OnGameResumed func(p *packets.PacketServerGameResumed)
+
+	// 连接断开, 服务端会判负断线一方正在进行的对局, 所以重连之后是空闲状态, 服务端重启的话见OnGameResumed
+	OnDisconnect func(err error)
+	// 重连并且重新登录成功
+	OnReconnect func()
+	// 一次重连失败, 在重连的协程里调用
+	OnReconnectFailed func(err error)
+
+	// 所有收到的包都会调用, 在上面的回调之前, 心跳除外
+	OnPacket func(p interface{})
+}
+
+// 收到一个包之后调用对应的回调
+func (c *Client) dispatch(packIface interface{}) {
+	h := &c.config.Handler
+	if _, ok := packIface.(*packets.PacketHeartbeat); ok {
+		return
+	}
+	if h.OnPacket != nil {
+		h.OnPacket(packIface)
+	}
+
+	switch p := packIface.(type) {
+	case *packets.PacketServerMatchedOK:
+		c.setOfferDraw(false)
+		if h.OnMatched != nil {
+			h.OnMatched(p)
+		}
+	case *packets.PacketServerMoveResp:
+		if h.OnMoveResult != nil {
+			h.OnMoveResult(p)
+		}
+	case *packets.PacketServerUpgradeOK:
+		if h.OnUpgradeOK != nil {
+			h.OnUpgradeOK(p)
+		}
+	case *packets.PacketServerNotifyRemoteMove:
+		if h.OnRemoteMove != nil {
+			h.OnRemoteMove(p)
+		}
+	case *packets.PacketServerRemoteUpgradeOK:
+		if h.OnRemoteUpgrade != nil {
+			h.OnRemoteUpgrade(p)
+		}
+	case *packets.PacketServerGameOver:
+		c.setOfferDraw(false)
+		if h.OnGameOver != nil {
+			h.OnGameOver(p)
+		}
+	case *packets.PacketServerRemoteLoseConnection:
+		c.setOfferDraw(false)
+		if h.OnRemoteLoseConnection != nil {
+			h.OnRemoteLoseConnection()
+		}
+	case *packets.PacketServerGameResumed:
+		if h.OnGameResumed != nil {
+			h.OnGameResumed(p)
+		}
+	case *packets.PacketServerError:
+		if h.OnError != nil {
+			h.OnError(p)
+		}
+	}
+}
+
+func (c *Client) setOfferDraw(offerDraw bool) {
+	c.lock.Lock()
+	c.offerDraw = offerDraw
+	c.lock.Unlock()
+}
+
+// 开始匹配, 匹配成功时调用OnMatched
+func (c *Client) StartMatch() error {
+	return c.Send(&packets.PacketClientStartMatch{})
+}
+
+// 走一步棋, 之前调用过OfferDraw的话同时提和
+func (c *Client) Move(fromX rune, fromY int, toX rune, toY int) error {
+	c.lock.Lock()
+	offerDraw := c.offerDraw
+	c.offerDraw = false
+	c.lock.Unlock()
+
+	return c.Send(&packets.PacketClientMove{FromX: fromX, FromY: fromY, ToX: toX, ToY: toY, DoDraw: offerDraw})
+}
+
+// 兵走到底线之后选择升变成什么
+func (c *Client) Promote(pieceType chess.ChessPieceType) error {
+	return c.Send(&packets.PacketClientSendPawnUpgrade{ChessPieceType: pieceType})
+}
+
+// 提和只能随着走棋一起提出, 这里只是记下来, 下一次Move时带上
+func (c *Client) OfferDraw() {
+	c.setOfferDraw(true)
+}
+
+// 应答对手的提和
+func (c *Client) AnswerDraw(accept bool) error {
+	return c.Send(&packets.PacketClientWheatherAcceptDraw{AcceptDraw: accept})
+}
+
+func (c *Client) Surrender() error {
+	return c.Send(&packets.PacketClientDoSurrender{})
+}
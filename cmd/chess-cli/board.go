@@ -0,0 +1,138 @@
+package main
+
+import (
+	"chess-backend/comm/chess"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 有颜色时两方都用实心的棋子, 靠前景色区分; 没有颜色时白方用空心的棋子
+var solidPieces = map[chess.ChessPieceType]string{
+	chess.ChessPieceTypeRook:   "♜",
+	chess.ChessPieceTypeKnight: "♞",
+	chess.ChessPieceTypeBishop: "♝",
+	chess.ChessPieceTypeQueen:  "♛",
+	chess.ChessPieceTypeKing:   "♚",
+	chess.ChessPieceTypePawn:   "♟",
+}
+
+var hollowPieces = map[chess.ChessPieceType]string{
+	chess.ChessPieceTypeRook:   "♖",
+	chess.ChessPieceTypeKnight: "♘",
+	chess.ChessPieceTypeBishop: "♗",
+	chess.ChessPieceTypeQueen:  "♕",
+	chess.ChessPieceTypeKing:   "♔",
+	chess.ChessPieceTypePawn:   "♙",
+}
+
+const (
+	ansiReset       = "\033[0m"
+	ansiLightSquare = "\033[48;5;180m"
+	ansiDarkSquare  = "\033[48;5;137m"
+	ansiWhitePiece  = "\033[1;97m"
+	ansiBlackPiece  = "\033[1;30m"
+	ansiWarning     = "\033[1;31m"
+)
+
+func pieceGlyph(piece *chess.ChessPiece, color bool) string {
+	if color || piece.GameSide == chess.SideBlack {
+		return solidPieces[piece.PieceType]
+	}
+	return hollowPieces[piece.PieceType]
+}
+
+// 从side的视角画棋盘, 自己的一方在下面
+func renderBoard(table *chess.ChessTable, side chess.Side, color bool) string {
+	var b strings.Builder
+	files := "abcdefgh"
+	ranks := []int{8, 7, 6, 5, 4, 3, 2, 1}
+	if side == chess.SideBlack {
+		files = "hgfedcba"
+		ranks = []int{1, 2, 3, 4, 5, 6, 7, 8}
+	}
+
+	for _, y := range ranks {
+		fmt.Fprintf(&b, " %d ", y)
+		for _, x := range files {
+			piece := table.GetPosition(x, y)
+			// a1是深色的格子
+			dark := (int(x-'a')+y)%2 == 1
+			glyph := " "
+			if piece != nil {
+				glyph = pieceGlyph(piece, color)
+			}
+			if !color {
+				fmt.Fprintf(&b, "%s ", glyph)
+				continue
+			}
+
+			background := ansiLightSquare
+			if dark {
+				background = ansiDarkSquare
+			}
+			foreground := ansiWhitePiece
+			if piece != nil && piece.GameSide == chess.SideBlack {
+				foreground = ansiBlackPiece
+			}
+			fmt.Fprintf(&b, "%s%s%s %s", background, foreground, glyph, ansiReset)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("   ")
+	for _, x := range files {
+		fmt.Fprintf(&b, "%c ", x)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// 棋钟, 包里的剩余时间是发包时的, 走时的一方要减去之后过去的时间
+type clockState struct {
+	whiteMs    int64
+	blackMs    int64
+	running    chess.Side
+	receivedAt time.Time
+}
+
+func (cs *clockState) remaining(side chess.Side, now time.Time) time.Duration {
+	ms := cs.whiteMs
+	if side == chess.SideBlack {
+		ms = cs.blackMs
+	}
+	remaining := time.Duration(ms) * time.Millisecond
+	if cs.running == side {
+		remaining -= now.Sub(cs.receivedAt)
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+func formatClock(d time.Duration) string {
+	d = d.Round(100 * time.Millisecond)
+	minutes := int(d / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%d:%04.1f", minutes, seconds)
+}
+
+func (cs *clockState) String() string {
+	now := time.Now()
+	white := "白方 " + formatClock(cs.remaining(chess.SideWhite, now))
+	black := "黑方 " + formatClock(cs.remaining(chess.SideBlack, now))
+	switch cs.running {
+	case chess.SideWhite:
+		white += " ◀"
+	case chess.SideBlack:
+		black += " ◀"
+	}
+	return white + "  |  " + black
+}
+
+func warning(text string, color bool) string {
+	if !color {
+		return "!! " + text
+	}
+	return ansiWarning + text + ansiReset
+}
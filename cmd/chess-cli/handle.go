@@ -0,0 +1,416 @@
+package main
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var sideNames = map[chess.Side]string{
+	chess.SideWhite: "白方",
+	chess.SideBlack: "黑方",
+	chess.SideBoth:  "随机",
+}
+
+var pieceNames = map[chess.ChessPieceType]string{
+	chess.ChessPieceTypeRook:   "车",
+	chess.ChessPieceTypeKnight: "马",
+	chess.ChessPieceTypeBishop: "象",
+	chess.ChessPieceTypeQueen:  "后",
+	chess.ChessPieceTypeKing:   "王",
+	chess.ChessPieceTypePawn:   "兵",
+}
+
+var tournamentFormatNames = map[packets.TournamentFormat]string{
+	packets.TournamentFormatSwiss:      "瑞士制",
+	packets.TournamentFormatRoundRobin: "单循环",
+	packets.TournamentFormatArena:      "竞技场",
+}
+
+var tournamentStateNames = map[packets.TournamentState]string{
+	packets.TournamentStateRegistering: "报名中",
+	packets.TournamentStateRunning:     "进行中",
+	packets.TournamentStateFinished:    "已结束",
+}
+
+var tournamentResultNames = map[packets.TournamentResult]string{
+	packets.TournamentResultPending:       "进行中",
+	packets.TournamentResultWhiteWin:      "1-0",
+	packets.TournamentResultBlackWin:      "0-1",
+	packets.TournamentResultDraw:          "½-½",
+	packets.TournamentResultDoubleForfeit: "双方弃权",
+	packets.TournamentResultBye:           "轮空",
+}
+
+func formatOptions(options chess.GameOptions) string {
+	tc := options.TimeControl
+	var s string
+	switch {
+	case tc.Correspondence():
+		s = fmt.Sprintf("每步%d天", tc.DaysPerMove)
+	case tc.Unlimited():
+		s = "不限时"
+	default:
+		s = fmt.Sprintf("%d+%d", tc.InitialSeconds/60, tc.IncrementSeconds)
+	}
+	if options.Casual {
+		s += " 不计分"
+	}
+	return s
+}
+
+func formatMove(move packets.MoveInfo) string {
+	s := fmt.Sprintf("%s %c%d-%c%d", sideNames[move.Side], move.FromX, move.FromY, move.ToX, move.ToY)
+	if move.Upgrade != nil {
+		s += "=" + pieceNames[*move.Upgrade]
+	}
+	return s
+}
+
+func (ui *cli) setClock(p *packets.PacketServerClockUpdate) {
+	if p == nil {
+		ui.clock = nil
+		return
+	}
+	ui.clock = &clockState{
+		whiteMs:    p.WhiteRemainingMs,
+		blackMs:    p.BlackRemainingMs,
+		running:    p.Running,
+		receivedAt: time.Now(),
+	}
+}
+
+// 处理服务端发来的所有包, 在SDK收包的协程里调用
+func (ui *cli) handlePacket(p interface{}) {
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	switch p := p.(type) {
+	// 对局
+	case *packets.PacketServerMatching:
+		fmt.Println("正在匹配对手...")
+	case *packets.PacketServerMatchedOK:
+		ui.side = p.Side
+		ui.table = p.Table
+		ui.inGame = true
+		ui.clock = nil
+		ui.pendingPromotion = nil
+		fmt.Printf("匹配成功, 你执%s, %s\n", sideNames[p.Side], formatOptions(p.Options))
+		ui.printBoardLocked()
+	case *packets.PacketServerMoveResp:
+		switch p.MoveRespType {
+		case packets.PacketTypeServerMoveRespTypeOK:
+			if p.TableOnOK != nil {
+				ui.table = p.TableOnOK
+			}
+			ui.printBoardLocked()
+			if p.KingThreat {
+				fmt.Println(warning("将军!", ui.color))
+			}
+		case packets.PacketTypeServerMoveRespTypeFailed:
+			ui.pendingPromotion = nil
+			fmt.Println("这步棋不合法")
+		case packets.PacketTypeServerMoveRespTypePawnUpgrade:
+			if p.TableOnOK != nil {
+				ui.table = p.TableOnOK
+			}
+			if ui.pendingPromotion != nil {
+				pieceType := *ui.pendingPromotion
+				ui.pendingPromotion = nil
+				// 在另一个协程里发, 避免持有锁的时候阻塞在写上
+				go ui.client.Promote(pieceType)
+				return
+			}
+			ui.printBoardLocked()
+			fmt.Println("兵到达了底线, 用swi bishop/knight/rook/queen选择升变的棋子")
+		}
+	case *packets.PacketServerUpgradeOK:
+		if p.Table != nil {
+			ui.table = p.Table
+		}
+		ui.printBoardLocked()
+	case *packets.PacketServerNotifyRemoteMove:
+		if p.Table != nil {
+			ui.table = p.Table
+		}
+		if p.RemotePawnUpgrade {
+			fmt.Println("对手的兵到达了底线, 等待对手选择升变的棋子")
+			return
+		}
+		ui.printBoardLocked()
+		if p.KingThreat {
+			fmt.Println(warning("你被将军了!", ui.color))
+		}
+		if p.RemoteRequestDraw {
+			fmt.Println("对手提出和棋, 输入accept接受或者refuse拒绝")
+		}
+	case *packets.PacketServerRemoteUpgradeOK:
+		if p.Table != nil {
+			ui.table = p.Table
+		}
+		ui.printBoardLocked()
+		if p.RemoteRequestDraw {
+			fmt.Println("对手提出和棋, 输入accept接受或者refuse拒绝")
+		}
+	case *packets.PacketServerClockUpdate:
+		ui.setClock(p)
+		fmt.Println(ui.clock.String())
+	case *packets.PacketServerGameOver:
+		if p.Table != nil {
+			ui.table = p.Table
+		}
+		ui.printBoardLocked()
+		ui.inGame = false
+		ui.pendingPromotion = nil
+		var result string
+		switch {
+		case p.IsDraw:
+			result = "和棋"
+		case p.WinnerSide == ui.side:
+			result = "你赢了"
+		default:
+			result = "你输了"
+		}
+		var reason string
+		switch {
+		case p.IsSurrender:
+			reason = "投降"
+		case p.IsTimeout:
+			reason = "超时"
+		default:
+			reason = p.Reason
+		}
+		if reason != "" {
+			result += " (" + reason + ")"
+		}
+		fmt.Println("对局结束, " + result)
+	case *packets.PacketServerRemoteLoseConnection:
+		fmt.Println(warning("对手断线了", ui.color))
+	case *packets.PacketServerGameResumed:
+		ui.side = p.Side
+		ui.table = p.Table
+		ui.inGame = true
+		ui.setClock(p.Clock)
+		fmt.Printf("恢复了对局%d, 你执%s, 已经走了%d步\n", p.GameID, sideNames[p.Side], len(p.Moves))
+		ui.printBoardLocked()
+		switch {
+		case p.WaitingUpgrade && p.WaitingSide == ui.side:
+			fmt.Println("等待你选择升变的棋子, 用swi bishop/knight/rook/queen")
+		case p.DrawOffered && p.WaitingSide == ui.side:
+			fmt.Println("对手提出和棋, 输入accept接受或者refuse拒绝")
+		}
+
+	// 账号和房间
+	case *packets.PacketServerLoginResp:
+		if p.OK {
+			fmt.Printf("登录成功, 账号%d, 等级分%d\n", p.AccountID, p.Rating)
+		} else {
+			fmt.Println("登录失败:", p.Message)
+		}
+	case *packets.PacketServerRoomCreated:
+		fmt.Println("房间已创建, 邀请码", p.InviteCode)
+	case *packets.PacketServerJoinRoomResp:
+		if !p.OK {
+			fmt.Println("加入房间失败:", p.Message)
+		}
+
+	// 挑战
+	case *packets.PacketServerChallengeResp:
+		if p.OK {
+			fmt.Println("已发出挑战", p.ChallengeID)
+		} else {
+			fmt.Println("挑战失败:", p.Message)
+		}
+	case *packets.PacketServerChallengeReceived:
+		from := p.FromName
+		if from == "" {
+			from = "匿名玩家"
+		}
+		fmt.Printf("%s向你发起挑战%d, 你将执%s, %s\n", from, p.ChallengeID, sideNames[p.Side], formatOptions(p.Options))
+	case *packets.PacketServerChallengeCanceled:
+		if p.Declined {
+			fmt.Printf("挑战%d被拒绝了\n", p.ChallengeID)
+		} else {
+			fmt.Printf("挑战%d已经失效\n", p.ChallengeID)
+		}
+
+	// 观战
+	case *packets.PacketServerGameList:
+		fmt.Printf("进行中的对局(%d):\n", len(p.Games))
+		for _, game := range p.Games {
+			fmt.Printf("  %d  %s vs %s  %s  %d步  %d人观战\n", game.GameID, game.WhiteName, game.BlackName, formatOptions(game.Options), game.MoveCount, game.Spectators)
+		}
+	case *packets.PacketServerSpectateResp:
+		if !p.OK {
+			fmt.Println("观战失败:", p.Message)
+			return
+		}
+		fmt.Printf("开始观战对局%d\n", p.GameID)
+		if p.Table != nil {
+			fmt.Print(renderBoard(p.Table, chess.SideWhite, ui.color))
+		}
+	case *packets.PacketServerSpectateMove:
+		fmt.Printf("[观战%d] %s\n", p.GameID, formatMove(p.Move))
+		if p.Table != nil {
+			fmt.Print(renderBoard(p.Table, chess.SideWhite, ui.color))
+		}
+		if p.KingThreat {
+			fmt.Println(warning("将军!", ui.color))
+		}
+	case *packets.PacketServerSpectateUpgrade:
+		fmt.Printf("[观战%d] %s的兵升变为%s\n", p.GameID, sideNames[p.Side], pieceNames[p.PieceType])
+	case *packets.PacketServerSpectateDraw:
+		if p.Offer {
+			fmt.Printf("[观战%d] %s提出和棋\n", p.GameID, sideNames[p.Side])
+		} else {
+			fmt.Printf("[观战%d] %s拒绝和棋\n", p.GameID, sideNames[p.Side])
+		}
+
+	// 聊天和再来一局
+	case *packets.PacketServerChat:
+		from := p.FromName
+		if from == "" {
+			from = sideNames[p.FromSide]
+		}
+		if p.Channel == packets.ChatChannelSpectators {
+			from = "[观战] " + from
+		}
+		fmt.Printf("%s: %s\n", from, p.Text)
+	case *packets.PacketServerChatRejected:
+		fmt.Println("消息没有发送:", p.Reason)
+	case *packets.PacketServerRematchOffered:
+		fmt.Println("对手想再来一局")
+	case *packets.PacketServerRematchCanceled:
+		if p.Declined {
+			fmt.Println("对手拒绝了再来一局")
+		} else {
+			fmt.Println("再来一局的请求已经失效")
+		}
+
+	// 锦标赛
+	case *packets.PacketServerTournamentResp:
+		if p.OK {
+			fmt.Println("锦标赛操作成功", p.TournamentID)
+		} else {
+			fmt.Println("锦标赛操作失败:", p.Message)
+		}
+	case *packets.PacketServerTournamentList:
+		fmt.Printf("锦标赛(%d):\n", len(p.Tournaments))
+		for _, t := range p.Tournaments {
+			fmt.Printf("  %d  %s  %s  %s  第%d/%d轮  %d人  %s\n", t.TournamentID, t.Name, tournamentFormatNames[t.Format], tournamentStateNames[t.State], t.CurrentRound, t.TotalRounds, t.Players, formatOptions(t.Options))
+		}
+	case *packets.PacketServerTournamentRound:
+		fmt.Printf("锦标赛%d第%d轮:\n", p.TournamentID, p.Round)
+		for _, pairing := range p.Pairings {
+			fmt.Printf("  %s vs %s  %s\n", pairing.WhiteName, pairing.BlackName, tournamentResultNames[pairing.Result])
+		}
+	case *packets.PacketServerTournamentStandings:
+		title := fmt.Sprintf("锦标赛%d第%d轮后的排名", p.TournamentID, p.Round)
+		if p.Finished {
+			title = fmt.Sprintf("锦标赛%d最终排名", p.TournamentID)
+		}
+		fmt.Println(title + ":")
+		for _, s := range p.Standings {
+			fmt.Printf("  %d. %s  %.1f分  布赫霍尔茨%.1f\n", s.Rank, s.Name, s.Score, s.Buchholz)
+		}
+	case *packets.PacketServerBerserk:
+		fmt.Printf("%s选择了狂暴模式\n", sideNames[p.Side])
+	case *packets.PacketServerArenaLeaderboard:
+		if p.Finished {
+			fmt.Printf("竞技场%d已结束:\n", p.TournamentID)
+		} else {
+			fmt.Printf("竞技场%d, 剩余%s:\n", p.TournamentID, formatClock(time.Duration(p.RemainingMs)*time.Millisecond))
+		}
+		for _, s := range p.Standings {
+			fire := ""
+			if s.OnFire {
+				fire = " 🔥"
+			}
+			fmt.Printf("  %d. %s  %d分%s\n", s.Rank, s.Name, s.Score, fire)
+		}
+
+	// 大厅
+	case *packets.PacketServerSeekList:
+		fmt.Printf("大厅里的邀约(%d):\n", len(p.Seeks))
+		for _, seek := range p.Seeks {
+			fmt.Println("  " + formatSeek(seek))
+		}
+	case *packets.PacketServerSeekAdded:
+		fmt.Println("新的邀约:", formatSeek(p.Seek))
+	case *packets.PacketServerSeekRemoved:
+		fmt.Printf("邀约%d已撤下\n", p.SeekID)
+	case *packets.PacketServerSeekResp:
+		if p.OK {
+			fmt.Println("邀约已发布", p.SeekID)
+		} else {
+			fmt.Println("邀约失败:", p.Message)
+		}
+
+	// 通信棋
+	case *packets.PacketServerCorrespondenceList:
+		fmt.Printf("通信棋对局(%d):\n", len(p.Games))
+		for _, game := range p.Games {
+			fmt.Println("  " + formatCorrespondence(game))
+		}
+	case *packets.PacketServerCorrespondenceUpdate:
+		fmt.Println("通信棋更新:", formatCorrespondence(p.Game))
+		if p.Table != nil {
+			fmt.Print(renderBoard(p.Table, p.Game.YourSide, ui.color))
+		}
+		if p.KingThreat {
+			fmt.Println(warning("将军!", ui.color))
+		}
+	case *packets.PacketServerCorrespondenceFailed:
+		fmt.Printf("通信棋%d操作失败: %s\n", p.GameID, p.Message)
+	case *packets.PacketServerCorrespondenceOver:
+		winner := "和棋"
+		if p.WinnerSide != chess.SideBoth {
+			winner = sideNames[p.WinnerSide] + "胜"
+		}
+		fmt.Printf("通信棋%d结束, %s (%s)\n", p.GameID, winner, p.Reason)
+
+	// 服务端通知
+	case *packets.PacketServerShutdown:
+		fmt.Println(warning("服务端即将关闭: "+p.Message, ui.color))
+	case *packets.PacketServerAnnouncement:
+		fmt.Println("公告:", p.Message)
+	case *packets.PacketServerMaintenance:
+		if p.Enabled {
+			fmt.Println(warning("服务端进入维护, 暂时不能开始新的对局 "+p.Message, ui.color))
+		} else {
+			fmt.Println("服务端维护结束")
+		}
+
+	// 协议
+	case *packets.PacketServerWelcome:
+		fmt.Printf("协议版本%d, 特性%s\n", p.Version, strings.Join(p.Features, ","))
+	case *packets.PacketServerError:
+		fmt.Println(warning(fmt.Sprintf("错误 %s: %s", p.Code, p.Message), ui.color))
+	case *packets.PacketServerPosition:
+		if ui.inGame && p.Table != nil {
+			ui.table = p.Table
+			ui.printBoardLocked()
+		}
+	}
+}
+
+func formatSeek(seek packets.SeekInfo) string {
+	name := seek.Name
+	if name == "" {
+		name = "匿名玩家"
+	}
+	return fmt.Sprintf("%d  %s(%d)  执%s  %s", seek.SeekID, name, seek.Rating, sideNames[seek.Side], formatOptions(seek.Options))
+}
+
+func formatCorrespondence(game packets.CorrespondenceGameInfo) string {
+	s := fmt.Sprintf("%d  %s vs %s  第%d步  轮到%s", game.GameID, game.WhiteName, game.BlackName, game.Moves, sideNames[game.ToMove])
+	if game.ToMove == game.YourSide {
+		s += fmt.Sprintf(", 期限%s", time.UnixMilli(game.DeadlineMs).Format("01-02 15:04"))
+	}
+	if game.DrawOffered {
+		s += ", 对方提出和棋"
+	}
+	return s
+}
@@ -0,0 +1,192 @@
+// 终端里的客户端, 用Unicode棋子和颜色画棋盘, 支持README里的命令和标准代数记谱法
+package main
+
+import (
+	"bufio"
+	"chess-backend/client"
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const helpText = `命令:
+  match                      开始随机匹配
+  mov a2 a3                  移动
+  dmov a2 a3                 移动并提出议和
+  e4, Nf3, exd5, O-O, e8=Q   用标准代数记谱法移动, 升变时自动选择棋子
+  accept                     接受对方的议和
+  refuse                     拒绝对方的议和
+  swi bishop/knight/rook/queen  进行一个兵的升变
+  sur                        直接投降
+  board                      重新显示棋盘和棋钟
+  chat 内容                  给对手发消息
+  help                       显示这个帮助
+  quit                       退出`
+
+var upgradePieces = map[string]chess.ChessPieceType{
+	"rook":   chess.ChessPieceTypeRook,
+	"knight": chess.ChessPieceTypeKnight,
+	"bishop": chess.ChessPieceTypeBishop,
+	"queen":  chess.ChessPieceTypeQueen,
+}
+
+type cli struct {
+	client *client.Client
+	color  bool
+
+	// 收包的协程和读输入的协程都会访问下面的状态
+	lock   sync.Mutex
+	side   chess.Side
+	table  *chess.ChessTable
+	inGame bool
+	clock  *clockState
+	// 用记谱法输入的升变, 服务端要求升变时自动发送
+	pendingPromotion *chess.ChessPieceType
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8000", "服务端地址")
+	name := flag.String("name", "", "账号名, 为空时不登录")
+	password := flag.String("password", "", "密码")
+	register := flag.Bool("register", false, "账号不存在时注册")
+	useTLS := flag.Bool("tls", false, "使用TLS连接")
+	useBinary := flag.Bool("binary", false, "使用二进制编码")
+	noColor := flag.Bool("no-color", false, "不使用颜色")
+	flag.Parse()
+
+	ui := &cli{color: !*noColor, side: chess.SideWhite}
+	config := client.Config{
+		Addr:     *addr,
+		Binary:   *useBinary,
+		Name:     *name,
+		Password: *password,
+		Register: *register,
+		Handler: client.Handler{
+			OnPacket: ui.handlePacket,
+			OnDisconnect: func(err error) {
+				fmt.Println("与服务端的连接断开了:", err)
+				os.Exit(1)
+			},
+		},
+	}
+	if *useTLS {
+		config.TLSConfig = &tls.Config{}
+	}
+
+	c, err := client.Connect(config)
+	if err != nil {
+		fmt.Println("连接失败:", err)
+		os.Exit(1)
+	}
+	ui.client = c
+	if *name != "" {
+		fmt.Printf("已登录为%s\n", *name)
+	}
+	fmt.Println(helpText)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "quit" {
+			break
+		}
+		if err := ui.runCommand(line); err != nil {
+			fmt.Println(err)
+		}
+	}
+	c.Close()
+}
+
+func (ui *cli) runCommand(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "help":
+		fmt.Println(helpText)
+		return nil
+	case "match":
+		return ui.client.StartMatch()
+	case "board":
+		ui.lock.Lock()
+		defer ui.lock.Unlock()
+		ui.printBoardLocked()
+		return nil
+	case "chat":
+		text := strings.TrimSpace(strings.TrimPrefix(line, "chat"))
+		return ui.client.Send(&packets.PacketClientChat{Channel: packets.ChatChannelPlayers, Text: text})
+	case "mov", "dmov":
+		if len(fields) != 3 {
+			return fmt.Errorf("用法: %s a2 a3", fields[0])
+		}
+		fromX, fromY, ok1 := parseSquare(fields[1])
+		toX, toY, ok2 := parseSquare(fields[2])
+		if !ok1 || !ok2 {
+			return fmt.Errorf("坐标不合法: %s %s", fields[1], fields[2])
+		}
+		if fields[0] == "dmov" {
+			ui.client.OfferDraw()
+		}
+		return ui.client.Move(fromX, fromY, toX, toY)
+	case "accept":
+		return ui.client.AnswerDraw(true)
+	case "refuse":
+		return ui.client.AnswerDraw(false)
+	case "swi":
+		if len(fields) != 2 {
+			return fmt.Errorf("用法: swi bishop/knight/rook/queen")
+		}
+		pieceType, ok := upgradePieces[fields[1]]
+		if !ok {
+			return fmt.Errorf("只能升变成bishop/knight/rook/queen")
+		}
+		return ui.client.Promote(pieceType)
+	case "sur":
+		return ui.client.Surrender()
+	}
+
+	// 剩下的当作记谱法
+	ui.lock.Lock()
+	if !ui.inGame || ui.table == nil {
+		ui.lock.Unlock()
+		return fmt.Errorf("不认识的命令%q, 输入help查看帮助", line)
+	}
+	move, err := parseSAN(ui.table, ui.side, line)
+	if err == errNotSAN {
+		err = fmt.Errorf("不认识的命令%q, 输入help查看帮助", line)
+	}
+	if err == nil {
+		ui.pendingPromotion = move.Promotion
+	}
+	ui.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return ui.client.Move(move.FromX, move.FromY, move.ToX, move.ToY)
+}
+
+// 比如e2
+func parseSquare(s string) (rune, int, bool) {
+	if len(s) != 2 || !isFile(s[0]) || !isRank(s[1]) {
+		return 0, 0, false
+	}
+	return rune(s[0]), int(s[1] - '0'), true
+}
+
+// 需要持有lock
+func (ui *cli) printBoardLocked() {
+	if ui.table == nil {
+		fmt.Println("现在没有对局")
+		return
+	}
+	fmt.Print(renderBoard(ui.table, ui.side, ui.color))
+	if ui.clock != nil {
+		fmt.Println(ui.clock.String())
+	}
+}
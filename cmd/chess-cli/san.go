@@ -0,0 +1,114 @@
+package main
+
+import (
+	"chess-backend/comm/chess"
+	"errors"
+	"fmt"
+	"strings"
+
+	chesstool "chess-backend/tools/chess"
+)
+
+// 解析出来的一步棋, Promotion不为nil时走完之后自动升变
+type parsedMove struct {
+	FromX     rune
+	FromY     int
+	ToX       rune
+	ToY       int
+	Promotion *chess.ChessPieceType
+}
+
+var sanPieces = map[byte]chess.ChessPieceType{
+	'K': chess.ChessPieceTypeKing,
+	'Q': chess.ChessPieceTypeQueen,
+	'R': chess.ChessPieceTypeRook,
+	'B': chess.ChessPieceTypeBishop,
+	'N': chess.ChessPieceTypeKnight,
+}
+
+var errNotSAN = errors.New("not a SAN move")
+
+func isFile(c byte) bool { return c >= 'a' && c <= 'h' }
+func isRank(c byte) bool { return c >= '1' && c <= '8' }
+
+// 按标准代数记谱法解析一步棋, 比如e4, Nf3, exd5, Raxe1, e8=Q, O-O, 末尾的+#!?会被忽略
+// 在当前局面上找出能走到目标格子的棋子, 没有或者不止一个时返回错误
+func parseSAN(table *chess.ChessTable, side chess.Side, san string) (parsedMove, error) {
+	s := strings.TrimRight(san, "+#!?")
+	if s == "" {
+		return parsedMove{}, errNotSAN
+	}
+
+	// 王车易位
+	homeRank := 1
+	if side == chess.SideBlack {
+		homeRank = 8
+	}
+	switch strings.ReplaceAll(s, "0", "O") {
+	case "O-O":
+		return parsedMove{FromX: 'e', FromY: homeRank, ToX: 'g', ToY: homeRank}, nil
+	case "O-O-O":
+		return parsedMove{FromX: 'e', FromY: homeRank, ToX: 'c', ToY: homeRank}, nil
+	}
+
+	pieceType := chess.ChessPieceTypePawn
+	if t, ok := sanPieces[s[0]]; ok {
+		pieceType = t
+		s = s[1:]
+	}
+
+	// 升变, e8=Q或者e8Q
+	var promotion *chess.ChessPieceType
+	if n := len(s); n >= 2 && !isRank(s[n-1]) {
+		t, ok := sanPieces[s[n-1]]
+		if !ok || t == chess.ChessPieceTypeKing || pieceType != chess.ChessPieceTypePawn {
+			return parsedMove{}, errNotSAN
+		}
+		promotion = &t
+		s = strings.TrimSuffix(s[:n-1], "=")
+	}
+
+	s = strings.ReplaceAll(s, "x", "")
+	if len(s) < 2 || len(s) > 4 || !isFile(s[len(s)-2]) || !isRank(s[len(s)-1]) {
+		return parsedMove{}, errNotSAN
+	}
+	toX, toY := rune(s[len(s)-2]), int(s[len(s)-1]-'0')
+
+	// 剩下的是消除歧义的列和行
+	var fromFile, fromRank byte
+	for i := 0; i < len(s)-2; i++ {
+		switch {
+		case isFile(s[i]) && fromFile == 0:
+			fromFile = s[i]
+		case isRank(s[i]) && fromRank == 0:
+			fromRank = s[i]
+		default:
+			return parsedMove{}, errNotSAN
+		}
+	}
+
+	var candidates []parsedMove
+	for _, piece := range table {
+		if piece == nil || piece.GameSide != side || piece.PieceType != pieceType {
+			continue
+		}
+		if (fromFile != 0 && piece.X != rune(fromFile)) || (fromRank != 0 && piece.Y != int(fromRank-'0')) {
+			continue
+		}
+		if piece.X == toX && piece.Y == toY {
+			continue
+		}
+		// 在拷贝的棋盘上试走一下
+		if result := chesstool.DoMove(table.Copy(), side, piece.X, piece.Y, toX, toY); result.OK {
+			candidates = append(candidates, parsedMove{FromX: piece.X, FromY: piece.Y, ToX: toX, ToY: toY, Promotion: promotion})
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return parsedMove{}, fmt.Errorf("%s: 没有棋子能这样走", san)
+	case 1:
+		return candidates[0], nil
+	}
+	return parsedMove{}, fmt.Errorf("%s: 有%d个棋子都能这样走, 需要写出起点的列或者行", san, len(candidates))
+}
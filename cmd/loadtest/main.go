@@ -0,0 +1,180 @@
+// 压测工具, 模拟大量同时进行的对局, 统计服务端每秒处理的着法数
+// 每个对局的双方都只来回跳马, 对局永远不会结束
+package main
+
+import (
+	"bufio"
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	packtool "chess-backend/tools/packet"
+)
+
+type knightMove struct {
+	FromX rune
+	FromY int
+	ToX   rune
+	ToY   int
+}
+
+// 白方和黑方各自来回跳的两步
+var knightMoves = map[chess.Side][2]knightMove{
+	chess.SideWhite: {{'b', 1, 'c', 3}, {'c', 3, 'b', 1}},
+	chess.SideBlack: {{'b', 8, 'c', 6}, {'c', 6, 'b', 8}},
+}
+
+// 完成的着法数
+var movesDone atomic.Int64
+
+type client struct {
+	conn   net.Conn
+	side   chess.Side
+	nextAt int
+	// 握手时请求二进制编码
+	binary bool
+	codec  packets.Codec
+}
+
+func (c *client) send(p packets.Packet) error {
+	_, err := c.conn.Write(packtool.DoPackWith4BytesHeader(c.codec.MustMarshal(p)))
+	return err
+}
+
+func (c *client) move() error {
+	m := knightMoves[c.side][c.nextAt%2]
+	c.nextAt++
+	return c.send(&packets.PacketClientMove{FromX: m.FromX, FromY: m.FromY, ToX: m.ToX, ToY: m.ToY})
+}
+
+func (c *client) run(stop <-chan struct{}) error {
+	hello := &packets.PacketClientHello{Version: packets.ProtocolVersion}
+	if c.binary {
+		hello.Features = []string{packets.FeatureBinaryCodec}
+	}
+	if err := c.send(hello); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(c.conn)
+	header := make([]byte, 4)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+
+		packIface, err := c.codec.ClientParse(body)
+		if err != nil {
+			return err
+		}
+		switch packet := packIface.(type) {
+		case *packets.PacketHeartbeat:
+			err = c.send(&packets.PacketHeartbeat{})
+		case *packets.PacketServerWelcome:
+			if !packet.OK {
+				return fmt.Errorf("handshake rejected: %s", packet.Message)
+			}
+			// 服务端收到握手之后就换了编码, 要等到握手结果再发别的包
+			for _, feature := range packet.Features {
+				if feature == packets.FeatureBinaryCodec {
+					c.codec = packets.CodecBinary
+				}
+			}
+			err = c.send(&packets.PacketClientStartMatch{})
+		case *packets.PacketServerMatchedOK:
+			c.side = packet.Side
+			c.nextAt = 0
+			if c.side == chess.SideWhite {
+				err = c.move()
+			}
+		case *packets.PacketServerMoveResp:
+			if packet.MoveRespType != packets.PacketTypeServerMoveRespTypeOK {
+				return fmt.Errorf("move rejected: %d", packet.MoveRespType)
+			}
+			movesDone.Add(1)
+		case *packets.PacketServerNotifyRemoteMove:
+			err = c.move()
+		case *packets.PacketServerGameOver, *packets.PacketServerRemoteLoseConnection:
+			err = c.send(&packets.PacketClientStartMatch{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8000", "服务端地址")
+	games := flag.Int("games", 1000, "同时进行的对局数")
+	duration := flag.Duration("duration", 30*time.Second, "压测时长")
+	useBinary := flag.Bool("binary", false, "使用二进制编码")
+	flag.Parse()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := 0; i < *games*2; i++ {
+		conn, err := net.Dial("tcp", *addr)
+		if err != nil {
+			log.Fatalf("dial %s failed: %v", *addr, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			c := &client{conn: conn, binary: *useBinary}
+			if err := c.run(stop); err != nil {
+				select {
+				case <-stop:
+				default:
+					failed.Add(1)
+					log.Printf("client failed: %v", err)
+				}
+			}
+		}()
+	}
+
+	startedAt := time.Now()
+	ticker := time.NewTicker(time.Second)
+	deadline := time.After(*duration)
+	last := int64(0)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			done := movesDone.Load()
+			log.Printf("%d moves/s", done-last)
+			last = done
+		case <-deadline:
+			break loop
+		}
+	}
+	ticker.Stop()
+	elapsed := time.Since(startedAt)
+	close(stop)
+
+	done := movesDone.Load()
+	fmt.Printf("games: %d, moves: %d, elapsed: %s, throughput: %.0f moves/s, failed clients: %d\n",
+		*games, done, elapsed.Round(time.Millisecond), float64(done)/elapsed.Seconds(), failed.Load())
+	// 阻塞在读上的连接要等服务端的下一个心跳才会退出
+	wg.Wait()
+}
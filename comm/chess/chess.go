@@ -1,5 +1,7 @@
 package chess
 
+import "strconv"
+
 type ChessPieceType int
 
 const (
@@ -26,6 +28,18 @@ const (
 	SideBoth
 )
 
+func (s Side) String() string {
+	switch s {
+	case SideWhite:
+		return "white"
+	case SideBlack:
+		return "black"
+	case SideBoth:
+		return "both"
+	}
+	return "Side(" + strconv.Itoa(int(s)) + ")"
+}
+
 // 棋子
 type ChessPiece struct {
 	// 棋子的类型
@@ -0,0 +1,36 @@
+package chess
+
+type Variant int
+
+const (
+	// 标准国际象棋, 目前只支持这一种
+	VariantStandard Variant = iota
+)
+
+// 时间控制, InitialSeconds为0表示不限时
+// DaysPerMove大于0表示通信棋, 每一步有若干天的期限, 这时不能设置棋钟
+type TimeControl struct {
+	InitialSeconds   int `json:"initial_seconds"`
+	IncrementSeconds int `json:"increment_seconds"`
+	DaysPerMove      int `json:"days_per_move,omitempty"`
+}
+
+func (tc TimeControl) Unlimited() bool {
+	return tc.InitialSeconds == 0
+}
+
+func (tc TimeControl) Correspondence() bool {
+	return tc.DaysPerMove > 0
+}
+
+// 一局棋的设置
+type GameOptions struct {
+	Variant     Variant     `json:"variant"`
+	TimeControl TimeControl `json:"time_control"`
+	// 不计分的对局, 不影响等级分
+	Casual bool `json:"casual,omitempty"`
+}
+
+func (o GameOptions) Rated() bool {
+	return !o.Casual
+}
@@ -0,0 +1,352 @@
+package packets
+
+import (
+	"chess-backend/comm/chess"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+)
+
+// 二进制编码, 握手时协商了FeatureBinaryCodec之后使用, 包含的信息和json编码完全一样
+//
+// 开头两个字节是大端序的包类型, 之后按声明顺序依次写出结构体的导出字段, 不写字段名:
+//
+//	bool       1个字节, 0或1
+//	有符号整数  zigzag varint
+//	无符号整数  uvarint
+//	float64    8个字节, 大端序的IEEE 754
+//	string     uvarint的长度, 然后是内容
+//	slice      uvarint的长度加1, 0表示nil, 然后依次是各个元素
+//	指针        1个字节, 0表示nil, 1的话接着是指向的值
+//	结构体      依次是各个字段, 嵌入的结构体也一样
+//	棋盘        固定48个字节, 见appendTable
+//
+// 顶层包的PacketHeader由开头的类型代替, 嵌在包里的包还是按结构体写出
+// 解码时忽略末尾多出来的字节, 以后只能在包的末尾加字段
+// 类型编号小于256时第一个字节总是0, 不会和以'{'开头的json混淆
+
+var ErrBinaryTruncated = errors.New("packets: binary data truncated")
+
+var headerType = reflect.TypeOf(PacketHeader{})
+var tableType = reflect.TypeOf(chess.ChessTable{})
+
+// 按二进制编码序列化包, p必须是指向包结构体的指针
+func marshalBinary(packetType PacketType, p Packet) []byte {
+	bs := make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(bs, uint16(packetType))
+	return appendStruct(bs, reflect.ValueOf(p).Elem(), true)
+}
+
+func appendStruct(bs []byte, v reflect.Value, top bool) []byte {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || (top && field.Anonymous && field.Type == headerType) {
+			continue
+		}
+		bs = appendValue(bs, v.Field(i))
+	}
+	return bs
+}
+
+func appendValue(bs []byte, v reflect.Value) []byte {
+	if v.Type() == tableType {
+		return appendTable(bs, v.Interface().(chess.ChessTable))
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(bs, 1)
+		}
+		return append(bs, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(bs, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(bs, v.Uint())
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(bs, math.Float64bits(v.Float()))
+	case reflect.String:
+		bs = binary.AppendUvarint(bs, uint64(v.Len()))
+		return append(bs, v.String()...)
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(bs, 0)
+		}
+		bs = binary.AppendUvarint(bs, uint64(v.Len())+1)
+		for i := 0; i < v.Len(); i++ {
+			bs = appendValue(bs, v.Index(i))
+		}
+		return bs
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(bs, 0)
+		}
+		return appendValue(append(bs, 1), v.Elem())
+	case reflect.Struct:
+		return appendStruct(bs, v, false)
+	}
+	panic(fmt.Sprintf("packets: binary codec does not support %v", v.Type()))
+}
+
+// 棋盘写成64个4位的格子, 两个格子一个字节, 下标小的格子在高4位, 格子的下标和ChessTable一样
+// 4位里最高位是游戏方, 0为白方1为黑方, 低3位是棋子类型加1, 0表示空格
+// 之后是两个8字节的位图, 第i位对应下标为i的格子, 依次是Moved和PawnMovedTwoLastTime
+// 棋子的X和Y由格子的下标决定
+func appendTable(bs []byte, table chess.ChessTable) []byte {
+	nibbles, moved, pawnMovedTwo := packTable(&table)
+	bs = append(bs, nibbles[:]...)
+	bs = binary.BigEndian.AppendUint64(bs, moved)
+	return binary.BigEndian.AppendUint64(bs, pawnMovedTwo)
+}
+
+// 局面哈希, 只包含每个格子上是什么棋子, 不包含Moved这些状态
+// 为appendTable里64个格子的32个字节的FNV-1a 64位哈希, 写成16个十六进制字符, 避免js的数字丢失精度
+func PositionHash(table *chess.ChessTable) string {
+	nibbles, _, _ := packTable(table)
+	h := fnv.New64a()
+	h.Write(nibbles[:])
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func packTable(table *chess.ChessTable) (nibbles [32]byte, moved uint64, pawnMovedTwo uint64) {
+	for i, piece := range table {
+		if piece == nil {
+			continue
+		}
+		if piece.PieceType < chess.ChessPieceTypeRook || piece.PieceType > chess.ChessPieceTypePawn ||
+			(piece.GameSide != chess.SideWhite && piece.GameSide != chess.SideBlack) {
+			panic(fmt.Sprintf("packets: invalid piece %+v", *piece))
+		}
+
+		nibble := byte(piece.PieceType) + 1
+		if piece.GameSide == chess.SideBlack {
+			nibble |= 0x8
+		}
+		if i%2 == 0 {
+			nibble <<= 4
+		}
+		nibbles[i/2] |= nibble
+
+		if piece.Moved {
+			moved |= 1 << i
+		}
+		if piece.PawnMovedTwoLastTime {
+			pawnMovedTwo |= 1 << i
+		}
+	}
+	return
+}
+
+type binaryDecoder struct {
+	bs []byte
+}
+
+// 按二进制编码解析, v必须是指向结构体的指针, 可以只解析出PacketHeader
+func UnmarshalBinary(bs []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("packets: cannot unmarshal binary into %T", v)
+	}
+	if len(bs) < 2 {
+		return ErrBinaryTruncated
+	}
+
+	packetType := PacketType(binary.BigEndian.Uint16(bs))
+	header := reflect.ValueOf(PacketHeader{Type: &packetType})
+	elem := rv.Elem()
+	if elem.Type() == headerType {
+		elem.Set(header)
+		return nil
+	}
+
+	d := &binaryDecoder{bs: bs[2:]}
+	t := elem.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type == headerType {
+			elem.Field(i).Set(header)
+			continue
+		}
+		if err := d.decodeValue(elem.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *binaryDecoder) next(n int) ([]byte, error) {
+	if len(d.bs) < n {
+		return nil, ErrBinaryTruncated
+	}
+	bs := d.bs[:n]
+	d.bs = d.bs[n:]
+	return bs, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.bs)
+	if n <= 0 {
+		return 0, ErrBinaryTruncated
+	}
+	d.bs = d.bs[n:]
+	return x, nil
+}
+
+// 长度最多是剩下的字节数, 避免按伪造的长度分配内存
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.bs)) {
+		return 0, ErrBinaryTruncated
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) decodeValue(v reflect.Value) error {
+	if v.Type() == tableType {
+		return d.decodeTable(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if b[0] > 1 {
+			return fmt.Errorf("packets: invalid bool %d", b[0])
+		}
+		v.SetBool(b[0] == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(d.bs)
+		if n <= 0 {
+			return ErrBinaryTruncated
+		}
+		d.bs = d.bs[n:]
+		if v.OverflowInt(x) {
+			return fmt.Errorf("packets: %d overflows %v", x, v.Type())
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(x) {
+			return fmt.Errorf("packets: %d overflows %v", x, v.Type())
+		}
+		v.SetUint(x)
+	case reflect.Float64:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case reflect.String:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		b, _ := d.next(n)
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.SetZero()
+			return nil
+		}
+		// 每个元素至少占一个字节
+		if n-1 > uint64(len(d.bs)) {
+			return ErrBinaryTruncated
+		}
+		s := reflect.MakeSlice(v.Type(), int(n-1), int(n-1))
+		for i := 0; i < s.Len(); i++ {
+			if err := d.decodeValue(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Pointer:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		switch b[0] {
+		case 0:
+			v.SetZero()
+		case 1:
+			p := reflect.New(v.Type().Elem())
+			if err := d.decodeValue(p.Elem()); err != nil {
+				return err
+			}
+			v.Set(p)
+		default:
+			return fmt.Errorf("packets: invalid pointer flag %d", b[0])
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := d.decodeValue(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("packets: binary codec does not support %v", v.Type())
+	}
+	return nil
+}
+
+func (d *binaryDecoder) decodeTable(v reflect.Value) error {
+	b, err := d.next(48)
+	if err != nil {
+		return err
+	}
+	moved := binary.BigEndian.Uint64(b[32:40])
+	pawnMovedTwo := binary.BigEndian.Uint64(b[40:48])
+
+	var table chess.ChessTable
+	for i := range table {
+		nibble := b[i/2]
+		if i%2 == 0 {
+			nibble >>= 4
+		}
+		nibble &= 0xf
+		if nibble == 0 {
+			continue
+		}
+
+		pieceType := chess.ChessPieceType(nibble&0x7) - 1
+		if pieceType < chess.ChessPieceTypeRook || pieceType > chess.ChessPieceTypePawn {
+			return fmt.Errorf("packets: invalid piece %#x at square %d", nibble, i)
+		}
+		side := chess.SideWhite
+		if nibble&0x8 != 0 {
+			side = chess.SideBlack
+		}
+		table[i] = &chess.ChessPiece{
+			PieceType:            pieceType,
+			X:                    rune('a' + i%8),
+			Y:                    i/8 + 1,
+			GameSide:             side,
+			Moved:                moved&(1<<i) != 0,
+			PawnMovedTwoLastTime: pawnMovedTwo&(1<<i) != 0,
+		}
+	}
+	v.Set(reflect.ValueOf(table))
+	return nil
+}
@@ -0,0 +1,243 @@
+package packets
+
+import (
+	"bytes"
+	"chess-backend/comm/chess"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 有升变出来的棋子, 空格, Moved和PawnMovedTwoLastTime的局面
+func testTable() *chess.ChessTable {
+	table := chess.NewChessTable()
+	// 白兵升变成后, 黑兵升变成马
+	table.ClearPosition('a', 2)
+	table.ClearPosition('a', 8)
+	table.SetPosition(&chess.ChessPiece{X: 'a', Y: 8, PieceType: chess.ChessPieceTypeQueen, GameSide: chess.SideWhite, Moved: true})
+	table.ClearPosition('h', 7)
+	table.ClearPosition('h', 1)
+	table.SetPosition(&chess.ChessPiece{X: 'h', Y: 1, PieceType: chess.ChessPieceTypeKnight, GameSide: chess.SideBlack, Moved: true})
+	// 刚走了两格的兵
+	table.ClearPosition('e', 2)
+	table.SetPosition(&chess.ChessPiece{X: 'e', Y: 4, PieceType: chess.ChessPieceTypePawn, GameSide: chess.SideWhite, Moved: true, PawnMovedTwoLastTime: true})
+	// 王走过, 不能再易位
+	table.GetPosition('e', 8).Moved = true
+	return table
+}
+
+// 按字段类型填上确定的非零值, 每次调用的值都不一样, 棋盘用testTable
+type filler struct {
+	n int64
+}
+
+func (f *filler) next() int64 {
+	f.n++
+	return f.n
+}
+
+func (f *filler) fill(v reflect.Value) {
+	if v.Type() == tableType {
+		v.Set(reflect.ValueOf(*testTable()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(f.next()%2 == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// 正负都要有
+		n := f.next()
+		if n%3 == 0 {
+			n = -n
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(f.next()))
+	case reflect.Float64:
+		v.SetFloat(float64(f.next()) + 0.5)
+	case reflect.String:
+		v.SetString("字段\"" + string(rune('a'+f.next()%26)))
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < s.Len(); i++ {
+			f.fill(s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Pointer:
+		p := reflect.New(v.Type().Elem())
+		f.fill(p.Elem())
+		v.Set(p)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				f.fill(v.Field(i))
+			}
+		}
+	default:
+		panic("packets test: cannot fill " + v.Type().String())
+	}
+}
+
+// 填满所有字段的包, 顶层的PacketHeader留给Marshal填
+func filledPacket(r *registration) Packet {
+	p := r.new()
+	v := reflect.ValueOf(p).Elem()
+	f := &filler{n: int64(r.packetType) * 1000}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() || (field.Anonymous && field.Type == headerType) {
+			continue
+		}
+		f.fill(v.Field(i))
+	}
+	return p
+}
+
+func directionsOf(r *registration) []Direction {
+	directions := make([]Direction, 0, 2)
+	for _, d := range []Direction{DirectionClientToServer, DirectionServerToClient} {
+		if r.direction&d != 0 {
+			directions = append(directions, d)
+		}
+	}
+	return directions
+}
+
+// 每种注册过的包, 空包和填满的包, 分别用两种编码序列化再解析, 结果要和原来的包以及彼此完全一样
+func TestCodecRoundTripEquivalence(t *testing.T) {
+	for i := range registrations {
+		r := &registrations[i]
+		for _, filled := range []bool{false, true} {
+			var p Packet
+			if filled {
+				p = filledPacket(r)
+			} else {
+				p = r.new()
+			}
+
+			jsonBytes, err := CodecJSON.Marshal(p)
+			if err != nil {
+				t.Fatalf("type %d: json marshal: %v", r.packetType, err)
+			}
+			binaryBytes, err := CodecBinary.Marshal(p)
+			if err != nil {
+				t.Fatalf("type %d: binary marshal: %v", r.packetType, err)
+			}
+
+			for _, direction := range directionsOf(r) {
+				fromJSON, err := CodecJSON.Unmarshal(jsonBytes, direction)
+				if err != nil {
+					t.Fatalf("type %d filled=%v: json unmarshal: %v", r.packetType, filled, err)
+				}
+				fromBinary, err := CodecBinary.Unmarshal(binaryBytes, direction)
+				if err != nil {
+					t.Fatalf("type %d filled=%v: binary unmarshal: %v", r.packetType, filled, err)
+				}
+				if !reflect.DeepEqual(fromJSON, p) {
+					t.Errorf("type %d filled=%v: json round trip differs\n got %+v\nwant %+v", r.packetType, filled, fromJSON, p)
+				}
+				if !reflect.DeepEqual(fromBinary, fromJSON) {
+					t.Errorf("type %d filled=%v: binary differs from json\nbinary %+v\n  json %+v", r.packetType, filled, fromBinary, fromJSON)
+				}
+
+				// 解析出来的包再编码一次, 字节应该不变
+				again, err := CodecBinary.Marshal(fromBinary)
+				if err != nil || !bytes.Equal(again, binaryBytes) {
+					t.Errorf("type %d filled=%v: binary re-encode differs: %v", r.packetType, filled, err)
+				}
+			}
+		}
+	}
+}
+
+func TestBinaryTableNibbles(t *testing.T) {
+	var table chess.ChessTable
+	// a1 白车, b1 黑兵, h8 黑王, 其余是空格
+	table.SetPosition(&chess.ChessPiece{X: 'a', Y: 1, PieceType: chess.ChessPieceTypeRook, GameSide: chess.SideWhite, Moved: true})
+	table.SetPosition(&chess.ChessPiece{X: 'b', Y: 1, PieceType: chess.ChessPieceTypePawn, GameSide: chess.SideBlack, PawnMovedTwoLastTime: true})
+	table.SetPosition(&chess.ChessPiece{X: 'h', Y: 8, PieceType: chess.ChessPieceTypeKing, GameSide: chess.SideBlack, Moved: true})
+
+	bs := appendTable(nil, table)
+	if len(bs) != 48 {
+		t.Fatalf("table encoded to %d bytes, want 48", len(bs))
+	}
+	// 下标小的格子在高4位, 最高位是黑方, 低3位是棋子类型加1
+	if bs[0] != 0x1e {
+		t.Errorf("byte 0 = %#x, want 0x1e", bs[0])
+	}
+	if bs[31] != 0x0d {
+		t.Errorf("byte 31 = %#x, want 0x0d", bs[31])
+	}
+	for i := 1; i < 31; i++ {
+		if bs[i] != 0 {
+			t.Errorf("empty byte %d = %#x", i, bs[i])
+		}
+	}
+	if moved := binary.BigEndian.Uint64(bs[32:40]); moved != 1|1<<63 {
+		t.Errorf("moved bits = %#x", moved)
+	}
+	if two := binary.BigEndian.Uint64(bs[40:48]); two != 1<<1 {
+		t.Errorf("pawn moved two bits = %#x", two)
+	}
+
+	// 解码出来的X和Y由下标决定
+	d := &binaryDecoder{bs: bs}
+	var decoded chess.ChessTable
+	if err := d.decodeTable(reflect.ValueOf(&decoded).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, table) {
+		t.Errorf("decoded table differs")
+	}
+
+	full := testTable()
+	d = &binaryDecoder{bs: appendTable(nil, *full)}
+	if err := d.decodeTable(reflect.ValueOf(&decoded).Elem()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, *full) {
+		t.Errorf("decoded test table differs")
+	}
+}
+
+func TestBinaryTableInvalidNibble(t *testing.T) {
+	bs := make([]byte, 48)
+	// 低3位是7, 不是合法的棋子类型
+	bs[5] = 0x70
+	d := &binaryDecoder{bs: bs}
+	var table chess.ChessTable
+	if err := d.decodeTable(reflect.ValueOf(&table).Elem()); err == nil {
+		t.Error("invalid nibble accepted")
+	}
+
+	d = &binaryDecoder{bs: bs[:47]}
+	if err := d.decodeTable(reflect.ValueOf(&table).Elem()); !errors.Is(err, ErrBinaryTruncated) {
+		t.Errorf("short table: %v", err)
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	p := filledPacket(registryByType[PacketTypeServerSpectateResp])
+	bs := CodecBinary.MustMarshal(p)
+	for n := 0; n < len(bs); n++ {
+		if _, err := CodecBinary.ClientParse(bs[:n]); err == nil {
+			t.Fatalf("truncated to %d of %d bytes accepted", n, len(bs))
+		}
+	}
+}
+
+func TestPositionHashIgnoresState(t *testing.T) {
+	a := testTable()
+	b := a.Copy()
+	b.GetPosition('e', 4).PawnMovedTwoLastTime = false
+	b.GetPosition('e', 8).Moved = false
+	if PositionHash(a) != PositionHash(b) {
+		t.Error("position hash depends on moved bits")
+	}
+	b.ClearPosition('e', 4)
+	if PositionHash(a) == PositionHash(b) {
+		t.Error("position hash ignores pieces")
+	}
+}
@@ -0,0 +1,87 @@
+package packets
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 包本体的编码方式, 握手之前总是json, 握手时双方都支持FeatureBinaryCodec的话之后改用二进制编码
+type Codec int32
+
+const (
+	CodecJSON Codec = iota
+	CodecBinary
+)
+
+// 编码方式的数量, 用来给每种编码各缓存一份序列化结果
+const CodecCount = 2
+
+// 握手时请求这个特性表示之后使用二进制编码
+const FeatureBinaryCodec = "binary_codec"
+
+func (c Codec) String() string {
+	if c == CodecBinary {
+		return "binary"
+	}
+	return "json"
+}
+
+func (c Codec) unmarshal(bs []byte, v interface{}) error {
+	if c == CodecBinary {
+		return UnmarshalBinary(bs, v)
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// 按这种编码序列化包, 不带长度头, 包没有注册时返回错误
+func (c Codec) Marshal(p Packet) ([]byte, error) {
+	packetType, err := TypeOf(p)
+	if err != nil {
+		return nil, err
+	}
+	if c == CodecBinary {
+		return marshalBinary(packetType, p), nil
+	}
+	p.header().Type = &packetType
+	return json.Marshal(p)
+}
+
+// 和Marshal一样, 出错时panic, 用于服务端自己构造的包
+func (c Codec) MustMarshal(p Packet) []byte {
+	bs, err := c.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// 按这种编码解析一个包, direction是收到的包应有的方向
+// 没有type字段时返回ErrNoPacketType, 类型没有注册时返回ErrUnknownPacketType, 方向不对时返回ErrWrongDirection
+func (c Codec) Unmarshal(bs []byte, direction Direction) (Packet, error) {
+	header := PacketHeader{}
+	if err := c.unmarshal(bs, &header); err != nil {
+		return nil, fmt.Errorf("packets: decode header: %w", err)
+	}
+	if header.Type == nil {
+		return nil, ErrNoPacketType
+	}
+
+	p, err := newPacket(*header.Type, direction)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.unmarshal(bs, p); err != nil {
+		return nil, fmt.Errorf("packets: decode packet type %d: %w", *header.Type, err)
+	}
+	return p, nil
+}
+
+// 按这种编码解析客户端发来的包
+func (c Codec) ServerParse(bs []byte) (Packet, error) {
+	return c.Unmarshal(bs, DirectionClientToServer)
+}
+
+// 按这种编码解析服务端发来的包
+func (c Codec) ClientParse(bs []byte) (Packet, error) {
+	return c.Unmarshal(bs, DirectionServerToClient)
+}
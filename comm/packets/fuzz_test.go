@@ -0,0 +1,78 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	protocoltool "chess-backend/tools/protocol"
+
+	"github.com/Allenxuxu/ringbuffer"
+)
+
+const fuzzMaxFrameSize = 1024
+
+// 和服务端一样先用Protocol分包, 再用ServerParse解析
+// 空包和超长的包必须在分包时返回FrameError, 不能交给ServerParse
+func FuzzServerParse(f *testing.F) {
+	for i := range registrations {
+		r := &registrations[i]
+		f.Add(CodecJSON.MustMarshal(filledPacket(r)))
+		f.Add(CodecBinary.MustMarshal(filledPacket(r)))
+	}
+	f.Add([]byte{})
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"type":null}`))
+	f.Add([]byte(`{"type":82}`))
+	f.Add([]byte(`{"type":4,"from_x":1e999}`))
+	f.Add([]byte{0, 4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0, 30, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Add(make([]byte, fuzzMaxFrameSize+1))
+
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		protocol := &protocoltool.Protocol{MaxFrameSize: fuzzMaxFrameSize}
+		buffer := ringbuffer.New(64)
+		buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(bs))))
+		buffer.Write(bs)
+
+		ctx, frame := protocol.UnPacket(nil, buffer)
+		if len(bs) == 0 || len(bs) > fuzzMaxFrameSize {
+			frameErr, ok := ctx.(*protocoltool.FrameError)
+			if !ok || frameErr.Length != uint32(len(bs)) || frameErr.Empty != (len(bs) == 0) || frame != nil {
+				t.Fatalf("%d byte frame: got ctx %v, frame %d bytes, want FrameError", len(bs), ctx, len(frame))
+			}
+			return
+		}
+		if ctx != nil || len(frame) != len(bs) {
+			t.Fatalf("%d byte frame: got ctx %v, frame %d bytes", len(bs), ctx, len(frame))
+		}
+
+		for _, codec := range []Codec{CodecJSON, CodecBinary} {
+			p, err := codec.ServerParse(frame)
+			if err != nil {
+				if p != nil {
+					t.Fatalf("%v: got packet %T with error %v", codec, p, err)
+				}
+				continue
+			}
+			packetType, err := TypeOf(p)
+			if err != nil {
+				t.Fatalf("%v: parsed unregistered packet %T", codec, p)
+			}
+			if registryByType[packetType].direction&DirectionClientToServer == 0 {
+				t.Fatalf("%v: parsed server packet %T", codec, p)
+			}
+			// 解析出来的包一定能再编码, 再解析的结果相同
+			again, err := codec.Marshal(p)
+			if err != nil {
+				t.Fatalf("%v: marshal %T: %v", codec, p, err)
+			}
+			if _, err := codec.ServerParse(again); err != nil {
+				t.Fatalf("%v: reparse %T: %v", codec, p, err)
+			}
+			if _, err := codec.ClientParse(again); packetType != PacketTypeHeartbeat && !errors.Is(err, ErrWrongDirection) {
+				t.Fatalf("%v: client parsed %T: %v", codec, p, err)
+			}
+		}
+	})
+}
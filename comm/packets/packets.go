@@ -1,7 +1,9 @@
 package packets
 
 import (
+	"bytes"
 	"chess-backend/comm/chess"
+	"encoding/binary"
 	"encoding/json"
 )
 
@@ -13,285 +15,1052 @@ const (
 	PacketTypeServerMoveRespTypePawnUpgrade
 )
 
+type ChatChannel int
+
+const (
+	// 对局双方之间的聊天
+	ChatChannelPlayers ChatChannel = iota
+	// 同一局对局的观战者之间的聊天, 玩家看不到
+	ChatChannelSpectators
+)
+
+type TournamentFormat int
+
+const (
+	// 瑞士制
+	TournamentFormatSwiss TournamentFormat = iota
+	// 单循环
+	TournamentFormatRoundRobin
+	// 竞技场, 规定时间内一局结束马上编排下一局
+	TournamentFormatArena
+)
+
+type TournamentState int
+
+const (
+	TournamentStateRegistering TournamentState = iota
+	TournamentStateRunning
+	TournamentStateFinished
+)
+
+type TournamentResult int
+
+const (
+	TournamentResultPending TournamentResult = iota
+	TournamentResultWhiteWin
+	TournamentResultBlackWin
+	TournamentResultDraw
+	// 双方都弃权
+	TournamentResultDoubleForfeit
+	// 轮空
+	TournamentResultBye
+)
+
+// PacketServerError里的错误码, 是协议的一部分, 已经发布的不能修改
+type ErrorCode string
+
+const (
+	// 不是json, 或者没有type字段
+	ErrorCodeMalformedPacket ErrorCode = "malformed_packet"
+	// 服务端不认识的包类型
+	ErrorCodeUnknownPacketType ErrorCode = "unknown_packet_type"
+	// 还没有握手就发送了别的包, 服务端随后断开连接
+	ErrorCodeHandshakeRequired ErrorCode = "handshake_required"
+	// 连接当前的状态不能发送这个包, 比如对局中开始匹配, 没有对局时走棋
+	ErrorCodeWrongState ErrorCode = "wrong_state"
+	// 对局中还没有轮到自己, 或者对局当前不接受这个操作
+	ErrorCodeNotYourTurn ErrorCode = "not_your_turn"
+	// 包里的字段不合法, 比如坐标越界, 对局设置不合法
+	ErrorCodeInvalidArgument ErrorCode = "invalid_argument"
+	// 需要先登录
+	ErrorCodeLoginRequired ErrorCode = "login_required"
+	// 长度头超过了服务端允许的最大长度, 服务端随后断开连接
+	ErrorCodeFrameTooLarge ErrorCode = "frame_too_large"
+	// 长度头为0, 服务端随后断开连接
+	ErrorCodeEmptyFrame ErrorCode = "empty_frame"
+	// 服务端内部出错, 比如存储不可用, 请求没有生效, 可以稍后重试
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+// 包的类型, 编号是协议的一部分, 已经发布的编号不能修改也不能复用, 新的包只能在末尾使用新的编号
 type PacketType int
 
 const (
 	// 心跳包
-	PacketTypeHeartbeat PacketType = iota
+	PacketTypeHeartbeat PacketType = 0
 
 	// 客户端要求开始匹配
-	PacketTypeClientStartMatch
+	PacketTypeClientStartMatch PacketType = 1
 
 	// 服务端表示已经开始匹配
-	PacketTypeServerMatching
+	PacketTypeServerMatching PacketType = 2
 
 	// 匹配完毕, 即将开始游戏
-	PacketTypeServerMatchedOK
+	PacketTypeServerMatchedOK PacketType = 3
 
 	// 客户端发送下棋的消息
-	PacketTypeClientMove
+	PacketTypeClientMove PacketType = 4
 
 	// 服务端告知用户下棋结果, 可能用户的输入不合法, 这里提示, 可能成功, 可能发生兵的升变, 要求用户继续输入
-	PacketTypeServerMoveResp
+	PacketTypeServerMoveResp PacketType = 5
 
 	// 告知服务端兵升变成什么
-	PacketTypeClientSendPawnUpgrade
+	PacketTypeClientSendPawnUpgrade PacketType = 6
 
 	// 通知游戏结束
-	PacketTypeServerGameOver
+	PacketTypeServerGameOver PacketType = 7
 
 	// 通知对方掉线
-	PacketTypeServerRemoteLoseConnection
+	PacketTypeServerRemoteLoseConnection PacketType = 8
 
 	// 对方下棋下好了
-	PacketTypeServerNotifyRemoteMove
+	PacketTypeServerNotifyRemoteMove PacketType = 9
 
 	// 告知对方, 自己是否接受和棋
-	PacketTypeClientWheatherAcceptDraw
+	PacketTypeClientWheatherAcceptDraw PacketType = 10
+
+	PacketTypeClientDoSurrender PacketType = 11
+
+	PacketTypeServerRemoteUpgradeOK PacketType = 12
+
+	PacketTypeServerUpgradeOK PacketType = 13
+
+	// 登录或注册账号, 未登录也可以匹配, 但是不计等级分
+	PacketTypeClientLogin PacketType = 14
+
+	// 登录结果
+	PacketTypeServerLoginResp PacketType = 15
+
+	// 创建私人房间, 指定颜色和对局设置
+	PacketTypeClientCreateRoom PacketType = 16
+
+	// 私人房间创建成功, 返回邀请码
+	PacketTypeServerRoomCreated PacketType = 17
+
+	// 通过邀请码加入私人房间
+	PacketTypeClientJoinRoom PacketType = 18
+
+	// 加入私人房间的结果
+	PacketTypeServerJoinRoomResp PacketType = 19
+
+	// 房主取消房间
+	PacketTypeClientCancelRoom PacketType = 20
+
+	// 向一个在线的账号发起挑战
+	PacketTypeClientChallenge PacketType = 21
+
+	// 发起挑战的结果, 成功时带上挑战id
+	PacketTypeServerChallengeResp PacketType = 22
+
+	// 通知被挑战方
+	PacketTypeServerChallengeReceived PacketType = 23
+
+	// 被挑战方接受或者拒绝
+	PacketTypeClientAnswerChallenge PacketType = 24
+
+	// 挑战被拒绝, 或者因为一方离开而失效
+	PacketTypeServerChallengeCanceled PacketType = 25
+
+	// 双方剩余时间, 每次轮到的一方变化之后发送
+	PacketTypeServerClockUpdate PacketType = 26
+
+	// 列出正在进行的对局
+	PacketTypeClientListGames PacketType = 27
+
+	// 正在进行的对局列表
+	PacketTypeServerGameList PacketType = 28
+
+	// 观战一局对局
+	PacketTypeClientSpectate PacketType = 29
+
+	// 观战的结果, 成功时带上当前局面和所有着法
+	PacketTypeServerSpectateResp PacketType = 30
+
+	// 停止观战
+	PacketTypeClientStopSpectate PacketType = 31
+
+	// 观战时, 对局中有人走了一步棋
+	PacketTypeServerSpectateMove PacketType = 32
+
+	// 观战时, 对局中有人完成了兵的升变
+	PacketTypeServerSpectateUpgrade PacketType = 33
+
+	// 观战时, 对局中有人提出或者拒绝了和棋
+	PacketTypeServerSpectateDraw PacketType = 34
+
+	// 发送一条聊天消息
+	PacketTypeClientChat PacketType = 35
+
+	// 收到一条聊天消息
+	PacketTypeServerChat PacketType = 36
 
-	PacketTypeClientDoSurrender
+	// 自己的聊天消息没有发出去, 比如太长, 太快, 或者被过滤
+	PacketTypeServerChatRejected PacketType = 37
 
-	PacketTypeServerRemoteUpgradeOK
+	// 屏蔽或者取消屏蔽对手的聊天
+	PacketTypeClientMuteOpponent PacketType = 38
 
-	PacketTypeServerUpgradeOK
+	// 对局结束之后提出, 接受或者拒绝再来一局
+	PacketTypeClientRematch PacketType = 39
+
+	// 对手提出了再来一局
+	PacketTypeServerRematchOffered PacketType = 40
+
+	// 再来一局被拒绝, 或者已经失效
+	PacketTypeServerRematchCanceled PacketType = 41
+
+	// 创建锦标赛, 需要登录
+	PacketTypeClientCreateTournament PacketType = 42
+
+	// 报名参加锦标赛, 需要登录
+	PacketTypeClientJoinTournament PacketType = 43
+
+	// 退出锦标赛
+	PacketTypeClientWithdrawTournament PacketType = 44
+
+	// 组织者开始锦标赛
+	PacketTypeClientStartTournament PacketType = 45
+
+	// 上面四个包的结果
+	PacketTypeServerTournamentResp PacketType = 46
+
+	// 列出所有锦标赛
+	PacketTypeClientListTournaments PacketType = 47
+
+	// 锦标赛列表
+	PacketTypeServerTournamentList PacketType = 48
+
+	// 新的一轮编排好了, 发给所有参赛者, 紧接着自己的对局会收到PacketServerMatchedOK
+	PacketTypeServerTournamentRound PacketType = 49
+
+	// 一轮结束之后的排名, 发给所有参赛者
+	PacketTypeServerTournamentStandings PacketType = 50
+
+	// 竞技场对局中, 在自己走第一步之前狂暴, 时间减半没有加秒, 赢了多得1分
+	PacketTypeClientBerserk PacketType = 51
+
+	// 有一方狂暴了, 发给双方和观战者, 紧接着会有棋钟更新
+	PacketTypeServerBerserk PacketType = 52
+
+	// 竞技场的实时排行榜, 有积分变化时发给所有参赛者
+	PacketTypeServerArenaLeaderboard PacketType = 53
+
+	// 订阅大厅的约战列表
+	PacketTypeClientSubscribeLobby PacketType = 54
+
+	// 取消订阅大厅
+	PacketTypeClientUnsubscribeLobby PacketType = 55
+
+	// 订阅之后收到的完整约战列表
+	PacketTypeServerSeekList PacketType = 56
+
+	// 大厅里新增了一个约战
+	PacketTypeServerSeekAdded PacketType = 57
+
+	// 大厅里的一个约战被接受或者撤销了
+	PacketTypeServerSeekRemoved PacketType = 58
+
+	// 在大厅里发起约战
+	PacketTypeClientPostSeek PacketType = 59
+
+	// 撤销自己的约战
+	PacketTypeClientCancelSeek PacketType = 60
+
+	// 接受别人的约战, 成功之后双方收到PacketServerMatchedOK
+	PacketTypeClientAcceptSeek PacketType = 61
+
+	// 发起或者接受约战的结果
+	PacketTypeServerSeekResp PacketType = 62
+
+	// 列出自己所有进行中的通信棋
+	PacketTypeClientListCorrespondence PacketType = 63
+
+	// 通信棋列表, 轮到自己走的排在前面
+	PacketTypeServerCorrespondenceList PacketType = 64
+
+	// 获取一局通信棋的棋盘
+	PacketTypeClientGetCorrespondence PacketType = 65
+
+	// 通信棋走一步
+	PacketTypeClientCorrespondenceMove PacketType = 66
+
+	// 通信棋兵升变
+	PacketTypeClientCorrespondenceUpgrade PacketType = 67
+
+	// 应答对手提出的和棋
+	PacketTypeClientCorrespondenceAnswerDraw PacketType = 68
+
+	// 通信棋认输
+	PacketTypeClientCorrespondenceResign PacketType = 69
+
+	// 通信棋开始或者有变化, 发给在线的双方, 也是PacketClientGetCorrespondence的回复
+	PacketTypeServerCorrespondenceUpdate PacketType = 70
+
+	// 通信棋操作失败
+	PacketTypeServerCorrespondenceFailed PacketType = 71
+
+	// 通信棋结束, 发给在线的双方
+	PacketTypeServerCorrespondenceOver PacketType = 72
+
+	// 服务端即将关闭, 进行中的对局已经保存, 重启之后双方重新登录就可以继续
+	PacketTypeServerShutdown PacketType = 73
+
+	// 服务端重启之后双方都重新登录了, 继续之前的对局, 之后和普通对局一样
+	PacketTypeServerGameResumed PacketType = 74
+
+	// 管理员发给所有连接的公告
+	PacketTypeServerAnnouncement PacketType = 75
+
+	// 维护模式开关时发给所有连接, 维护期间开始新对局的请求也会收到这个包
+	PacketTypeServerMaintenance PacketType = 76
+
+	// 连接之后客户端发送的第一个包, 告知协议版本和支持的特性
+	PacketTypeClientHello PacketType = 77
+
+	// 握手的结果, 版本不兼容时服务端发完这个包之后断开连接
+	PacketTypeServerWelcome PacketType = 78
+
+	// 客户端发来的包违反了协议, 带上错误码和出错的包的类型
+	PacketTypeServerError PacketType = 79
+
+	// 对局中请求完整的局面, 用增量着法时局面哈希对不上之后发送
+	PacketTypeClientRequestPosition PacketType = 80
+
+	// 完整的局面
+	PacketTypeServerPosition PacketType = 81
 )
 
 type PacketHeader struct {
 	Type *PacketType `json:"type"`
 }
 
+// 只读出包的类型, 不解析整个包, 用来做统计
+// 服务端发出的包type总是第一个字段, 直接读数字, 其他情况退回到json解析
+// 第一个字节是0的是二进制编码的包, 开头两个字节就是类型
+func PeekType(bs []byte) (PacketType, bool) {
+	if len(bs) >= 2 && bs[0] == 0 {
+		return PacketType(binary.BigEndian.Uint16(bs)), true
+	}
+
+	const prefix = `{"type":`
+	if bytes.HasPrefix(bs, []byte(prefix)) {
+		n, i := 0, len(prefix)
+		for ; i < len(bs) && bs[i] >= '0' && bs[i] <= '9'; i++ {
+			n = n*10 + int(bs[i]-'0')
+		}
+		if i > len(prefix) && i < len(bs) && (bs[i] == ',' || bs[i] == '}') {
+			return PacketType(n), true
+		}
+	}
+
+	header := PacketHeader{}
+	if err := json.Unmarshal(bs, &header); err != nil || header.Type == nil {
+		return 0, false
+	}
+	return *header.Type, true
+}
+
 type PacketHeartbeat struct {
 	PacketHeader
 }
 
-func (p *PacketHeartbeat) MustMarshalToBytes() []byte {
-	i := PacketTypeHeartbeat
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketClientStartMatch struct {
+	PacketHeader
+}
 
-	return bs
+type PacketServerMatching struct {
+	PacketHeader
 }
 
-type PacketClientStartMatch struct {
+type PacketServerMatchedOK struct {
 	PacketHeader
+	Side    chess.Side        `json:"game_side"`
+	Table   *chess.ChessTable `json:"game_table"`
+	Options chess.GameOptions `json:"game_options"`
 }
 
-func (p *PacketClientStartMatch) MustMarshalToBytes() []byte {
-	i := PacketTypeClientStartMatch
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketClientMove struct {
+	PacketHeader
+	FromX rune `json:"from_x"`
+	FromY int  `json:"from_y"`
+	ToX   rune `json:"to_x"`
+	ToY   int  `json:"to_y"`
 
-	return bs
+	// 和棋
+	DoDraw bool `json:"do_draw"`
 }
 
-type PacketServerMatching struct {
+type PacketClientSendPawnUpgrade struct {
 	PacketHeader
+	ChessPieceType chess.ChessPieceType `json:"piece_type"`
 }
 
-func (p *PacketServerMatching) MustMarshalToBytes() []byte {
-	i := PacketTypeServerMatching
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerMoveResp struct {
+	PacketHeader
+	MoveRespType PacketTypeServerMoveRespType `json:"resp_type"`
+	// 下面的字段只有在状态OK的时候出现
+	TableOnOK  *chess.ChessTable `json:"table,omitempty"`
+	KingThreat bool              `json:"king_threat"`
+	// 协商了FeatureDeltaMoves时代替TableOnOK
+	Delta *MoveDelta `json:"delta,omitempty"`
+}
 
-	return bs
+type PacketServerGameOver struct {
+	PacketHeader
+	Table       *chess.ChessTable `json:"final_table"`
+	WinnerSide  chess.Side        `json:"winner_side"`
+	IsSurrender bool              `json:"is_surrender"`
+	IsDraw      bool              `json:"is_draw"`
+	// 超时判负
+	IsTimeout bool `json:"is_timeout"`
+	// 结束原因, 和棋谱里保存的一样, 比如checkmate, timeout, adjudicated
+	Reason string `json:"reason,omitempty"`
 }
 
-type PacketServerMatchedOK struct {
+type PacketServerRemoteLoseConnection struct {
 	PacketHeader
-	Side  chess.Side        `json:"game_side"`
-	Table *chess.ChessTable `json:"game_table"`
 }
 
-func (p *PacketServerMatchedOK) MustMarshalToBytes() []byte {
-	i := PacketTypeServerMatchedOK
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerNotifyRemoteMove struct {
+	PacketHeader
+	Table             *chess.ChessTable `json:"table"`
+	RemotePawnUpgrade bool              `json:"remote_pawn_upgrade"`
+	KingThreat        bool              `json:"king_threat"`
+	RemoteRequestDraw bool              `json:"RemoteRequestDraw"`
+	// 协商了FeatureDeltaMoves时代替Table, 这时Table为null
+	Delta *MoveDelta `json:"delta,omitempty"`
+}
 
-	return bs
+type PacketClientWheatherAcceptDraw struct {
+	PacketHeader
+	AcceptDraw bool `json:"accept_draw"`
 }
 
-type PacketClientMove struct {
+type PacketClientDoSurrender struct {
+	PacketHeader
+}
+
+type PacketServerRemoteUpgradeOK struct {
+	PacketHeader
+	Table             *chess.ChessTable `json:"table"`
+	RemoteRequestDraw bool              `json:"remote_request_draw"`
+	// 协商了FeatureDeltaMoves时代替Table, 这时Table为null
+	Delta *MoveDelta `json:"delta,omitempty"`
+}
+
+type PacketServerUpgradeOK struct {
+	PacketHeader
+	Table *chess.ChessTable `json:"table"`
+	// 协商了FeatureDeltaMoves时代替Table, 这时Table为null
+	Delta *MoveDelta `json:"delta,omitempty"`
+}
+
+type PacketClientLogin struct {
+	PacketHeader
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// 为true时账号不存在则注册
+	Register bool `json:"register"`
+}
+
+type PacketServerLoginResp struct {
+	PacketHeader
+	OK bool `json:"ok"`
+	// 下面的字段只有在OK的时候有意义
+	AccountID int64 `json:"account_id,omitempty"`
+	Rating    int   `json:"rating,omitempty"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
+}
+
+type PacketClientCreateRoom struct {
+	PacketHeader
+	// 房主想要的颜色, SideBoth表示随机
+	Side    chess.Side        `json:"side"`
+	Options chess.GameOptions `json:"options"`
+}
+
+type PacketServerRoomCreated struct {
+	PacketHeader
+	InviteCode string `json:"invite_code"`
+}
+
+type PacketClientJoinRoom struct {
+	PacketHeader
+	InviteCode string `json:"invite_code"`
+}
+
+// 成功之后紧接着会收到PacketServerMatchedOK
+type PacketServerJoinRoomResp struct {
+	PacketHeader
+	OK bool `json:"ok"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
+}
+
+type PacketClientCancelRoom struct {
+	PacketHeader
+}
+
+type PacketClientChallenge struct {
+	PacketHeader
+	TargetAccountID int64 `json:"target_account_id"`
+	// 发起方想要的颜色, SideBoth表示随机
+	Side    chess.Side        `json:"side"`
+	Options chess.GameOptions `json:"options"`
+}
+
+type PacketServerChallengeResp struct {
+	PacketHeader
+	OK          bool  `json:"ok"`
+	ChallengeID int64 `json:"challenge_id,omitempty"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
+}
+
+type PacketServerChallengeReceived struct {
+	PacketHeader
+	ChallengeID int64 `json:"challenge_id"`
+	// 发起方, 未登录时id为0, name为空
+	FromAccountID int64  `json:"from_account_id"`
+	FromName      string `json:"from_name"`
+	// 被挑战方将会执的颜色, SideBoth表示随机
+	Side    chess.Side        `json:"side"`
+	Options chess.GameOptions `json:"options"`
+}
+
+type PacketClientAnswerChallenge struct {
+	PacketHeader
+	ChallengeID int64 `json:"challenge_id"`
+	Accept      bool  `json:"accept"`
+}
+
+type PacketServerChallengeCanceled struct {
+	PacketHeader
+	ChallengeID int64 `json:"challenge_id"`
+	// 被拒绝为true, 因为一方离开或者开始了别的对局而失效为false
+	Declined bool `json:"declined"`
+}
+
+type PacketServerClockUpdate struct {
 	PacketHeader
+	WhiteRemainingMs int64 `json:"white_remaining_ms"`
+	BlackRemainingMs int64 `json:"black_remaining_ms"`
+	// 正在走时的一方
+	Running chess.Side `json:"running"`
+}
+
+// 一步棋, Upgrade只有在兵升变完成之后才有
+type MoveInfo struct {
+	Side    chess.Side            `json:"side"`
+	FromX   rune                  `json:"from_x"`
+	FromY   int                   `json:"from_y"`
+	ToX     rune                  `json:"to_x"`
+	ToY     int                   `json:"to_y"`
+	Upgrade *chess.ChessPieceType `json:"upgrade,omitempty"`
+}
+
+// 棋盘上的一个格子
+type Square struct {
+	X rune `json:"x"`
+	Y int  `json:"y"`
+}
+
+// 一步棋对棋盘的改动, 客户端在自己的局面上应用之后, 局面哈希应该和PositionHash一样
+// 兵升变的包里From和To都是升变的兵所在的格子, 只有Promotion有意义
+type MoveDelta struct {
 	FromX rune `json:"from_x"`
 	FromY int  `json:"from_y"`
 	ToX   rune `json:"to_x"`
 	ToY   int  `json:"to_y"`
+	// 吃掉的棋子, 包括吃过路兵
+	Captured *chess.ChessPieceType `json:"captured,omitempty"`
+	// 吃过路兵时被吃掉的兵所在的格子
+	EnPassantVictim *Square `json:"en_passant_victim,omitempty"`
+	// 王车易位时车的移动
+	CastleRookFrom *Square `json:"castle_rook_from,omitempty"`
+	CastleRookTo   *Square `json:"castle_rook_to,omitempty"`
+	// 兵升变成的棋子
+	Promotion *chess.ChessPieceType `json:"promotion,omitempty"`
+	// 改动之后的局面哈希, 见PositionHash
+	PositionHash string `json:"position_hash"`
+}
 
-	// 和棋
-	DoDraw bool `json:"do_draw"`
+// 对局列表中的一项, 未登录的玩家名字为空
+type LiveGameInfo struct {
+	GameID     int64             `json:"game_id"`
+	WhiteName  string            `json:"white_name"`
+	BlackName  string            `json:"black_name"`
+	Options    chess.GameOptions `json:"options"`
+	MoveCount  int               `json:"move_count"`
+	Spectators int               `json:"spectators"`
 }
 
-func (p *PacketClientMove) MustMarshalToBytes() []byte {
-	i := PacketTypeClientMove
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketClientListGames struct {
+	PacketHeader
+}
 
-	return bs
+type PacketServerGameList struct {
+	PacketHeader
+	Games []LiveGameInfo `json:"games"`
 }
 
-type PacketClientSendPawnUpgrade struct {
+type PacketClientSpectate struct {
 	PacketHeader
-	ChessPieceType chess.ChessPieceType `json:"piece_type"`
+	GameID int64 `json:"game_id"`
 }
 
-func (p *PacketClientSendPawnUpgrade) MustMarshalToBytes() []byte {
-	i := PacketTypeClientSendPawnUpgrade
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+// 成功之后会持续收到这局对局的走棋, 升变, 和棋, 棋钟和结束的通知
+type PacketServerSpectateResp struct {
+	PacketHeader
+	OK bool `json:"ok"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
 
-	return bs
+	// 下面的字段只有在OK的时候有意义
+	GameID int64             `json:"game_id,omitempty"`
+	Info   *LiveGameInfo     `json:"info,omitempty"`
+	Table  *chess.ChessTable `json:"table,omitempty"`
+	Moves  []MoveInfo        `json:"moves,omitempty"`
+	// 正在等待操作的一方
+	WaitingSide chess.Side `json:"waiting_side"`
+	// 正在等待兵的升变
+	WaitingUpgrade bool `json:"waiting_upgrade"`
+	// 正在等待应答和棋
+	DrawOffered bool `json:"draw_offered"`
+	// 不限时的对局没有
+	Clock *PacketServerClockUpdate `json:"clock,omitempty"`
 }
 
-type PacketServerMoveResp struct {
+type PacketClientStopSpectate struct {
 	PacketHeader
-	MoveRespType PacketTypeServerMoveRespType `json:"resp_type"`
-	// 下面的字段只有在状态OK的时候出现
-	TableOnOK  *chess.ChessTable `json:"table,omitempty"`
+}
+
+type PacketServerSpectateMove struct {
+	PacketHeader
+	GameID     int64             `json:"game_id"`
+	Move       MoveInfo          `json:"move"`
+	Table      *chess.ChessTable `json:"table"`
 	KingThreat bool              `json:"king_threat"`
+	// 走棋的一方接下来需要选择兵升变成什么
+	UpgradePending bool `json:"upgrade_pending"`
 }
 
-func (p *PacketServerMoveResp) MustMarshalToBytes() []byte {
-	i := PacketTypeServerMoveResp
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerSpectateUpgrade struct {
+	PacketHeader
+	GameID    int64                `json:"game_id"`
+	Side      chess.Side           `json:"side"`
+	PieceType chess.ChessPieceType `json:"piece_type"`
+	Table     *chess.ChessTable    `json:"table"`
+}
 
-	return bs
+type PacketServerSpectateDraw struct {
+	PacketHeader
+	GameID int64      `json:"game_id"`
+	Side   chess.Side `json:"side"`
+	// true为提出和棋, false为拒绝和棋
+	Offer bool `json:"offer"`
 }
 
-type PacketServerGameOver struct {
+type PacketClientChat struct {
 	PacketHeader
-	Table       *chess.ChessTable `json:"final_table"`
-	WinnerSide  chess.Side        `json:"winner_side"`
-	IsSurrender bool              `json:"is_surrender"`
-	IsDraw      bool              `json:"is_draw"`
+	Channel ChatChannel `json:"channel"`
+	Text    string      `json:"text"`
 }
 
-func (p *PacketServerGameOver) MustMarshalToBytes() []byte {
-	i := PacketTypeServerGameOver
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerChat struct {
+	PacketHeader
+	GameID  int64       `json:"game_id"`
+	Channel ChatChannel `json:"channel"`
+	// 玩家频道中发送方的颜色, 观战频道中没有意义
+	FromSide chess.Side `json:"from_side"`
+	// 未登录时为空
+	FromName string `json:"from_name"`
+	Text     string `json:"text"`
+}
 
-	return bs
+type PacketServerChatRejected struct {
+	PacketHeader
+	Reason string `json:"reason"`
 }
 
-type PacketServerRemoteLoseConnection struct {
+type PacketClientMuteOpponent struct {
 	PacketHeader
+	Mute bool `json:"mute"`
 }
 
-func (p *PacketServerRemoteLoseConnection) MustMarshalToBytes() []byte {
-	i := PacketTypeServerRemoteLoseConnection
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+// 双方都同意之后交换颜色, 使用相同的对局设置立即开始, 双方收到PacketServerMatchedOK
+type PacketClientRematch struct {
+	PacketHeader
+	// true时对手还没有提出则提出, 对手已经提出则接受, false时拒绝或者撤回
+	Accept bool `json:"accept"`
+}
 
-	return bs
+type PacketServerRematchOffered struct {
+	PacketHeader
 }
 
-type PacketServerNotifyRemoteMove struct {
+type PacketServerRematchCanceled struct {
 	PacketHeader
-	Table             *chess.ChessTable `json:"table"`
-	RemotePawnUpgrade bool              `json:"remote_pawn_upgrade"`
-	KingThreat        bool              `json:"king_threat"`
-	RemoteRequestDraw bool              `json:"RemoteRequestDraw"`
+	// 被对手拒绝为true, 超时或者对手离开为false
+	Declined bool `json:"declined"`
 }
 
-func (p *PacketServerNotifyRemoteMove) MustMarshalToBytes() []byte {
-	i := PacketTypeServerNotifyRemoteMove
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type TournamentInfo struct {
+	TournamentID int64             `json:"tournament_id"`
+	Name         string            `json:"name"`
+	Format       TournamentFormat  `json:"format"`
+	State        TournamentState   `json:"state"`
+	TotalRounds  int               `json:"total_rounds"`
+	CurrentRound int               `json:"current_round"`
+	Players      int               `json:"players"`
+	Options      chess.GameOptions `json:"options"`
+	// 竞技场剩余时间
+	RemainingMs int64 `json:"remaining_ms,omitempty"`
+}
 
-	return bs
+// 轮空时Black为0
+type TournamentPairingInfo struct {
+	White     int64            `json:"white"`
+	WhiteName string           `json:"white_name"`
+	Black     int64            `json:"black"`
+	BlackName string           `json:"black_name"`
+	Result    TournamentResult `json:"result"`
+	// 一方没有出现而判负
+	Forfeit bool `json:"forfeit"`
 }
 
-type PacketClientWheatherAcceptDraw struct {
+type ArenaStandingInfo struct {
+	Rank      int    `json:"rank"`
+	AccountID int64  `json:"account_id"`
+	Name      string `json:"name"`
+	Score     int    `json:"score"`
+	// 连胜中, 胜和积分翻倍
+	OnFire bool `json:"on_fire"`
+	// 每一局的得分
+	Sheet     []int `json:"sheet"`
+	Playing   bool  `json:"playing"`
+	Withdrawn bool  `json:"withdrawn"`
+}
+
+type TournamentStandingInfo struct {
+	Rank            int     `json:"rank"`
+	AccountID       int64   `json:"account_id"`
+	Name            string  `json:"name"`
+	Score           float64 `json:"score"`
+	Buchholz        float64 `json:"buchholz"`
+	SonnebornBerger float64 `json:"sonneborn_berger"`
+	Withdrawn       bool    `json:"withdrawn"`
+}
+
+type PacketClientCreateTournament struct {
 	PacketHeader
-	AcceptDraw bool `json:"accept_draw"`
+	Name   string           `json:"name"`
+	Format TournamentFormat `json:"format"`
+	// 瑞士制的轮数, 其他赛制忽略
+	Rounds int `json:"rounds"`
+	// 竞技场的时长, 其他赛制忽略
+	DurationMinutes int               `json:"duration_minutes"`
+	Options         chess.GameOptions `json:"options"`
 }
 
-func (p *PacketClientWheatherAcceptDraw) MustMarshalToBytes() []byte {
-	i := PacketTypeClientWheatherAcceptDraw
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketClientJoinTournament struct {
+	PacketHeader
+	TournamentID int64 `json:"tournament_id"`
+}
 
-	return bs
+type PacketClientWithdrawTournament struct {
+	PacketHeader
+	TournamentID int64 `json:"tournament_id"`
 }
 
-type PacketClientDoSurrender struct {
+type PacketClientStartTournament struct {
 	PacketHeader
+	TournamentID int64 `json:"tournament_id"`
 }
 
-func (p *PacketClientDoSurrender) MustMarshalToBytes() []byte {
-	i := PacketTypeClientDoSurrender
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerTournamentResp struct {
+	PacketHeader
+	OK           bool  `json:"ok"`
+	TournamentID int64 `json:"tournament_id,omitempty"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
+}
 
-	return bs
+type PacketClientListTournaments struct {
+	PacketHeader
 }
 
-type PacketServerRemoteUpgradeOK struct {
+type PacketServerTournamentList struct {
 	PacketHeader
-	Table             *chess.ChessTable `json:"table"`
-	RemoteRequestDraw bool              `json:"remote_request_draw"`
+	Tournaments []TournamentInfo `json:"tournaments"`
 }
 
-func (p *PacketServerRemoteUpgradeOK) MustMarshalToBytes() []byte {
-	i := PacketTypeServerRemoteUpgradeOK
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerTournamentRound struct {
+	PacketHeader
+	TournamentID int64                   `json:"tournament_id"`
+	Round        int                     `json:"round"`
+	Pairings     []TournamentPairingInfo `json:"pairings"`
+}
 
-	return bs
+type PacketServerTournamentStandings struct {
+	PacketHeader
+	TournamentID int64                    `json:"tournament_id"`
+	Round        int                      `json:"round"`
+	Finished     bool                     `json:"finished"`
+	Standings    []TournamentStandingInfo `json:"standings"`
 }
 
-type PacketServerUpgradeOK struct {
+type PacketClientBerserk struct {
 	PacketHeader
-	Table *chess.ChessTable `json:"table"`
 }
 
-func (p *PacketServerUpgradeOK) MustMarshalToBytes() []byte {
-	i := PacketTypeServerUpgradeOK
-	p.Type = &i
-	bs, err := json.Marshal(p)
-	if err != nil {
-		panic(err)
-	}
+type PacketServerBerserk struct {
+	PacketHeader
+	Side chess.Side `json:"side"`
+}
+
+type PacketServerArenaLeaderboard struct {
+	PacketHeader
+	TournamentID int64               `json:"tournament_id"`
+	RemainingMs  int64               `json:"remaining_ms"`
+	Finished     bool                `json:"finished"`
+	Standings    []ArenaStandingInfo `json:"standings"`
+}
+
+type SeekInfo struct {
+	SeekID int64 `json:"seek_id"`
+	// 发起方未登录时为0
+	AccountID int64  `json:"account_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Rating    int    `json:"rating,omitempty"`
+	// 发起方执什么颜色, SideBoth表示随机
+	Side    chess.Side        `json:"side"`
+	Options chess.GameOptions `json:"options"`
+	// 接受方的等级分范围, 为0表示不限制
+	MinRating int `json:"min_rating,omitempty"`
+	MaxRating int `json:"max_rating,omitempty"`
+}
 
-	return bs
+type PacketClientSubscribeLobby struct {
+	PacketHeader
+}
+
+type PacketClientUnsubscribeLobby struct {
+	PacketHeader
+}
+
+type PacketServerSeekList struct {
+	PacketHeader
+	Seeks []SeekInfo `json:"seeks"`
+}
+
+type PacketServerSeekAdded struct {
+	PacketHeader
+	Seek SeekInfo `json:"seek"`
+}
+
+type PacketServerSeekRemoved struct {
+	PacketHeader
+	SeekID int64 `json:"seek_id"`
+}
+
+type PacketClientPostSeek struct {
+	PacketHeader
+	// 想要的颜色, SideBoth表示随机
+	Side chess.Side `json:"side"`
+	// Options.Casual为false时是计分的约战, 需要登录
+	Options chess.GameOptions `json:"options"`
+	// 接受方的等级分范围, 为0表示不限制, 设置了范围的话接受方需要登录
+	MinRating int `json:"min_rating"`
+	MaxRating int `json:"max_rating"`
+}
+
+type PacketClientCancelSeek struct {
+	PacketHeader
+}
+
+type PacketClientAcceptSeek struct {
+	PacketHeader
+	SeekID int64 `json:"seek_id"`
+}
+
+type PacketServerSeekResp struct {
+	PacketHeader
+	OK     bool  `json:"ok"`
+	SeekID int64 `json:"seek_id,omitempty"`
+	// 失败原因
+	Message string `json:"message,omitempty"`
+}
+
+type CorrespondenceGameInfo struct {
+	GameID         int64             `json:"game_id"`
+	WhiteAccountID int64             `json:"white_account_id"`
+	WhiteName      string            `json:"white_name"`
+	BlackAccountID int64             `json:"black_account_id"`
+	BlackName      string            `json:"black_name"`
+	Options        chess.GameOptions `json:"options"`
+	// 接收方执什么颜色
+	YourSide chess.Side `json:"your_side"`
+	ToMove   chess.Side `json:"to_move"`
+	// 轮到的一方还需要选择兵升变的棋子
+	PendingUpgrade bool `json:"pending_upgrade"`
+	// 对手提出了和棋, 等待轮到的一方应答
+	DrawOffered bool `json:"draw_offered"`
+	Moves       int  `json:"moves"`
+	// 轮到的一方走棋的期限, unix毫秒
+	DeadlineMs int64 `json:"deadline_ms"`
+}
+
+type PacketClientListCorrespondence struct {
+	PacketHeader
+}
+
+type PacketServerCorrespondenceList struct {
+	PacketHeader
+	Games []CorrespondenceGameInfo `json:"games"`
+}
+
+type PacketClientGetCorrespondence struct {
+	PacketHeader
+	GameID int64 `json:"game_id"`
+}
+
+type PacketClientCorrespondenceMove struct {
+	PacketHeader
+	GameID int64 `json:"game_id"`
+	FromX  rune  `json:"from_x"`
+	FromY  int   `json:"from_y"`
+	ToX    rune  `json:"to_x"`
+	ToY    int   `json:"to_y"`
+
+	// 走完之后提出和棋
+	DoDraw bool `json:"do_draw"`
+}
+
+type PacketClientCorrespondenceUpgrade struct {
+	PacketHeader
+	GameID         int64                `json:"game_id"`
+	ChessPieceType chess.ChessPieceType `json:"piece_type"`
+}
+
+type PacketClientCorrespondenceAnswerDraw struct {
+	PacketHeader
+	GameID int64 `json:"game_id"`
+	Accept bool  `json:"accept"`
+}
+
+type PacketClientCorrespondenceResign struct {
+	PacketHeader
+	GameID int64 `json:"game_id"`
+}
+
+type PacketServerCorrespondenceUpdate struct {
+	PacketHeader
+	Game  CorrespondenceGameInfo `json:"game"`
+	Table *chess.ChessTable      `json:"table"`
+	// 轮到的一方被将军
+	KingThreat bool `json:"king_threat"`
+}
+
+type PacketServerCorrespondenceFailed struct {
+	PacketHeader
+	GameID  int64  `json:"game_id"`
+	Message string `json:"message"`
+}
+
+type PacketServerCorrespondenceOver struct {
+	PacketHeader
+	GameID     int64             `json:"game_id"`
+	Table      *chess.ChessTable `json:"table"`
+	WinnerSide chess.Side        `json:"winner_side"`
+	// 结束原因, 比如checkmate, surrender, draw_agreed, timeout
+	Reason string `json:"reason"`
+}
+
+type PacketServerShutdown struct {
+	PacketHeader
+	Message string `json:"message"`
+}
+
+type PacketServerGameResumed struct {
+	PacketHeader
+	GameID  int64             `json:"game_id"`
+	Side    chess.Side        `json:"side"`
+	Table   *chess.ChessTable `json:"table"`
+	Moves   []MoveInfo        `json:"moves"`
+	Options chess.GameOptions `json:"options"`
+	// 正在等待操作的一方
+	WaitingSide chess.Side `json:"waiting_side"`
+	// 正在等待兵的升变
+	WaitingUpgrade bool `json:"waiting_upgrade"`
+	// 正在等待应答和棋
+	DrawOffered bool `json:"draw_offered"`
+	// 不限时的对局没有
+	Clock *PacketServerClockUpdate `json:"clock,omitempty"`
+}
+
+type PacketServerAnnouncement struct {
+	PacketHeader
+	Message string `json:"message"`
+}
+
+type PacketServerMaintenance struct {
+	PacketHeader
+	// 维护期间不能开始新的对局, 进行中的对局不受影响
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// 协议版本, 有不兼容的改动时加1
+const ProtocolVersion = 1
+
+// 服务端还能处理的最旧的协议版本
+const MinProtocolVersion = 1
+
+// 握手时请求这个特性表示走棋和升变之后只收到着法和局面哈希, 不再收到整个棋盘
+const FeatureDeltaMoves = "delta_moves"
+
+// 服务端支持的可选特性, 握手之后双方只使用都支持的特性
+var SupportedFeatures = []string{FeatureBinaryCodec, FeatureDeltaMoves}
+
+type PacketClientHello struct {
+	PacketHeader
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+}
+
+type PacketServerWelcome struct {
+	PacketHeader
+	// 为false时版本不兼容, 服务端随后断开连接
+	OK bool `json:"ok"`
+	// 之后使用的协议版本
+	Version int `json:"version"`
+	// 服务端支持的协议版本范围
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+	// 双方都支持的特性
+	Features []string `json:"features"`
+	Message  string   `json:"message,omitempty"`
+}
+
+type PacketServerError struct {
+	PacketHeader
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// 出错的包的类型, 包无法解析时没有
+	PacketType *PacketType `json:"packet_type,omitempty"`
+	// 为true时服务端随后断开连接
+	Fatal bool `json:"fatal"`
+}
+
+type PacketClientRequestPosition struct {
+	PacketHeader
+}
+
+type PacketServerPosition struct {
+	PacketHeader
+	GameID       int64             `json:"game_id"`
+	Table        *chess.ChessTable `json:"table"`
+	PositionHash string            `json:"position_hash"`
 }
@@ -0,0 +1,165 @@
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// 包的方向, 收到方向不对的包和收到不认识的包一样处理
+type Direction int
+
+const (
+	// 客户端发给服务端
+	DirectionClientToServer Direction = 1 << iota
+	// 服务端发给客户端
+	DirectionServerToClient
+	// 双方都会发, 目前只有心跳
+	DirectionBoth = DirectionClientToServer | DirectionServerToClient
+)
+
+var ErrNoPacketType = errors.New("packets: packet has no type")
+var ErrUnknownPacketType = errors.New("packets: unknown packet type")
+var ErrWrongDirection = errors.New("packets: packet sent in the wrong direction")
+var ErrUnregisteredPacket = errors.New("packets: packet is not registered")
+
+// 所有的包都实现了这个接口, 方法由嵌入的PacketHeader提供, 包的类型由注册表决定
+type Packet interface {
+	header() *PacketHeader
+}
+
+func (h *PacketHeader) header() *PacketHeader {
+	return h
+}
+
+type registration struct {
+	packetType PacketType
+	direction  Direction
+	// 返回一个空包, 解析时往里面填
+	new func() Packet
+}
+
+// 新的包在这里注册, 按类型编号排列
+var registrations = []registration{
+	{PacketTypeHeartbeat, DirectionBoth, func() Packet { return &PacketHeartbeat{} }},
+	{PacketTypeClientStartMatch, DirectionClientToServer, func() Packet { return &PacketClientStartMatch{} }},
+	{PacketTypeServerMatching, DirectionServerToClient, func() Packet { return &PacketServerMatching{} }},
+	{PacketTypeServerMatchedOK, DirectionServerToClient, func() Packet { return &PacketServerMatchedOK{} }},
+	{PacketTypeClientMove, DirectionClientToServer, func() Packet { return &PacketClientMove{} }},
+	{PacketTypeServerMoveResp, DirectionServerToClient, func() Packet { return &PacketServerMoveResp{} }},
+	{PacketTypeClientSendPawnUpgrade, DirectionClientToServer, func() Packet { return &PacketClientSendPawnUpgrade{} }},
+	{PacketTypeServerGameOver, DirectionServerToClient, func() Packet { return &PacketServerGameOver{} }},
+	{PacketTypeServerRemoteLoseConnection, DirectionServerToClient, func() Packet { return &PacketServerRemoteLoseConnection{} }},
+	{PacketTypeServerNotifyRemoteMove, DirectionServerToClient, func() Packet { return &PacketServerNotifyRemoteMove{} }},
+	{PacketTypeClientWheatherAcceptDraw, DirectionClientToServer, func() Packet { return &PacketClientWheatherAcceptDraw{} }},
+	{PacketTypeClientDoSurrender, DirectionClientToServer, func() Packet { return &PacketClientDoSurrender{} }},
+	{PacketTypeServerRemoteUpgradeOK, DirectionServerToClient, func() Packet { return &PacketServerRemoteUpgradeOK{} }},
+	{PacketTypeServerUpgradeOK, DirectionServerToClient, func() Packet { return &PacketServerUpgradeOK{} }},
+	{PacketTypeClientLogin, DirectionClientToServer, func() Packet { return &PacketClientLogin{} }},
+	{PacketTypeServerLoginResp, DirectionServerToClient, func() Packet { return &PacketServerLoginResp{} }},
+	{PacketTypeClientCreateRoom, DirectionClientToServer, func() Packet { return &PacketClientCreateRoom{} }},
+	{PacketTypeServerRoomCreated, DirectionServerToClient, func() Packet { return &PacketServerRoomCreated{} }},
+	{PacketTypeClientJoinRoom, DirectionClientToServer, func() Packet { return &PacketClientJoinRoom{} }},
+	{PacketTypeServerJoinRoomResp, DirectionServerToClient, func() Packet { return &PacketServerJoinRoomResp{} }},
+	{PacketTypeClientCancelRoom, DirectionClientToServer, func() Packet { return &PacketClientCancelRoom{} }},
+	{PacketTypeClientChallenge, DirectionClientToServer, func() Packet { return &PacketClientChallenge{} }},
+	{PacketTypeServerChallengeResp, DirectionServerToClient, func() Packet { return &PacketServerChallengeResp{} }},
+	{PacketTypeServerChallengeReceived, DirectionServerToClient, func() Packet { return &PacketServerChallengeReceived{} }},
+	{PacketTypeClientAnswerChallenge, DirectionClientToServer, func() Packet { return &PacketClientAnswerChallenge{} }},
+	{PacketTypeServerChallengeCanceled, DirectionServerToClient, func() Packet { return &PacketServerChallengeCanceled{} }},
+	{PacketTypeServerClockUpdate, DirectionServerToClient, func() Packet { return &PacketServerClockUpdate{} }},
+	{PacketTypeClientListGames, DirectionClientToServer, func() Packet { return &PacketClientListGames{} }},
+	{PacketTypeServerGameList, DirectionServerToClient, func() Packet { return &PacketServerGameList{} }},
+	{PacketTypeClientSpectate, DirectionClientToServer, func() Packet { return &PacketClientSpectate{} }},
+	{PacketTypeServerSpectateResp, DirectionServerToClient, func() Packet { return &PacketServerSpectateResp{} }},
+	{PacketTypeClientStopSpectate, DirectionClientToServer, func() Packet { return &PacketClientStopSpectate{} }},
+	{PacketTypeServerSpectateMove, DirectionServerToClient, func() Packet { return &PacketServerSpectateMove{} }},
+	{PacketTypeServerSpectateUpgrade, DirectionServerToClient, func() Packet { return &PacketServerSpectateUpgrade{} }},
+	{PacketTypeServerSpectateDraw, DirectionServerToClient, func() Packet { return &PacketServerSpectateDraw{} }},
+	{PacketTypeClientChat, DirectionClientToServer, func() Packet { return &PacketClientChat{} }},
+	{PacketTypeServerChat, DirectionServerToClient, func() Packet { return &PacketServerChat{} }},
+	{PacketTypeServerChatRejected, DirectionServerToClient, func() Packet { return &PacketServerChatRejected{} }},
+	{PacketTypeClientMuteOpponent, DirectionClientToServer, func() Packet { return &PacketClientMuteOpponent{} }},
+	{PacketTypeClientRematch, DirectionClientToServer, func() Packet { return &PacketClientRematch{} }},
+	{PacketTypeServerRematchOffered, DirectionServerToClient, func() Packet { return &PacketServerRematchOffered{} }},
+	{PacketTypeServerRematchCanceled, DirectionServerToClient, func() Packet { return &PacketServerRematchCanceled{} }},
+	{PacketTypeClientCreateTournament, DirectionClientToServer, func() Packet { return &PacketClientCreateTournament{} }},
+	{PacketTypeClientJoinTournament, DirectionClientToServer, func() Packet { return &PacketClientJoinTournament{} }},
+	{PacketTypeClientWithdrawTournament, DirectionClientToServer, func() Packet { return &PacketClientWithdrawTournament{} }},
+	{PacketTypeClientStartTournament, DirectionClientToServer, func() Packet { return &PacketClientStartTournament{} }},
+	{PacketTypeServerTournamentResp, DirectionServerToClient, func() Packet { return &PacketServerTournamentResp{} }},
+	{PacketTypeClientListTournaments, DirectionClientToServer, func() Packet { return &PacketClientListTournaments{} }},
+	{PacketTypeServerTournamentList, DirectionServerToClient, func() Packet { return &PacketServerTournamentList{} }},
+	{PacketTypeServerTournamentRound, DirectionServerToClient, func() Packet { return &PacketServerTournamentRound{} }},
+	{PacketTypeServerTournamentStandings, DirectionServerToClient, func() Packet { return &PacketServerTournamentStandings{} }},
+	{PacketTypeClientBerserk, DirectionClientToServer, func() Packet { return &PacketClientBerserk{} }},
+	{PacketTypeServerBerserk, DirectionServerToClient, func() Packet { return &PacketServerBerserk{} }},
+	{PacketTypeServerArenaLeaderboard, DirectionServerToClient, func() Packet { return &PacketServerArenaLeaderboard{} }},
+	{PacketTypeClientSubscribeLobby, DirectionClientToServer, func() Packet { return &PacketClientSubscribeLobby{} }},
+	{PacketTypeClientUnsubscribeLobby, DirectionClientToServer, func() Packet { return &PacketClientUnsubscribeLobby{} }},
+	{PacketTypeServerSeekList, DirectionServerToClient, func() Packet { return &PacketServerSeekList{} }},
+	{PacketTypeServerSeekAdded, DirectionServerToClient, func() Packet { return &PacketServerSeekAdded{} }},
+	{PacketTypeServerSeekRemoved, DirectionServerToClient, func() Packet { return &PacketServerSeekRemoved{} }},
+	{PacketTypeClientPostSeek, DirectionClientToServer, func() Packet { return &PacketClientPostSeek{} }},
+	{PacketTypeClientCancelSeek, DirectionClientToServer, func() Packet { return &PacketClientCancelSeek{} }},
+	{PacketTypeClientAcceptSeek, DirectionClientToServer, func() Packet { return &PacketClientAcceptSeek{} }},
+	{PacketTypeServerSeekResp, DirectionServerToClient, func() Packet { return &PacketServerSeekResp{} }},
+	{PacketTypeClientListCorrespondence, DirectionClientToServer, func() Packet { return &PacketClientListCorrespondence{} }},
+	{PacketTypeServerCorrespondenceList, DirectionServerToClient, func() Packet { return &PacketServerCorrespondenceList{} }},
+	{PacketTypeClientGetCorrespondence, DirectionClientToServer, func() Packet { return &PacketClientGetCorrespondence{} }},
+	{PacketTypeClientCorrespondenceMove, DirectionClientToServer, func() Packet { return &PacketClientCorrespondenceMove{} }},
+	{PacketTypeClientCorrespondenceUpgrade, DirectionClientToServer, func() Packet { return &PacketClientCorrespondenceUpgrade{} }},
+	{PacketTypeClientCorrespondenceAnswerDraw, DirectionClientToServer, func() Packet { return &PacketClientCorrespondenceAnswerDraw{} }},
+	{PacketTypeClientCorrespondenceResign, DirectionClientToServer, func() Packet { return &PacketClientCorrespondenceResign{} }},
+	{PacketTypeServerCorrespondenceUpdate, DirectionServerToClient, func() Packet { return &PacketServerCorrespondenceUpdate{} }},
+	{PacketTypeServerCorrespondenceFailed, DirectionServerToClient, func() Packet { return &PacketServerCorrespondenceFailed{} }},
+	{PacketTypeServerCorrespondenceOver, DirectionServerToClient, func() Packet { return &PacketServerCorrespondenceOver{} }},
+	{PacketTypeServerShutdown, DirectionServerToClient, func() Packet { return &PacketServerShutdown{} }},
+	{PacketTypeServerGameResumed, DirectionServerToClient, func() Packet { return &PacketServerGameResumed{} }},
+	{PacketTypeServerAnnouncement, DirectionServerToClient, func() Packet { return &PacketServerAnnouncement{} }},
+	{PacketTypeServerMaintenance, DirectionServerToClient, func() Packet { return &PacketServerMaintenance{} }},
+	{PacketTypeClientHello, DirectionClientToServer, func() Packet { return &PacketClientHello{} }},
+	{PacketTypeServerWelcome, DirectionServerToClient, func() Packet { return &PacketServerWelcome{} }},
+	{PacketTypeServerError, DirectionServerToClient, func() Packet { return &PacketServerError{} }},
+	{PacketTypeClientRequestPosition, DirectionClientToServer, func() Packet { return &PacketClientRequestPosition{} }},
+	{PacketTypeServerPosition, DirectionServerToClient, func() Packet { return &PacketServerPosition{} }},
+}
+
+var registryByType = map[PacketType]*registration{}
+var registryByGoType = map[reflect.Type]*registration{}
+
+func init() {
+	for i := range registrations {
+		r := &registrations[i]
+		t := reflect.TypeOf(r.new())
+		if _, ok := registryByType[r.packetType]; ok {
+			panic(fmt.Sprintf("packets: packet type %d registered twice", r.packetType))
+		}
+		if _, ok := registryByGoType[t]; ok {
+			panic(fmt.Sprintf("packets: %v registered twice", t))
+		}
+		registryByType[r.packetType] = r
+		registryByGoType[t] = r
+	}
+}
+
+// 包的类型, p必须是注册过的包结构体的指针
+func TypeOf(p Packet) (PacketType, error) {
+	r, ok := registryByGoType[reflect.TypeOf(p)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %T", ErrUnregisteredPacket, p)
+	}
+	return r.packetType, nil
+}
+
+// 创建一个packetType类型的空包, 类型没有注册或者方向不是direction时返回错误
+func newPacket(packetType PacketType, direction Direction) (Packet, error) {
+	r, ok := registryByType[packetType]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownPacketType, packetType)
+	}
+	if r.direction&direction == 0 {
+		return nil, fmt.Errorf("%w: type %d", ErrWrongDirection, packetType)
+	}
+	return r.new(), nil
+}
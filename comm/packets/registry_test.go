@@ -0,0 +1,213 @@
+package packets
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 改成注册表之前ServerParse和ClientParse两个switch里的对应关系, 编号是已经发布的协议, 不能改
+// 只在ServerParse里的是客户端发来的包, 只在ClientParse里的是服务端发出的包, 两边都有的是心跳
+var legacySwitch = []struct {
+	packetType PacketType
+	packet     Packet
+	direction  Direction
+}{
+	{0, &PacketHeartbeat{}, DirectionBoth},
+	{1, &PacketClientStartMatch{}, DirectionClientToServer},
+	{2, &PacketServerMatching{}, DirectionServerToClient},
+	{3, &PacketServerMatchedOK{}, DirectionServerToClient},
+	{4, &PacketClientMove{}, DirectionClientToServer},
+	{5, &PacketServerMoveResp{}, DirectionServerToClient},
+	{6, &PacketClientSendPawnUpgrade{}, DirectionClientToServer},
+	{7, &PacketServerGameOver{}, DirectionServerToClient},
+	{8, &PacketServerRemoteLoseConnection{}, DirectionServerToClient},
+	{9, &PacketServerNotifyRemoteMove{}, DirectionServerToClient},
+	{10, &PacketClientWheatherAcceptDraw{}, DirectionClientToServer},
+	{11, &PacketClientDoSurrender{}, DirectionClientToServer},
+	{12, &PacketServerRemoteUpgradeOK{}, DirectionServerToClient},
+	{13, &PacketServerUpgradeOK{}, DirectionServerToClient},
+	{14, &PacketClientLogin{}, DirectionClientToServer},
+	{15, &PacketServerLoginResp{}, DirectionServerToClient},
+	{16, &PacketClientCreateRoom{}, DirectionClientToServer},
+	{17, &PacketServerRoomCreated{}, DirectionServerToClient},
+	{18, &PacketClientJoinRoom{}, DirectionClientToServer},
+	{19, &PacketServerJoinRoomResp{}, DirectionServerToClient},
+	{20, &PacketClientCancelRoom{}, DirectionClientToServer},
+	{21, &PacketClientChallenge{}, DirectionClientToServer},
+	{22, &PacketServerChallengeResp{}, DirectionServerToClient},
+	{23, &PacketServerChallengeReceived{}, DirectionServerToClient},
+	{24, &PacketClientAnswerChallenge{}, DirectionClientToServer},
+	{25, &PacketServerChallengeCanceled{}, DirectionServerToClient},
+	{26, &PacketServerClockUpdate{}, DirectionServerToClient},
+	{27, &PacketClientListGames{}, DirectionClientToServer},
+	{28, &PacketServerGameList{}, DirectionServerToClient},
+	{29, &PacketClientSpectate{}, DirectionClientToServer},
+	{30, &PacketServerSpectateResp{}, DirectionServerToClient},
+	{31, &PacketClientStopSpectate{}, DirectionClientToServer},
+	{32, &PacketServerSpectateMove{}, DirectionServerToClient},
+	{33, &PacketServerSpectateUpgrade{}, DirectionServerToClient},
+	{34, &PacketServerSpectateDraw{}, DirectionServerToClient},
+	{35, &PacketClientChat{}, DirectionClientToServer},
+	{36, &PacketServerChat{}, DirectionServerToClient},
+	{37, &PacketServerChatRejected{}, DirectionServerToClient},
+	{38, &PacketClientMuteOpponent{}, DirectionClientToServer},
+	{39, &PacketClientRematch{}, DirectionClientToServer},
+	{40, &PacketServerRematchOffered{}, DirectionServerToClient},
+	{41, &PacketServerRematchCanceled{}, DirectionServerToClient},
+	{42, &PacketClientCreateTournament{}, DirectionClientToServer},
+	{43, &PacketClientJoinTournament{}, DirectionClientToServer},
+	{44, &PacketClientWithdrawTournament{}, DirectionClientToServer},
+	{45, &PacketClientStartTournament{}, DirectionClientToServer},
+	{46, &PacketServerTournamentResp{}, DirectionServerToClient},
+	{47, &PacketClientListTournaments{}, DirectionClientToServer},
+	{48, &PacketServerTournamentList{}, DirectionServerToClient},
+	{49, &PacketServerTournamentRound{}, DirectionServerToClient},
+	{50, &PacketServerTournamentStandings{}, DirectionServerToClient},
+	{51, &PacketClientBerserk{}, DirectionClientToServer},
+	{52, &PacketServerBerserk{}, DirectionServerToClient},
+	{53, &PacketServerArenaLeaderboard{}, DirectionServerToClient},
+	{54, &PacketClientSubscribeLobby{}, DirectionClientToServer},
+	{55, &PacketClientUnsubscribeLobby{}, DirectionClientToServer},
+	{56, &PacketServerSeekList{}, DirectionServerToClient},
+	{57, &PacketServerSeekAdded{}, DirectionServerToClient},
+	{58, &PacketServerSeekRemoved{}, DirectionServerToClient},
+	{59, &PacketClientPostSeek{}, DirectionClientToServer},
+	{60, &PacketClientCancelSeek{}, DirectionClientToServer},
+	{61, &PacketClientAcceptSeek{}, DirectionClientToServer},
+	{62, &PacketServerSeekResp{}, DirectionServerToClient},
+	{63, &PacketClientListCorrespondence{}, DirectionClientToServer},
+	{64, &PacketServerCorrespondenceList{}, DirectionServerToClient},
+	{65, &PacketClientGetCorrespondence{}, DirectionClientToServer},
+	{66, &PacketClientCorrespondenceMove{}, DirectionClientToServer},
+	{67, &PacketClientCorrespondenceUpgrade{}, DirectionClientToServer},
+	{68, &PacketClientCorrespondenceAnswerDraw{}, DirectionClientToServer},
+	{69, &PacketClientCorrespondenceResign{}, DirectionClientToServer},
+	{70, &PacketServerCorrespondenceUpdate{}, DirectionServerToClient},
+	{71, &PacketServerCorrespondenceFailed{}, DirectionServerToClient},
+	{72, &PacketServerCorrespondenceOver{}, DirectionServerToClient},
+	{73, &PacketServerShutdown{}, DirectionServerToClient},
+	{74, &PacketServerGameResumed{}, DirectionServerToClient},
+	{75, &PacketServerAnnouncement{}, DirectionServerToClient},
+	{76, &PacketServerMaintenance{}, DirectionServerToClient},
+	{77, &PacketClientHello{}, DirectionClientToServer},
+	{78, &PacketServerWelcome{}, DirectionServerToClient},
+	{79, &PacketServerError{}, DirectionServerToClient},
+	{80, &PacketClientRequestPosition{}, DirectionClientToServer},
+	{81, &PacketServerPosition{}, DirectionServerToClient},
+}
+
+func TestRegistryMatchesLegacySwitch(t *testing.T) {
+	if len(registrations) != len(legacySwitch) {
+		t.Errorf("%d packets registered, legacy switch had %d", len(registrations), len(legacySwitch))
+	}
+	for i, legacy := range legacySwitch {
+		if legacy.packetType != PacketType(i) {
+			t.Fatalf("legacy table out of order at %d", i)
+		}
+		r, ok := registryByType[legacy.packetType]
+		if !ok {
+			t.Errorf("type %d not registered", legacy.packetType)
+			continue
+		}
+		if got, want := reflect.TypeOf(r.new()), reflect.TypeOf(legacy.packet); got != want {
+			t.Errorf("type %d registered as %v, legacy switch returned %v", legacy.packetType, got, want)
+		}
+		if r.direction != legacy.direction {
+			t.Errorf("type %d direction %d, legacy %d", legacy.packetType, r.direction, legacy.direction)
+		}
+		packetType, err := TypeOf(legacy.packet)
+		if err != nil || packetType != legacy.packetType {
+			t.Errorf("TypeOf(%T) = %d, %v", legacy.packet, packetType, err)
+		}
+	}
+}
+
+// 每种包在两个方向上解析, 方向对的解析出同样的类型, 方向不对的返回ErrWrongDirection
+func TestRegistryDirections(t *testing.T) {
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		for _, legacy := range legacySwitch {
+			bs, err := codec.Marshal(legacy.packet)
+			if err != nil {
+				t.Fatalf("%v type %d: %v", codec, legacy.packetType, err)
+			}
+			cases := []struct {
+				parse     func([]byte) (Packet, error)
+				direction Direction
+			}{
+				{codec.ServerParse, DirectionClientToServer},
+				{codec.ClientParse, DirectionServerToClient},
+			}
+			for _, c := range cases {
+				p, err := c.parse(bs)
+				if legacy.direction&c.direction == 0 {
+					if !errors.Is(err, ErrWrongDirection) || p != nil {
+						t.Errorf("%v type %d direction %d: got %T, %v, want ErrWrongDirection", codec, legacy.packetType, c.direction, p, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%v type %d direction %d: %v", codec, legacy.packetType, c.direction, err)
+					continue
+				}
+				if reflect.TypeOf(p) != reflect.TypeOf(legacy.packet) {
+					t.Errorf("%v type %d parsed as %T, want %T", codec, legacy.packetType, p, legacy.packet)
+				}
+			}
+		}
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	unknown := make([]byte, 2)
+	unknown[1] = byte(len(legacySwitch))
+	cases := []struct {
+		name  string
+		codec Codec
+		bs    []byte
+		want  error
+	}{
+		{"json no type", CodecJSON, []byte(`{}`), ErrNoPacketType},
+		{"json null type", CodecJSON, []byte(`{"type":null}`), ErrNoPacketType},
+		{"json unknown type", CodecJSON, []byte(`{"type":82}`), ErrUnknownPacketType},
+		{"json negative type", CodecJSON, []byte(`{"type":-1}`), ErrUnknownPacketType},
+		{"binary unknown type", CodecBinary, unknown, ErrUnknownPacketType},
+		{"binary max type", CodecBinary, []byte{0xff, 0xff}, ErrUnknownPacketType},
+		{"binary truncated header", CodecBinary, []byte{0}, ErrBinaryTruncated},
+	}
+	for _, c := range cases {
+		for _, direction := range []Direction{DirectionClientToServer, DirectionServerToClient} {
+			p, err := c.codec.Unmarshal(c.bs, direction)
+			if !errors.Is(err, c.want) || p != nil {
+				t.Errorf("%s direction %d: got %v, %v, want %v", c.name, direction, p, err, c.want)
+			}
+		}
+	}
+
+	// 类型对但是内容不合法
+	if _, err := CodecJSON.ServerParse([]byte(`{"type":4,"from_x":"a"`)); err == nil {
+		t.Error("broken json accepted")
+	}
+	if _, err := CodecJSON.ServerParse([]byte(`not json`)); err == nil {
+		t.Error("garbage accepted")
+	}
+}
+
+type unregisteredPacket struct {
+	PacketHeader
+}
+
+func TestTypeOfUnregistered(t *testing.T) {
+	if _, err := TypeOf(&unregisteredPacket{}); !errors.Is(err, ErrUnregisteredPacket) {
+		t.Errorf("TypeOf unregistered: %v", err)
+	}
+	for _, codec := range []Codec{CodecJSON, CodecBinary} {
+		if _, err := codec.Marshal(&unregisteredPacket{}); !errors.Is(err, ErrUnregisteredPacket) {
+			t.Errorf("%v marshal unregistered: %v", codec, err)
+		}
+	}
+	// 注册的是包结构体, 单独的PacketHeader不算注册过
+	if _, err := TypeOf(&PacketHeader{}); !errors.Is(err, ErrUnregisteredPacket) {
+		t.Errorf("TypeOf header: %v", err)
+	}
+}
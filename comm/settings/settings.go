@@ -12,3 +12,94 @@ const MaxLoseHeartbeat = 5
 // 服务端的配置
 const ServerListenIP = "0.0.0.0"
 const ServerListenPort = 8000
+
+// 给浏览器用的WebSocket监听端口, 和ServerListenPort上的客户端在同一个匹配队列里, 为0时不开启
+const WebSocketListenPort = 8002
+
+// 上面两个端口的TLS证书和私钥文件, 为空时不开启TLS, 文件替换之后下一次握手时自动加载新的证书
+const TLSCertFile = ""
+const TLSKeyFile = ""
+
+// 校验客户端证书的CA文件, 为空时不接受客户端证书
+// 客户端证书的CommonName就是账号名, 机器人账号可以用它登录或者注册, 不需要密码
+const TLSClientCAFile = ""
+
+// 持久化数据库文件的路径
+const StoragePath = "chess.db"
+
+// 账号名的最大长度
+const MaxAccountNameLength = 32
+
+// 时间控制的范围, 单位秒
+const MaxTimeControlInitialSeconds = 3 * 60 * 60
+const MaxTimeControlIncrementSeconds = 60
+
+// 私人房间邀请码的长度
+const InviteCodeLength = 6
+
+// 每次从存储里预留多少个对局id, 剩下的不到GameIDRefillThreshold个时在后台预留下一段
+// 几千局同时结束时后台的预留要排在保存棋谱的写事务后面, 所以留得比较多, 重启时跳过的id不影响什么
+const GameIDBlockSize = 10000
+const GameIDRefillThreshold = 5000
+
+// 每局对局最多缓存多少条还没有发给观战者的通知, 超出的会被丢弃
+const SpectatorEventBufferSize = 256
+
+// 聊天配置
+// 一条消息最多多少个字符
+const MaxChatMessageLength = 200
+
+// 每个连接的聊天限速, 最多连续发送ChatBurst条, 之后每秒恢复ChatPerSecond条
+const ChatBurst = 5
+const ChatPerSecond = 0.5
+
+// 同一个字符最多连续重复多少次, 超过视为刷屏
+const ChatMaxRepeat = 10
+
+// 屏蔽词表文件, 一行一个词, 文件不存在则不过滤屏蔽词
+const ChatWordlistPath = "wordlist.txt"
+
+// 对局结束之后多少秒之内可以提出再来一局
+const RematchWindowSeconds = 30
+
+// 锦标赛配置
+const MaxTournamentNameLength = 64
+const MaxSwissRounds = 15
+const MaxArenaDurationMinutes = 3 * 60
+
+// 通信棋每一步最多多少天
+const MaxCorrespondenceDaysPerMove = 14
+
+// 多久检查一次通信棋是否超时
+const CorrespondenceCheckIntervalSeconds = 60
+
+// 重启之后多少分钟之内双方没有都回来, 恢复出来的对局作废
+const SuspendedGameTimeoutMinutes = 10
+
+// 关闭服务之前等待多少毫秒, 让关闭通知发出去
+const ShutdownFlushMilliseconds = 500
+
+// 管理接口的监听地址, 只监听本机
+const AdminListenAddress = "127.0.0.1:8001"
+
+// 管理接口的令牌从这个环境变量读取, 没有设置时不开启管理接口
+const AdminTokenEnv = "CHESS_ADMIN_TOKEN"
+
+// Prometheus抓取指标的地址, 为空时不开启
+const MetricsListenAddress = ":9180"
+
+// 对局审计文件的目录, 每局一个文件, 为空时不记录
+const AuditDirectory = "audit"
+
+// 日志级别从这个环境变量读取, 可以是DEBUG, INFO, WARN, ERROR, 默认为INFO
+const LogLevelEnv = "CHESS_LOG_LEVEL"
+
+// 每个连接的协议错误限速, 最多连续出错ProtocolErrorBurst次, 之后每秒恢复ProtocolErrorPerSecond次, 超过时断开连接
+const ProtocolErrorBurst = 5
+const ProtocolErrorPerSecond = 0.2
+
+// 因为协议错误断开连接时, 发出错误包之后等待多少毫秒再断开
+const CloseAfterErrorMilliseconds = 1000
+
+// 客户端发来的包本体的最大长度, 超过时断开连接, 也是每个连接读缓冲区的上限
+const MaxFrameSize = 16 * 1024
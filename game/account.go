@@ -0,0 +1,124 @@
+package game
+
+import (
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/storage"
+
+	protocoltool "chess-backend/tools/protocol"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func sendLoginResp(connCtx *ConnContext, resp packets.PacketServerLoginResp) {
+	sendPacketTo(connCtx, &resp)
+}
+
+// 登录只能在空闲状态下进行, 一个连接只能登录一次, 一个账号同时只能在一个连接上登录
+// 调用时不能持有LobbyLock: bcrypt很慢, 读写存储和校验密码都在锁外面做, 最后再拿锁绑定账号
+func handleLogin(connCtx *ConnContext, packet *packets.PacketClientLogin) {
+	// 协议判断
+	LobbyLock.Lock()
+	idle := connCtx.ConnState == ConnStateNone && connCtx.Account == nil
+	LobbyLock.Unlock()
+	if !idle {
+		rejectPacket(connCtx, packets.PacketTypeClientLogin, packets.ErrorCodeWrongState, "can only log in once, when idle")
+		return
+	}
+
+	account, byCert, ok := authenticate(connCtx, packet)
+	if !ok {
+		return
+	}
+
+	// 读出来到绑定账号之间不能有对局结束改了等级分, 否则缓存的是旧的
+	ratingLock.Lock()
+	rating, err := Store.GetRating(account.ID)
+	if err != nil {
+		ratingLock.Unlock()
+		connCtx.Log.Error("load rating failed", "account", account.ID, "err", err)
+		sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "internal error"})
+		return
+	}
+
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	ratingLock.Unlock()
+	// 同一个连接的包按顺序处理, 校验密码期间这个连接的状态不会变, 但是别的连接可能已经登录了这个账号
+	if Accounts[account.ID] != nil {
+		sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "account is already logged in on another connection"})
+		return
+	}
+	connCtx.Account = account
+	connCtx.Rating = rating.Rating
+	Accounts[account.ID] = connCtx
+	connCtx.Log.Info("logged in", "account", account.ID, "name", account.Name, "client_cert", byCert)
+	sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: true, AccountID: account.ID, Rating: rating.Rating})
+
+	// 对手已经回来的话继续重启之前的对局
+	resumeSuspendedGamesOf(connCtx)
+}
+
+// 校验账号和密码, 需要注册时注册, 失败时已经回复了客户端, 不拿LobbyLock
+func authenticate(connCtx *ConnContext, packet *packets.PacketClientLogin) (account *storage.Account, byCert bool, ok bool) {
+	// 客户端证书校验通过并且CommonName就是这个账号时不需要密码, 给机器人账号用
+	byCert = packet.Name != "" && protocoltool.ClientCertName(connCtx.Conn) == packet.Name
+
+	if len(packet.Name) == 0 || len(packet.Name) > settings.MaxAccountNameLength || (len(packet.Password) == 0 && !byCert) {
+		sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "invalid name or password"})
+		return nil, byCert, false
+	}
+
+	account, err := Store.GetAccountByName(packet.Name)
+	switch {
+	case err == storage.ErrNotFound && packet.Register && byCert:
+		// 用证书注册的账号没有密码, 只能用证书登录
+		account, err = Store.CreateAccount(packet.Name, nil)
+		if err == storage.ErrAccountExists {
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "account already exists"})
+			return nil, byCert, false
+		}
+		if err != nil {
+			connCtx.Log.Error("create account failed", "name", packet.Name, "err", err)
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "internal error"})
+			return nil, byCert, false
+		}
+	case err == storage.ErrNotFound && packet.Register:
+		hash, err := bcrypt.GenerateFromPassword([]byte(packet.Password), bcrypt.DefaultCost)
+		if err != nil {
+			// 密码太长
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "invalid password"})
+			return nil, byCert, false
+		}
+		account, err = Store.CreateAccount(packet.Name, hash)
+		if err == storage.ErrAccountExists {
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "account already exists"})
+			return nil, byCert, false
+		}
+		if err != nil {
+			connCtx.Log.Error("create account failed", "name", packet.Name, "err", err)
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "internal error"})
+			return nil, byCert, false
+		}
+	case err == storage.ErrNotFound:
+		sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "wrong name or password"})
+		return nil, byCert, false
+	case err != nil:
+		connCtx.Log.Error("load account failed", "name", packet.Name, "err", err)
+		sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "internal error"})
+		return nil, byCert, false
+	case byCert:
+		// 证书已经证明了身份
+	default:
+		if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(packet.Password)) != nil {
+			sendLoginResp(connCtx, packets.PacketServerLoginResp{OK: false, Message: "wrong name or password"})
+			return nil, byCert, false
+		}
+	}
+	return account, byCert, true
+}
+
+// 找到登录了这个账号的连接, 不在线时返回nil, 需要持有LobbyLock
+func onlineConnOf(accountID int64) *ConnContext {
+	return Accounts[accountID]
+}
@@ -0,0 +1,146 @@
+package game
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"chess-backend/client"
+
+	testcerttool "chess-backend/tools/testcert"
+)
+
+// 开一个要求TLS的测试服务器, 返回地址, 带着CommonName为botName的客户端证书和不带证书的客户端配置
+func startCertTestServer(t *testing.T, heartbeat bool, botName string) (addr string, withCert, withoutCert *tls.Config) {
+	ca, err := testcerttool.NewCA("test ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverLeaf, err := ca.IssueServer("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := serverLeaf.TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = startTestServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}, heartbeat)
+
+	botLeaf, err := ca.IssueClient(botName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	botCert, err := botLeaf.TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCert = &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost", Certificates: []tls.Certificate{botCert}}
+	withoutCert = &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"}
+	return addr, withCert, withoutCert
+}
+
+// 机器人账号用客户端证书登录, 证书的CommonName就是账号名, 不需要密码
+func TestLoginByClientCert(t *testing.T) {
+	addr, withCert, withoutCert := startCertTestServer(t, false, "certbot")
+
+	connect := func(config client.Config) (*client.Client, error) {
+		config.Addr = addr
+		c, err := client.Connect(config)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		return c, err
+	}
+
+	// 没有证书也没有密码, 不能注册
+	if _, err := connect(client.Config{TLSConfig: withoutCert, Name: "certbot", Register: true}); err == nil || !strings.Contains(err.Error(), "invalid name or password") {
+		t.Fatalf("register without cert: %v", err)
+	}
+
+	// 用证书注册, 之后用证书登录是同一个账号
+	registered, err := connect(client.Config{TLSConfig: withCert, Name: "certbot", Register: true})
+	if err != nil {
+		t.Fatalf("register with cert: %v", err)
+	}
+	if registered.AccountID() == 0 {
+		t.Fatal("no account id after register")
+	}
+	registered.Close()
+	waitLoggedOut(t, registered.AccountID())
+
+	loggedIn, err := connect(client.Config{TLSConfig: withCert, Name: "certbot"})
+	if err != nil {
+		t.Fatalf("login with cert: %v", err)
+	}
+	if loggedIn.AccountID() != registered.AccountID() {
+		t.Errorf("login with cert got account %d, registered %d", loggedIn.AccountID(), registered.AccountID())
+	}
+	loggedIn.Close()
+	waitLoggedOut(t, loggedIn.AccountID())
+
+	// 没有证书时用证书注册的账号没有密码, 登录不了
+	if _, err := connect(client.Config{TLSConfig: withoutCert, Name: "certbot"}); err == nil {
+		t.Error("login without cert succeeded")
+	}
+	if _, err := connect(client.Config{TLSConfig: withoutCert, Name: "certbot", Password: "guess"}); err == nil {
+		t.Error("login with password to a cert account succeeded")
+	}
+
+	// 证书只能登录CommonName对应的账号
+	if _, err := connect(client.Config{TLSConfig: withCert, Name: "someone-else", Register: true}); err == nil {
+		t.Error("cert logged in as another account")
+	}
+
+	// 有证书的连接也可以用密码登录别的账号
+	if _, err := connect(client.Config{TLSConfig: withCert, Name: "password-user", Password: "secret", Register: true}); err != nil {
+		t.Errorf("password register over client cert connection: %v", err)
+	}
+}
+
+// 一个账号同时只能在一个连接上登录, 先登录的连接断开之后才能再登录
+// 用证书登录不用算bcrypt, 服务器可以一直发心跳, 先登录的连接不会因为超时断开
+func TestDuplicateLogin(t *testing.T) {
+	addr, withCert, withoutCert := startCertTestServer(t, true, "dup")
+	connect := func(config client.Config) (*client.Client, error) {
+		config.Addr = addr
+		config.Name = "dup"
+		return client.Connect(config)
+	}
+
+	first, err := connect(client.Config{TLSConfig: withCert, Register: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	if _, err := connect(client.Config{TLSConfig: withCert}); err == nil || !strings.Contains(err.Error(), "already logged in") {
+		t.Fatalf("second login: %v", err)
+	}
+	// 身份校验失败时还是报密码错误, 不能用来探测账号是否在线
+	if _, err := connect(client.Config{TLSConfig: withoutCert, Password: "guess"}); err == nil || !strings.Contains(err.Error(), "wrong name or password") {
+		t.Fatalf("login with wrong password: %v", err)
+	}
+
+	LobbyLock.Lock()
+	online := onlineConnOf(first.AccountID())
+	LobbyLock.Unlock()
+	if online == nil || online.Account.ID != first.AccountID() {
+		t.Fatalf("online connection of account %d: %v", first.AccountID(), online)
+	}
+
+	first.Close()
+	waitLoggedOut(t, first.AccountID())
+	second, err := connect(client.Config{TLSConfig: withCert})
+	if err != nil {
+		t.Fatalf("login after first connection closed: %v", err)
+	}
+	if second.AccountID() != first.AccountID() {
+		t.Errorf("logged in as account %d, want %d", second.AccountID(), first.AccountID())
+	}
+	second.Close()
+	waitLoggedOut(t, second.AccountID())
+}
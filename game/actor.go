@@ -0,0 +1,134 @@
+package game
+
+import (
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+	"sync"
+	"time"
+)
+
+// 对局协程的信箱, 不限长度, 投递永远不会阻塞, 所以拿着LobbyLock的时候也可以投递
+type gameMailbox struct {
+	lock   sync.Mutex
+	tasks  []func()
+	notify chan struct{}
+}
+
+func newGameMailbox() *gameMailbox {
+	return &gameMailbox{notify: make(chan struct{}, 1)}
+}
+
+func (m *gameMailbox) post(task func()) {
+	m.lock.Lock()
+	m.tasks = append(m.tasks, task)
+	m.lock.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 取出目前所有的任务
+func (m *gameMailbox) take() []func() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tasks := m.tasks
+	m.tasks = nil
+	return tasks
+}
+
+// 把一个操作投递到对局协程里执行
+func (gameContext *GameContext) post(task func()) {
+	gameContext.mailbox.post(task)
+}
+
+// 对局协程, 按投递的顺序处理信箱里的操作, 同时盯着走时一方的棋钟, 对局结束或者挂起之后退出
+func (gameContext *GameContext) run() {
+	for gameContext.Machine.State() != machine.StateOver && !gameContext.suspended {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if gameContext.Clock != nil {
+			timer = time.NewTimer(gameContext.Clock.Remaining(gameContext.Clock.Running, time.Now()))
+			timeout = timer.C
+		}
+
+		select {
+		case <-gameContext.mailbox.notify:
+			gameContext.runTasks()
+		case <-timeout:
+			checkGameClock(gameContext)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	// 对局结束之前已经投递进来的操作, 这时候它们只会发现对局已经结束
+	gameContext.runTasks()
+	gameContext.audit.close()
+}
+
+// 挂起之后的操作都丢掉, 保存下来的快照就是最终的局面
+func (gameContext *GameContext) runTasks() {
+	for _, task := range gameContext.mailbox.take() {
+		if gameContext.suspended {
+			return
+		}
+		startedAt := time.Now()
+		task()
+		metricHandlerDuration.With("GameTask").ObserveSince(startedAt)
+	}
+}
+
+// 确认连接正在对局之后把操作投递到它的对局协程, 不需要LobbyLock
+// 对局刚刚结束时可能投递到已经退出的协程, 这时候操作不会执行, 和对局结束之后才收到是一样的
+func postToGame(connCtx *ConnContext, packetType packets.PacketType, task func(gameContext *GameContext)) {
+	// 协议判断
+	gameContext := connCtx.Gcontext.Load()
+	if gameContext == nil {
+		rejectPacket(connCtx, packetType, packets.ErrorCodeWrongState, "not in a game")
+		return
+	}
+
+	gameContext.post(func() {
+		task(gameContext)
+	})
+}
+
+// 对局里的包直接投递给对局协程, 不拿LobbyLock, 不是对局里的包时返回false
+// 握手之前的包要在锁里回复错误, 也返回false
+func dispatchGamePacket(connCtx *ConnContext, packIface packets.Packet) bool {
+	// ProtocolVersion只在这个连接自己的协程里修改, 可以不拿锁读
+	if connCtx.ProtocolVersion == 0 {
+		return false
+	}
+
+	switch packet := packIface.(type) {
+	case *packets.PacketClientMove:
+		postToGame(connCtx, packets.PacketTypeClientMove, func(gameContext *GameContext) {
+			handleMove(gameContext, connCtx, packet)
+		})
+	case *packets.PacketClientSendPawnUpgrade:
+		postToGame(connCtx, packets.PacketTypeClientSendPawnUpgrade, func(gameContext *GameContext) {
+			handlePawnUpgrade(gameContext, connCtx, packet)
+		})
+	case *packets.PacketClientRequestPosition:
+		postToGame(connCtx, packets.PacketTypeClientRequestPosition, func(gameContext *GameContext) {
+			handleRequestPosition(gameContext, connCtx)
+		})
+	case *packets.PacketClientDoSurrender:
+		postToGame(connCtx, packets.PacketTypeClientDoSurrender, func(gameContext *GameContext) {
+			handleSurrender(gameContext, connCtx)
+		})
+	case *packets.PacketClientWheatherAcceptDraw:
+		postToGame(connCtx, packets.PacketTypeClientWheatherAcceptDraw, func(gameContext *GameContext) {
+			handleAnswerDraw(gameContext, connCtx, packet)
+		})
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+	"errors"
+	"sort"
+	"time"
+)
+
+// 下面是给管理接口用的操作, 都可以在任意协程里调用
+
+var ErrConnNotFound = errors.New("connection not found")
+var ErrGameNotFound = errors.New("game not found")
+
+// 等待对局协程执行管理操作的最长时间, 超过的话对局多半已经结束了
+const adminCallTimeout = 2 * time.Second
+
+// 维护模式, 由LobbyLock保护
+var maintenance bool
+var maintenanceMessage string
+
+type AdminConnInfo struct {
+	ID          int    `json:"id"`
+	RemoteAddr  string `json:"remote_addr"`
+	State       string `json:"state"`
+	AccountID   int64  `json:"account_id,omitempty"`
+	AccountName string `json:"account_name,omitempty"`
+	// 正在下或者正在观战的对局
+	GameID int64 `json:"game_id,omitempty"`
+}
+
+type AdminGameInfo struct {
+	packets.LiveGameInfo
+	WhiteConnID  int       `json:"white_conn_id"`
+	BlackConnID  int       `json:"black_conn_id"`
+	TournamentID int64     `json:"tournament_id,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+type AdminGameDetail struct {
+	AdminGameInfo
+	State string                           `json:"state"`
+	Table *chess.ChessTable                `json:"table"`
+	Moves []packets.MoveInfo               `json:"moves"`
+	Clock *packets.PacketServerClockUpdate `json:"clock,omitempty"`
+}
+
+func AdminListConns() []AdminConnInfo {
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+
+	conns := make([]AdminConnInfo, 0)
+	Conns.Range(func(v *ConnContext) bool {
+		info := AdminConnInfo{ID: v.ID, RemoteAddr: v.Conn.PeerAddr(), State: v.ConnState.String()}
+		if v.Account != nil {
+			info.AccountID = v.Account.ID
+			info.AccountName = v.Account.Name
+		}
+		if v.ConnState == ConnStateGaming {
+			info.GameID = v.Gcontext.Load().ID
+		} else if v.ConnState == ConnStateSpectating {
+			info.GameID = v.Spectating.ID
+		}
+		conns = append(conns, info)
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// 需要持有LobbyLock
+func adminGameInfoOf(gameContext *GameContext) AdminGameInfo {
+	info := AdminGameInfo{
+		LiveGameInfo: liveGameInfoOf(gameContext),
+		WhiteConnID:  gameContext.WhiteConnContext.ID,
+		BlackConnID:  gameContext.BlackConnContext.ID,
+		StartedAt:    gameContext.StartedAt,
+	}
+	if gameContext.Tournament != nil {
+		info.TournamentID = gameContext.Tournament.ID
+	} else if gameContext.Arena != nil {
+		info.TournamentID = gameContext.Arena.ID
+	}
+	return info
+}
+
+func AdminListGames() []AdminGameInfo {
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+
+	games := make([]AdminGameInfo, 0, len(Games))
+	for _, gameContext := range Games {
+		games = append(games, adminGameInfoOf(gameContext))
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].GameID < games[j].GameID
+	})
+	return games
+}
+
+// 在对局协程里执行fn并等它执行完, 不能在持有LobbyLock的时候调用
+func callGame(gameID int64, fn func(gameContext *GameContext)) error {
+	LobbyLock.Lock()
+	gameContext := Games[gameID]
+	if gameContext == nil {
+		LobbyLock.Unlock()
+		return ErrGameNotFound
+	}
+	done := make(chan struct{})
+	gameContext.post(func() {
+		defer close(done)
+		fn(gameContext)
+	})
+	LobbyLock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(adminCallTimeout):
+		return ErrGameNotFound
+	}
+}
+
+func AdminInspectGame(gameID int64) (*AdminGameDetail, error) {
+	LobbyLock.Lock()
+	gameContext := Games[gameID]
+	var info AdminGameInfo
+	if gameContext != nil {
+		info = adminGameInfoOf(gameContext)
+	}
+	LobbyLock.Unlock()
+	if gameContext == nil {
+		return nil, ErrGameNotFound
+	}
+
+	var detail *AdminGameDetail
+	err := callGame(gameID, func(gameContext *GameContext) {
+		if gameContext.Machine.State() == machine.StateOver {
+			return
+		}
+
+		moves := make([]packets.MoveInfo, 0, len(gameContext.Moves))
+		for _, record := range gameContext.Moves {
+			moves = append(moves, moveInfoOf(record))
+		}
+		detail = &AdminGameDetail{
+			AdminGameInfo: info,
+			State:         gameContext.Machine.State().String(),
+			Table:         gameContext.Table.Copy(),
+			Moves:         moves,
+		}
+		if gameContext.Clock != nil {
+			detail.Clock = clockUpdatePacket(gameContext, time.Now())
+		}
+	})
+	// 超时的话fn可能还没有执行, 不能读detail
+	if err != nil {
+		return nil, err
+	}
+	if detail == nil {
+		return nil, ErrGameNotFound
+	}
+	return detail, nil
+}
+
+// 断开一个连接, 和客户端自己断开一样处理
+func AdminKick(connID int) error {
+	connCtx := Conns.Get(connID)
+	if connCtx == nil {
+		return ErrConnNotFound
+	}
+	return connCtx.Conn.Close()
+}
+
+// 结束一局对局, winnerSide为SideBoth时判和, abort为true时作废, 不影响等级分
+func AdminEndGame(gameID int64, winnerSide chess.Side, abort bool) error {
+	outcome := gameOutcome{WinnerSide: winnerSide, Reason: GameEndReasonAdjudicated}
+	if abort {
+		outcome = gameOutcome{WinnerSide: chess.SideBoth, Reason: GameEndReasonAborted}
+	}
+
+	ended := false
+	err := callGame(gameID, func(gameContext *GameContext) {
+		ended = fireGameEvent(gameContext, chess.SideWhite, machine.EventAdjudicate, outcome)
+	})
+	if err != nil {
+		return err
+	}
+	if !ended {
+		return ErrGameNotFound
+	}
+	return nil
+}
+
+func AdminBroadcast(message string) {
+	announcementPacket := &packets.PacketServerAnnouncement{Message: message}
+	Conns.Range(func(v *ConnContext) bool {
+		sendPacketTo(v, announcementPacket)
+		return true
+	})
+}
+
+// 打开维护模式之后不能开始新的对局, 锦标赛也暂停推进, 进行中的对局不受影响
+func SetMaintenance(enabled bool, message string) {
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+
+	maintenance = enabled
+	maintenanceMessage = message
+	maintenancePacket := &packets.PacketServerMaintenance{Enabled: enabled, Message: message}
+	Conns.Range(func(v *ConnContext) bool {
+		sendPacketTo(v, maintenancePacket)
+		return true
+	})
+}
+
+func Maintenance() (bool, string) {
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+
+	return maintenance, maintenanceMessage
+}
+
+// 会开始新对局的请求
+func startsNewGame(packIface interface{}) bool {
+	switch packet := packIface.(type) {
+	case *packets.PacketClientStartMatch, *packets.PacketClientCreateRoom, *packets.PacketClientJoinRoom,
+		*packets.PacketClientChallenge, *packets.PacketClientPostSeek, *packets.PacketClientAcceptSeek,
+		*packets.PacketClientCreateTournament, *packets.PacketClientJoinTournament, *packets.PacketClientStartTournament:
+		return true
+	case *packets.PacketClientAnswerChallenge:
+		return packet.Accept
+	case *packets.PacketClientRematch:
+		return packet.Accept
+	default:
+		return false
+	}
+}
@@ -0,0 +1,234 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"chess-backend/tournament"
+	"log/slog"
+	"time"
+)
+
+func arenaInfoOf(a *tournament.Arena, now time.Time) packets.TournamentInfo {
+	return packets.TournamentInfo{
+		TournamentID: a.ID,
+		Name:         a.Name,
+		Format:       packets.TournamentFormatArena,
+		State:        packets.TournamentState(a.State),
+		CurrentRound: len(a.Games),
+		Players:      len(a.Players),
+		Options:      a.Options,
+		RemainingMs:  a.Remaining(now).Milliseconds(),
+	}
+}
+
+func createArena(connCtx *ConnContext, packet *packets.PacketClientCreateTournament) {
+	if packet.DurationMinutes < 1 || packet.DurationMinutes > settings.MaxArenaDurationMinutes {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "invalid duration"})
+		return
+	}
+	// 竞技场必须限时, 否则没法狂暴
+	if packet.Options.TimeControl.Unlimited() {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "arena requires a time control"})
+		return
+	}
+
+	a := tournament.NewArena(
+		AtomicTournamentIDIncrease.Add(1),
+		packet.Name,
+		packet.Options,
+		connCtx.Account.ID,
+		time.Duration(packet.DurationMinutes)*time.Minute,
+	)
+	Arenas[a.ID] = a
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: a.ID})
+}
+
+func joinArena(connCtx *ConnContext, a *tournament.Arena) {
+	err := a.Register(connCtx.Account.ID, connCtx.Account.Name, connCtx.Rating, time.Now())
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: a.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: a.ID})
+	broadcastArenaLeaderboard(a)
+}
+
+// 比赛中退出只是暂停, 正在下的这一局不受影响
+func withdrawArena(connCtx *ConnContext, a *tournament.Arena) {
+	if a.State == tournament.StateFinished {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: a.ID, Message: "tournament is finished"})
+		return
+	}
+
+	err := a.Withdraw(connCtx.Account.ID)
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: a.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: a.ID})
+	broadcastArenaLeaderboard(a)
+}
+
+// 开始之后由心跳负责编排
+func startArena(connCtx *ConnContext, a *tournament.Arena) {
+	if connCtx.Account == nil || connCtx.Account.ID != a.OrganizerID {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: a.ID, Message: "not the organizer"})
+		return
+	}
+
+	err := a.Start(time.Now())
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: a.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: a.ID})
+	broadcastArenaLeaderboard(a)
+}
+
+func broadcastArenaLeaderboard(a *tournament.Arena) {
+	leaderboardPacket := packets.PacketServerArenaLeaderboard{
+		TournamentID: a.ID,
+		RemainingMs:  a.Remaining(time.Now()).Milliseconds(),
+		Finished:     a.State == tournament.StateFinished,
+		Standings:    make([]packets.ArenaStandingInfo, 0, len(a.Players)),
+	}
+	for _, s := range a.Leaderboard() {
+		sheet := make([]int, 0, len(s.Player.Sheet))
+		for _, entry := range s.Player.Sheet {
+			sheet = append(sheet, entry.Points)
+		}
+		leaderboardPacket.Standings = append(leaderboardPacket.Standings, packets.ArenaStandingInfo{
+			Rank:      s.Rank,
+			AccountID: s.Player.ID,
+			Name:      s.Player.Name,
+			Score:     s.Player.Score,
+			OnFire:    s.Player.OnFire(),
+			Sheet:     sheet,
+			Playing:   s.Player.Playing,
+			Withdrawn: s.Player.Withdrawn,
+		})
+	}
+
+	leaderboardShared := newSharedPacket(&leaderboardPacket)
+	for _, p := range a.Players {
+		if connCtx := onlineConnOf(p.ID); connCtx != nil {
+			sendSharedTo(connCtx, leaderboardShared)
+		}
+	}
+}
+
+// 竞技场只编排在线并且空闲的选手
+func arenaPlayerAvailable(accountID int64) bool {
+	connCtx := onlineConnOf(accountID)
+	return connCtx != nil && connCtx.ConnState == ConnStateNone
+}
+
+// 在心跳里检查, 给空闲的选手编排对局, 时间到了并且所有对局结束之后公布最终排名
+func progressArenas() {
+	now := time.Now()
+	for _, a := range Arenas {
+		if a.State != tournament.StateRunning {
+			continue
+		}
+
+		if a.Ended(now) {
+			if a.PlayingGames() == 0 {
+				a.Finish()
+				broadcastArenaLeaderboard(a)
+			}
+			continue
+		}
+
+		games := a.Pair(now, arenaPlayerAvailable)
+		for _, g := range games {
+			gameContext, err := startGame(onlineConnOf(g.White), onlineConnOf(g.Black), a.Options)
+			if err != nil {
+				// 没下成的对局双方都不得分, 之后重新编排
+				if err := a.Report(g, tournament.ResultDoubleForfeit, 0, now); err != nil {
+					slog.Error("report arena game failed", "arena", a.ID, "err", err)
+				}
+				continue
+			}
+			gameContext.Arena = a
+			gameContext.ArenaGame = g
+		}
+		if len(games) > 0 {
+			broadcastArenaLeaderboard(a)
+		}
+	}
+}
+
+// 对局结束之后计分并更新排行榜, 作废的对局和没下成的对局一样, 双方都不得分
+func reportArenaGame(gameContext *GameContext, winnerSide chess.Side, reason string) {
+	var result tournament.Result
+	switch {
+	case reason == GameEndReasonAborted:
+		result = tournament.ResultDoubleForfeit
+	case winnerSide == chess.SideWhite:
+		result = tournament.ResultWhiteWin
+	case winnerSide == chess.SideBlack:
+		result = tournament.ResultBlackWin
+	default:
+		result = tournament.ResultDraw
+	}
+
+	a := gameContext.Arena
+	if err := a.Report(gameContext.ArenaGame, result, len(gameContext.Moves), time.Now()); err != nil {
+		gameContext.Log.Error("report game failed", "arena", a.ID, "err", err)
+		return
+	}
+	broadcastArenaLeaderboard(a)
+}
+
+func handleBerserk(connCtx *ConnContext) {
+	gameContext := connCtx.Gcontext.Load()
+	// 协议判断, 只有竞技场的限时对局可以狂暴
+	if connCtx.ConnState != ConnStateGaming || gameContext == nil || gameContext.Arena == nil || gameContext.Clock == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientBerserk, packets.ErrorCodeWrongState, "can only berserk in a timed arena game")
+		return
+	}
+
+	// 着法和棋钟只能在对局协程里读写
+	gameContext.post(func() {
+		doBerserk(gameContext, connCtx)
+	})
+}
+
+func doBerserk(gameContext *GameContext, connCtx *ConnContext) {
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	side := sideOf(gameContext, connCtx)
+
+	// 只能在自己走第一步之前狂暴
+	for _, move := range gameContext.Moves {
+		if move.Side == side {
+			rejectPacket(connCtx, packets.PacketTypeClientBerserk, packets.ErrorCodeWrongState, "can only berserk before your first move")
+			return
+		}
+	}
+
+	LobbyLock.Lock()
+	err := gameContext.Arena.Berserk(gameContext.ArenaGame, accountIDOf(connCtx))
+	LobbyLock.Unlock()
+	if err != nil {
+		rejectPacket(connCtx, packets.PacketTypeClientBerserk, packets.ErrorCodeWrongState, err.Error())
+		return
+	}
+
+	now := time.Now()
+	gameContext.Clock.Berserk(side)
+
+	berserkPacket := &packets.PacketServerBerserk{Side: side}
+	clockPacket := clockUpdatePacket(gameContext, now)
+	berserkShared, clockShared := newSharedPacket(berserkPacket), newSharedPacket(clockPacket)
+	for _, v := range []*ConnContext{gameContext.WhiteConnContext, gameContext.BlackConnContext} {
+		sendSharedTo(v, berserkShared)
+		sendSharedTo(v, clockShared)
+	}
+	gameContext.Spectators.Publish(berserkPacket)
+	gameContext.Spectators.Publish(clockPacket)
+}
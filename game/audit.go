@@ -0,0 +1,128 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 审计记录里包的方向
+const (
+	auditIn  = "in"
+	auditOut = "out"
+)
+
+// 审计文件里的一行, 按时间顺序把玩家的包重新发一遍就能重放整局对局
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// in为客户端发来的包, out为发给客户端的包
+	Dir    string     `json:"dir"`
+	ConnID int        `json:"conn"`
+	Side   chess.Side `json:"side"`
+	// 包的本体, 不含长度头, 不是合法json的包放在Raw里
+	Packet json.RawMessage `json:"packet,omitempty"`
+	Raw    []byte          `json:"raw,omitempty"`
+	// 连接使用二进制编码时为binary, 这时包总是放在Raw里
+	Codec string `json:"codec,omitempty"`
+}
+
+// 一局对局的审计文件, 只追加不修改, 重启之后继续的对局接着写同一个文件
+// 连接的收包和对局协程的发包会同时写, 用锁保护
+type gameAudit struct {
+	lock        sync.Mutex
+	file        *os.File
+	whiteConnID int
+	blackConnID int
+	log         *slog.Logger
+	writeFailed bool
+}
+
+// 审计文件的路径
+func AuditPath(gameID int64) string {
+	return filepath.Join(settings.AuditDirectory, strconv.FormatInt(gameID, 10)+".jsonl")
+}
+
+// 没有开启审计或者打开失败时返回nil, nil上的方法什么也不做
+func openGameAudit(gameContext *GameContext) *gameAudit {
+	if settings.AuditDirectory == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(settings.AuditDirectory, 0o755); err != nil {
+		gameContext.Log.Error("create audit directory failed", "err", err)
+		return nil
+	}
+	file, err := os.OpenFile(AuditPath(gameContext.ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		gameContext.Log.Error("open audit file failed", "err", err)
+		return nil
+	}
+	return &gameAudit{
+		file:        file,
+		whiteConnID: gameContext.WhiteConnContext.ID,
+		blackConnID: gameContext.BlackConnContext.ID,
+		log:         gameContext.Log,
+	}
+}
+
+func (a *gameAudit) record(connCtx *ConnContext, dir string, packetBytes []byte) {
+	if a == nil {
+		return
+	}
+
+	entry := AuditEntry{Time: time.Now(), Dir: dir, ConnID: connCtx.ID, Side: chess.SideBoth}
+	switch connCtx.ID {
+	case a.whiteConnID:
+		entry.Side = chess.SideWhite
+	case a.blackConnID:
+		entry.Side = chess.SideBlack
+	}
+	if codec := connCtx.Codec(); codec != packets.CodecJSON {
+		entry.Codec = codec.String()
+		entry.Raw = packetBytes
+	} else if json.Valid(packetBytes) {
+		entry.Packet = packetBytes
+	} else {
+		entry.Raw = packetBytes
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return
+	}
+	// 一整行一次写入, O_APPEND保证不会和别的写交错
+	if _, err := a.file.Write(line); err != nil && !a.writeFailed {
+		a.writeFailed = true
+		a.log.Error("write audit file failed", "err", err)
+	}
+}
+
+// 对局协程退出时关闭, 之后还在路上的包不再记录
+func (a *gameAudit) close() {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return
+	}
+	if err := a.file.Close(); err != nil {
+		a.log.Error("close audit file failed", "err", err)
+	}
+	a.file = nil
+}
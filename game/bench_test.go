@@ -0,0 +1,267 @@
+package game
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+
+	packtool "chess-backend/tools/packet"
+)
+
+// 同时进行的对局数, 每一局两个连接
+var benchGameCounts = []int{100, 1000, 2000}
+
+// 白方和黑方来回跳马, 对局永远不会结束
+var knightShuffle = [4]struct {
+	fromX rune
+	fromY int
+	toX   rune
+	toY   int
+}{
+	{'g', 1, 'f', 3},
+	{'g', 8, 'f', 6},
+	{'f', 3, 'g', 1},
+	{'f', 6, 'g', 8},
+}
+
+// 压测用的客户端, 直接用二进制编码收发包
+// SDK每个连接都要收发心跳, 几千个连接挤在一个CPU上时会误判超时, 所以压测的服务端也不开心跳
+type benchClient struct {
+	conn     net.Conn
+	received chan packets.Packet
+}
+
+func dialBenchClient(addr string) (*benchClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &benchClient{conn: conn, received: make(chan packets.Packet, 64)}
+	hello := &packets.PacketClientHello{Version: packets.ProtocolVersion, Features: []string{packets.FeatureBinaryCodec}}
+	if _, err := conn.Write(packtool.DoPackWith4BytesHeader(packets.CodecJSON.MustMarshal(hello))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	if _, err := waitPacket[*packets.PacketServerWelcome](c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 握手之后服务端改用二进制编码, 欢迎包还是json
+func (c *benchClient) readLoop() {
+	defer close(c.received)
+	reader := bufio.NewReader(c.conn)
+	codec := packets.CodecJSON
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+		p, err := codec.ClientParse(body)
+		if err != nil {
+			return
+		}
+		if _, ok := p.(*packets.PacketServerWelcome); ok {
+			codec = packets.CodecBinary
+		}
+		if _, ok := p.(*packets.PacketHeartbeat); !ok {
+			c.received <- p
+		}
+	}
+}
+
+func (c *benchClient) send(p packets.Packet) {
+	c.conn.Write(packtool.DoPackWith4BytesHeader(packets.CodecBinary.MustMarshal(p)))
+}
+
+// 等到下一个T类型的包, 中间的其他包丢掉, 在驱动对局的协程里用, 不能调用b.Fatal
+func waitPacket[T packets.Packet](c *benchClient) (T, error) {
+	var zero T
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case p, ok := <-c.received:
+			if !ok {
+				return zero, fmt.Errorf("connection closed while waiting for %T", zero)
+			}
+			if t, ok := p.(T); ok {
+				return t, nil
+			}
+		case <-timeout:
+			return zero, fmt.Errorf("timed out waiting for %T", zero)
+		}
+	}
+}
+
+// 和waitPacket一样, 不在驱动对局的协程里时用这个, 等不到直接失败
+// T为packets.Packet时就是下一个包, 不跳过任何包
+func expectBenchPacket[T packets.Packet](tb testing.TB, c *benchClient) T {
+	tb.Helper()
+	p, err := waitPacket[T](c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// 一局压测用的对局, 只在驱动它的协程里使用
+type benchGame struct {
+	white *benchClient
+	black *benchClient
+	// 这一局已经走了几步
+	moves int
+}
+
+// 一对一对地连接并匹配, 开始n局对局
+func startBenchGames(b *testing.B, addr string, n int) []*benchGame {
+	games := make([]*benchGame, 0, n)
+	for i := 0; i < n; i++ {
+		first, err := dialBenchClient(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		second, err := dialBenchClient(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		games = append(games, &benchGame{white: first, black: second})
+
+		first.send(&packets.PacketClientStartMatch{})
+		expectBenchPacket[*packets.PacketServerMatching](b, first)
+		second.send(&packets.PacketClientStartMatch{})
+		if expectBenchPacket[*packets.PacketServerMatchedOK](b, first).Side == chess.SideBlack {
+			games[i].white, games[i].black = second, first
+		}
+		expectBenchPacket[*packets.PacketServerMatchedOK](b, second)
+	}
+	b.Cleanup(func() {
+		for _, g := range games {
+			for _, c := range []*benchClient{g.white, g.black} {
+				c.conn.Close()
+				// 收包的协程可能正堵在满了的channel上
+				go func(c *benchClient) {
+					for range c.received {
+					}
+				}(c)
+			}
+		}
+	})
+	return games
+}
+
+// 走一步, 等走棋的一方收到结果, 对手收到通知
+func (g *benchGame) move() error {
+	step := knightShuffle[g.moves%len(knightShuffle)]
+	mover, other := g.white, g.black
+	if g.moves%2 == 1 {
+		mover, other = other, mover
+	}
+
+	mover.send(&packets.PacketClientMove{FromX: step.fromX, FromY: step.fromY, ToX: step.toX, ToY: step.toY})
+	resp, err := waitPacket[*packets.PacketServerMoveResp](mover)
+	if err != nil {
+		return err
+	}
+	if resp.MoveRespType != packets.PacketTypeServerMoveRespTypeOK {
+		return fmt.Errorf("move %d rejected: %+v", g.moves, resp)
+	}
+	if _, err := waitPacket[*packets.PacketServerNotifyRemoteMove](other); err != nil {
+		return err
+	}
+	g.moves++
+	return nil
+}
+
+// 认输结束这一局, 双方马上再来一局, 颜色交换
+func (g *benchGame) surrenderAndRematch() error {
+	g.white.send(&packets.PacketClientDoSurrender{})
+	for _, c := range []*benchClient{g.white, g.black} {
+		if _, err := waitPacket[*packets.PacketServerGameOver](c); err != nil {
+			return err
+		}
+	}
+
+	g.white.send(&packets.PacketClientRematch{Accept: true})
+	g.black.send(&packets.PacketClientRematch{Accept: true})
+	for _, c := range []*benchClient{g.white, g.black} {
+		if _, err := waitPacket[*packets.PacketServerMatchedOK](c); err != nil {
+			return err
+		}
+	}
+	g.white, g.black = g.black, g.white
+	g.moves = 0
+	return nil
+}
+
+// 所有对局同时进行, 一共做total次op, 平均分给每一局
+func runBenchGames(games []*benchGame, total int, op func(g *benchGame) error) error {
+	perGame := (total + len(games) - 1) / len(games)
+	errs := make(chan error, len(games))
+	var wg sync.WaitGroup
+	for _, g := range games {
+		wg.Add(1)
+		go func(g *benchGame) {
+			defer wg.Done()
+			for i := 0; i < perGame; i++ {
+				if err := op(g); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// 内存存储和bolt存储下分别跑每一种对局数, bolt存储下拿着LobbyLock读写存储的话会明显变慢
+func forEachBenchSetup(b *testing.B, run func(b *testing.B, n int)) {
+	for _, store := range []string{"memory", "bolt"} {
+		for _, n := range benchGameCounts {
+			b.Run(fmt.Sprintf("store=%s/games=%d", store, n), func(b *testing.B) {
+				if store == "bolt" {
+					useBoltStore(b)
+				}
+				run(b, n)
+			})
+		}
+	}
+}
+
+// 几千局同时走棋, 一次op是一步棋, 走棋的包不拿LobbyLock
+func BenchmarkConcurrentMoves(b *testing.B) {
+	forEachBenchSetup(b, func(b *testing.B, n int) {
+		games := startBenchGames(b, startTestServer(b, nil, false), n)
+		b.ResetTimer()
+		if err := runBenchGames(games, b.N, (*benchGame).move); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+// 几千局同时结束又马上开始, 一次op是一局对局, 结束时保存棋谱和快照不占着LobbyLock
+func BenchmarkConcurrentGameOver(b *testing.B) {
+	forEachBenchSetup(b, func(b *testing.B, n int) {
+		games := startBenchGames(b, startTestServer(b, nil, false), n)
+		b.ResetTimer()
+		if err := runBenchGames(games, b.N, (*benchGame).surrenderAndRematch); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
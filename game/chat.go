@@ -0,0 +1,92 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	chatfiltertool "chess-backend/tools/chatfilter"
+)
+
+// 聊天过滤器, 所有聊天消息发出去之前都要经过它, 在启动服务之前可以替换或者追加
+var ChatFilter chatfiltertool.Filter = chatfiltertool.Chain{
+	&chatfiltertool.RepeatFilter{MaxRepeat: settings.ChatMaxRepeat},
+}
+
+func sendChatRejected(connCtx *ConnContext, reason string) {
+	rejectedPacket := packets.PacketServerChatRejected{Reason: reason}
+	sendPacketTo(connCtx, &rejectedPacket)
+}
+
+func handleChat(connCtx *ConnContext, packet *packets.PacketClientChat) {
+	// 协议判断, 玩家只能在玩家频道说话, 观战者只能在观战频道说话
+	if packet.Channel != packets.ChatChannelPlayers && packet.Channel != packets.ChatChannelSpectators {
+		rejectPacket(connCtx, packets.PacketTypeClientChat, packets.ErrorCodeInvalidArgument, "unknown chat channel")
+		return
+	}
+	if (packet.Channel == packets.ChatChannelPlayers && connCtx.ConnState != ConnStateGaming) ||
+		(packet.Channel == packets.ChatChannelSpectators && connCtx.ConnState != ConnStateSpectating) {
+		rejectPacket(connCtx, packets.PacketTypeClientChat, packets.ErrorCodeWrongState, "players chat in the players channel, spectators in the spectators channel")
+		return
+	}
+
+	text := strings.TrimSpace(packet.Text)
+	if text == "" || !utf8.ValidString(text) {
+		sendChatRejected(connCtx, "invalid message")
+		return
+	}
+	if utf8.RuneCountInString(text) > settings.MaxChatMessageLength {
+		sendChatRejected(connCtx, "message too long")
+		return
+	}
+	if !connCtx.ChatLimiter.Allow(time.Now()) {
+		sendChatRejected(connCtx, "too many messages")
+		return
+	}
+	text, ok := ChatFilter.Filter(text)
+	if !ok {
+		sendChatRejected(connCtx, "message blocked")
+		return
+	}
+
+	chatPacket := packets.PacketServerChat{Channel: packet.Channel, Text: text}
+	if connCtx.Account != nil {
+		chatPacket.FromName = connCtx.Account.Name
+	}
+
+	if packet.Channel == packets.ChatChannelSpectators {
+		// 观战频道通过观战的协程分发, 发送方自己也会收到
+		chatPacket.GameID = connCtx.Spectating.ID
+		connCtx.Spectating.Spectators.Publish(&chatPacket)
+		return
+	}
+
+	gameContext := connCtx.Gcontext.Load()
+	remoteContext := gameContext.WhiteConnContext
+	chatPacket.FromSide = chess.SideBlack
+	if gameContext.WhiteConnContext == connCtx {
+		remoteContext = gameContext.BlackConnContext
+		chatPacket.FromSide = chess.SideWhite
+	}
+	chatPacket.GameID = gameContext.ID
+
+	chatShared := newSharedPacket(&chatPacket)
+	sendSharedTo(connCtx, chatShared)
+	if !remoteContext.MutedOpponent {
+		sendSharedTo(remoteContext, chatShared)
+	}
+}
+
+// 屏蔽只在当前这局对局有效
+func handleMuteOpponent(connCtx *ConnContext, packet *packets.PacketClientMuteOpponent) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateGaming {
+		rejectPacket(connCtx, packets.PacketTypeClientMuteOpponent, packets.ErrorCodeWrongState, "not in a game")
+		return
+	}
+
+	connCtx.MutedOpponent = packet.Mute
+}
@@ -0,0 +1,121 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+	"time"
+)
+
+// 对局的棋钟, 只有等待某一方操作的时候那一方的时间在走
+type GameClock struct {
+	WhiteRemaining time.Duration
+	BlackRemaining time.Duration
+	Increment      time.Duration
+	// 狂暴的一方没有加秒
+	WhiteBerserk bool
+	BlackBerserk bool
+	// 正在走时的一方
+	Running       chess.Side
+	TurnStartedAt time.Time
+}
+
+func newGameClock(tc chess.TimeControl, now time.Time) *GameClock {
+	initial := time.Duration(tc.InitialSeconds) * time.Second
+	return &GameClock{
+		WhiteRemaining: initial,
+		BlackRemaining: initial,
+		Increment:      time.Duration(tc.IncrementSeconds) * time.Second,
+		Running:        chess.SideWhite,
+		TurnStartedAt:  now,
+	}
+}
+
+// 某一方现在还剩多少时间, 可能为负数
+func (gc *GameClock) Remaining(side chess.Side, now time.Time) time.Duration {
+	var remaining time.Duration
+	if side == chess.SideWhite {
+		remaining = gc.WhiteRemaining
+	} else {
+		remaining = gc.BlackRemaining
+	}
+
+	if side == gc.Running {
+		remaining -= now.Sub(gc.TurnStartedAt)
+	}
+	return remaining
+}
+
+// 切换走时的一方, 之前走时的一方扣掉用时并加上加秒
+func (gc *GameClock) SwitchTo(side chess.Side, now time.Time) {
+	if side == gc.Running {
+		return
+	}
+
+	elapsed := now.Sub(gc.TurnStartedAt)
+	if gc.Running == chess.SideWhite {
+		gc.WhiteRemaining -= elapsed
+		if !gc.WhiteBerserk {
+			gc.WhiteRemaining += gc.Increment
+		}
+	} else {
+		gc.BlackRemaining -= elapsed
+		if !gc.BlackBerserk {
+			gc.BlackRemaining += gc.Increment
+		}
+	}
+
+	gc.Running = side
+	gc.TurnStartedAt = now
+}
+
+// 狂暴, 这一方的时间减半并且之后没有加秒, 只能在这一方走第一步之前调用
+func (gc *GameClock) Berserk(side chess.Side) {
+	if side == chess.SideWhite {
+		gc.WhiteRemaining /= 2
+		gc.WhiteBerserk = true
+	} else {
+		gc.BlackRemaining /= 2
+		gc.BlackBerserk = true
+	}
+}
+
+func clockUpdatePacket(gameContext *GameContext, now time.Time) *packets.PacketServerClockUpdate {
+	return &packets.PacketServerClockUpdate{
+		WhiteRemainingMs: gameContext.Clock.Remaining(chess.SideWhite, now).Milliseconds(),
+		BlackRemainingMs: gameContext.Clock.Remaining(chess.SideBlack, now).Milliseconds(),
+		Running:          gameContext.Clock.Running,
+	}
+}
+
+// 游戏状态变化之后调用, 切换棋钟并通知双方, 然后保存快照
+func onGameStateChanged(gameContext *GameContext) {
+	if gameContext.Clock != nil {
+		now := time.Now()
+		running := gameContext.Clock.Running
+		gameContext.Clock.SwitchTo(gameContext.Machine.State().Actor(), now)
+
+		if running != gameContext.Clock.Running {
+			clockPacket := clockUpdatePacket(gameContext, now)
+			clockShared := newSharedPacket(clockPacket)
+			sendSharedTo(gameContext.WhiteConnContext, clockShared)
+			sendSharedTo(gameContext.BlackConnContext, clockShared)
+			gameContext.Spectators.Publish(clockPacket)
+		}
+	}
+
+	saveSnapshot(gameContext)
+}
+
+// 对局协程里走时一方的棋钟到点时调用, 超时的一方判负
+func checkGameClock(gameContext *GameContext) {
+	running := gameContext.Clock.Running
+	if gameContext.Clock.Remaining(running, time.Now()) > 0 {
+		return
+	}
+
+	fireGameEvent(gameContext, running, machine.EventTimeout, gameOutcome{
+		WinnerSide: otherSide(running),
+		Reason:     GameEndReasonTimeout,
+	})
+}
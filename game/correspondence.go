@@ -0,0 +1,596 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"container/heap"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	chesstool "chess-backend/tools/chess"
+)
+
+// 上一次检查通信棋超时的时间(UnixNano), 心跳可能重叠执行, 用CAS保证同一个间隔里只有一次检查
+var lastCorrespondenceCheck atomic.Int64
+
+// 通信棋的处理都要读写存储, 不拿LobbyLock, 读出来改完再保存的整个过程由这把锁保护
+// 需要同时拿LobbyLock时先拿这把锁
+var correspondenceLock sync.Mutex
+
+// 一局通信棋的走棋期限
+type deadlineEntry struct {
+	gameID   int64
+	deadline time.Time
+}
+
+// 按期限排序的最小堆
+type deadlineHeap []deadlineEntry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(deadlineEntry)) }
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// 所有进行中的通信棋的期限, 启动时从存储里读一次, 之后随着走棋更新, 检查超时不需要扫描存储
+// 期限变了之后旧的记录还留在堆里, 弹出时和current对不上就跳过
+var correspondenceDeadlines = struct {
+	lock    sync.Mutex
+	heap    deadlineHeap
+	current map[int64]time.Time
+}{current: make(map[int64]time.Time)}
+
+// 设置一局通信棋的期限, 覆盖之前的期限
+func scheduleCorrespondenceDeadline(gameID int64, deadline time.Time) {
+	correspondenceDeadlines.lock.Lock()
+	defer correspondenceDeadlines.lock.Unlock()
+
+	correspondenceDeadlines.current[gameID] = deadline
+	heap.Push(&correspondenceDeadlines.heap, deadlineEntry{gameID: gameID, deadline: deadline})
+}
+
+// 对局结束之后不再检查
+func unscheduleCorrespondenceDeadline(gameID int64) {
+	correspondenceDeadlines.lock.Lock()
+	defer correspondenceDeadlines.lock.Unlock()
+
+	delete(correspondenceDeadlines.current, gameID)
+}
+
+// 弹出所有在now之前到期的对局, 弹出之后不再检查, 调用方确认没有超时的话要重新设置期限
+func expiredCorrespondenceGames(now time.Time) []int64 {
+	correspondenceDeadlines.lock.Lock()
+	defer correspondenceDeadlines.lock.Unlock()
+
+	var expired []int64
+	h := &correspondenceDeadlines.heap
+	for h.Len() > 0 && !(*h)[0].deadline.After(now) {
+		entry := heap.Pop(h).(deadlineEntry)
+		if deadline, ok := correspondenceDeadlines.current[entry.gameID]; ok && deadline.Equal(entry.deadline) {
+			delete(correspondenceDeadlines.current, entry.gameID)
+			expired = append(expired, entry.gameID)
+		}
+	}
+	return expired
+}
+
+// 启动服务之前调用, 读出所有进行中的通信棋的期限
+func LoadCorrespondenceDeadlines() error {
+	games, err := Store.ListCorrespondenceGames(0)
+	if err != nil {
+		return err
+	}
+	for _, g := range games {
+		scheduleCorrespondenceDeadline(g.ID, g.Deadline)
+	}
+	return nil
+}
+
+// 拿correspondenceLock准备修改通信棋, 正在关闭服务时返回false, 这时没有拿锁
+func lockCorrespondence() bool {
+	correspondenceLock.Lock()
+	if shuttingDown.Load() {
+		correspondenceLock.Unlock()
+		return false
+	}
+	return true
+}
+
+func otherSide(side chess.Side) chess.Side {
+	if side == chess.SideWhite {
+		return chess.SideBlack
+	}
+	return chess.SideWhite
+}
+
+func correspondenceDeadline(g *storage.CorrespondenceGame, now time.Time) time.Time {
+	return now.Add(time.Duration(g.Options.TimeControl.DaysPerMove) * 24 * time.Hour)
+}
+
+// 轮到对手走了, 重新计算期限
+func resetCorrespondenceDeadline(g *storage.CorrespondenceGame, now time.Time) {
+	g.Deadline = correspondenceDeadline(g, now)
+	scheduleCorrespondenceDeadline(g.ID, g.Deadline)
+}
+
+func accountIDOfSide(g *storage.CorrespondenceGame, side chess.Side) int64 {
+	if side == chess.SideWhite {
+		return g.WhiteAccountID
+	}
+	return g.BlackAccountID
+}
+
+func accountNameOf(accountID int64) string {
+	account, err := Store.GetAccount(accountID)
+	if err != nil {
+		slog.Error("load account failed", "account", accountID, "err", err)
+		return ""
+	}
+	return account.Name
+}
+
+// 通信棋保存在账号下面, 需要登录
+func correspondenceNeedsLogin(connCtx *ConnContext, options chess.GameOptions) bool {
+	return options.TimeControl.Correspondence() && connCtx.Account == nil
+}
+
+func correspondenceInfoOf(g *storage.CorrespondenceGame, yourSide chess.Side) packets.CorrespondenceGameInfo {
+	state := machine.State(g.State)
+	return packets.CorrespondenceGameInfo{
+		GameID:         g.ID,
+		WhiteAccountID: g.WhiteAccountID,
+		WhiteName:      accountNameOf(g.WhiteAccountID),
+		BlackAccountID: g.BlackAccountID,
+		BlackName:      accountNameOf(g.BlackAccountID),
+		Options:        g.Options,
+		YourSide:       yourSide,
+		ToMove:         state.Actor(),
+		PendingUpgrade: state.WaitingUpgrade(),
+		DrawOffered:    state.DrawOffered(),
+		Moves:          len(g.Moves),
+		DeadlineMs:     g.Deadline.UnixMilli(),
+	}
+}
+
+func sendCorrespondenceUpdate(connCtx *ConnContext, g *storage.CorrespondenceGame, side chess.Side, kingThreat bool) {
+	updatePacket := packets.PacketServerCorrespondenceUpdate{
+		Game:       correspondenceInfoOf(g, side),
+		Table:      g.Table,
+		KingThreat: kingThreat,
+	}
+	sendPacketTo(connCtx, &updatePacket)
+}
+
+// 双方在线的连接, 不在线的一方为nil, 只在查找的时候拿LobbyLock
+func onlineCorrespondencePlayers(g *storage.CorrespondenceGame) (white *ConnContext, black *ConnContext) {
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+
+	return onlineConnOf(g.WhiteAccountID), onlineConnOf(g.BlackAccountID)
+}
+
+// 通知在线的双方, 不在线的一方下次连上来之后自己查询
+func notifyCorrespondencePlayers(g *storage.CorrespondenceGame, kingThreat bool) {
+	white, black := onlineCorrespondencePlayers(g)
+	if white != nil {
+		sendCorrespondenceUpdate(white, g, chess.SideWhite, kingThreat)
+	}
+	if black != nil {
+		sendCorrespondenceUpdate(black, g, chess.SideBlack, kingThreat)
+	}
+}
+
+func sendCorrespondenceFailed(connCtx *ConnContext, gameID int64, message string) {
+	failedPacket := packets.PacketServerCorrespondenceFailed{GameID: gameID, Message: message}
+	sendPacketTo(connCtx, &failedPacket)
+}
+
+func saveCorrespondence(g *storage.CorrespondenceGame) {
+	g.UpdatedAt = time.Now()
+	if err := Store.SaveCorrespondenceGame(g); err != nil {
+		slog.Error("save correspondence game failed", "game", g.ID, "err", err)
+	}
+}
+
+// 开始一局通信棋, 双方都必须已经登录, 开始之后双方回到空闲状态, 需要持有LobbyLock
+// 保存和通知双方要读写存储, 放到锁外面的协程里做, 双方收到通知之前不知道对局id, 不会先发来操作
+func startCorrespondenceGame(whiteConnContext *ConnContext, blackConnContext *ConnContext, options chess.GameOptions) error {
+	cancelPendingOffers(whiteConnContext)
+	cancelPendingOffers(blackConnContext)
+	setConnState(whiteConnContext, ConnStateNone)
+	setConnState(blackConnContext, ConnStateNone)
+
+	gameID, err := gameIDs.take()
+	if err != nil {
+		failStartGame(whiteConnContext, blackConnContext, err)
+		return err
+	}
+
+	now := time.Now()
+	g := &storage.CorrespondenceGame{
+		ID:             gameID,
+		WhiteAccountID: whiteConnContext.Account.ID,
+		BlackAccountID: blackConnContext.Account.ID,
+		Table:          chess.NewChessTable(),
+		Moves:          make([]storage.MoveRecord, 0),
+		Options:        options,
+		State:          int(machine.StateWaitingWhitePut),
+		StartedAt:      now,
+	}
+	go func() {
+		// 新对局的id不会和别的通信棋冲突, 只是和关闭服务互斥
+		if !lockCorrespondence() {
+			return
+		}
+		defer correspondenceLock.Unlock()
+
+		resetCorrespondenceDeadline(g, now)
+		saveCorrespondence(g)
+		sendCorrespondenceUpdate(whiteConnContext, g, chess.SideWhite, false)
+		sendCorrespondenceUpdate(blackConnContext, g, chess.SideBlack, false)
+	}()
+	return nil
+}
+
+// 对局结束, 保存棋谱并删除进行中的记录, 需要持有correspondenceLock
+func finishCorrespondence(g *storage.CorrespondenceGame, winnerSide chess.Side, reason string) {
+	metricGamesFinished.With(reason).Inc()
+	g.State = int(machine.StateOver)
+	unscheduleCorrespondenceDeadline(g.ID)
+	record := &storage.GameRecord{
+		ID:             g.ID,
+		WhiteAccountID: g.WhiteAccountID,
+		BlackAccountID: g.BlackAccountID,
+		Moves:          g.Moves,
+		FinalTable:     g.Table,
+		Options:        g.Options,
+		WinnerSide:     winnerSide,
+		Reason:         reason,
+		StartedAt:      g.StartedAt,
+		EndedAt:        time.Now(),
+	}
+	if err := Store.SaveGame(record); err != nil {
+		slog.Error("save game failed", "game", g.ID, "err", err)
+	}
+	if err := Store.DeleteCorrespondenceGame(g.ID); err != nil {
+		slog.Error("delete correspondence game failed", "game", g.ID, "err", err)
+	}
+
+	if g.Options.Rated() && g.WhiteAccountID != g.BlackAccountID {
+		updateRatings(g.WhiteAccountID, g.BlackAccountID, winnerSide)
+	}
+
+	overPacket := packets.PacketServerCorrespondenceOver{GameID: g.ID, Table: g.Table, WinnerSide: winnerSide, Reason: reason}
+	overShared := newSharedPacket(&overPacket)
+	white, black := onlineCorrespondencePlayers(g)
+	for _, connCtx := range []*ConnContext{white, black} {
+		if connCtx != nil {
+			sendSharedTo(connCtx, overShared)
+		}
+	}
+}
+
+// 棋盘判断出胜负之后结束对局, 没有胜者时是逼和
+func finishCorrespondenceOnBoard(g *storage.CorrespondenceGame, winnerSide chess.Side) {
+	if winnerSide == chess.SideBoth {
+		finishCorrespondence(g, winnerSide, GameEndReasonStalemate)
+	} else {
+		finishCorrespondence(g, winnerSide, GameEndReasonCheckmate)
+	}
+}
+
+// 读取自己参加的一局通信棋, 失败时已经回复了客户端
+func loadCorrespondence(connCtx *ConnContext, gameID int64) (*storage.CorrespondenceGame, chess.Side, bool) {
+	g, err := Store.GetCorrespondenceGame(gameID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			slog.Error("load correspondence game failed", "game", gameID, "err", err)
+		}
+		sendCorrespondenceFailed(connCtx, gameID, "game not found")
+		return nil, chess.SideBoth, false
+	}
+
+	switch connCtx.Account.ID {
+	case g.WhiteAccountID:
+		return g, chess.SideWhite, true
+	case g.BlackAccountID:
+		return g, chess.SideBlack, true
+	default:
+		sendCorrespondenceFailed(connCtx, gameID, "game not found")
+		return nil, chess.SideBoth, false
+	}
+}
+
+// 轮到自己走的排在前面, 然后按期限排序
+func handleListCorrespondence(connCtx *ConnContext) {
+	// 协议判断
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientListCorrespondence, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	games, err := Store.ListCorrespondenceGames(connCtx.Account.ID)
+	if err != nil {
+		connCtx.Log.Error("list correspondence games failed", "account", connCtx.Account.ID, "err", err)
+		games = nil
+	}
+
+	listPacket := packets.PacketServerCorrespondenceList{Games: make([]packets.CorrespondenceGameInfo, 0, len(games))}
+	for _, g := range games {
+		side := chess.SideBlack
+		if g.WhiteAccountID == connCtx.Account.ID {
+			side = chess.SideWhite
+		}
+		listPacket.Games = append(listPacket.Games, correspondenceInfoOf(g, side))
+	}
+	sort.SliceStable(listPacket.Games, func(i, j int) bool {
+		a, b := listPacket.Games[i], listPacket.Games[j]
+		aTurn, bTurn := a.ToMove == a.YourSide, b.ToMove == b.YourSide
+		if aTurn != bTurn {
+			return aTurn
+		}
+		return a.DeadlineMs < b.DeadlineMs
+	})
+
+	sendPacketTo(connCtx, &listPacket)
+}
+
+func handleGetCorrespondence(connCtx *ConnContext, packet *packets.PacketClientGetCorrespondence) {
+	// 协议判断
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientGetCorrespondence, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	g, side, ok := loadCorrespondence(connCtx, packet.GameID)
+	if !ok {
+		return
+	}
+	sendCorrespondenceUpdate(connCtx, g, side, false)
+}
+
+func handleCorrespondenceMove(connCtx *ConnContext, packet *packets.PacketClientCorrespondenceMove) {
+	// 协议判断, 输入格式判断
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceMove, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+	if !chesstool.CheckChessPostsionVaild(packet.FromX, packet.FromY) ||
+		!chesstool.CheckChessPostsionVaild(packet.ToX, packet.ToY) ||
+		(packet.FromX == packet.ToX && packet.FromY == packet.ToY) {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceMove, packets.ErrorCodeInvalidArgument, "invalid coordinates")
+		return
+	}
+
+	if !lockCorrespondence() {
+		return
+	}
+	defer correspondenceLock.Unlock()
+
+	g, side, ok := loadCorrespondence(connCtx, packet.GameID)
+	if !ok {
+		return
+	}
+	// 直接走棋表示拒绝对手的和棋
+	state := machine.State(g.State)
+	if state.DrawOffered() {
+		if t, err := machine.Lookup(state, side, machine.EventRefuseDraw); err == nil {
+			state = t.To
+		}
+	}
+	if _, err := machine.Lookup(state, side, machine.EventMove); err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "not your turn")
+		return
+	}
+
+	result := chesstool.DoMove(g.Table, side, packet.FromX, packet.FromY, packet.ToX, packet.ToY)
+	if !result.OK {
+		metricIllegalMoves.Inc()
+		sendCorrespondenceFailed(connCtx, g.ID, "invalid move")
+		return
+	}
+
+	event := machine.EventMove
+	switch {
+	case result.GameOver:
+		event = machine.EventMoveGameOver
+	case result.PawnUpgrade && packet.DoDraw:
+		// 等升变完了再处理和棋
+		event = machine.EventMoveNeedUpgradeOfferDraw
+	case result.PawnUpgrade:
+		event = machine.EventMoveNeedUpgrade
+	case packet.DoDraw:
+		event = machine.EventMoveOfferDraw
+	}
+	t, err := machine.Lookup(state, side, event)
+	if err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "not your turn")
+		return
+	}
+
+	now := time.Now()
+	g.Moves = append(g.Moves, storage.MoveRecord{
+		Side:  side,
+		FromX: packet.FromX,
+		FromY: packet.FromY,
+		ToX:   packet.ToX,
+		ToY:   packet.ToY,
+		At:    now,
+	})
+	g.State = int(t.To)
+
+	if t.To == machine.StateOver {
+		finishCorrespondenceOnBoard(g, result.GameWinner)
+		return
+	}
+	// 等升变的时候还是自己走, 期限不变
+	if t.To.Actor() != side {
+		resetCorrespondenceDeadline(g, now)
+	}
+	saveCorrespondence(g)
+	notifyCorrespondencePlayers(g, result.KingThreat)
+}
+
+func handleCorrespondenceUpgrade(connCtx *ConnContext, packet *packets.PacketClientCorrespondenceUpgrade) {
+	// 协议判断, 只允许以下4种棋子
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceUpgrade, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+	if !checkUpgradePieceValid(packet.ChessPieceType) {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceUpgrade, packets.ErrorCodeInvalidArgument, "invalid upgrade piece type")
+		return
+	}
+
+	if !lockCorrespondence() {
+		return
+	}
+	defer correspondenceLock.Unlock()
+
+	g, side, ok := loadCorrespondence(connCtx, packet.GameID)
+	if !ok {
+		return
+	}
+	state := machine.State(g.State)
+	if _, err := machine.Lookup(state, side, machine.EventUpgrade); err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "no pending upgrade")
+		return
+	}
+
+	result := chesstool.DoUpgrade(g.Table, side, otherSide(side), packet.ChessPieceType)
+	pieceType := packet.ChessPieceType
+	g.Moves[len(g.Moves)-1].Upgrade = &pieceType
+
+	event := machine.EventUpgrade
+	if result.GameOver {
+		event = machine.EventUpgradeGameOver
+	}
+	t, err := machine.Lookup(state, side, event)
+	if err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "no pending upgrade")
+		return
+	}
+	g.State = int(t.To)
+
+	if t.To == machine.StateOver {
+		finishCorrespondenceOnBoard(g, result.WinnerSide)
+		return
+	}
+	resetCorrespondenceDeadline(g, time.Now())
+	saveCorrespondence(g)
+	notifyCorrespondencePlayers(g, false)
+}
+
+func handleCorrespondenceAnswerDraw(connCtx *ConnContext, packet *packets.PacketClientCorrespondenceAnswerDraw) {
+	// 协议判断
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceAnswerDraw, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	if !lockCorrespondence() {
+		return
+	}
+	defer correspondenceLock.Unlock()
+
+	g, side, ok := loadCorrespondence(connCtx, packet.GameID)
+	if !ok {
+		return
+	}
+	event := machine.EventRefuseDraw
+	if packet.Accept {
+		event = machine.EventAcceptDraw
+	}
+	t, err := machine.Lookup(machine.State(g.State), side, event)
+	if err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "no draw offer")
+		return
+	}
+	g.State = int(t.To)
+
+	if t.To == machine.StateOver {
+		finishCorrespondence(g, chess.SideBoth, GameEndReasonDrawAgreed)
+		return
+	}
+	saveCorrespondence(g)
+	notifyCorrespondencePlayers(g, false)
+}
+
+// 任何时候都可以认输
+func handleCorrespondenceResign(connCtx *ConnContext, packet *packets.PacketClientCorrespondenceResign) {
+	// 协议判断
+	if connCtx.Account == nil {
+		rejectPacket(connCtx, packets.PacketTypeClientCorrespondenceResign, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	if !lockCorrespondence() {
+		return
+	}
+	defer correspondenceLock.Unlock()
+
+	g, side, ok := loadCorrespondence(connCtx, packet.GameID)
+	if !ok {
+		return
+	}
+	if _, err := machine.Lookup(machine.State(g.State), side, machine.EventSurrender); err != nil {
+		sendCorrespondenceFailed(connCtx, g.ID, "game not found")
+		return
+	}
+	finishCorrespondence(g, otherSide(side), GameEndReasonSurrender)
+}
+
+// 在心跳里调用, 每隔一段时间检查一次, 超过期限没有走棋的一方判负
+// 只从内存里的期限堆弹出到期的对局, 不拿LobbyLock
+func checkCorrespondenceDeadlines() {
+	now := time.Now()
+	last := lastCorrespondenceCheck.Load()
+	if now.Sub(time.Unix(0, last)) < settings.CorrespondenceCheckIntervalSeconds*time.Second {
+		return
+	}
+	if !lastCorrespondenceCheck.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	for _, gameID := range expiredCorrespondenceGames(now) {
+		timeoutCorrespondence(gameID, now)
+	}
+}
+
+// 到期的对局重新从存储里读出来确认, 走棋和超时同时发生时以存储里的期限为准
+func timeoutCorrespondence(gameID int64, now time.Time) {
+	if !lockCorrespondence() {
+		return
+	}
+	defer correspondenceLock.Unlock()
+
+	g, err := Store.GetCorrespondenceGame(gameID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			slog.Error("load correspondence game failed", "game", gameID, "err", err)
+		}
+		return
+	}
+	if g.Deadline.After(now) {
+		scheduleCorrespondenceDeadline(g.ID, g.Deadline)
+		return
+	}
+
+	state := machine.State(g.State)
+	if _, err := machine.Lookup(state, chess.SideBoth, machine.EventTimeout); err != nil {
+		slog.Error("correspondence game can not time out", "game", g.ID, "state", state)
+		return
+	}
+	finishCorrespondence(g, otherSide(state.Actor()), GameEndReasonTimeout)
+}
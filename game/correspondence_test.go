@@ -0,0 +1,144 @@
+package game
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/storage"
+)
+
+// 期限改了之后旧的记录不会再弹出来, 取消之后也不会
+func TestCorrespondenceDeadlineHeap(t *testing.T) {
+	// 用负数的id, 不会和其他测试里真正的对局冲突
+	base := time.Now()
+	scheduleCorrespondenceDeadline(-1, base.Add(1*time.Hour))
+	scheduleCorrespondenceDeadline(-2, base.Add(2*time.Hour))
+	scheduleCorrespondenceDeadline(-3, base.Add(3*time.Hour))
+	scheduleCorrespondenceDeadline(-1, base.Add(4*time.Hour))
+	unscheduleCorrespondenceDeadline(-3)
+
+	expect := func(now time.Time, want ...int64) {
+		t.Helper()
+		got := expiredCorrespondenceGames(now)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expired at %v: got %v, want %v", now.Sub(base), got, want)
+		}
+	}
+	expect(base.Add(90 * time.Minute))
+	expect(base.Add(3*time.Hour), -2)
+	expect(base.Add(4*time.Hour), -1)
+	expect(base.Add(5 * time.Hour))
+}
+
+// 用压测客户端登录一个新账号, 它不会因为收不到心跳断开, race模式下bcrypt慢一点也没关系
+func loginBenchClient(t *testing.T, addr string, name string) (*benchClient, int64) {
+	c, err := dialBenchClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.conn.Close()
+		for range c.received {
+		}
+	})
+	c.send(&packets.PacketClientLogin{Name: name, Password: "secret", Register: true})
+	resp := expectBenchPacket[*packets.PacketServerLoginResp](t, c)
+	if !resp.OK {
+		t.Fatalf("login %s: %s", name, resp.Message)
+	}
+	return c, resp.AccountID
+}
+
+// 通信棋的轮次和提和由状态机决定, 直接走棋表示拒绝和棋, 超过期限由内存里的期限堆判负
+func TestCorrespondenceTurnsAndTimeout(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+	white, whiteID := loginBenchClient(t, addr, "corr-white")
+	black, blackID := loginBenchClient(t, addr, "corr-black")
+
+	gameID, err := gameIDs.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := chess.GameOptions{TimeControl: chess.TimeControl{DaysPerMove: 1}}
+	g := &storage.CorrespondenceGame{
+		ID:             gameID,
+		WhiteAccountID: whiteID,
+		BlackAccountID: blackID,
+		Table:          chess.NewChessTable(),
+		Moves:          make([]storage.MoveRecord, 0),
+		Options:        options,
+		StartedAt:      time.Now(),
+	}
+	resetCorrespondenceDeadline(g, time.Now())
+	saveCorrespondence(g)
+
+	expectUpdate := func(toMove chess.Side, drawOffered bool) {
+		t.Helper()
+		for _, c := range []*benchClient{white, black} {
+			update := expectBenchPacket[*packets.PacketServerCorrespondenceUpdate](t, c)
+			if update.Game.ToMove != toMove || update.Game.DrawOffered != drawOffered || update.Game.PendingUpgrade {
+				t.Errorf("got %+v, want to move %v, draw offered %v", update.Game, toMove, drawOffered)
+			}
+		}
+	}
+	expectFailed := func(c *benchClient, message string) {
+		t.Helper()
+		failed := expectBenchPacket[*packets.PacketServerCorrespondenceFailed](t, c)
+		if failed.GameID != gameID || failed.Message != message {
+			t.Errorf("got %+v, want %q", failed, message)
+		}
+	}
+
+	// 没轮到黑方
+	black.send(&packets.PacketClientCorrespondenceMove{GameID: gameID, FromX: 'e', FromY: 7, ToX: 'e', ToY: 5})
+	expectFailed(black, "not your turn")
+
+	// 白方走完提和, 黑方拒绝之后还是轮到黑方
+	white.send(&packets.PacketClientCorrespondenceMove{GameID: gameID, FromX: 'e', FromY: 2, ToX: 'e', ToY: 4, DoDraw: true})
+	expectUpdate(chess.SideBlack, true)
+	white.send(&packets.PacketClientCorrespondenceAnswerDraw{GameID: gameID, Accept: true})
+	expectFailed(white, "no draw offer")
+	black.send(&packets.PacketClientCorrespondenceAnswerDraw{GameID: gameID})
+	expectUpdate(chess.SideBlack, false)
+
+	// 黑方走完提和, 白方直接走棋表示拒绝
+	black.send(&packets.PacketClientCorrespondenceMove{GameID: gameID, FromX: 'e', FromY: 7, ToX: 'e', ToY: 5, DoDraw: true})
+	expectUpdate(chess.SideWhite, true)
+	white.send(&packets.PacketClientCorrespondenceMove{GameID: gameID, FromX: 'g', FromY: 1, ToX: 'f', ToY: 3})
+	expectUpdate(chess.SideBlack, false)
+
+	// 把存储里的期限改到过去, 心跳里检查时黑方超时判负
+	correspondenceLock.Lock()
+	g, err = Store.GetCorrespondenceGame(gameID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Deadline = time.Now().Add(-time.Minute)
+	saveCorrespondence(g)
+	scheduleCorrespondenceDeadline(g.ID, g.Deadline)
+	correspondenceLock.Unlock()
+
+	now := time.Now()
+	for _, id := range expiredCorrespondenceGames(now) {
+		timeoutCorrespondence(id, now)
+	}
+	for _, c := range []*benchClient{white, black} {
+		over := expectBenchPacket[*packets.PacketServerCorrespondenceOver](t, c)
+		if over.GameID != gameID || over.WinnerSide != chess.SideWhite || over.Reason != GameEndReasonTimeout {
+			t.Errorf("got %+v", over)
+		}
+	}
+	if _, err := Store.GetCorrespondenceGame(gameID); err != storage.ErrNotFound {
+		t.Errorf("correspondence game still stored: %v", err)
+	}
+	record, err := Store.GetGame(gameID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.WinnerSide != chess.SideWhite || len(record.Moves) != 3 {
+		t.Errorf("got record %+v", record)
+	}
+}
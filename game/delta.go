@@ -0,0 +1,89 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+)
+
+// 对局里有人协商了增量着法, 需要在走棋之前保留局面用来算出改动
+func wantsDelta(gameContext *GameContext) bool {
+	return gameContext.WhiteConnContext.Features[packets.FeatureDeltaMoves] ||
+		gameContext.BlackConnContext.Features[packets.FeatureDeltaMoves]
+}
+
+// 比较走棋前后的棋盘, 算出除了起点和终点之外被吃掉的过路兵和易位的车
+func moveDeltaOf(before *chess.ChessTable, after *chess.ChessTable, fromX rune, fromY int, toX rune, toY int) *packets.MoveDelta {
+	delta := &packets.MoveDelta{FromX: fromX, FromY: fromY, ToX: toX, ToY: toY, PositionHash: packets.PositionHash(after)}
+
+	mover := before.GetPosition(fromX, fromY)
+	if captured := before.GetPosition(toX, toY); captured != nil {
+		delta.Captured = &captured.PieceType
+	}
+
+	fromIndex, toIndex := indexOf(fromX, fromY), indexOf(toX, toY)
+	for i := range before {
+		if i == fromIndex || i == toIndex || samePiece(before[i], after[i]) {
+			continue
+		}
+		x, y := chess.MustIndexToPosition(i%8, i/8)
+		square := &packets.Square{X: x, Y: y}
+		switch {
+		case before[i] != nil && after[i] == nil && before[i].GameSide != mover.GameSide:
+			delta.EnPassantVictim = square
+			delta.Captured = &before[i].PieceType
+		case before[i] != nil && after[i] == nil:
+			delta.CastleRookFrom = square
+		case before[i] == nil && after[i] != nil:
+			delta.CastleRookTo = square
+		}
+	}
+	return delta
+}
+
+// 升变之后的改动, 升变的兵在上一步棋的终点
+func upgradeDeltaOf(gameContext *GameContext, pieceType chess.ChessPieceType) *packets.MoveDelta {
+	last := gameContext.Moves[len(gameContext.Moves)-1]
+	return &packets.MoveDelta{
+		FromX:        last.ToX,
+		FromY:        last.ToY,
+		ToX:          last.ToX,
+		ToY:          last.ToY,
+		Promotion:    &pieceType,
+		PositionHash: packets.PositionHash(gameContext.Table),
+	}
+}
+
+// 发给connCtx的棋盘和增量, 协商了增量着法并且有增量的话不再发棋盘
+func tableOrDelta(connCtx *ConnContext, table *chess.ChessTable, delta *packets.MoveDelta) (*chess.ChessTable, *packets.MoveDelta) {
+	if delta != nil && connCtx.Features[packets.FeatureDeltaMoves] {
+		return nil, delta
+	}
+	return table, nil
+}
+
+// 走棋之前的棋盘是拷贝出来的, 只比较棋子的类型和游戏方
+func samePiece(a *chess.ChessPiece, b *chess.ChessPiece) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.PieceType == b.PieceType && a.GameSide == b.GameSide
+}
+
+func indexOf(X rune, Y int) int {
+	x, y := chess.MustPositionToIndex(X, Y)
+	return y*8 + x
+}
+
+func handleRequestPosition(gameContext *GameContext, connCtx *ConnContext) {
+	// 对局已经结束, 结束的包里已经有最后的局面了
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	sendPacketTo(connCtx, &packets.PacketServerPosition{
+		GameID:       gameContext.ID,
+		Table:        gameContext.Table,
+		PositionHash: packets.PositionHash(gameContext.Table),
+	})
+}
@@ -0,0 +1,78 @@
+package game
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"chess-backend/comm/settings"
+)
+
+// 池子里的对局id用完了, 后台还没有预留到新的
+var errNoGameID = errors.New("no game id available")
+
+// 对局id池, 一次从存储里预留一段id, 拿着LobbyLock开始对局时不用写存储
+// 剩下的不多时在后台预留下一段, 重启之后没有用完的id直接跳过
+type gameIDPool struct {
+	lock sync.Mutex
+	// 还没有用的id段, 每段是[first, end)
+	ranges    [][2]int64
+	remaining int
+	refilling bool
+}
+
+var gameIDs gameIDPool
+
+// 取一个对局id, 不读写存储, 可以拿着LobbyLock调用
+func (p *gameIDPool) take() (int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.remaining <= settings.GameIDRefillThreshold && !p.refilling {
+		p.refilling = true
+		go p.refill()
+	}
+	if p.remaining == 0 {
+		return 0, errNoGameID
+	}
+
+	r := &p.ranges[0]
+	id := r[0]
+	r[0]++
+	if r[0] == r[1] {
+		p.ranges = p.ranges[1:]
+	}
+	p.remaining--
+	return id, nil
+}
+
+// 从存储里预留一段id放进池子, 不能拿着LobbyLock调用
+func (p *gameIDPool) fill() error {
+	first, err := Store.ReserveGameIDs(settings.GameIDBlockSize)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ranges = append(p.ranges, [2]int64{first, first + settings.GameIDBlockSize})
+	p.remaining += settings.GameIDBlockSize
+	return nil
+}
+
+func (p *gameIDPool) refill() {
+	if err := p.fill(); err != nil {
+		slog.Error("reserve game ids failed", "err", err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.refilling = false
+}
+
+// 启动服务之前调用, 预留第一段对局id
+func ReserveGameIDs() error {
+	return gameIDs.fill()
+}
@@ -2,37 +2,160 @@ package game
 
 import (
 	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"chess-backend/tournament"
+	"log/slog"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	ratelimittool "chess-backend/tools/ratelimit"
 
 	"github.com/Allenxuxu/gev"
 )
 
+// ID, Conn, Log, 心跳计数和原子类型的字段可以随便读, 其余字段由LobbyLock保护
 type ConnContext struct {
 	ID                int
-	LoseHertbeatCount int
+	LoseHertbeatCount atomic.Int32
 	Conn              *gev.Connection
-	ConnState         ConnState
+	// 带上连接id的日志
+	Log       *slog.Logger
+	ConnState ConnState
+	// 握手时协商的协议版本, 还没有握手时为0
+	ProtocolVersion int
+	// 握手时协商的双方都支持的特性
+	Features map[string]bool
+	// 包的编码, 握手之前总是json, 发包时不拿锁读取
+	codec atomic.Int32
+	// 未登录时为nil
+	Account *storage.Account
+	// 登录账号的等级分, 登录时从存储读出, 更新等级分之后同步, 大厅里直接用不读存储
+	Rating int
+	// 聊天限速
+	ChatLimiter *ratelimittool.TokenBucket
+	// 协议错误的限速, 超过之后断开连接, 对局协程里也会用到, 由errorLimiterLock保护
+	errorLimiter     *ratelimittool.TokenBucket
+	errorLimiterLock sync.Mutex
+	// 因为协议错误正在断开连接
+	closing atomic.Bool
 
 	// 下面的字段只有在ConnState为Gaming时有意义
-	Gcontext *GameContext
+	// 所在的对局, 和ConnState一起在LobbyLock里修改, 对局里的包不拿锁读取
+	Gcontext atomic.Pointer[GameContext]
+	// 所在对局的审计文件, 收发包时不拿锁读取
+	audit atomic.Pointer[gameAudit]
+	// 屏蔽了对手的聊天, 每局开始时重置
+	MutedOpponent bool
+
+	// 下面的字段只有在ConnState为InRoom时有意义
+	Room *Room
+
+	// 下面的字段只有在ConnState为Spectating时有意义
+	Spectating *GameContext
+
+	// 上一局结束之后和对手的联系, 过期或者离开空闲状态之后为nil
+	Rematch *RematchLink
+
+	// 订阅了大厅的约战列表, 开始对局时自动取消订阅
+	InLobby bool
+	// 下面的字段只有在ConnState为Seeking时有意义
+	Seek *Seek
 }
 
+// 这个连接收发包使用的编码
+func (connCtx *ConnContext) Codec() packets.Codec {
+	return packets.Codec(connCtx.codec.Load())
+}
+
+// 每局对局由自己的协程驱动, Machine, Table, Clock和Moves只能在这个协程里读写,
+// 其他地方要通过post把操作投递到对局的信箱里
 type GameContext struct {
+	// 持久化的对局id, 重启之后也不会重复
+	ID               int64
 	BlackConnContext *ConnContext
 	WhiteConnContext *ConnContext
-	Gstate           GameState
+	Machine          *machine.Game
 	Table            *chess.ChessTable
-	DrawAfterUpgrade bool
+	Options          chess.GameOptions
+	// 不限时的对局为nil
+	Clock *GameClock
+	// 到目前为止的所有着法
+	Moves []storage.MoveRecord
+	// 着法数, 给对局协程之外的地方读
+	MoveCount atomic.Int32
+	StartedAt time.Time
+	// 带上对局id的日志
+	Log *slog.Logger
+	// 审计文件, 没有开启审计时为nil
+	audit *gameAudit
+	// 观战者
+	Spectators *SpectatorHub
+	// 对局协程的信箱
+	mailbox *gameMailbox
+	// 关闭服务时保存了快照, 对局协程不再处理任何操作
+	suspended bool
+	// 下面的字段由LobbyLock保护
+	// 锦标赛的对局, 普通对局为nil
+	Tournament        *tournament.Tournament
+	TournamentPairing *tournament.Pairing
+	// 竞技场的对局, 其他对局为nil
+	Arena     *tournament.Arena
+	ArenaGame *tournament.ArenaGame
 }
 
-// 包含所有连接的上下文, 用锁保护
-var ConnMap map[int]*ConnContext
-var ConnMapLock sync.Mutex
+// 包含所有连接的上下文
+var Conns *ConnRegistry
+
+// 保护连接的状态和下面几个全局表, 对局协程在对局结束的时候也要拿这把锁
+// 拿着这把锁的时候不能等待对局协程, 只能往信箱里投递
+var LobbyLock sync.Mutex
+
+// 已经登录的连接, key为账号id, 一个账号同时只能在一个连接上登录
+var Accounts map[int64]*ConnContext
+
+// 正在进行的对局, key为对局id
+var Games map[int64]*GameContext
+
+// 等待加入的私人房间, key为邀请码
+var Rooms map[string]*Room
+
+// 还没有应答的挑战, key为挑战id
+var Challenges map[int64]*Challenge
+
+// 大厅里的约战, key为约战id
+var Seeks map[int64]*Seek
+
+// 所有锦标赛, 包括已经结束的, key为锦标赛id
+var Tournaments map[int64]*tournament.Tournament
+
+// 所有竞技场, 和锦标赛共用id
+var Arenas map[int64]*tournament.Arena
 
 func init() {
-	ConnMap = make(map[int]*ConnContext)
+	Conns = NewConnRegistry()
+	Accounts = make(map[int64]*ConnContext)
+	Games = make(map[int64]*GameContext)
+	Rooms = make(map[string]*Room)
+	Challenges = make(map[int64]*Challenge)
+	Seeks = make(map[int64]*Seek)
+	Tournaments = make(map[int64]*tournament.Tournament)
+	Arenas = make(map[int64]*tournament.Arena)
 }
 
 // 用来做自增连接id的计数器
 var AtomicIDIncrease atomic.Int32
+
+// 挑战id的计数器
+var AtomicChallengeIDIncrease atomic.Int64
+
+// 约战id的计数器
+var AtomicSeekIDIncrease atomic.Int64
+
+// 锦标赛id的计数器
+var AtomicTournamentIDIncrease atomic.Int64
+
+// 持久化存储, 在启动服务之前设置
+var Store storage.Storage
@@ -4,10 +4,14 @@ import (
 	"chess-backend/comm/chess"
 	"chess-backend/comm/packets"
 	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
 
-	chesstool "chess-backend/tools/chess"
-	othertool "chess-backend/tools/other"
-	packtool "chess-backend/tools/packet"
+	protocoltool "chess-backend/tools/protocol"
+	ratelimittool "chess-backend/tools/ratelimit"
 
 	"github.com/Allenxuxu/gev"
 )
@@ -19,464 +23,407 @@ const (
 	ConnStateNone ConnState = iota
 	ConnStateMatching
 	ConnStateGaming
+	// 创建了私人房间, 等待对手通过邀请码加入
+	ConnStateInRoom
+	// 正在观战
+	ConnStateSpectating
+	// 在大厅里发起了约战, 等待别人接受
+	ConnStateSeeking
 )
 
-type GameState int
+var connStateNames = map[ConnState]string{
+	ConnStateNone:       "None",
+	ConnStateMatching:   "Matching",
+	ConnStateGaming:     "Gaming",
+	ConnStateInRoom:     "InRoom",
+	ConnStateSpectating: "Spectating",
+	ConnStateSeeking:    "Seeking",
+}
 
-const (
-	GameStateWaitingWhitePut GameState = iota
-	GameStateWaitingBlackPut
-	// 等待黑方的兵升迁
-	GameStateWaitingBlackUpgrade
-	// 等待白方的兵升迁
-	GameStateWaitingWhiteUpgrade
-	// 等待响应, 是否接受和棋
-	GameStateWaitingBlackAcceptDraw
-	GameStateWaitingWhiteAcceptDraw
-)
+func (s ConnState) String() string {
+	if name, ok := connStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
 
 type ConnHandler struct{}
 
+// 切换连接的状态, 需要持有LobbyLock
+func setConnState(connCtx *ConnContext, state ConnState) {
+	if connCtx.ConnState != state {
+		connCtx.Log.Info("conn state changed", "from", connCtx.ConnState, "to", state)
+	}
+	connCtx.ConnState = state
+}
+
+// 客户端发来的包违反了协议, 回复错误码, 短时间内错误太多时断开连接
+func rejectPacket(connCtx *ConnContext, packetType packets.PacketType, code packets.ErrorCode, message string) {
+	sendProtocolError(connCtx, &packets.PacketServerError{Code: code, Message: message, PacketType: &packetType}, false)
+}
+
+// fatal为true时不管错误多少都断开连接, 可以在任意协程里调用
+func sendProtocolError(connCtx *ConnContext, errorPacket *packets.PacketServerError, fatal bool) {
+	metricProtocolErrors.With(string(errorPacket.Code)).Inc()
+	logArgs := []any{"code", errorPacket.Code, "message", errorPacket.Message}
+	if errorPacket.PacketType != nil {
+		logArgs = append(logArgs, "packet_type", *errorPacket.PacketType)
+	}
+	connCtx.Log.Warn("protocol error", logArgs...)
+
+	// 已经在断开了, 错误包也已经发过了
+	if connCtx.closing.Load() {
+		return
+	}
+
+	if !fatal && allowProtocolError(connCtx) {
+		sendPacketTo(connCtx, errorPacket)
+		return
+	}
+
+	if !connCtx.closing.CompareAndSwap(false, true) {
+		return
+	}
+	errorPacket.Fatal = true
+	metricProtocolErrorDisconnects.Inc()
+	connCtx.Log.Warn("too many protocol errors, closing connection")
+	sendAndClose(connCtx, errorPacket)
+}
+
+// 连接的错误限速, 对局协程和连接的协程都会调用
+func allowProtocolError(connCtx *ConnContext) bool {
+	connCtx.errorLimiterLock.Lock()
+	defer connCtx.errorLimiterLock.Unlock()
+
+	return connCtx.errorLimiter.Allow(time.Now())
+}
+
+// 发送最后一个包之后断开连接
+// 包写出去之后再等一会儿才断开, 这段时间里继续读客户端发来的数据但是不处理, 避免断开时客户端还没有收到
+func sendAndClose(connCtx *ConnContext, p packets.Packet) {
+	connCtx.closing.Store(true)
+	conn := connCtx.Conn
+	sendPacketTo(connCtx, p, gev.SendInLoop(func(interface{}) {
+		time.AfterFunc(time.Millisecond*settings.CloseAfterErrorMilliseconds, func() {
+			conn.Close()
+		})
+	}))
+}
+
 func (ch *ConnHandler) OnConnect(c *gev.Connection) {
+	defer metricHandlerDuration.With("OnConnect").ObserveSince(time.Now())
+
 	connID := int(AtomicIDIncrease.Add(1))
-	connCtx := &ConnContext{ID: int(connID), LoseHertbeatCount: 0, Conn: c, ConnState: ConnStateNone, Gcontext: nil}
+	connCtx := &ConnContext{ID: int(connID), Conn: c, ConnState: ConnStateNone,
+		Log:          slog.With("conn", connID),
+		ChatLimiter:  ratelimittool.NewTokenBucket(settings.ChatBurst, settings.ChatPerSecond),
+		errorLimiter: ratelimittool.NewTokenBucket(settings.ProtocolErrorBurst, settings.ProtocolErrorPerSecond)}
 
-	ConnMapLock.Lock()
-	ConnMap[connID] = connCtx
-	ConnMapLock.Unlock()
+	Conns.Add(connCtx)
+	connCtx.Log.Info("connected", "remote_addr", c.PeerAddr())
 
 	c.SetContext(connID)
 }
 
 func (ch *ConnHandler) OnClose(c *gev.Connection) {
+	defer metricHandlerDuration.With("OnClose").ObserveSince(time.Now())
+
 	connID := c.Context().(int)
-	ConnMapLock.Lock()
-	if ConnMap[connID].ConnState == ConnStateGaming {
-		// 需要告知游戏对端, 对手连接丢失
-		var remoteConnContext *ConnContext
-		if ConnMap[connID].Gcontext.BlackConnContext.ID == connID {
-			remoteConnContext = ConnMap[connID].Gcontext.WhiteConnContext
-		} else {
-			remoteConnContext = ConnMap[connID].Gcontext.BlackConnContext
-		}
-		packet := packets.PacketServerRemoteLoseConnection{}
-		packetBytesWithHeader := packtool.DoPackWith4BytesHeader(packet.MustMarshalToBytes())
-		remoteConnContext.Conn.Send(packetBytesWithHeader)
-		remoteConnContext.ConnState = ConnStateNone
+	connCtx := Conns.Get(connID)
+
+	LobbyLock.Lock()
+	connCtx.Log.Info("closed", "state", connCtx.ConnState)
+	if connCtx.ConnState == ConnStateGaming {
+		// 断线的一方判负, 告知游戏对端对手连接丢失
+		gameContext := connCtx.Gcontext.Load()
+		selfSide := sideOf(gameContext, connCtx)
+		gameContext.post(func() {
+			fireGameEvent(gameContext, selfSide, machine.EventDisconnect, gameOutcome{
+				WinnerSide: otherSide(selfSide),
+				Reason:     GameEndReasonDisconnect,
+			})
+		})
 	}
-	delete(ConnMap, connID)
-	ConnMapLock.Unlock()
+	if connCtx.ConnState == ConnStateInRoom {
+		closeRoomOf(connCtx)
+	}
+	if connCtx.ConnState == ConnStateSpectating {
+		stopSpectating(connCtx)
+	}
+	if connCtx.ConnState == ConnStateSeeking {
+		removeSeekOf(connCtx)
+	}
+	cancelPendingOffers(connCtx)
+	if connCtx.Account != nil {
+		delete(Accounts, connCtx.Account.ID)
+	}
+	Conns.Remove(connID)
+	LobbyLock.Unlock()
 }
 
 func (ch *ConnHandler) OnMessage(c *gev.Connection, ctx interface{}, data []byte) interface{} {
 	// 没有收到消息, 继续等待消息传完
-	if data == nil {
+	if data == nil && ctx == nil {
 		return nil
 	}
 
-	connID := c.Context().(int)
-
-	packIface := packets.ServerParse(data)
-
-	ConnMapLock.Lock()
-	defer ConnMapLock.Unlock()
-	switch packet := packIface.(type) {
-	case *packets.PacketHeartbeat:
-		// 清0丢失心跳计数
-		ConnMap[connID].LoseHertbeatCount = 0
-	case *packets.PacketClientStartMatch:
-		// 协议错误
-		if ConnMap[connID].ConnState != ConnStateNone {
-			c.Close()
-		}
+	defer metricHandlerDuration.With("OnMessage").ObserveSince(time.Now())
 
-		// 找一个正在match的连接
-		for _, v := range ConnMap {
-			if v.ID != connID && v.ConnState == ConnStateMatching {
-				// 随机摇game side
-				var whiteConnContext *ConnContext
-				var blackConnContext *ConnContext
-				if othertool.RandGetBool() {
-					whiteConnContext = ConnMap[connID]
-					blackConnContext = ConnMap[v.ID]
-				} else {
-					blackConnContext = ConnMap[connID]
-					whiteConnContext = ConnMap[v.ID]
-				}
-
-				// 创建一个默认棋盘
-				table := chess.NewChessTable()
-
-				// 建立游戏上下文
-				gameContext := GameContext{
-					WhiteConnContext: whiteConnContext,
-					BlackConnContext: blackConnContext,
-					Gstate:           GameStateWaitingWhitePut,
-					Table:            table,
-				}
-
-				// matching已经发送给v.ID的conn了, 重复发送可能造成协议错误
-				matchingPacket := packets.PacketServerMatching{}
-				matchingPacketWithHeader := packtool.DoPackWith4BytesHeader(matchingPacket.MustMarshalToBytes())
-				c.Send(matchingPacketWithHeader)
-
-				packetForBlack := packets.PacketServerMatchedOK{Side: chess.SideBlack, Table: table}
-				packetForBlackBytesWithHeader := packtool.DoPackWith4BytesHeader(packetForBlack.MustMarshalToBytes())
-				blackConnContext.ConnState = ConnStateGaming
-				blackConnContext.Gcontext = &gameContext
-				blackConnContext.Conn.Send(packetForBlackBytesWithHeader)
-
-				packetForWhite := packets.PacketServerMatchedOK{Side: chess.SideWhite, Table: table}
-				packetForWhiteBytesWithHeader := packtool.DoPackWith4BytesHeader(packetForWhite.MustMarshalToBytes())
-				whiteConnContext.ConnState = ConnStateGaming
-				whiteConnContext.Gcontext = &gameContext
-				whiteConnContext.Conn.Send(packetForWhiteBytesWithHeader)
-				return nil
-			}
-		}
+	connID := c.Context().(int)
+	connCtx := Conns.Get(connID)
 
-		// 找不到一个匹配的, 那么标记为正在匹配
-		ConnMap[connID].ConnState = ConnStateMatching
-		retPacket := packets.PacketServerMatching{}
-		retPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(retPacket.MustMarshalToBytes())
-		ConnMap[connID].Conn.Send(retPacketBytesWithHeader)
+	// 因为协议错误正在断开, 之后收到的包都不处理
+	if connCtx.closing.Load() {
 		return nil
-	case *packets.PacketClientMove:
-		// 协议判断
-		if ConnMap[connID].ConnState != ConnStateGaming {
-			ConnMap[connID].Conn.Close()
-			return nil
-		}
-
-		// 建立一些信息, 方便写代码
-		var gameContext = ConnMap[connID].Gcontext
-		var selfContext *ConnContext = ConnMap[connID]
-		var selfSide chess.Side
-		var remoteContext *ConnContext
-		var remoteSide chess.Side
-		othertool.Ignore(remoteContext)
-		othertool.Ignore(remoteSide)
-		if gameContext.BlackConnContext == selfContext {
-			remoteContext = gameContext.WhiteConnContext
-			selfSide = chess.SideBlack
-			remoteSide = chess.SideWhite
-		} else {
-			remoteContext = gameContext.BlackConnContext
-			selfSide = chess.SideWhite
-			remoteSide = chess.SideBlack
-		}
-
-		// 协议判断, 要求发送方确实是下棋的一方
-		if (selfSide == chess.SideBlack && gameContext.Gstate != GameStateWaitingBlackPut) ||
-			(selfSide == chess.SideWhite && gameContext.Gstate != GameStateWaitingWhitePut) {
-			ConnMap[connID].Conn.Close()
-			return nil
-		}
+	}
 
-		// 协议判断, 输入格式判断, 要求输入格式确实正确
-		// 注意x,y两两相等的情况也是不合法的, 这点应该在客户端得到保障
-		if !chesstool.CheckChessPostsionVaild(packet.FromX, packet.FromY) ||
-			!chesstool.CheckChessPostsionVaild(packet.ToX, packet.ToY) ||
-			(packet.FromX == packet.ToX && packet.FromY == packet.ToY) {
-			ConnMap[connID].Conn.Close()
-			return nil
+	// 长度头不合法, 之后的数据没法再分包了, 只能断开
+	if frameErr, ok := ctx.(*protocoltool.FrameError); ok {
+		errorPacket := &packets.PacketServerError{
+			Code:    packets.ErrorCodeFrameTooLarge,
+			Message: fmt.Sprintf("frame of %d bytes exceeds the limit of %d bytes", frameErr.Length, settings.MaxFrameSize),
 		}
-
-		result := chesstool.DoMove(gameContext.Table, selfSide, packet.FromX, packet.FromY, packet.ToX, packet.ToY)
-		// result.OK 移动是否有效
-		if !result.OK {
-			moveFailedPacket := packets.PacketServerMoveResp{
-				MoveRespType: packets.PacketTypeServerMoveRespTypeFailed,
-				TableOnOK:    nil,
-			}
-			moveFailedPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(moveFailedPacket.MustMarshalToBytes())
-			selfContext.Conn.Send(moveFailedPacketBytesWithHeader)
-			return nil
+		if frameErr.Empty {
+			errorPacket.Code = packets.ErrorCodeEmptyFrame
+			errorPacket.Message = "frame length is 0"
 		}
+		sendProtocolError(connCtx, errorPacket, true)
+		return nil
+	}
 
-		if !result.GameOver {
-			// 处理兵的升变问题
-			if result.PawnUpgrade {
-				// 标记升变后请求和棋
-				if packet.DoDraw {
-					gameContext.DrawAfterUpgrade = true
-				}
-
-				moveOKPacket := packets.PacketServerMoveResp{
-					MoveRespType: packets.PacketTypeServerMoveRespTypePawnUpgrade,
-					TableOnOK:    gameContext.Table,
-					KingThreat:   result.KingThreat,
-				}
-				moveOKPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(moveOKPacket.MustMarshalToBytes())
-				selfContext.Conn.Send(moveOKPacketBytesWithHeader)
-
-				remoteMovePacket := packets.PacketServerNotifyRemoteMove{
-					Table:             gameContext.Table,
-					RemotePawnUpgrade: true,
-					KingThreat:        moveOKPacket.KingThreat,
-					// 等升变完了再处理议和问题
-					RemoteRequestDraw: false,
-				}
-				remoteMovePacketBytesWithHeader := packtool.DoPackWith4BytesHeader(remoteMovePacket.MustMarshalToBytes())
-				remoteContext.Conn.Send(remoteMovePacketBytesWithHeader)
-
-				if selfSide == chess.SideWhite {
-					gameContext.Gstate = GameStateWaitingWhiteUpgrade
-				} else {
-					gameContext.Gstate = GameStateWaitingBlackUpgrade
-				}
-				return nil
-			} else {
-				moveOKPacket := packets.PacketServerMoveResp{
-					MoveRespType: packets.PacketTypeServerMoveRespTypeOK,
-					TableOnOK:    gameContext.Table,
-					KingThreat:   result.KingThreat,
-				}
-				moveOKPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(moveOKPacket.MustMarshalToBytes())
-				selfContext.Conn.Send(moveOKPacketBytesWithHeader)
-
-				remoteMovePacket := packets.PacketServerNotifyRemoteMove{
-					Table:             gameContext.Table,
-					RemotePawnUpgrade: false,
-					KingThreat:        result.KingThreat,
-					RemoteRequestDraw: packet.DoDraw,
-				}
-				remoteMovePacketBytesWithHeader := packtool.DoPackWith4BytesHeader(remoteMovePacket.MustMarshalToBytes())
-				remoteContext.Conn.Send(remoteMovePacketBytesWithHeader)
-
-				if packet.DoDraw {
-					if selfSide == chess.SideWhite {
-						gameContext.Gstate = GameStateWaitingBlackAcceptDraw
-					} else {
-						gameContext.Gstate = GameStateWaitingWhiteAcceptDraw
-					}
-				} else {
-					if selfSide == chess.SideWhite {
-						gameContext.Gstate = GameStateWaitingBlackPut
-					} else {
-						gameContext.Gstate = GameStateWaitingWhitePut
-					}
-				}
-				return nil
-			}
-		}
+	packIface, parseErr := connCtx.Codec().ServerParse(data)
 
-		// game over, 发送消息, 清空资源
-		gameOverPacket := packets.PacketServerGameOver{
-			Table:       gameContext.Table,
-			WinnerSide:  result.GameWinner,
-			IsSurrender: false,
-			IsDraw:      false,
-		}
-		gameOverPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(gameOverPacket.MustMarshalToBytes())
-		selfContext.Conn.Send(gameOverPacketBytesWithHeader)
-		remoteContext.Conn.Send(gameOverPacketBytesWithHeader)
+	// 心跳不需要拿锁
+	if _, ok := packIface.(*packets.PacketHeartbeat); ok {
+		// 清0丢失心跳计数
+		connCtx.LoseHertbeatCount.Store(0)
+		return nil
+	}
 
-		selfContext.Gcontext = nil
-		selfContext.ConnState = ConnStateNone
-		remoteContext.Gcontext = nil
-		remoteContext.ConnState = ConnStateNone
+	// 对局里收到的包都记到审计文件里
+	connCtx.audit.Load().record(connCtx, auditIn, data)
 
+	// 正在关闭服务, 局面已经保存了, 不能再有变化
+	if shuttingDown.Load() {
 		return nil
-	case *packets.PacketClientSendPawnUpgrade:
-		// 协议判断
-		if ConnMap[connID].ConnState != ConnStateGaming {
-			ConnMap[connID].Conn.Close()
-			return nil
-		}
-
-		// 拿到一些信息
-		var gameContext = ConnMap[connID].Gcontext
-		var selfContext *ConnContext = ConnMap[connID]
-		var selfSide chess.Side
-		var remoteContext *ConnContext
-		var remoteSide chess.Side
-		othertool.Ignore(remoteContext)
-		othertool.Ignore(remoteSide)
-		if gameContext.BlackConnContext == selfContext {
-			remoteContext = gameContext.WhiteConnContext
-			selfSide = chess.SideBlack
-			remoteSide = chess.SideWhite
-		} else {
-			remoteContext = gameContext.BlackConnContext
-			selfSide = chess.SideWhite
-			remoteSide = chess.SideBlack
-		}
+	}
 
-		// 协议判断
-		if selfSide == chess.SideWhite && gameContext.Gstate != GameStateWaitingWhiteUpgrade {
-			selfContext.Conn.Close()
-			return nil
-		}
-		if selfSide == chess.SideBlack && gameContext.Gstate != GameStateWaitingBlackUpgrade {
-			selfContext.Conn.Close()
-			return nil
-		}
+	// 对局里的包不拿锁, 直接投递给对局协程处理, 关闭服务时挂起的对局协程会丢掉它们
+	if dispatchGamePacket(connCtx, packIface) {
+		return nil
+	}
 
-		// 协议判断, 检查升变的棋子是否合法, 只允许以下4种棋子
-		if packet.ChessPieceType != chess.ChessPieceTypeRook && packet.ChessPieceType != chess.ChessPieceTypeBishop &&
-			packet.ChessPieceType != chess.ChessPieceTypeKnight && packet.ChessPieceType != chess.ChessPieceTypeQueen {
-			selfContext.Conn.Close()
+	LobbyLock.Lock()
+	if !checkBeforeDispatch(connCtx, packIface) {
+		LobbyLock.Unlock()
+		return nil
+	}
+	// 要读写存储的包不能拿着锁处理, 处理函数需要时自己拿锁
+	if handle := unlockedHandlerOf(connCtx, packIface); handle != nil {
+		LobbyLock.Unlock()
+		handle()
+		return nil
+	}
+	defer LobbyLock.Unlock()
+	switch packet := packIface.(type) {
+	case *packets.PacketClientStartMatch:
+		// 协议错误
+		if connCtx.ConnState != ConnStateNone {
+			rejectPacket(connCtx, packets.PacketTypeClientStartMatch, packets.ErrorCodeWrongState, "can only start matching when idle")
 			return nil
 		}
 
-		result := chesstool.DoUpgrade(gameContext.Table, selfSide, remoteSide, packet.ChessPieceType)
-		notifyUpgradeOK := packets.PacketServerRemoteUpgradeOK{
-			Table: gameContext.Table,
-		}
-		if gameContext.DrawAfterUpgrade {
-			notifyUpgradeOK.RemoteRequestDraw = true
-			gameContext.DrawAfterUpgrade = false
-			if selfSide == chess.SideWhite {
-				gameContext.Gstate = GameStateWaitingBlackAcceptDraw
-			} else {
-				gameContext.Gstate = GameStateWaitingBlackAcceptDraw
-			}
-		} else {
-			if selfSide == chess.SideWhite {
-				gameContext.Gstate = GameStateWaitingBlackPut
-			} else {
-				gameContext.Gstate = GameStateWaitingWhitePut
-			}
-		}
-		notifyUpgradeOKBytesWithHeader := packtool.DoPackWith4BytesHeader(notifyUpgradeOK.MustMarshalToBytes())
-		remoteContext.Conn.Send(notifyUpgradeOKBytesWithHeader)
+		// 进入随机匹配之后, 还没有应答的邀请都失效
+		cancelPendingOffers(connCtx)
 
-		notifySelfUpgradeOK := packets.PacketServerUpgradeOK{
-			Table: gameContext.Table,
-		}
-		notifySelfUpgradeOKBytesWithHeader := packtool.DoPackWith4BytesHeader(notifySelfUpgradeOK.MustMarshalToBytes())
-		selfContext.Conn.Send(notifySelfUpgradeOKBytesWithHeader)
-
-		if result.GameOver {
-			gameOverPacket := packets.PacketServerGameOver{
-				Table:       gameContext.Table,
-				WinnerSide:  result.WinnerSide,
-				IsSurrender: false,
-				IsDraw:      false,
+		// 找一个正在match的连接
+		var opponent *ConnContext
+		Conns.Range(func(v *ConnContext) bool {
+			if v.ID != connID && v.ConnState == ConnStateMatching {
+				opponent = v
+				return false
 			}
-			gameOverPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(gameOverPacket.MustMarshalToBytes())
-			selfContext.ConnState = ConnStateNone
-			selfContext.Gcontext = nil
-			remoteContext.ConnState = ConnStateNone
-			remoteContext.Gcontext = nil
-			remoteContext.Conn.Send(gameOverPacketBytesWithHeader)
-			selfContext.Conn.Send(gameOverPacketBytesWithHeader)
+			return true
+		})
+		if opponent != nil {
+			// matching已经发送给opponent的conn了, 重复发送可能造成协议错误
+			matchingPacket := packets.PacketServerMatching{}
+			sendPacketTo(connCtx, &matchingPacket)
+
+			// 随机摇game side
+			whiteConnContext, blackConnContext := assignSides(connCtx, opponent, chess.SideBoth)
+			startGame(whiteConnContext, blackConnContext, DefaultGameOptions)
+			return nil
 		}
 
+		// 找不到一个匹配的, 那么标记为正在匹配
+		setConnState(connCtx, ConnStateMatching)
+		retPacket := packets.PacketServerMatching{}
+		sendPacketTo(connCtx, &retPacket)
 		return nil
-	case *packets.PacketClientDoSurrender:
-		// 协议判断
-		if ConnMap[connID].ConnState != ConnStateGaming {
-			ConnMap[connID].Conn.Close()
-			return nil
+	case *packets.PacketClientCreateRoom:
+		handleCreateRoom(connCtx, packet)
+		return nil
+	case *packets.PacketClientJoinRoom:
+		handleJoinRoom(connCtx, packet)
+		return nil
+	case *packets.PacketClientCancelRoom:
+		handleCancelRoom(connCtx)
+		return nil
+	case *packets.PacketClientChallenge:
+		handleChallenge(connCtx, packet)
+		return nil
+	case *packets.PacketClientAnswerChallenge:
+		handleAnswerChallenge(connCtx, packet)
+		return nil
+	case *packets.PacketClientListGames:
+		handleListGames(connCtx)
+		return nil
+	case *packets.PacketClientSpectate:
+		handleSpectate(connCtx, packet)
+		return nil
+	case *packets.PacketClientStopSpectate:
+		handleStopSpectate(connCtx)
+		return nil
+	case *packets.PacketClientChat:
+		handleChat(connCtx, packet)
+		return nil
+	case *packets.PacketClientMuteOpponent:
+		handleMuteOpponent(connCtx, packet)
+		return nil
+	case *packets.PacketClientRematch:
+		handleRematch(connCtx, packet)
+		return nil
+	case *packets.PacketClientCreateTournament:
+		handleCreateTournament(connCtx, packet)
+		return nil
+	case *packets.PacketClientJoinTournament:
+		handleJoinTournament(connCtx, packet)
+		return nil
+	case *packets.PacketClientWithdrawTournament:
+		handleWithdrawTournament(connCtx, packet)
+		return nil
+	case *packets.PacketClientStartTournament:
+		handleStartTournament(connCtx, packet)
+		return nil
+	case *packets.PacketClientListTournaments:
+		handleListTournaments(connCtx)
+		return nil
+	case *packets.PacketClientBerserk:
+		handleBerserk(connCtx)
+		return nil
+	case *packets.PacketClientSubscribeLobby:
+		handleSubscribeLobby(connCtx)
+		return nil
+	case *packets.PacketClientUnsubscribeLobby:
+		handleUnsubscribeLobby(connCtx)
+		return nil
+	case *packets.PacketClientPostSeek:
+		handlePostSeek(connCtx, packet)
+		return nil
+	case *packets.PacketClientCancelSeek:
+		handleCancelSeek(connCtx)
+		return nil
+	case *packets.PacketClientAcceptSeek:
+		handleAcceptSeek(connCtx, packet)
+		return nil
+	case nil:
+		// 协议错误, 认得出类型的话带上类型
+		packetType, ok := packets.PeekType(data)
+		switch {
+		case !ok:
+			sendProtocolError(connCtx, &packets.PacketServerError{
+				Code:    packets.ErrorCodeMalformedPacket,
+				Message: "packet cannot be decoded or has no type",
+			}, false)
+		case errors.Is(parseErr, packets.ErrUnknownPacketType):
+			rejectPacket(connCtx, packetType, packets.ErrorCodeUnknownPacketType, "unknown packet type")
+		case errors.Is(parseErr, packets.ErrWrongDirection):
+			rejectPacket(connCtx, packetType, packets.ErrorCodeUnknownPacketType, "packet type is only sent by the server")
+		default:
+			rejectPacket(connCtx, packetType, packets.ErrorCodeMalformedPacket, parseErr.Error())
 		}
+	}
+	return nil
+}
 
-		var gameContext = ConnMap[connID].Gcontext
-		var selfContext *ConnContext = ConnMap[connID]
-		var selfSide chess.Side
-		othertool.Ignore(selfSide)
-		var remoteContext *ConnContext
-		var remoteSide chess.Side
-		othertool.Ignore(remoteContext)
-		othertool.Ignore(remoteSide)
-		if gameContext.BlackConnContext == selfContext {
-			remoteContext = gameContext.WhiteConnContext
-			selfSide = chess.SideBlack
-			remoteSide = chess.SideWhite
-		} else {
-			remoteContext = gameContext.BlackConnContext
-			selfSide = chess.SideWhite
-			remoteSide = chess.SideBlack
-		}
+// 登录要用bcrypt校验密码, 通信棋每次都要读写存储, 这些包在LobbyLock外面处理, 其他包返回nil
+// 连接的Account只在自己的协程里登录时修改, 处理函数可以不拿锁读
+func unlockedHandlerOf(connCtx *ConnContext, packIface packets.Packet) func() {
+	switch packet := packIface.(type) {
+	case *packets.PacketClientLogin:
+		return func() { handleLogin(connCtx, packet) }
+	case *packets.PacketClientListCorrespondence:
+		return func() { handleListCorrespondence(connCtx) }
+	case *packets.PacketClientGetCorrespondence:
+		return func() { handleGetCorrespondence(connCtx, packet) }
+	case *packets.PacketClientCorrespondenceMove:
+		return func() { handleCorrespondenceMove(connCtx, packet) }
+	case *packets.PacketClientCorrespondenceUpgrade:
+		return func() { handleCorrespondenceUpgrade(connCtx, packet) }
+	case *packets.PacketClientCorrespondenceAnswerDraw:
+		return func() { handleCorrespondenceAnswerDraw(connCtx, packet) }
+	case *packets.PacketClientCorrespondenceResign:
+		return func() { handleCorrespondenceResign(connCtx, packet) }
+	default:
+		return nil
+	}
+}
 
-		gameOverPacket := packets.PacketServerGameOver{
-			Table:       gameContext.Table,
-			WinnerSide:  remoteSide,
-			IsSurrender: true,
-		}
-		gameOverPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(gameOverPacket.MustMarshalToBytes())
-		selfContext.Conn.Send(gameOverPacketBytesWithHeader)
-		remoteContext.Conn.Send(gameOverPacketBytesWithHeader)
-		selfContext.Gcontext = nil
-		selfContext.ConnState = ConnStateNone
-		remoteContext.Gcontext = nil
-		remoteContext.ConnState = ConnStateNone
-		return nil
-	case *packets.PacketClientWheatherAcceptDraw:
-		// 协议判断
-		if ConnMap[connID].ConnState != ConnStateGaming {
-			ConnMap[connID].Conn.Close()
-			return nil
+// 握手和维护期间的检查, 返回false时这个包已经处理完了, 需要持有LobbyLock
+func checkBeforeDispatch(connCtx *ConnContext, packIface packets.Packet) bool {
+	// 握手之前只能发送握手包, 否则多半是不认识这个协议的客户端, 直接断开
+	if hello, ok := packIface.(*packets.PacketClientHello); ok || connCtx.ProtocolVersion == 0 {
+		if !ok {
+			sendProtocolError(connCtx, &packets.PacketServerError{
+				Code:    packets.ErrorCodeHandshakeRequired,
+				Message: "send hello before any other packet",
+			}, true)
+			return false
 		}
+		handleHello(connCtx, hello)
+		return false
+	}
+	// 维护期间不能开始新的对局
+	if maintenance && startsNewGame(packIface) {
+		sendPacketTo(connCtx, &packets.PacketServerMaintenance{Enabled: true, Message: maintenanceMessage})
+		return false
+	}
+	return true
+}
 
-		var gameContext = ConnMap[connID].Gcontext
-		var selfContext *ConnContext = ConnMap[connID]
-		var selfSide chess.Side
-		var remoteContext *ConnContext
-		var remoteSide chess.Side
-		othertool.Ignore(remoteContext)
-		othertool.Ignore(remoteSide)
-		if gameContext.BlackConnContext == selfContext {
-			remoteContext = gameContext.WhiteConnContext
-			selfSide = chess.SideBlack
-			remoteSide = chess.SideWhite
-		} else {
-			remoteContext = gameContext.BlackConnContext
-			selfSide = chess.SideWhite
-			remoteSide = chess.SideBlack
-		}
+func OnTimeout() {
+	defer metricHandlerDuration.With("OnTimeout").ObserveSince(time.Now())
 
-		// 判断更多协议错误
-		if selfSide == chess.SideWhite && gameContext.Gstate != GameStateWaitingWhiteAcceptDraw {
-			ConnMap[connID].Conn.Close()
-			return nil
-		}
-		if selfSide == chess.SideBlack && gameContext.Gstate != GameStateWaitingBlackAcceptDraw {
-			ConnMap[connID].Conn.Close()
-			return nil
-		}
+	heartbeatShared := newSharedPacket(&packets.PacketHeartbeat{})
 
-		if packet.AcceptDraw {
-			gameOver := packets.PacketServerGameOver{
-				Table:       gameContext.Table,
-				WinnerSide:  chess.SideBoth,
-				IsSurrender: false,
-				IsDraw:      true,
-			}
-			gameOverBytesWithHeader := packtool.DoPackWith4BytesHeader(gameOver.MustMarshalToBytes())
-			selfContext.Conn.Send(gameOverBytesWithHeader)
-			remoteContext.Conn.Send(gameOverBytesWithHeader)
-			selfContext.ConnState = ConnStateNone
-			selfContext.Gcontext = nil
-			remoteContext.ConnState = ConnStateNone
-			remoteContext.Gcontext = nil
-			return nil
-		} else {
-			if selfSide == chess.SideWhite {
-				gameContext.Gstate = GameStateWaitingWhitePut
-			} else {
-				gameContext.Gstate = GameStateWaitingBlackPut
+	// 心跳只需要分片的锁, 棋钟由各个对局协程自己检查, 心跳不记到审计文件里
+	Conns.Range(func(v *ConnContext) bool {
+		v.Conn.Send(heartbeatShared.bytesFor(v.Codec()))
+		if lost := v.LoseHertbeatCount.Add(1); lost >= settings.MaxLoseHeartbeat {
+			// 断开是异步的, 只在第一次超过的时候计数
+			if lost == settings.MaxLoseHeartbeat {
+				metricHeartbeatTimeouts.Inc()
 			}
+			v.Conn.Close()
 		}
-	case nil:
-		// 协议错误, 直接关闭
-		c.Close()
+		return true
+	})
+
+	// 通信棋的期限在内存里, 重启之前的对局在登录时继续, 这里只作废过期的, 两者都要读写存储, 不拿LobbyLock
+	if !shuttingDown.Load() {
+		checkCorrespondenceDeadlines()
+		expireSuspendedGames()
 	}
-	return nil
-}
 
-func OnTimeout() {
-	var packet = packets.PacketHeartbeat{}
-	heartPacketBytesWithHeader := packtool.DoPackWith4BytesHeader(packet.MustMarshalToBytes())
-
-	ConnMapLock.Lock()
-	for k := range ConnMap {
-		ConnMap[k].Conn.Send(heartPacketBytesWithHeader)
-		ConnMap[k].LoseHertbeatCount++
-		if ConnMap[k].LoseHertbeatCount >= settings.MaxLoseHeartbeat {
-			ConnMap[k].Conn.Close()
+	// 顺便检查再来一局的有效期, 推进锦标赛
+	LobbyLock.Lock()
+	if !shuttingDown.Load() {
+		expireRematchLinks()
+		if !maintenance {
+			progressTournaments()
+			progressArenas()
 		}
 	}
-	ConnMapLock.Unlock()
+	LobbyLock.Unlock()
 }
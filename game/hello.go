@@ -0,0 +1,56 @@
+package game
+
+import (
+	"chess-backend/comm/packets"
+	"fmt"
+)
+
+// 握手, 连接之后客户端必须先发送PacketClientHello, 在这之前除了心跳之外的包都算协议错误
+// 版本不兼容时回复原因之后断开连接
+func handleHello(connCtx *ConnContext, packet *packets.PacketClientHello) {
+	// 协议判断, 只能握手一次
+	if connCtx.ProtocolVersion != 0 {
+		rejectPacket(connCtx, packets.PacketTypeClientHello, packets.ErrorCodeWrongState, "hello can only be sent once")
+		return
+	}
+
+	if packet.Version < packets.MinProtocolVersion || packet.Version > packets.ProtocolVersion {
+		connCtx.Log.Warn("incompatible protocol version", "version", packet.Version)
+		sendAndClose(connCtx, &packets.PacketServerWelcome{
+			OK:         false,
+			MinVersion: packets.MinProtocolVersion,
+			MaxVersion: packets.ProtocolVersion,
+			Features:   []string{},
+			Message: fmt.Sprintf("protocol version %d is not supported, server supports %d to %d",
+				packet.Version, packets.MinProtocolVersion, packets.ProtocolVersion),
+		})
+		return
+	}
+
+	// 只保留双方都支持的特性
+	features := make([]string, 0)
+	connCtx.Features = make(map[string]bool)
+	for _, feature := range packet.Features {
+		for _, supported := range packets.SupportedFeatures {
+			if feature == supported && !connCtx.Features[feature] {
+				connCtx.Features[feature] = true
+				features = append(features, feature)
+			}
+		}
+	}
+	connCtx.ProtocolVersion = packet.Version
+	connCtx.Log.Info("hello", "version", packet.Version, "features", features)
+
+	sendPacketTo(connCtx, &packets.PacketServerWelcome{
+		OK:         true,
+		Version:    packet.Version,
+		MinVersion: packets.MinProtocolVersion,
+		MaxVersion: packets.ProtocolVersion,
+		Features:   features,
+	})
+
+	// 握手包总是json, 之后收发的包都换成协商的编码
+	if connCtx.Features[packets.FeatureBinaryCodec] {
+		connCtx.codec.Store(int32(packets.CodecBinary))
+	}
+}
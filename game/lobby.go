@@ -0,0 +1,179 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"time"
+)
+
+// 大厅里公开的约战, 任何满足条件的人都可以接受
+type Seek struct {
+	ID    int64
+	Owner *ConnContext
+	// 发起方的等级分, 未登录时为0
+	OwnerRating int
+	// 发起方想要的颜色, SideBoth表示随机
+	Side    chess.Side
+	Options chess.GameOptions
+	// 接受方的等级分范围, 为0表示不限制
+	MinRating int
+	MaxRating int
+	CreatedAt time.Time
+}
+
+func seekInfoOf(seek *Seek) packets.SeekInfo {
+	info := packets.SeekInfo{
+		SeekID:    seek.ID,
+		Rating:    seek.OwnerRating,
+		Side:      seek.Side,
+		Options:   seek.Options,
+		MinRating: seek.MinRating,
+		MaxRating: seek.MaxRating,
+	}
+	if seek.Owner.Account != nil {
+		info.AccountID = seek.Owner.Account.ID
+		info.Name = seek.Owner.Account.Name
+	}
+	return info
+}
+
+func (seek *Seek) hasRatingRange() bool {
+	return seek.MinRating != 0 || seek.MaxRating != 0
+}
+
+func (seek *Seek) ratingInRange(rating int) bool {
+	return (seek.MinRating == 0 || rating >= seek.MinRating) && (seek.MaxRating == 0 || rating <= seek.MaxRating)
+}
+
+func sendSeekResp(connCtx *ConnContext, resp packets.PacketServerSeekResp) {
+	sendPacketTo(connCtx, &resp)
+}
+
+// 发给所有订阅了大厅的连接
+func broadcastToLobby(p packets.Packet) {
+	sp := newSharedPacket(p)
+	Conns.Range(func(v *ConnContext) bool {
+		if v.InLobby {
+			sendSharedTo(v, sp)
+		}
+		return true
+	})
+}
+
+// 订阅之后先收到完整的列表, 之后只收到增加和删除
+func handleSubscribeLobby(connCtx *ConnContext) {
+	connCtx.InLobby = true
+
+	listPacket := packets.PacketServerSeekList{Seeks: make([]packets.SeekInfo, 0, len(Seeks))}
+	for _, seek := range Seeks {
+		listPacket.Seeks = append(listPacket.Seeks, seekInfoOf(seek))
+	}
+	sendPacketTo(connCtx, &listPacket)
+}
+
+func handleUnsubscribeLobby(connCtx *ConnContext) {
+	connCtx.InLobby = false
+}
+
+func handlePostSeek(connCtx *ConnContext, packet *packets.PacketClientPostSeek) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientPostSeek, packets.ErrorCodeWrongState, "can only post a seek when idle")
+		return
+	}
+	if !checkSideChoiceValid(packet.Side) || !checkGameOptionsValid(packet.Options) ||
+		packet.MinRating < 0 || packet.MaxRating < 0 || (packet.MaxRating != 0 && packet.MinRating > packet.MaxRating) {
+		rejectPacket(connCtx, packets.PacketTypeClientPostSeek, packets.ErrorCodeInvalidArgument, "invalid side, options or rating range")
+		return
+	}
+
+	seek := &Seek{
+		ID:        AtomicSeekIDIncrease.Add(1),
+		Owner:     connCtx,
+		Side:      packet.Side,
+		Options:   packet.Options,
+		MinRating: packet.MinRating,
+		MaxRating: packet.MaxRating,
+		CreatedAt: time.Now(),
+	}
+
+	// 计分的约战和通信棋需要登录
+	if (seek.Options.Rated() || seek.Options.TimeControl.Correspondence()) && connCtx.Account == nil {
+		sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: false, Message: "login required"})
+		return
+	}
+	if connCtx.Account != nil {
+		seek.OwnerRating = connCtx.Rating
+	}
+
+	Seeks[seek.ID] = seek
+	cancelPendingOffers(connCtx)
+	setConnState(connCtx, ConnStateSeeking)
+	connCtx.Seek = seek
+	sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: true, SeekID: seek.ID})
+
+	addedPacket := packets.PacketServerSeekAdded{Seek: seekInfoOf(seek)}
+	broadcastToLobby(&addedPacket)
+}
+
+func handleCancelSeek(connCtx *ConnContext) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateSeeking {
+		rejectPacket(connCtx, packets.PacketTypeClientCancelSeek, packets.ErrorCodeWrongState, "no seek to cancel")
+		return
+	}
+
+	removeSeekOf(connCtx)
+}
+
+// 删除连接发起的约战并通知大厅, 连接回到空闲状态
+func removeSeekOf(connCtx *ConnContext) {
+	if seek := connCtx.Seek; seek != nil {
+		delete(Seeks, seek.ID)
+		connCtx.Seek = nil
+
+		removedPacket := packets.PacketServerSeekRemoved{SeekID: seek.ID}
+		broadcastToLobby(&removedPacket)
+	}
+	setConnState(connCtx, ConnStateNone)
+}
+
+func handleAcceptSeek(connCtx *ConnContext, packet *packets.PacketClientAcceptSeek) {
+	// 协议判断, 自己正在约战的话可以接受别人的约战, 自己的约战会被撤销
+	if connCtx.ConnState != ConnStateNone && connCtx.ConnState != ConnStateSeeking {
+		rejectPacket(connCtx, packets.PacketTypeClientAcceptSeek, packets.ErrorCodeWrongState, "can only accept a seek when idle or seeking")
+		return
+	}
+
+	// 约战可能刚刚被接受或者撤销, 客户端还没有收到删除通知
+	seek := Seeks[packet.SeekID]
+	if seek == nil {
+		sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: false, SeekID: packet.SeekID, Message: "seek not found"})
+		return
+	}
+	if seek.Owner == connCtx || (connCtx.Account != nil && accountIDOf(seek.Owner) == connCtx.Account.ID) {
+		sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: false, SeekID: seek.ID, Message: "cannot accept own seek"})
+		return
+	}
+
+	if seek.Options.Rated() || seek.hasRatingRange() || seek.Options.TimeControl.Correspondence() {
+		if connCtx.Account == nil {
+			sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: false, SeekID: seek.ID, Message: "login required"})
+			return
+		}
+		if !seek.ratingInRange(connCtx.Rating) {
+			sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: false, SeekID: seek.ID, Message: "rating out of range"})
+			return
+		}
+	}
+
+	owner := seek.Owner
+	removeSeekOf(owner)
+	if connCtx.ConnState == ConnStateSeeking {
+		removeSeekOf(connCtx)
+	}
+	sendSeekResp(connCtx, packets.PacketServerSeekResp{OK: true, SeekID: seek.ID})
+
+	white, black := assignSides(owner, connCtx, seek.Side)
+	startGame(white, black, seek.Options)
+}
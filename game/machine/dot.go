@@ -0,0 +1,41 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 把转移表输出成Graphviz的dot格式, 比如 dot -Tsvg -o machine.svg
+// 任何状态都可以触发的事件合并成一条边
+func WriteDot(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph game {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box];\n")
+	fmt.Fprintf(&b, "\t%s [shape=doublecircle];\n", StateOver)
+
+	for _, t := range Transitions {
+		if isAnySideEvent(t.Event) {
+			continue
+		}
+		emits := make([]string, 0, len(t.Emits))
+		for _, e := range t.Emits {
+			emits = append(emits, e.String())
+		}
+		fmt.Fprintf(&b, "\t%s -> %s [label=\"%s\\n%s\"];\n", t.From, t.To, t.Event, strings.Join(emits, ", "))
+	}
+
+	b.WriteString("\tAny [shape=plaintext, label=\"any state\"];\n")
+	for _, e := range anySideEvents {
+		emits := make([]string, 0, len(anySideEmits[e]))
+		for _, emit := range anySideEmits[e] {
+			emits = append(emits, emit.String())
+		}
+		fmt.Fprintf(&b, "\tAny -> %s [style=dashed, label=\"%s\\n%s\"];\n", StateOver, e, strings.Join(emits, ", "))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
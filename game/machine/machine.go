@@ -0,0 +1,319 @@
+package machine
+
+import (
+	"chess-backend/comm/chess"
+	"errors"
+	"fmt"
+)
+
+// 当前状态不接受这个事件, 或者不是这一方操作
+var ErrInvalidTransition = errors.New("machine: invalid transition")
+
+// 对局状态, 数值会保存在快照里面, 只能在末尾追加
+type State int
+
+const (
+	StateWaitingWhitePut State = iota
+	StateWaitingBlackPut
+	// 等待黑方的兵升变
+	StateWaitingBlackUpgrade
+	// 等待白方的兵升变
+	StateWaitingWhiteUpgrade
+	// 等待响应, 是否接受和棋
+	StateWaitingBlackAcceptDraw
+	StateWaitingWhiteAcceptDraw
+	// 等待兵升变, 升变之后向对手提出和棋
+	StateWaitingWhiteUpgradeThenDraw
+	StateWaitingBlackUpgradeThenDraw
+	// 对局已经结束
+	StateOver
+)
+
+var stateNames = map[State]string{
+	StateWaitingWhitePut:             "WaitingWhitePut",
+	StateWaitingBlackPut:             "WaitingBlackPut",
+	StateWaitingBlackUpgrade:         "WaitingBlackUpgrade",
+	StateWaitingWhiteUpgrade:         "WaitingWhiteUpgrade",
+	StateWaitingBlackAcceptDraw:      "WaitingBlackAcceptDraw",
+	StateWaitingWhiteAcceptDraw:      "WaitingWhiteAcceptDraw",
+	StateWaitingWhiteUpgradeThenDraw: "WaitingWhiteUpgradeThenDraw",
+	StateWaitingBlackUpgradeThenDraw: "WaitingBlackUpgradeThenDraw",
+	StateOver:                        "Over",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// 正在等待哪一方操作, 对局结束之后为SideBoth
+func (s State) Actor() chess.Side {
+	switch s {
+	case StateWaitingWhitePut, StateWaitingWhiteUpgrade, StateWaitingWhiteAcceptDraw, StateWaitingWhiteUpgradeThenDraw:
+		return chess.SideWhite
+	case StateWaitingBlackPut, StateWaitingBlackUpgrade, StateWaitingBlackAcceptDraw, StateWaitingBlackUpgradeThenDraw:
+		return chess.SideBlack
+	default:
+		return chess.SideBoth
+	}
+}
+
+func (s State) WaitingUpgrade() bool {
+	switch s {
+	case StateWaitingWhiteUpgrade, StateWaitingBlackUpgrade, StateWaitingWhiteUpgradeThenDraw, StateWaitingBlackUpgradeThenDraw:
+		return true
+	default:
+		return false
+	}
+}
+
+// 升变之后会提出和棋
+func (s State) DrawAfterUpgrade() bool {
+	return s == StateWaitingWhiteUpgradeThenDraw || s == StateWaitingBlackUpgradeThenDraw
+}
+
+func (s State) DrawOffered() bool {
+	return s == StateWaitingWhiteAcceptDraw || s == StateWaitingBlackAcceptDraw
+}
+
+// 对局中发生的事件, 棋子怎么走由调用方用棋盘判断, 状态机只关心结果
+type Event int
+
+const (
+	// 普通的一步
+	EventMove Event = iota
+	// 走完之后提出和棋
+	EventMoveOfferDraw
+	// 走到底线, 需要选择兵升变的棋子
+	EventMoveNeedUpgrade
+	// 走到底线, 升变之后提出和棋
+	EventMoveNeedUpgradeOfferDraw
+	// 这一步将死或者逼和
+	EventMoveGameOver
+	// 选择了升变的棋子
+	EventUpgrade
+	// 升变之后将死或者逼和
+	EventUpgradeGameOver
+	EventAcceptDraw
+	EventRefuseDraw
+	// 下面的事件任何一方在任何时候都可以触发
+	EventSurrender
+	EventTimeout
+	EventDisconnect
+	// 管理员裁定结果或者作废对局
+	EventAdjudicate
+)
+
+var eventNames = map[Event]string{
+	EventMove:                     "Move",
+	EventMoveOfferDraw:            "MoveOfferDraw",
+	EventMoveNeedUpgrade:          "MoveNeedUpgrade",
+	EventMoveNeedUpgradeOfferDraw: "MoveNeedUpgradeOfferDraw",
+	EventMoveGameOver:             "MoveGameOver",
+	EventUpgrade:                  "Upgrade",
+	EventUpgradeGameOver:          "UpgradeGameOver",
+	EventAcceptDraw:               "AcceptDraw",
+	EventRefuseDraw:               "RefuseDraw",
+	EventSurrender:                "Surrender",
+	EventTimeout:                  "Timeout",
+	EventDisconnect:               "Disconnect",
+	EventAdjudicate:               "Adjudicate",
+}
+
+func (e Event) String() string {
+	if name, ok := eventNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Event(%d)", int(e))
+}
+
+// 状态转移之后需要发出的包, 按顺序发送, 包的内容由调用方根据棋盘填写
+type Emit int
+
+const (
+	// 告诉操作方走棋成功, PacketServerMoveResp
+	EmitMoveOK Emit = iota
+	// 告诉操作方走棋成功并且需要升变, PacketServerMoveResp
+	EmitMoveNeedUpgrade
+	// 告诉对手走了一步, PacketServerNotifyRemoteMove
+	EmitRemoteMove
+	// 告诉对手走了一步并且提出和棋
+	EmitRemoteMoveOfferDraw
+	// 告诉对手走了一步, 正在升变
+	EmitRemoteMoveNeedUpgrade
+	// 告诉操作方升变成功, PacketServerUpgradeOK
+	EmitUpgradeOK
+	// 告诉对手升变完成, PacketServerRemoteUpgradeOK
+	EmitRemoteUpgradeOK
+	// 告诉对手升变完成并且提出和棋
+	EmitRemoteUpgradeOKOfferDraw
+	// 告诉双方对局结束, PacketServerGameOver
+	EmitGameOver
+	// 告诉对手操作方断线了, PacketServerRemoteLoseConnection
+	EmitRemoteLoseConnection
+	// 告诉观战者走了一步
+	EmitPublishMove
+	// 告诉观战者走了一步, 正在升变
+	EmitPublishMoveNeedUpgrade
+	// 告诉观战者升变的棋子
+	EmitPublishUpgrade
+	// 告诉观战者操作方提出了和棋
+	EmitPublishDrawOffer
+	// 告诉观战者操作方拒绝了和棋
+	EmitPublishDrawRefused
+)
+
+var emitNames = map[Emit]string{
+	EmitMoveOK:                   "MoveOK",
+	EmitMoveNeedUpgrade:          "MoveNeedUpgrade",
+	EmitRemoteMove:               "RemoteMove",
+	EmitRemoteMoveOfferDraw:      "RemoteMoveOfferDraw",
+	EmitRemoteMoveNeedUpgrade:    "RemoteMoveNeedUpgrade",
+	EmitUpgradeOK:                "UpgradeOK",
+	EmitRemoteUpgradeOK:          "RemoteUpgradeOK",
+	EmitRemoteUpgradeOKOfferDraw: "RemoteUpgradeOKOfferDraw",
+	EmitGameOver:                 "GameOver",
+	EmitRemoteLoseConnection:     "RemoteLoseConnection",
+	EmitPublishMove:              "PublishMove",
+	EmitPublishMoveNeedUpgrade:   "PublishMoveNeedUpgrade",
+	EmitPublishUpgrade:           "PublishUpgrade",
+	EmitPublishDrawOffer:         "PublishDrawOffer",
+	EmitPublishDrawRefused:       "PublishDrawRefused",
+}
+
+func (e Emit) String() string {
+	if name, ok := emitNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Emit(%d)", int(e))
+}
+
+type Transition struct {
+	From  State
+	Event Event
+	To    State
+	Emits []Emit
+}
+
+// 任何一方在任何时候都可以触发的事件, 对局结束之后不再接受
+var anySideEvents = []Event{EventSurrender, EventTimeout, EventDisconnect, EventAdjudicate}
+
+// 断线的一方收不到包, 只通知对手
+var anySideEmits = map[Event][]Emit{
+	EventSurrender:  {EmitGameOver},
+	EventTimeout:    {EmitGameOver},
+	EventDisconnect: {EmitRemoteLoseConnection},
+	EventAdjudicate: {EmitGameOver},
+}
+
+// 一方操作的转移, 白黑双方对称, 用白方的写法生成黑方的
+func sideTransitions(put, otherPut, upgrade, upgradeThenDraw, acceptDraw, otherAcceptDraw State) []Transition {
+	return []Transition{
+		{put, EventMove, otherPut, []Emit{EmitMoveOK, EmitRemoteMove, EmitPublishMove}},
+		{put, EventMoveOfferDraw, otherAcceptDraw, []Emit{EmitMoveOK, EmitRemoteMoveOfferDraw, EmitPublishMove, EmitPublishDrawOffer}},
+		{put, EventMoveNeedUpgrade, upgrade, []Emit{EmitMoveNeedUpgrade, EmitRemoteMoveNeedUpgrade, EmitPublishMoveNeedUpgrade}},
+		{put, EventMoveNeedUpgradeOfferDraw, upgradeThenDraw, []Emit{EmitMoveNeedUpgrade, EmitRemoteMoveNeedUpgrade, EmitPublishMoveNeedUpgrade}},
+		{put, EventMoveGameOver, StateOver, []Emit{EmitGameOver, EmitPublishMove}},
+
+		{upgrade, EventUpgrade, otherPut, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK}},
+		{upgrade, EventUpgradeGameOver, StateOver, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK, EmitGameOver}},
+		{upgradeThenDraw, EventUpgrade, otherAcceptDraw, []Emit{EmitPublishUpgrade, EmitPublishDrawOffer, EmitRemoteUpgradeOKOfferDraw, EmitUpgradeOK}},
+		{upgradeThenDraw, EventUpgradeGameOver, StateOver, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK, EmitGameOver}},
+
+		// 拒绝和棋之后轮到拒绝的一方走
+		{acceptDraw, EventAcceptDraw, StateOver, []Emit{EmitGameOver}},
+		{acceptDraw, EventRefuseDraw, put, []Emit{EmitPublishDrawRefused}},
+	}
+}
+
+func buildTransitions() []Transition {
+	transitions := make([]Transition, 0)
+	transitions = append(transitions, sideTransitions(
+		StateWaitingWhitePut, StateWaitingBlackPut, StateWaitingWhiteUpgrade,
+		StateWaitingWhiteUpgradeThenDraw, StateWaitingWhiteAcceptDraw, StateWaitingBlackAcceptDraw,
+	)...)
+	transitions = append(transitions, sideTransitions(
+		StateWaitingBlackPut, StateWaitingWhitePut, StateWaitingBlackUpgrade,
+		StateWaitingBlackUpgradeThenDraw, StateWaitingBlackAcceptDraw, StateWaitingWhiteAcceptDraw,
+	)...)
+
+	for s := StateWaitingWhitePut; s < StateOver; s++ {
+		for _, e := range anySideEvents {
+			transitions = append(transitions, Transition{s, e, StateOver, anySideEmits[e]})
+		}
+	}
+	return transitions
+}
+
+type transitionKey struct {
+	from  State
+	event Event
+}
+
+// 完整的转移表
+var Transitions = buildTransitions()
+
+var transitionIndex = func() map[transitionKey]Transition {
+	index := make(map[transitionKey]Transition, len(Transitions))
+	for _, t := range Transitions {
+		index[transitionKey{t.From, t.Event}] = t
+	}
+	return index
+}()
+
+func isAnySideEvent(event Event) bool {
+	for _, e := range anySideEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 一局棋的状态, 不关心连接和棋盘
+type Game struct {
+	state State
+}
+
+func New() *Game {
+	return &Game{state: StateWaitingWhitePut}
+}
+
+// 从快照恢复
+func Restore(state State) *Game {
+	return &Game{state: state}
+}
+
+func (g *Game) State() State {
+	return g.state
+}
+
+// 查找转移, 不改变状态
+func Lookup(state State, side chess.Side, event Event) (Transition, error) {
+	t, ok := transitionIndex[transitionKey{state, event}]
+	if !ok {
+		return Transition{}, ErrInvalidTransition
+	}
+	if !isAnySideEvent(event) && state.Actor() != side {
+		return Transition{}, ErrInvalidTransition
+	}
+	return t, nil
+}
+
+// side触发一个事件, 返回需要发出的包, 不合法时状态不变
+func (g *Game) Fire(side chess.Side, event Event) ([]Emit, error) {
+	t, err := Lookup(g.state, side, event)
+	if err != nil {
+		return nil, err
+	}
+	g.state = t.To
+	return t.Emits, nil
+}
+
+// 这一方现在能不能触发这个事件
+func (g *Game) Can(side chess.Side, event Event) bool {
+	_, err := Lookup(g.state, side, event)
+	return err == nil
+}
@@ -0,0 +1,299 @@
+package machine
+
+import (
+	"bytes"
+	"chess-backend/comm/chess"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 手写的期望转移表, 不依赖sideTransitions生成, 用来发现生成逻辑里的错误
+type expected struct {
+	to    State
+	emits []Emit
+}
+
+type expectedKey struct {
+	from  State
+	side  chess.Side
+	event Event
+}
+
+func sideTable(side chess.Side, put, otherPut, upgrade, upgradeThenDraw, acceptDraw, otherAcceptDraw State) map[expectedKey]expected {
+	return map[expectedKey]expected{
+		{put, side, EventMove}:                     {otherPut, []Emit{EmitMoveOK, EmitRemoteMove, EmitPublishMove}},
+		{put, side, EventMoveOfferDraw}:            {otherAcceptDraw, []Emit{EmitMoveOK, EmitRemoteMoveOfferDraw, EmitPublishMove, EmitPublishDrawOffer}},
+		{put, side, EventMoveNeedUpgrade}:          {upgrade, []Emit{EmitMoveNeedUpgrade, EmitRemoteMoveNeedUpgrade, EmitPublishMoveNeedUpgrade}},
+		{put, side, EventMoveNeedUpgradeOfferDraw}: {upgradeThenDraw, []Emit{EmitMoveNeedUpgrade, EmitRemoteMoveNeedUpgrade, EmitPublishMoveNeedUpgrade}},
+		{put, side, EventMoveGameOver}:             {StateOver, []Emit{EmitGameOver, EmitPublishMove}},
+
+		{upgrade, side, EventUpgrade}:                 {otherPut, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK}},
+		{upgrade, side, EventUpgradeGameOver}:         {StateOver, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK, EmitGameOver}},
+		{upgradeThenDraw, side, EventUpgrade}:         {otherAcceptDraw, []Emit{EmitPublishUpgrade, EmitPublishDrawOffer, EmitRemoteUpgradeOKOfferDraw, EmitUpgradeOK}},
+		{upgradeThenDraw, side, EventUpgradeGameOver}: {StateOver, []Emit{EmitPublishUpgrade, EmitRemoteUpgradeOK, EmitUpgradeOK, EmitGameOver}},
+
+		{acceptDraw, side, EventAcceptDraw}: {StateOver, []Emit{EmitGameOver}},
+		{acceptDraw, side, EventRefuseDraw}: {put, []Emit{EmitPublishDrawRefused}},
+	}
+}
+
+func expectedTable() map[expectedKey]expected {
+	table := make(map[expectedKey]expected)
+	for k, v := range sideTable(chess.SideWhite,
+		StateWaitingWhitePut, StateWaitingBlackPut, StateWaitingWhiteUpgrade,
+		StateWaitingWhiteUpgradeThenDraw, StateWaitingWhiteAcceptDraw, StateWaitingBlackAcceptDraw) {
+		table[k] = v
+	}
+	for k, v := range sideTable(chess.SideBlack,
+		StateWaitingBlackPut, StateWaitingWhitePut, StateWaitingBlackUpgrade,
+		StateWaitingBlackUpgradeThenDraw, StateWaitingBlackAcceptDraw, StateWaitingWhiteAcceptDraw) {
+		table[k] = v
+	}
+	for s := StateWaitingWhitePut; s < StateOver; s++ {
+		for _, side := range []chess.Side{chess.SideWhite, chess.SideBlack} {
+			table[expectedKey{s, side, EventSurrender}] = expected{StateOver, []Emit{EmitGameOver}}
+			table[expectedKey{s, side, EventTimeout}] = expected{StateOver, []Emit{EmitGameOver}}
+			table[expectedKey{s, side, EventDisconnect}] = expected{StateOver, []Emit{EmitRemoteLoseConnection}}
+			table[expectedKey{s, side, EventAdjudicate}] = expected{StateOver, []Emit{EmitGameOver}}
+		}
+	}
+	return table
+}
+
+var (
+	allStates = []State{
+		StateWaitingWhitePut, StateWaitingBlackPut, StateWaitingBlackUpgrade, StateWaitingWhiteUpgrade,
+		StateWaitingBlackAcceptDraw, StateWaitingWhiteAcceptDraw,
+		StateWaitingWhiteUpgradeThenDraw, StateWaitingBlackUpgradeThenDraw, StateOver,
+	}
+	allEvents = []Event{
+		EventMove, EventMoveOfferDraw, EventMoveNeedUpgrade, EventMoveNeedUpgradeOfferDraw, EventMoveGameOver,
+		EventUpgrade, EventUpgradeGameOver, EventAcceptDraw, EventRefuseDraw,
+		EventSurrender, EventTimeout, EventDisconnect, EventAdjudicate,
+	}
+	allSides = []chess.Side{chess.SideWhite, chess.SideBlack}
+)
+
+// 遍历所有 状态 × 事件 × 操作方, 合法的转移要和手写的表一致, 其余的都要拒绝
+func TestLookupExhaustive(t *testing.T) {
+	table := expectedTable()
+	valid := 0
+	for _, state := range allStates {
+		for _, event := range allEvents {
+			for _, side := range allSides {
+				name := fmt.Sprintf("%s/%s/%s", state, event, side)
+				want, ok := table[expectedKey{state, side, event}]
+				got, err := Lookup(state, side, event)
+				if !ok {
+					if !errors.Is(err, ErrInvalidTransition) {
+						t.Errorf("%s: want ErrInvalidTransition, got %+v, %v", name, got, err)
+					}
+					continue
+				}
+				valid++
+				if err != nil {
+					t.Errorf("%s: unexpected error %v", name, err)
+					continue
+				}
+				if got.From != state || got.Event != event || got.To != want.to {
+					t.Errorf("%s: got %s -%s-> %s, want -> %s", name, got.From, got.Event, got.To, want.to)
+				}
+				if !reflect.DeepEqual(got.Emits, want.emits) {
+					t.Errorf("%s: emits %v, want %v", name, got.Emits, want.emits)
+				}
+			}
+		}
+	}
+	if valid != len(table) {
+		t.Errorf("checked %d valid transitions, table has %d", valid, len(table))
+	}
+}
+
+// 转移表里不能有手写表之外的转移
+func TestTransitionsMatchTable(t *testing.T) {
+	table := expectedTable()
+	seen := make(map[transitionKey]bool)
+	for _, tr := range Transitions {
+		key := transitionKey{tr.From, tr.Event}
+		if seen[key] {
+			t.Errorf("duplicate transition %s -%s->", tr.From, tr.Event)
+		}
+		seen[key] = true
+
+		side := tr.From.Actor()
+		if side == chess.SideBoth {
+			t.Errorf("transition from %s which has no actor", tr.From)
+			continue
+		}
+		want, ok := table[expectedKey{tr.From, side, tr.Event}]
+		if !ok {
+			t.Errorf("unexpected transition %s -%s-> %s", tr.From, tr.Event, tr.To)
+			continue
+		}
+		if tr.To != want.to || !reflect.DeepEqual(tr.Emits, want.emits) {
+			t.Errorf("%s -%s->: got %s %v, want %s %v", tr.From, tr.Event, tr.To, tr.Emits, want.to, want.emits)
+		}
+	}
+}
+
+func TestFireInvalidKeepsState(t *testing.T) {
+	for _, state := range allStates {
+		for _, event := range allEvents {
+			for _, side := range allSides {
+				g := Restore(state)
+				_, lookupErr := Lookup(state, side, event)
+				if g.Can(side, event) != (lookupErr == nil) {
+					t.Errorf("%s/%s/%s: Can disagrees with Lookup", state, event, side)
+				}
+				emits, err := g.Fire(side, event)
+				if lookupErr != nil {
+					if err == nil || emits != nil || g.State() != state {
+						t.Errorf("%s/%s/%s: invalid fire changed state to %s", state, event, side, g.State())
+					}
+				} else if err != nil {
+					t.Errorf("%s/%s/%s: Fire failed: %v", state, event, side, err)
+				}
+			}
+		}
+	}
+}
+
+// 以前升变之后提出和棋的两个分支都进入WaitingBlackAcceptDraw, 这里确保和棋是向对手提出的
+func TestUpgradeThenDraw(t *testing.T) {
+	cases := []struct {
+		side      chess.Side
+		put       State
+		waiting   State
+		offeredTo State
+	}{
+		{chess.SideWhite, StateWaitingWhitePut, StateWaitingWhiteUpgradeThenDraw, StateWaitingBlackAcceptDraw},
+		{chess.SideBlack, StateWaitingBlackPut, StateWaitingBlackUpgradeThenDraw, StateWaitingWhiteAcceptDraw},
+	}
+	for _, c := range cases {
+		g := Restore(c.put)
+		if _, err := g.Fire(c.side, EventMoveNeedUpgradeOfferDraw); err != nil {
+			t.Fatalf("side %s: %v", c.side, err)
+		}
+		if g.State() != c.waiting {
+			t.Fatalf("side %s: state %s, want %s", c.side, g.State(), c.waiting)
+		}
+		if !g.State().WaitingUpgrade() || !g.State().DrawAfterUpgrade() || g.State().DrawOffered() {
+			t.Errorf("side %s: wrong flags for %s", c.side, g.State())
+		}
+		if g.State().Actor() != c.side {
+			t.Errorf("side %s: actor of %s is %s", c.side, g.State(), g.State().Actor())
+		}
+		// 对手不能替升变的一方选择
+		if g.Can(chess.SideWhite+chess.SideBlack-c.side, EventUpgrade) {
+			t.Errorf("side %s: opponent can upgrade in %s", c.side, g.State())
+		}
+
+		emits, err := g.Fire(c.side, EventUpgrade)
+		if err != nil {
+			t.Fatalf("side %s: %v", c.side, err)
+		}
+		if g.State() != c.offeredTo {
+			t.Errorf("side %s: after upgrade state %s, want %s", c.side, g.State(), c.offeredTo)
+		}
+		if g.State().Actor() == c.side {
+			t.Errorf("side %s: draw offered to the offering side", c.side)
+		}
+		if !containsEmit(emits, EmitRemoteUpgradeOKOfferDraw) || !containsEmit(emits, EmitPublishDrawOffer) {
+			t.Errorf("side %s: emits %v missing draw offer", c.side, emits)
+		}
+
+		// 升变直接结束对局时不会再提出和棋
+		g = Restore(c.waiting)
+		emits, err = g.Fire(c.side, EventUpgradeGameOver)
+		if err != nil || g.State() != StateOver {
+			t.Errorf("side %s: upgrade game over: %s %v", c.side, g.State(), err)
+		}
+		if containsEmit(emits, EmitRemoteUpgradeOKOfferDraw) || containsEmit(emits, EmitPublishDrawOffer) {
+			t.Errorf("side %s: game over emits draw offer %v", c.side, emits)
+		}
+	}
+}
+
+func TestStateHelpers(t *testing.T) {
+	for _, s := range allStates {
+		if strings.HasPrefix(s.String(), "State(") {
+			t.Errorf("state %d has no name", int(s))
+		}
+		actor := s.Actor()
+		if (s == StateOver) != (actor == chess.SideBoth) {
+			t.Errorf("%s: actor %s", s, actor)
+		}
+	}
+	for _, e := range allEvents {
+		if strings.HasPrefix(e.String(), "Event(") {
+			t.Errorf("event %d has no name", int(e))
+		}
+	}
+	if got := State(100).String(); got != "State(100)" {
+		t.Errorf("unknown state name %q", got)
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+
+	header := []string{"digraph game {", "\trankdir=LR;", "\tnode [shape=box];", "\tOver [shape=doublecircle];"}
+	if len(lines) < len(header)+1 || !reflect.DeepEqual(lines[:len(header)], header) {
+		t.Fatalf("unexpected header:\n%s", out)
+	}
+	if lines[len(lines)-1] != "}" {
+		t.Fatalf("missing closing brace:\n%s", out)
+	}
+
+	// 每个非任意状态的转移一条实线, 任意状态的事件各一条虚线
+	edges, dashed := 0, 0
+	for _, line := range lines {
+		if strings.Contains(line, "->") {
+			if strings.Contains(line, "style=dashed") {
+				dashed++
+			} else {
+				edges++
+			}
+		}
+	}
+	oneSide := 0
+	for _, tr := range Transitions {
+		if !isAnySideEvent(tr.Event) {
+			oneSide++
+		}
+	}
+	if edges != oneSide {
+		t.Errorf("got %d edges, want %d", edges, oneSide)
+	}
+	if dashed != len(anySideEvents) {
+		t.Errorf("got %d dashed edges, want %d", dashed, len(anySideEvents))
+	}
+
+	for _, want := range []string{
+		"\tWaitingWhiteUpgradeThenDraw -> WaitingBlackAcceptDraw [label=\"Upgrade\\nPublishUpgrade, PublishDrawOffer, RemoteUpgradeOKOfferDraw, UpgradeOK\"];",
+		"\tWaitingBlackAcceptDraw -> WaitingBlackPut [label=\"RefuseDraw\\nPublishDrawRefused\"];",
+		"\tAny [shape=plaintext, label=\"any state\"];",
+		"\tAny -> Over [style=dashed, label=\"Disconnect\\nRemoteLoseConnection\"];",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing line %q", want)
+		}
+	}
+}
+
+func containsEmit(emits []Emit, emit Emit) bool {
+	for _, e := range emits {
+		if e == emit {
+			return true
+		}
+	}
+	return false
+}
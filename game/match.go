@@ -0,0 +1,118 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"log/slog"
+
+	othertool "chess-backend/tools/other"
+)
+
+// 随机匹配使用的对局设置, 不限时
+var DefaultGameOptions = chess.GameOptions{Variant: chess.VariantStandard}
+
+// 检查客户端发来的对局设置是否合法
+func checkGameOptionsValid(options chess.GameOptions) bool {
+	if options.Variant != chess.VariantStandard {
+		return false
+	}
+
+	tc := options.TimeControl
+	if tc.InitialSeconds < 0 || tc.InitialSeconds > settings.MaxTimeControlInitialSeconds ||
+		tc.IncrementSeconds < 0 || tc.IncrementSeconds > settings.MaxTimeControlIncrementSeconds ||
+		tc.DaysPerMove < 0 || tc.DaysPerMove > settings.MaxCorrespondenceDaysPerMove {
+		return false
+	}
+
+	// 通信棋不能同时有棋钟
+	if tc.Correspondence() && !tc.Unlimited() {
+		return false
+	}
+
+	// 不限时的对局不能有加秒
+	if tc.Unlimited() && tc.IncrementSeconds != 0 {
+		return false
+	}
+
+	return true
+}
+
+// 客户端指定的颜色只能是白, 黑或者随机
+func checkSideChoiceValid(side chess.Side) bool {
+	return side == chess.SideWhite || side == chess.SideBlack || side == chess.SideBoth
+}
+
+// 根据发起方选择的颜色分配双方, SideBoth表示随机
+func assignSides(initiator *ConnContext, other *ConnContext, initiatorSide chess.Side) (white *ConnContext, black *ConnContext) {
+	if initiatorSide == chess.SideBoth {
+		if othertool.RandGetBool() {
+			initiatorSide = chess.SideWhite
+		} else {
+			initiatorSide = chess.SideBlack
+		}
+	}
+
+	if initiatorSide == chess.SideWhite {
+		return initiator, other
+	}
+	return other, initiator
+}
+
+// 把连接切换到游戏状态
+func enterGame(connCtx *ConnContext, gameContext *GameContext) {
+	setConnState(connCtx, ConnStateGaming)
+	connCtx.Gcontext.Store(gameContext)
+	connCtx.audit.Store(gameContext.audit)
+	connCtx.MutedOpponent = false
+	connCtx.InLobby = false
+}
+
+// 开始一局新的对局, 通知双方并把双方切换到游戏状态, 需要持有LobbyLock
+// 通信棋不需要游戏上下文, 返回nil
+// 分配不到对局id时不开始对局, 双方回到空闲状态并收到internal_error, 返回错误
+func startGame(whiteConnContext *ConnContext, blackConnContext *ConnContext, options chess.GameOptions) (*GameContext, error) {
+	if options.TimeControl.Correspondence() {
+		return nil, startCorrespondenceGame(whiteConnContext, blackConnContext, options)
+	}
+
+	// 开始对局之后, 双方还没有应答的邀请都失效
+	cancelPendingOffers(whiteConnContext)
+	cancelPendingOffers(blackConnContext)
+
+	// 创建一个默认棋盘
+	table := chess.NewChessTable()
+
+	// 建立游戏上下文
+	gameContext, err := newGameContext(whiteConnContext, blackConnContext, table, options)
+	if err != nil {
+		failStartGame(whiteConnContext, blackConnContext, err)
+		return nil, err
+	}
+	Games[gameContext.ID] = gameContext
+	gameContext.Log.Info("game started", "initial_seconds", options.TimeControl.InitialSeconds, "increment_seconds", options.TimeControl.IncrementSeconds)
+
+	packetForBlack := packets.PacketServerMatchedOK{Side: chess.SideBlack, Table: table, Options: options}
+	enterGame(blackConnContext, gameContext)
+	sendPacketTo(blackConnContext, &packetForBlack)
+
+	packetForWhite := packets.PacketServerMatchedOK{Side: chess.SideWhite, Table: table, Options: options}
+	enterGame(whiteConnContext, gameContext)
+	sendPacketTo(whiteConnContext, &packetForWhite)
+
+	// 开始走棋钟和保存第一份快照也交给对局协程
+	gameContext.post(func() {
+		onGameStateChanged(gameContext)
+	})
+	go gameContext.run()
+	return gameContext, nil
+}
+
+// 没能开始对局, 双方回到空闲状态, 需要持有LobbyLock
+func failStartGame(whiteConnContext *ConnContext, blackConnContext *ConnContext, err error) {
+	slog.Error("start game failed", "white_conn", whiteConnContext.ID, "black_conn", blackConnContext.ID, "err", err)
+	for _, connCtx := range []*ConnContext{whiteConnContext, blackConnContext} {
+		setConnState(connCtx, ConnStateNone)
+		sendPacketTo(connCtx, &packets.PacketServerError{Code: packets.ErrorCodeInternal, Message: "could not start the game"})
+	}
+}
@@ -0,0 +1,50 @@
+package game
+
+import (
+	"testing"
+
+	"chess-backend/client"
+	"chess-backend/comm/packets"
+)
+
+// 分配不到对局id时不能用id 0开始对局, 双方收到internal_error之后回到空闲状态
+func TestStartGameWithoutGameID(t *testing.T) {
+	addr := startTestServer(t, nil, true)
+	a := connectTestClient(t, addr, client.Config{})
+	b := connectTestClient(t, addr, client.Config{})
+
+	testStore.failGameID.Store(true)
+	defer testStore.failGameID.Store(false)
+	drainGameIDs(t)
+
+	a.StartMatch()
+	expectPacket[*packets.PacketServerMatching](t, a)
+	b.StartMatch()
+	for _, c := range []*testClient{a, b} {
+		errorPacket := expectPacket[*packets.PacketServerError](t, c)
+		if errorPacket.Code != packets.ErrorCodeInternal || errorPacket.Fatal {
+			t.Errorf("got error %+v", errorPacket)
+		}
+	}
+	LobbyLock.Lock()
+	for id := range Games {
+		if id == 0 {
+			t.Error("game started with id 0")
+		}
+	}
+	LobbyLock.Unlock()
+
+	// 存储恢复, 重新预留到id之后可以重新匹配
+	testStore.failGameID.Store(false)
+	if err := ReserveGameIDs(); err != nil {
+		t.Fatal(err)
+	}
+	a.StartMatch()
+	expectPacket[*packets.PacketServerMatching](t, a)
+	b.StartMatch()
+	matchedA := expectPacket[*packets.PacketServerMatchedOK](t, a)
+	matchedB := expectPacket[*packets.PacketServerMatchedOK](t, b)
+	if matchedA.Side == matchedB.Side {
+		t.Errorf("both sides are %v", matchedA.Side)
+	}
+}
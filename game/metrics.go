@@ -0,0 +1,83 @@
+package game
+
+import (
+	"chess-backend/comm/packets"
+	"strconv"
+
+	metricstool "chess-backend/tools/metrics"
+)
+
+// 服务端的所有指标, 由/metrics输出
+var Metrics = metricstool.NewRegistry()
+
+var (
+	metricPacketsReceived = Metrics.NewCounterVec("chess_packets_received_total",
+		"Packets received from clients by packet type.", "type")
+	metricPacketsSent = Metrics.NewCounterVec("chess_packets_sent_total",
+		"Packets sent to clients by packet type.", "type")
+	metricBytesReceived = Metrics.NewCounter("chess_received_bytes_total",
+		"Packet bytes received from clients, without the length header.")
+	metricBytesSent = Metrics.NewCounter("chess_sent_bytes_total",
+		"Bytes sent to clients, including the length header.")
+	metricIllegalMoves = Metrics.NewCounter("chess_illegal_moves_total",
+		"Moves rejected because they are not legal on the board.")
+	metricProtocolErrors = Metrics.NewCounterVec("chess_protocol_errors_total",
+		"Protocol errors reported to clients by error code.", "code")
+	metricProtocolErrorDisconnects = Metrics.NewCounter("chess_protocol_error_disconnects_total",
+		"Connections closed because of too many or fatal protocol errors.")
+	metricHeartbeatTimeouts = Metrics.NewCounter("chess_heartbeat_timeouts_total",
+		"Connections closed because too many heartbeats were lost.")
+	metricSpectatorResyncs = Metrics.NewCounter("chess_spectator_resyncs_total",
+		"Full positions resent to spectators after spectator events were dropped.")
+	metricGamesFinished = Metrics.NewCounterVec("chess_games_finished_total",
+		"Finished games by termination reason.", "reason")
+	metricHandlerDuration = Metrics.NewHistogramVec("chess_handler_duration_seconds",
+		"Time spent in connection handlers, the heartbeat tick and game tasks.", metricstool.DefaultLatencyBuckets, "handler")
+)
+
+func init() {
+	Metrics.NewGaugeFunc("chess_connections", "Open connections.", func() float64 {
+		return float64(Conns.Len())
+	})
+	Metrics.NewGaugeFunc("chess_matching_queue_length", "Connections waiting for a random opponent.", func() float64 {
+		LobbyLock.Lock()
+		defer LobbyLock.Unlock()
+
+		n := 0
+		Conns.Range(func(v *ConnContext) bool {
+			if v.ConnState == ConnStateMatching {
+				n++
+			}
+			return true
+		})
+		return float64(n)
+	})
+	Metrics.NewGaugeFunc("chess_active_games", "Live games in progress.", func() float64 {
+		LobbyLock.Lock()
+		defer LobbyLock.Unlock()
+
+		return float64(len(Games))
+	})
+}
+
+func packetTypeLabel(bs []byte) string {
+	packetType, ok := packets.PeekType(bs)
+	if !ok {
+		return "unknown"
+	}
+	return strconv.Itoa(int(packetType))
+}
+
+// 给Protocol.OnUnPacket用
+func ObservePacketReceived(packetBytes []byte) {
+	metricPacketsReceived.With(packetTypeLabel(packetBytes)).Inc()
+	metricBytesReceived.Add(uint64(len(packetBytes)))
+}
+
+// 给Protocol.OnPacket用, data带有4个字节的长度头
+func ObservePacketSent(data []byte) {
+	if len(data) >= 4 {
+		metricPacketsSent.With(packetTypeLabel(data[4:])).Inc()
+	}
+	metricBytesSent.Add(uint64(len(data)))
+}
@@ -0,0 +1,232 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"log/slog"
+	"sync"
+	"time"
+
+	ratingtool "chess-backend/tools/rating"
+)
+
+// 对局结束的原因
+const (
+	GameEndReasonCheckmate  = "checkmate"
+	GameEndReasonStalemate  = "stalemate"
+	GameEndReasonSurrender  = "surrender"
+	GameEndReasonDrawAgreed = "draw_agreed"
+	GameEndReasonDisconnect = "disconnect"
+	GameEndReasonTimeout    = "timeout"
+	// 服务端重启之后双方没有按时回来, 或者管理员作废
+	GameEndReasonAborted = "aborted"
+	// 管理员裁定结果
+	GameEndReasonAdjudicated = "adjudicated"
+)
+
+func accountIDOf(connCtx *ConnContext) int64 {
+	if connCtx.Account == nil {
+		return 0
+	}
+	return connCtx.Account.ID
+}
+
+// 建立游戏上下文, 从预留的id池里取一个持久化的对局id, 不写存储, 取不到id时返回错误
+func newGameContext(whiteConnContext *ConnContext, blackConnContext *ConnContext, table *chess.ChessTable, options chess.GameOptions) (*GameContext, error) {
+	gameID, err := gameIDs.take()
+	if err != nil {
+		return nil, err
+	}
+
+	gameContext := &GameContext{
+		ID:               gameID,
+		WhiteConnContext: whiteConnContext,
+		BlackConnContext: blackConnContext,
+		Machine:          machine.New(),
+		Table:            table,
+		Options:          options,
+		Moves:            make([]storage.MoveRecord, 0),
+		StartedAt:        time.Now(),
+		Spectators:       newSpectatorHub(),
+		mailbox:          newGameMailbox(),
+	}
+	if !options.TimeControl.Unlimited() {
+		gameContext.Clock = newGameClock(options.TimeControl, gameContext.StartedAt)
+	}
+	gameContext.Log = gameLogger(gameContext)
+	watchSpectatorGaps(gameContext)
+	gameContext.audit = openGameAudit(gameContext)
+	return gameContext, nil
+}
+
+// 带上对局id和双方连接id的日志
+func gameLogger(gameContext *GameContext) *slog.Logger {
+	return slog.With("game", gameContext.ID, "white_conn", gameContext.WhiteConnContext.ID, "black_conn", gameContext.BlackConnContext.ID)
+}
+
+// 记录一步棋
+func recordMove(gameContext *GameContext, side chess.Side, fromX rune, fromY int, toX rune, toY int) {
+	gameContext.Moves = append(gameContext.Moves, storage.MoveRecord{
+		Side:  side,
+		FromX: fromX,
+		FromY: fromY,
+		ToX:   toX,
+		ToY:   toY,
+		At:    time.Now(),
+	})
+	gameContext.MoveCount.Store(int32(len(gameContext.Moves)))
+}
+
+// 给最后一步棋补上兵升变的结果
+func recordUpgrade(gameContext *GameContext, pieceType chess.ChessPieceType) {
+	if len(gameContext.Moves) == 0 {
+		return
+	}
+	gameContext.Moves[len(gameContext.Moves)-1].Upgrade = &pieceType
+}
+
+// 每次局面变化之后保存一份快照
+func saveSnapshot(gameContext *GameContext) {
+	snapshot := &storage.GameSnapshot{
+		GameID:         gameContext.ID,
+		WhiteAccountID: accountIDOf(gameContext.WhiteConnContext),
+		BlackAccountID: accountIDOf(gameContext.BlackConnContext),
+		Table:          gameContext.Table,
+		Moves:          gameContext.Moves,
+		State:          int(gameContext.Machine.State()),
+		Options:        gameContext.Options,
+		StartedAt:      gameContext.StartedAt,
+		UpdatedAt:      time.Now(),
+	}
+	if gameContext.Clock != nil {
+		snapshot.WhiteRemainingMs = gameContext.Clock.Remaining(chess.SideWhite, snapshot.UpdatedAt).Milliseconds()
+		snapshot.BlackRemainingMs = gameContext.Clock.Remaining(chess.SideBlack, snapshot.UpdatedAt).Milliseconds()
+	}
+
+	err := Store.SaveSnapshot(snapshot)
+	if err != nil {
+		gameContext.Log.Error("save snapshot failed", "err", err)
+	}
+}
+
+// 对局结束, 通知观战者, 锦标赛和竞技场的对局把结果交给比赛, 普通对局建立再来一局的联系, 需要持有LobbyLock
+// 返回要保存的棋谱, 释放LobbyLock之后在对局协程里交给saveFinishedGame
+func finishGame(gameContext *GameContext, winnerSide chess.Side, reason string) *storage.GameRecord {
+	metricGamesFinished.With(reason).Inc()
+	gameContext.Log.Info("game over", "winner", winnerSide, "reason", reason, "moves", len(gameContext.Moves))
+	delete(Games, gameContext.ID)
+	releaseSpectators(gameContext, &packets.PacketServerGameOver{
+		Table:       gameContext.Table,
+		WinnerSide:  winnerSide,
+		IsSurrender: reason == GameEndReasonSurrender,
+		IsDraw:      reason == GameEndReasonDrawAgreed,
+		IsTimeout:   reason == GameEndReasonTimeout,
+		Reason:      reason,
+	})
+
+	record := &storage.GameRecord{
+		ID:             gameContext.ID,
+		WhiteAccountID: accountIDOf(gameContext.WhiteConnContext),
+		BlackAccountID: accountIDOf(gameContext.BlackConnContext),
+		Moves:          gameContext.Moves,
+		FinalTable:     gameContext.Table,
+		Options:        gameContext.Options,
+		WinnerSide:     winnerSide,
+		Reason:         reason,
+		StartedAt:      gameContext.StartedAt,
+		EndedAt:        time.Now(),
+	}
+	savingGames.Add(1)
+
+	if gameContext.Tournament != nil {
+		reportTournamentGame(gameContext, winnerSide, reason)
+		return record
+	}
+	if gameContext.Arena != nil {
+		reportArenaGame(gameContext, winnerSide, reason)
+		return record
+	}
+
+	// 双方都还在线的话可以再来一局
+	if reason != GameEndReasonDisconnect {
+		linkForRematch(gameContext)
+	}
+	return record
+}
+
+// 已经从Games里删掉但是还没有保存完的对局, 关闭服务时要等它们保存完
+var savingGames sync.WaitGroup
+
+// 等级分的读改写, 两局同时结束时同一个账号的等级分不能互相覆盖
+var ratingLock sync.Mutex
+
+// 保存棋谱, 删除快照, 计分并且没有作废的对局双方都登录了的话更新等级分
+// 在对局协程里调用, 不能持有LobbyLock
+func saveFinishedGame(gameContext *GameContext, record *storage.GameRecord) {
+	defer savingGames.Done()
+
+	if err := Store.SaveGame(record); err != nil {
+		gameContext.Log.Error("save game failed", "err", err)
+	}
+	if err := Store.DeleteSnapshot(gameContext.ID); err != nil {
+		gameContext.Log.Error("delete snapshot failed", "err", err)
+	}
+
+	if gameContext.Options.Rated() && record.Reason != GameEndReasonAborted && record.WhiteAccountID != 0 && record.BlackAccountID != 0 &&
+		record.WhiteAccountID != record.BlackAccountID {
+		updateRatings(record.WhiteAccountID, record.BlackAccountID, record.WinnerSide)
+	}
+}
+
+func updateRatings(whiteAccountID int64, blackAccountID int64, winnerSide chess.Side) {
+	ratingLock.Lock()
+	defer ratingLock.Unlock()
+
+	whiteRating, err := Store.GetRating(whiteAccountID)
+	if err != nil {
+		slog.Error("load rating failed", "account", whiteAccountID, "err", err)
+		return
+	}
+	blackRating, err := Store.GetRating(blackAccountID)
+	if err != nil {
+		slog.Error("load rating failed", "account", blackAccountID, "err", err)
+		return
+	}
+
+	var whiteScore float64
+	switch winnerSide {
+	case chess.SideWhite:
+		whiteScore = 1
+		whiteRating.Wins++
+		blackRating.Losses++
+	case chess.SideBlack:
+		whiteScore = 0
+		whiteRating.Losses++
+		blackRating.Wins++
+	default:
+		whiteScore = 0.5
+		whiteRating.Draws++
+		blackRating.Draws++
+	}
+	whiteRating.Games++
+	blackRating.Games++
+	whiteRating.Rating, blackRating.Rating = ratingtool.Elo(whiteRating.Rating, blackRating.Rating, whiteScore)
+
+	if err := Store.SaveRating(whiteRating); err != nil {
+		slog.Error("save rating failed", "account", whiteAccountID, "err", err)
+	}
+	if err := Store.SaveRating(blackRating); err != nil {
+		slog.Error("save rating failed", "account", blackAccountID, "err", err)
+	}
+
+	// 同步在线账号缓存的等级分
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	for _, rating := range []*storage.Rating{whiteRating, blackRating} {
+		if connCtx := onlineConnOf(rating.AccountID); connCtx != nil {
+			connCtx.Rating = rating.Rating
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package game
+
+import "sync"
+
+// 连接表分成若干个分片, 每个分片一把锁, 查找和心跳不需要拿LobbyLock
+const connRegistryShards = 64
+
+type connShard struct {
+	lock  sync.RWMutex
+	conns map[int]*ConnContext
+}
+
+type ConnRegistry struct {
+	shards [connRegistryShards]connShard
+}
+
+func NewConnRegistry() *ConnRegistry {
+	r := &ConnRegistry{}
+	for i := range r.shards {
+		r.shards[i].conns = make(map[int]*ConnContext)
+	}
+	return r
+}
+
+func (r *ConnRegistry) shardOf(connID int) *connShard {
+	return &r.shards[uint(connID)%connRegistryShards]
+}
+
+func (r *ConnRegistry) Add(connCtx *ConnContext) {
+	shard := r.shardOf(connCtx.ID)
+	shard.lock.Lock()
+	shard.conns[connCtx.ID] = connCtx
+	shard.lock.Unlock()
+}
+
+func (r *ConnRegistry) Remove(connID int) {
+	shard := r.shardOf(connID)
+	shard.lock.Lock()
+	delete(shard.conns, connID)
+	shard.lock.Unlock()
+}
+
+// 找不到时返回nil
+func (r *ConnRegistry) Get(connID int) *ConnContext {
+	shard := r.shardOf(connID)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	return shard.conns[connID]
+}
+
+// 依次遍历每个分片, 遍历一个分片时只持有这个分片的读锁, fn返回false时停止
+// fn里面不能再调用Add和Remove
+func (r *ConnRegistry) Range(fn func(connCtx *ConnContext) bool) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.lock.RLock()
+		for _, v := range shard.conns {
+			if !fn(v) {
+				shard.lock.RUnlock()
+				return
+			}
+		}
+		shard.lock.RUnlock()
+	}
+}
+
+func (r *ConnRegistry) Len() int {
+	n := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.lock.RLock()
+		n += len(shard.conns)
+		shard.lock.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,127 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"time"
+)
+
+// 对局结束之后双方之间短暂保留的联系, 用来再来一局
+type RematchLink struct {
+	// 上一局的双方
+	White *ConnContext
+	Black *ConnContext
+	// 上一局的对局设置
+	Options   chess.GameOptions
+	ExpiresAt time.Time
+	// 已经提出再来一局的一方, 还没有人提出时为nil
+	OfferedBy *ConnContext
+}
+
+// 按建立的先后排列的联系, 有效期都一样, 所以也是按过期时间排列, 由LobbyLock保护
+// 已经失效的联系等过期的时候再从队列里去掉
+var rematchLinks []*RematchLink
+
+// 对局结束之后建立双方的联系, 需要持有LobbyLock
+func linkForRematch(gameContext *GameContext) {
+	link := &RematchLink{
+		White:     gameContext.WhiteConnContext,
+		Black:     gameContext.BlackConnContext,
+		Options:   gameContext.Options,
+		ExpiresAt: time.Now().Add(settings.RematchWindowSeconds * time.Second),
+	}
+	gameContext.WhiteConnContext.Rematch = link
+	gameContext.BlackConnContext.Rematch = link
+	rematchLinks = append(rematchLinks, link)
+}
+
+func (link *RematchLink) other(connCtx *ConnContext) *ConnContext {
+	if link.White == connCtx {
+		return link.Black
+	}
+	return link.White
+}
+
+// 删除联系, 并告知另外一方
+func cancelRematchOf(connCtx *ConnContext, declined bool) {
+	link := connCtx.Rematch
+	if link == nil {
+		return
+	}
+
+	link.White.Rematch = nil
+	link.Black.Rematch = nil
+
+	canceledPacket := packets.PacketServerRematchCanceled{Declined: declined}
+	sendPacketTo(link.other(connCtx), &canceledPacket)
+}
+
+func handleRematch(connCtx *ConnContext, packet *packets.PacketClientRematch) {
+	// 联系可能刚刚失效, 客户端已经收到了失效通知, 这里直接忽略
+	link := connCtx.Rematch
+	if link == nil {
+		return
+	}
+
+	if !packet.Accept {
+		cancelRematchOf(connCtx, true)
+		return
+	}
+
+	// 协议判断, 有联系的一方一旦离开空闲状态联系就会失效
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientRematch, packets.ErrorCodeWrongState, "can only accept a rematch when idle")
+		return
+	}
+
+	other := link.other(connCtx)
+	if link.OfferedBy == nil {
+		link.OfferedBy = connCtx
+		offeredPacket := packets.PacketServerRematchOffered{}
+		sendPacketTo(other, &offeredPacket)
+		return
+	}
+
+	// 重复提出
+	if link.OfferedBy == connCtx {
+		return
+	}
+
+	// 对手已经提出了, 交换颜色立即开始
+	link.White.Rematch = nil
+	link.Black.Rematch = nil
+	startGame(link.Black, link.White, link.Options)
+}
+
+// 清理过期的联系, 只看队列开头已经过期的部分, 需要持有LobbyLock
+func expireRematchLinks() {
+	now := time.Now()
+	expired := 0
+	for _, link := range rematchLinks {
+		if now.Before(link.ExpiresAt) {
+			break
+		}
+		expired++
+
+		// 已经再来一局, 被拒绝或者有一方离开了
+		if link.White.Rematch != link {
+			continue
+		}
+		link.White.Rematch = nil
+		link.Black.Rematch = nil
+		canceledPacket := packets.PacketServerRematchCanceled{Declined: false}
+		canceledShared := newSharedPacket(&canceledPacket)
+		sendSharedTo(link.White, canceledShared)
+		sendSharedTo(link.Black, canceledShared)
+	}
+	if expired > 0 {
+		rematchLinks = append(rematchLinks[:0:0], rematchLinks[expired:]...)
+	}
+}
+
+// 连接离开空闲状态, 或者断开时调用, 让所有还没有应答的邀请失效
+func cancelPendingOffers(connCtx *ConnContext) {
+	cancelChallengesOf(connCtx)
+	cancelRematchOf(connCtx, false)
+}
@@ -0,0 +1,212 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"strings"
+
+	othertool "chess-backend/tools/other"
+)
+
+// 私人房间, 房主创建之后等待对手通过邀请码加入
+type Room struct {
+	InviteCode string
+	Creator    *ConnContext
+	// 房主想要的颜色, SideBoth表示随机
+	CreatorSide chess.Side
+	Options     chess.GameOptions
+}
+
+// 向在线账号发起的挑战
+type Challenge struct {
+	ID   int64
+	From *ConnContext
+	To   *ConnContext
+	// 发起方想要的颜色, SideBoth表示随机
+	FromSide chess.Side
+	Options  chess.GameOptions
+}
+
+func handleCreateRoom(connCtx *ConnContext, packet *packets.PacketClientCreateRoom) {
+	// 协议判断
+	// 通信棋需要登录, 客户端应该保证
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientCreateRoom, packets.ErrorCodeWrongState, "can only create a room when idle")
+		return
+	}
+	if !checkSideChoiceValid(packet.Side) || !checkGameOptionsValid(packet.Options) {
+		rejectPacket(connCtx, packets.PacketTypeClientCreateRoom, packets.ErrorCodeInvalidArgument, "invalid side or options")
+		return
+	}
+	if correspondenceNeedsLogin(connCtx, packet.Options) {
+		rejectPacket(connCtx, packets.PacketTypeClientCreateRoom, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	// 邀请码冲突的话重新生成
+	code := othertool.RandInviteCode(settings.InviteCodeLength)
+	for Rooms[code] != nil {
+		code = othertool.RandInviteCode(settings.InviteCodeLength)
+	}
+
+	room := &Room{InviteCode: code, Creator: connCtx, CreatorSide: packet.Side, Options: packet.Options}
+	Rooms[code] = room
+	cancelPendingOffers(connCtx)
+	setConnState(connCtx, ConnStateInRoom)
+	connCtx.Room = room
+
+	createdPacket := packets.PacketServerRoomCreated{InviteCode: code}
+	sendPacketTo(connCtx, &createdPacket)
+}
+
+func handleJoinRoom(connCtx *ConnContext, packet *packets.PacketClientJoinRoom) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientJoinRoom, packets.ErrorCodeWrongState, "can only join a room when idle")
+		return
+	}
+
+	// 邀请码不区分大小写
+	room := Rooms[strings.ToUpper(packet.InviteCode)]
+	if room == nil {
+		failedPacket := packets.PacketServerJoinRoomResp{OK: false, Message: "room not found"}
+		sendPacketTo(connCtx, &failedPacket)
+		return
+	}
+	if correspondenceNeedsLogin(connCtx, room.Options) {
+		failedPacket := packets.PacketServerJoinRoomResp{OK: false, Message: "login required"}
+		sendPacketTo(connCtx, &failedPacket)
+		return
+	}
+
+	delete(Rooms, room.InviteCode)
+	room.Creator.Room = nil
+
+	okPacket := packets.PacketServerJoinRoomResp{OK: true}
+	sendPacketTo(connCtx, &okPacket)
+
+	white, black := assignSides(room.Creator, connCtx, room.CreatorSide)
+	startGame(white, black, room.Options)
+}
+
+func handleCancelRoom(connCtx *ConnContext) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateInRoom {
+		rejectPacket(connCtx, packets.PacketTypeClientCancelRoom, packets.ErrorCodeWrongState, "no room to cancel")
+		return
+	}
+
+	closeRoomOf(connCtx)
+}
+
+// 关闭连接创建的房间, 连接回到空闲状态
+func closeRoomOf(connCtx *ConnContext) {
+	if connCtx.Room != nil {
+		delete(Rooms, connCtx.Room.InviteCode)
+		connCtx.Room = nil
+	}
+	setConnState(connCtx, ConnStateNone)
+}
+
+func sendChallengeResp(connCtx *ConnContext, resp packets.PacketServerChallengeResp) {
+	sendPacketTo(connCtx, &resp)
+}
+
+func handleChallenge(connCtx *ConnContext, packet *packets.PacketClientChallenge) {
+	// 协议判断
+	// 通信棋需要登录, 客户端应该保证, 被挑战方一定是登录了的
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientChallenge, packets.ErrorCodeWrongState, "can only challenge when idle")
+		return
+	}
+	if !checkSideChoiceValid(packet.Side) || !checkGameOptionsValid(packet.Options) {
+		rejectPacket(connCtx, packets.PacketTypeClientChallenge, packets.ErrorCodeInvalidArgument, "invalid side or options")
+		return
+	}
+	if correspondenceNeedsLogin(connCtx, packet.Options) {
+		rejectPacket(connCtx, packets.PacketTypeClientChallenge, packets.ErrorCodeLoginRequired, "correspondence games need login")
+		return
+	}
+
+	target := onlineConnOf(packet.TargetAccountID)
+	if target == nil || target == connCtx {
+		sendChallengeResp(connCtx, packets.PacketServerChallengeResp{OK: false, Message: "player is offline"})
+		return
+	}
+	if target.ConnState != ConnStateNone {
+		sendChallengeResp(connCtx, packets.PacketServerChallengeResp{OK: false, Message: "player is busy"})
+		return
+	}
+
+	challenge := &Challenge{
+		ID:       AtomicChallengeIDIncrease.Add(1),
+		From:     connCtx,
+		To:       target,
+		FromSide: packet.Side,
+		Options:  packet.Options,
+	}
+	Challenges[challenge.ID] = challenge
+	sendChallengeResp(connCtx, packets.PacketServerChallengeResp{OK: true, ChallengeID: challenge.ID})
+
+	// 告诉被挑战方他会执什么颜色
+	targetSide := chess.SideBoth
+	switch packet.Side {
+	case chess.SideWhite:
+		targetSide = chess.SideBlack
+	case chess.SideBlack:
+		targetSide = chess.SideWhite
+	}
+	receivedPacket := packets.PacketServerChallengeReceived{
+		ChallengeID: challenge.ID,
+		Side:        targetSide,
+		Options:     packet.Options,
+	}
+	if connCtx.Account != nil {
+		receivedPacket.FromAccountID = connCtx.Account.ID
+		receivedPacket.FromName = connCtx.Account.Name
+	}
+	sendPacketTo(target, &receivedPacket)
+}
+
+func handleAnswerChallenge(connCtx *ConnContext, packet *packets.PacketClientAnswerChallenge) {
+	// 挑战可能刚刚失效, 客户端已经收到了失效通知, 这里直接忽略
+	challenge := Challenges[packet.ChallengeID]
+	if challenge == nil || challenge.To != connCtx {
+		return
+	}
+	delete(Challenges, challenge.ID)
+
+	if !packet.Accept {
+		declinedPacket := packets.PacketServerChallengeCanceled{ChallengeID: challenge.ID, Declined: true}
+		sendPacketTo(challenge.From, &declinedPacket)
+		return
+	}
+
+	// 协议判断, 被挑战方必须是空闲的, 发起方在进入别的状态时挑战就已经失效了
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientAnswerChallenge, packets.ErrorCodeWrongState, "can only accept a challenge when idle")
+		return
+	}
+
+	white, black := assignSides(challenge.From, challenge.To, challenge.FromSide)
+	startGame(white, black, challenge.Options)
+}
+
+// 让和这个连接有关的所有挑战失效, 并通知另外一方
+func cancelChallengesOf(connCtx *ConnContext) {
+	for id, challenge := range Challenges {
+		var other *ConnContext
+		if challenge.From == connCtx {
+			other = challenge.To
+		} else if challenge.To == connCtx {
+			other = challenge.From
+		} else {
+			continue
+		}
+
+		delete(Challenges, id)
+		canceledPacket := packets.PacketServerChallengeCanceled{ChallengeID: id, Declined: false}
+		sendPacketTo(other, &canceledPacket)
+	}
+}
@@ -0,0 +1,201 @@
+package game
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chess-backend/client"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/storage"
+
+	protocoltool "chess-backend/tools/protocol"
+
+	"github.com/Allenxuxu/gev"
+)
+
+// 审计文件写在当前目录下, 测试时换到临时目录
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chess-game-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	Store = testStore
+	if err := ReserveGameIDs(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var errTestStorage = errors.New("test storage failure")
+
+// 测试用的存储, 可以让预留对局id失败
+type testStorage struct {
+	storage.Storage
+	failGameID atomic.Bool
+}
+
+func (s *testStorage) ReserveGameIDs(n int) (int64, error) {
+	if s.failGameID.Load() {
+		return 0, errTestStorage
+	}
+	return s.Storage.ReserveGameIDs(n)
+}
+
+var testStore = &testStorage{Storage: storage.NewMemoryStorage()}
+
+// 等后台的预留做完, 然后丢掉池子里所有的id
+func drainGameIDs(tb testing.TB) {
+	tb.Helper()
+	for i := 0; ; i++ {
+		gameIDs.lock.Lock()
+		if !gameIDs.refilling {
+			gameIDs.ranges = nil
+			gameIDs.remaining = 0
+			gameIDs.lock.Unlock()
+			return
+		}
+		gameIDs.lock.Unlock()
+		if i == 500 {
+			tb.Fatal("game id refill did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 换成bolt存储, 对局id也从新的存储里预留, 结束时换回测试用的存储
+func useBoltStore(tb testing.TB) {
+	tb.Helper()
+	bs, err := storage.OpenBoltStorage(filepath.Join(tb.TempDir(), "bench.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	drainGameIDs(tb)
+	Store = bs
+	if err := ReserveGameIDs(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		drainGameIDs(tb)
+		Store = testStore
+		if err := ReserveGameIDs(); err != nil {
+			tb.Error(err)
+		}
+		bs.Close()
+	})
+}
+
+func freeAddr(tb testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// 和main.go一样启动服务端, tlsConfig不为nil时开启TLS, 返回监听的地址
+// heartbeat为true时定时调用OnTimeout; SDK在登录完成之前不发心跳, 测试登录时race模式下的bcrypt可能比心跳超时还慢
+func startTestServer(tb testing.TB, tlsConfig *tls.Config, heartbeat bool) string {
+	addr := freeAddr(tb)
+	handler := &ConnHandler{}
+	var protocol gev.Protocol = &protocoltool.Protocol{MaxFrameSize: 16 * 1024}
+	if tlsConfig != nil {
+		protocol = &protocoltool.TLSProtocol{Inner: protocol, Config: tlsConfig, Handler: handler}
+	}
+	server, err := gev.NewServer(handler,
+		gev.Address(addr),
+		gev.Network("tcp"),
+		gev.LoadBalance(gev.RoundRobin()),
+		gev.NumLoops(4),
+		gev.CustomProtocol(protocol),
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if heartbeat {
+		server.RunEvery(time.Millisecond*settings.HeartbeatInterval, OnTimeout)
+	}
+	go server.Start()
+	tb.Cleanup(server.Stop)
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatal("server did not start")
+	return ""
+}
+
+// 收到的包都放进channel, 按顺序检查
+type testClient struct {
+	*client.Client
+	received chan interface{}
+}
+
+func connectTestClient(tb testing.TB, addr string, config client.Config) *testClient {
+	c := &testClient{received: make(chan interface{}, 1024)}
+	config.Addr = addr
+	config.Handler.OnPacket = func(p interface{}) {
+		c.received <- p
+	}
+	var err error
+	c.Client, err = client.Connect(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+// 等到下一个T类型的包, 中间的其他包丢掉
+func expectPacket[T packets.Packet](tb testing.TB, c *testClient) T {
+	tb.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-c.received:
+			if t, ok := p.(T); ok {
+				return t
+			}
+		case <-timeout:
+			var zero T
+			tb.Fatalf("timed out waiting for %T", zero)
+			return zero
+		}
+	}
+}
+
+// 客户端关闭之后服务端要等OnClose处理完才会注销账号, 等到这个账号不在线为止
+func waitLoggedOut(tb testing.TB, accountID int64) {
+	tb.Helper()
+	for i := 0; i < 500; i++ {
+		LobbyLock.Lock()
+		online := onlineConnOf(accountID) != nil
+		LobbyLock.Unlock()
+		if !online {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("account %d still online", accountID)
+}
@@ -0,0 +1,247 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 正在关闭服务, 在LobbyLock里设置, 对局里的包不拿锁读取
+var shuttingDown atomic.Bool
+
+// 重启之后从快照恢复出来, 等待双方重新登录的对局, key为对局id, 由LobbyLock保护
+var SuspendedGames = make(map[int64]*storage.GameSnapshot)
+
+// 按账号索引的SuspendedGames, 登录时直接找到自己的对局, 由LobbyLock保护
+var suspendedGamesOf = make(map[int64][]*storage.GameSnapshot)
+
+// 恢复快照的时间, 超过settings.SuspendedGameTimeoutMinutes还没有继续的对局作废
+var restoredAt time.Time
+
+// 已经作废过一次, 之后不会再有暂停的对局, 心跳里直接返回, 不再拿LobbyLock
+var suspendedGamesExpired atomic.Bool
+
+// 开始关闭服务: 之后除了心跳不再处理任何包, 通知所有连接, 等所有进行中的对局保存好快照之后返回
+func Shutdown() {
+	var wg sync.WaitGroup
+
+	LobbyLock.Lock()
+	shuttingDown.Store(true)
+
+	shutdownPacket := &packets.PacketServerShutdown{Message: "server is shutting down, log in again after restart to continue your game"}
+	Conns.Range(func(v *ConnContext) bool {
+		sendPacketTo(v, shutdownPacket)
+		return true
+	})
+
+	// 要在锁里投递, 否则对局可能在投递之前结束, 协程已经退出
+	for _, gameContext := range Games {
+		gameContext := gameContext
+		wg.Add(1)
+		gameContext.post(func() {
+			defer wg.Done()
+			suspendGame(gameContext)
+		})
+	}
+	LobbyLock.Unlock()
+
+	wg.Wait()
+	// 关闭之前刚刚结束的对局可能还在保存
+	savingGames.Wait()
+	// 等正在处理的通信棋操作保存完, 之后的操作都会看到shuttingDown
+	correspondenceLock.Lock()
+	correspondenceLock.Unlock()
+}
+
+// 在对局协程里调用, 按现在的棋钟保存快照, 之后对局协程退出
+func suspendGame(gameContext *GameContext) {
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	saveSnapshot(gameContext)
+	gameContext.suspended = true
+}
+
+// 启动服务之前调用, 把上次关闭时保存的快照读出来等待双方重新登录
+// 有一方没有登录的对局没法认出是谁回来了, 直接作废, 游客的对局不能跨重启继续
+func RestoreGames() error {
+	snapshots, err := Store.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.WhiteAccountID == 0 || snapshot.BlackAccountID == 0 || snapshot.WhiteAccountID == snapshot.BlackAccountID {
+			abortSnapshot(snapshot)
+			continue
+		}
+		addSuspendedGame(snapshot)
+	}
+	restoredAt = time.Now()
+	return nil
+}
+
+// 需要持有LobbyLock
+func addSuspendedGame(snapshot *storage.GameSnapshot) {
+	SuspendedGames[snapshot.GameID] = snapshot
+	for _, accountID := range []int64{snapshot.WhiteAccountID, snapshot.BlackAccountID} {
+		suspendedGamesOf[accountID] = append(suspendedGamesOf[accountID], snapshot)
+	}
+}
+
+// 需要持有LobbyLock
+func removeSuspendedGame(snapshot *storage.GameSnapshot) {
+	delete(SuspendedGames, snapshot.GameID)
+	for _, accountID := range []int64{snapshot.WhiteAccountID, snapshot.BlackAccountID} {
+		remaining := make([]*storage.GameSnapshot, 0, len(suspendedGamesOf[accountID]))
+		for _, s := range suspendedGamesOf[accountID] {
+			if s != snapshot {
+				remaining = append(remaining, s)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(suspendedGamesOf, accountID)
+		} else {
+			suspendedGamesOf[accountID] = remaining
+		}
+	}
+}
+
+// 作废一局恢复出来的对局, 保存棋谱但是不影响等级分
+func abortSnapshot(snapshot *storage.GameSnapshot) {
+	metricGamesFinished.With(GameEndReasonAborted).Inc()
+	record := &storage.GameRecord{
+		ID:             snapshot.GameID,
+		WhiteAccountID: snapshot.WhiteAccountID,
+		BlackAccountID: snapshot.BlackAccountID,
+		Moves:          snapshot.Moves,
+		FinalTable:     snapshot.Table,
+		Options:        snapshot.Options,
+		WinnerSide:     chess.SideBoth,
+		Reason:         GameEndReasonAborted,
+		StartedAt:      snapshot.StartedAt,
+		EndedAt:        time.Now(),
+	}
+	if err := Store.SaveGame(record); err != nil {
+		slog.Error("save game failed", "game", snapshot.GameID, "err", err)
+	}
+	if err := Store.DeleteSnapshot(snapshot.GameID); err != nil {
+		slog.Error("delete snapshot failed", "game", snapshot.GameID, "err", err)
+	}
+}
+
+// 登录或者对局结束, 这个连接空闲之后调用, 对手也在线并且没有在下棋的话继续这个账号被挂起的对局
+// 对手正在匹配, 在房间里, 观战或者约战时直接拉回来, 需要持有LobbyLock
+func resumeSuspendedGamesOf(connCtx *ConnContext) {
+	if connCtx.Account == nil || connCtx.ConnState != ConnStateNone {
+		return
+	}
+
+	for _, snapshot := range suspendedGamesOf[connCtx.Account.ID] {
+		white := onlineConnOf(snapshot.WhiteAccountID)
+		black := onlineConnOf(snapshot.BlackAccountID)
+		// 自己正在断开的话已经不在Accounts里了
+		if white == nil || black == nil || (white != connCtx && black != connCtx) {
+			continue
+		}
+		opponent := white
+		if opponent == connCtx {
+			opponent = black
+		}
+		if !takeIntoGame(opponent) {
+			continue
+		}
+		removeSuspendedGame(snapshot)
+		resumeGame(snapshot, white, black, time.Now())
+		return
+	}
+}
+
+// 在心跳里调用, 超过settings.SuspendedGameTimeoutMinutes双方还没有都回来的对局作废
+// 只在取出对局时拿LobbyLock, 保存棋谱和删除快照在锁外面做, 只作废一次
+func expireSuspendedGames() {
+	if time.Since(restoredAt) < settings.SuspendedGameTimeoutMinutes*time.Minute || !suspendedGamesExpired.CompareAndSwap(false, true) {
+		return
+	}
+
+	LobbyLock.Lock()
+	expired := make([]*storage.GameSnapshot, 0, len(SuspendedGames))
+	for _, snapshot := range SuspendedGames {
+		expired = append(expired, snapshot)
+	}
+	SuspendedGames = make(map[int64]*storage.GameSnapshot)
+	suspendedGamesOf = make(map[int64][]*storage.GameSnapshot)
+	LobbyLock.Unlock()
+
+	for _, snapshot := range expired {
+		abortSnapshot(snapshot)
+	}
+}
+
+func resumeGame(snapshot *storage.GameSnapshot, whiteConnContext *ConnContext, blackConnContext *ConnContext, now time.Time) {
+	cancelPendingOffers(whiteConnContext)
+	cancelPendingOffers(blackConnContext)
+
+	state := machine.State(snapshot.State)
+	gameContext := &GameContext{
+		ID:               snapshot.GameID,
+		WhiteConnContext: whiteConnContext,
+		BlackConnContext: blackConnContext,
+		Machine:          machine.Restore(state),
+		Table:            snapshot.Table,
+		Options:          snapshot.Options,
+		Moves:            snapshot.Moves,
+		StartedAt:        snapshot.StartedAt,
+		Spectators:       newSpectatorHub(),
+		mailbox:          newGameMailbox(),
+	}
+	gameContext.MoveCount.Store(int32(len(snapshot.Moves)))
+	gameContext.Log = gameLogger(gameContext)
+	watchSpectatorGaps(gameContext)
+	gameContext.audit = openGameAudit(gameContext)
+	if !snapshot.Options.TimeControl.Unlimited() {
+		gameContext.Clock = &GameClock{
+			WhiteRemaining: time.Duration(snapshot.WhiteRemainingMs) * time.Millisecond,
+			BlackRemaining: time.Duration(snapshot.BlackRemainingMs) * time.Millisecond,
+			Increment:      time.Duration(snapshot.Options.TimeControl.IncrementSeconds) * time.Second,
+			Running:        state.Actor(),
+			TurnStartedAt:  now,
+		}
+	}
+	Games[gameContext.ID] = gameContext
+	gameContext.Log.Info("game resumed", "state", state, "moves", len(snapshot.Moves))
+
+	moves := make([]packets.MoveInfo, 0, len(snapshot.Moves))
+	for _, record := range snapshot.Moves {
+		moves = append(moves, moveInfoOf(record))
+	}
+	resumedPacket := packets.PacketServerGameResumed{
+		GameID:         gameContext.ID,
+		Table:          gameContext.Table,
+		Moves:          moves,
+		Options:        gameContext.Options,
+		WaitingSide:    state.Actor(),
+		WaitingUpgrade: state.WaitingUpgrade(),
+		DrawOffered:    state.DrawOffered(),
+	}
+	if gameContext.Clock != nil {
+		resumedPacket.Clock = clockUpdatePacket(gameContext, now)
+	}
+
+	enterGame(whiteConnContext, gameContext)
+	resumedPacket.Side = chess.SideWhite
+	sendPacketTo(whiteConnContext, &resumedPacket)
+
+	enterGame(blackConnContext, gameContext)
+	resumedPacket.Side = chess.SideBlack
+	sendPacketTo(blackConnContext, &resumedPacket)
+
+	go gameContext.run()
+}
@@ -0,0 +1,188 @@
+package game
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 测试账号名的序号, 同一个进程里多次运行测试时账号名也不重复
+var testAccountSeq atomic.Int64
+
+// 直接在存储里建账号, 返回账号名和id, 密码是loginBenchClient用的secret, 用最低的cost让登录快一点
+func createTestAccount(t *testing.T, prefix string) (string, int64) {
+	name := fmt.Sprintf("%s-%d", prefix, testAccountSeq.Add(1))
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := Store.CreateAccount(name, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name, account.ID
+}
+
+// 上次关闭时保存的快照
+func saveTestSnapshot(t *testing.T, whiteAccountID int64, blackAccountID int64) *storage.GameSnapshot {
+	gameID, err := gameIDs.take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &storage.GameSnapshot{
+		GameID:         gameID,
+		WhiteAccountID: whiteAccountID,
+		BlackAccountID: blackAccountID,
+		Table:          chess.NewChessTable(),
+		Moves:          make([]storage.MoveRecord, 0),
+		State:          int(machine.StateWaitingWhitePut),
+		StartedAt:      time.Now(),
+	}
+	if err := Store.SaveSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func expectAborted(t *testing.T, gameID int64) {
+	t.Helper()
+	record, err := Store.GetGame(gameID)
+	if err != nil {
+		t.Fatalf("game %d: %v", gameID, err)
+	}
+	if record.Reason != GameEndReasonAborted {
+		t.Errorf("game %d ended with %q, want aborted", gameID, record.Reason)
+	}
+}
+
+// 游客的对局启动时作废; 后回来的一方登录时继续对局, 先回来的一方正在匹配的话直接拉回来
+func TestResumeSuspendedGameOnLogin(t *testing.T) {
+	whiteName, whiteID := createTestAccount(t, "resume-white")
+	blackName, blackID := createTestAccount(t, "resume-black")
+	snapshot := saveTestSnapshot(t, whiteID, blackID)
+	guestSnapshot := saveTestSnapshot(t, whiteID, 0)
+	if err := RestoreGames(); err != nil {
+		t.Fatal(err)
+	}
+	expectAborted(t, guestSnapshot.GameID)
+
+	addr := startTestServer(t, nil, false)
+	white, _ := loginBenchClient(t, addr, whiteName)
+	white.send(&packets.PacketClientStartMatch{})
+	expectBenchPacket[*packets.PacketServerMatching](t, white)
+	black, _ := loginBenchClient(t, addr, blackName)
+
+	for side, c := range map[chess.Side]*benchClient{chess.SideWhite: white, chess.SideBlack: black} {
+		resumed := expectBenchPacket[*packets.PacketServerGameResumed](t, c)
+		if resumed.GameID != snapshot.GameID || resumed.Side != side {
+			t.Errorf("got %+v, want game %d as %v", resumed, snapshot.GameID, side)
+		}
+	}
+
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	if SuspendedGames[snapshot.GameID] != nil || len(suspendedGamesOf[whiteID]) != 0 || len(suspendedGamesOf[blackID]) != 0 {
+		t.Error("resumed game is still suspended")
+	}
+	if Games[snapshot.GameID] == nil {
+		t.Error("resumed game is not running")
+	}
+	if onlineConnOf(whiteID).ConnState != ConnStateGaming {
+		t.Errorf("white is %v after resume", onlineConnOf(whiteID).ConnState)
+	}
+}
+
+// 过期之后心跳里作废, 对手再登录也不会继续, 作废过一次之后心跳里不再检查
+func TestExpireSuspendedGames(t *testing.T) {
+	_, whiteID := createTestAccount(t, "expire-white")
+	_, blackID := createTestAccount(t, "expire-black")
+	snapshot := saveTestSnapshot(t, whiteID, blackID)
+
+	LobbyLock.Lock()
+	addSuspendedGame(snapshot)
+	restoredAt = time.Now().Add(-settings.SuspendedGameTimeoutMinutes*time.Minute - time.Second)
+	suspendedGamesExpired.Store(false)
+	LobbyLock.Unlock()
+
+	expireSuspendedGames()
+	expectAborted(t, snapshot.GameID)
+	snapshots, err := Store.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshots {
+		if s.GameID == snapshot.GameID {
+			t.Error("snapshot of the aborted game is still stored")
+		}
+	}
+
+	LobbyLock.Lock()
+	if len(SuspendedGames) != 0 || len(suspendedGamesOf) != 0 {
+		t.Errorf("suspended games left after expiry: %v", SuspendedGames)
+	}
+	// 只是为了看出第二次调用有没有动过, 正常运行时作废之后不会再有暂停的对局
+	addSuspendedGame(snapshot)
+	LobbyLock.Unlock()
+
+	expireSuspendedGames()
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	if SuspendedGames[snapshot.GameID] == nil {
+		t.Error("expired twice")
+	}
+	removeSuspendedGame(snapshot)
+}
+
+// 先回来的一方正在下别的棋, 那局结束之后再继续
+func TestResumeSuspendedGameAfterCurrentGame(t *testing.T) {
+	whiteName, whiteID := createTestAccount(t, "busy-white")
+	blackName, blackID := createTestAccount(t, "busy-black")
+	snapshot := saveTestSnapshot(t, whiteID, blackID)
+	LobbyLock.Lock()
+	addSuspendedGame(snapshot)
+	LobbyLock.Unlock()
+
+	addr := startTestServer(t, nil, false)
+	white, _ := loginBenchClient(t, addr, whiteName)
+	guest, err := dialBenchClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		guest.conn.Close()
+		for range guest.received {
+		}
+	})
+	white.send(&packets.PacketClientStartMatch{})
+	expectBenchPacket[*packets.PacketServerMatching](t, white)
+	guest.send(&packets.PacketClientStartMatch{})
+	for _, c := range []*benchClient{white, guest} {
+		expectBenchPacket[*packets.PacketServerMatchedOK](t, c)
+	}
+
+	black, _ := loginBenchClient(t, addr, blackName)
+	LobbyLock.Lock()
+	stillSuspended := SuspendedGames[snapshot.GameID] != nil
+	LobbyLock.Unlock()
+	if !stillSuspended {
+		t.Fatal("resumed while white is playing another game")
+	}
+
+	guest.send(&packets.PacketClientDoSurrender{})
+	expectBenchPacket[*packets.PacketServerGameOver](t, white)
+	for side, c := range map[chess.Side]*benchClient{chess.SideWhite: white, chess.SideBlack: black} {
+		resumed := expectBenchPacket[*packets.PacketServerGameResumed](t, c)
+		if resumed.GameID != snapshot.GameID || resumed.Side != side {
+			t.Errorf("got %+v, want game %d as %v", resumed, snapshot.GameID, side)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	packtool "chess-backend/tools/packet"
+
+	"github.com/Allenxuxu/gev"
+)
+
+type spectatorEvent struct {
+	seq uint64
+	// 按观战者用到的编码分别序列化, 没有观战者用的编码为nil
+	data [packets.CodecCount][]byte
+}
+
+type spectator struct {
+	conn  *gev.Connection
+	codec packets.Codec
+	// 加入观战时已经发布的最后一条通知, 这之前的通知已经包含在局面里面了
+	joinedAtSeq uint64
+}
+
+// 把一局对局的通知分发给观战者
+// 通知在发布时序列化, 然后交给单独的协程发送, 观战者再多也不会拖慢玩家自己的包
+// 发送跟不上导致缓冲满了的时候不阻塞对局, 丢掉通知之后再给所有观战者重新发一次完整局面
+type SpectatorHub struct {
+	lock       sync.Mutex
+	spectators map[int]*spectator
+	seq        uint64
+	events     chan spectatorEvent
+	running    bool
+	closed     bool
+	// 丢过通知, 还没有重新发送完整局面
+	gapped bool
+	// 第一次丢通知时调用, 不能阻塞, 在对局开始之前设置
+	onGap func()
+}
+
+func newSpectatorHub() *SpectatorHub {
+	return &SpectatorHub{
+		spectators: make(map[int]*spectator),
+		events:     make(chan spectatorEvent, settings.SpectatorEventBufferSize),
+	}
+}
+
+func (h *SpectatorHub) Subscribe(connID int, conn *gev.Connection, codec packets.Codec) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.spectators[connID] = &spectator{conn: conn, codec: codec, joinedAtSeq: h.seq}
+	if !h.running {
+		h.running = true
+		go h.run()
+	}
+}
+
+func (h *SpectatorHub) Unsubscribe(connID int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.spectators, connID)
+}
+
+func (h *SpectatorHub) Count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.spectators)
+}
+
+// 发布一条通知, 没有观战者的时候什么都不做
+func (h *SpectatorHub) Publish(p packets.Packet) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed || len(h.spectators) == 0 {
+		return
+	}
+
+	h.seq++
+	ev := spectatorEvent{seq: h.seq}
+	for _, s := range h.spectators {
+		if ev.data[s.codec] == nil {
+			ev.data[s.codec] = packtool.DoPackWith4BytesHeader(s.codec.MustMarshal(p))
+		}
+	}
+	select {
+	case h.events <- ev:
+	default:
+		// 丢掉的通知没法补发, 只能之后重新发送完整局面
+		if !h.gapped {
+			h.gapped = true
+			slog.Warn("spectator event buffer is full, resync spectators", "seq", ev.seq)
+			if h.onGap != nil {
+				h.onGap()
+			}
+		}
+	}
+}
+
+// 丢过通知的话把build返回的包直接发给所有观战者, 队列里还没有发出去的通知不再发送, 没有丢过通知时什么都不做
+// build返回的包必须已经包含了到目前为止发布过的所有通知
+func (h *SpectatorHub) Resync(build func() packets.Packet) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.gapped {
+		return
+	}
+	h.gapped = false
+	metricSpectatorResyncs.Inc()
+
+	p := build()
+	var data [packets.CodecCount][]byte
+	for _, s := range h.spectators {
+		if data[s.codec] == nil {
+			data[s.codec] = packtool.DoPackWith4BytesHeader(s.codec.MustMarshal(p))
+		}
+		// 拿着锁发送, 分发协程不会在这之后再发出更早的通知
+		s.conn.Send(data[s.codec])
+		s.joinedAtSeq = h.seq
+	}
+}
+
+// 对局结束之后调用, 已经发布的通知发送完之后协程退出
+func (h *SpectatorHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.events)
+}
+
+func (h *SpectatorHub) run() {
+	for ev := range h.events {
+		h.lock.Lock()
+		for _, s := range h.spectators {
+			if ev.seq > s.joinedAtSeq {
+				s.conn.Send(ev.data[s.codec])
+			}
+		}
+		h.lock.Unlock()
+	}
+}
+
+func moveInfoOf(record storage.MoveRecord) packets.MoveInfo {
+	return packets.MoveInfo{
+		Side:    record.Side,
+		FromX:   record.FromX,
+		FromY:   record.FromY,
+		ToX:     record.ToX,
+		ToY:     record.ToY,
+		Upgrade: record.Upgrade,
+	}
+}
+
+func liveGameInfoOf(gameContext *GameContext) packets.LiveGameInfo {
+	info := packets.LiveGameInfo{
+		GameID:     gameContext.ID,
+		Options:    gameContext.Options,
+		MoveCount:  int(gameContext.MoveCount.Load()),
+		Spectators: gameContext.Spectators.Count(),
+	}
+	if gameContext.WhiteConnContext.Account != nil {
+		info.WhiteName = gameContext.WhiteConnContext.Account.Name
+	}
+	if gameContext.BlackConnContext.Account != nil {
+		info.BlackName = gameContext.BlackConnContext.Account.Name
+	}
+	return info
+}
+
+// 通知观战者有人走了一步棋, 需要在recordMove之后调用
+func publishMove(gameContext *GameContext, kingThreat bool, upgradePending bool) {
+	gameContext.Spectators.Publish(&packets.PacketServerSpectateMove{
+		GameID:         gameContext.ID,
+		Move:           moveInfoOf(gameContext.Moves[len(gameContext.Moves)-1]),
+		Table:          gameContext.Table,
+		KingThreat:     kingThreat,
+		UpgradePending: upgradePending,
+	})
+}
+
+func publishUpgrade(gameContext *GameContext, side chess.Side, pieceType chess.ChessPieceType) {
+	gameContext.Spectators.Publish(&packets.PacketServerSpectateUpgrade{
+		GameID:    gameContext.ID,
+		Side:      side,
+		PieceType: pieceType,
+		Table:     gameContext.Table,
+	})
+}
+
+func publishDraw(gameContext *GameContext, side chess.Side, offer bool) {
+	gameContext.Spectators.Publish(&packets.PacketServerSpectateDraw{
+		GameID: gameContext.ID,
+		Side:   side,
+		Offer:  offer,
+	})
+}
+
+// 观战通知丢过之后在对局协程里调用, 重新发送完整局面
+// 对局已经结束时由releaseSpectators直接补发结束的通知
+func resyncSpectators(gameContext *GameContext) {
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+	gameContext.Spectators.Resync(func() packets.Packet {
+		return spectateRespOf(gameContext)
+	})
+}
+
+// 第一次丢观战通知时投递一次重新同步, 在对局协程启动之前调用
+func watchSpectatorGaps(gameContext *GameContext) {
+	gameContext.Spectators.onGap = func() {
+		gameContext.post(func() {
+			resyncSpectators(gameContext)
+		})
+	}
+}
+
+// 对局结束, 通知观战者并让他们回到空闲状态, 需要持有LobbyLock
+// 观战者跟不上的时候前面的通知不再发送, 直接发结束的通知, 里面有最终的局面
+func releaseSpectators(gameContext *GameContext, gameOverPacket *packets.PacketServerGameOver) {
+	gameContext.Spectators.Publish(gameOverPacket)
+	gameContext.Spectators.Resync(func() packets.Packet {
+		return gameOverPacket
+	})
+	gameContext.Spectators.Close()
+
+	Conns.Range(func(v *ConnContext) bool {
+		if v.ConnState == ConnStateSpectating && v.Spectating == gameContext {
+			setConnState(v, ConnStateNone)
+			v.Spectating = nil
+		}
+		return true
+	})
+}
+
+func handleListGames(connCtx *ConnContext) {
+	games := make([]packets.LiveGameInfo, 0, len(Games))
+	for _, gameContext := range Games {
+		games = append(games, liveGameInfoOf(gameContext))
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].GameID < games[j].GameID
+	})
+
+	listPacket := packets.PacketServerGameList{Games: games}
+	sendPacketTo(connCtx, &listPacket)
+}
+
+func handleSpectate(connCtx *ConnContext, packet *packets.PacketClientSpectate) {
+	// 协议判断
+	if connCtx.ConnState != ConnStateNone {
+		rejectPacket(connCtx, packets.PacketTypeClientSpectate, packets.ErrorCodeWrongState, "can only spectate when idle")
+		return
+	}
+
+	gameContext := Games[packet.GameID]
+	if gameContext == nil {
+		failedPacket := packets.PacketServerSpectateResp{OK: false, Message: "game not found"}
+		sendPacketTo(connCtx, &failedPacket)
+		return
+	}
+
+	cancelPendingOffers(connCtx)
+	setConnState(connCtx, ConnStateSpectating)
+	connCtx.Spectating = gameContext
+
+	// 局面只能在对局协程里读, 在那里发送局面并订阅, 之后的通知不会漏也不会重复
+	gameContext.post(func() {
+		sendSpectateResp(gameContext, connCtx)
+	})
+}
+
+func sendSpectateResp(gameContext *GameContext, connCtx *ConnContext) {
+	// 投递之后对局刚好结束了, 这时已经回到了空闲状态
+	if gameContext.Machine.State() == machine.StateOver {
+		failedPacket := packets.PacketServerSpectateResp{OK: false, Message: "game not found"}
+		sendPacketTo(connCtx, &failedPacket)
+		return
+	}
+
+	sendPacketTo(connCtx, spectateRespOf(gameContext))
+	gameContext.Spectators.Subscribe(connCtx.ID, connCtx.Conn, connCtx.Codec())
+}
+
+// 当前的完整局面, 只能在对局协程里调用
+func spectateRespOf(gameContext *GameContext) *packets.PacketServerSpectateResp {
+	info := liveGameInfoOf(gameContext)
+	moves := make([]packets.MoveInfo, 0, len(gameContext.Moves))
+	for _, record := range gameContext.Moves {
+		moves = append(moves, moveInfoOf(record))
+	}
+	respPacket := &packets.PacketServerSpectateResp{
+		OK:             true,
+		GameID:         gameContext.ID,
+		Info:           &info,
+		Table:          gameContext.Table,
+		Moves:          moves,
+		WaitingSide:    gameContext.Machine.State().Actor(),
+		WaitingUpgrade: gameContext.Machine.State().WaitingUpgrade(),
+		DrawOffered:    gameContext.Machine.State().DrawOffered(),
+	}
+	if gameContext.Clock != nil {
+		respPacket.Clock = clockUpdatePacket(gameContext, time.Now())
+	}
+	return respPacket
+}
+
+func handleStopSpectate(connCtx *ConnContext) {
+	// 对局刚刚结束的话已经回到了空闲状态, 直接忽略
+	if connCtx.ConnState == ConnStateNone {
+		return
+	}
+
+	// 协议判断
+	if connCtx.ConnState != ConnStateSpectating {
+		rejectPacket(connCtx, packets.PacketTypeClientStopSpectate, packets.ErrorCodeWrongState, "not spectating")
+		return
+	}
+
+	stopSpectating(connCtx)
+}
+
+func stopSpectating(connCtx *ConnContext) {
+	if gameContext := connCtx.Spectating; gameContext != nil {
+		// 和订阅一样在对局协程里退订, 保证先后顺序
+		gameContext.post(func() {
+			gameContext.Spectators.Unsubscribe(connCtx.ID)
+		})
+		connCtx.Spectating = nil
+	}
+	setConnState(connCtx, ConnStateNone)
+}
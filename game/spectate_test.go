@@ -0,0 +1,79 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+)
+
+// 服务端这一侧的连接, 按客户端的本地地址找
+func serverConnOf(t *testing.T, c *benchClient) *ConnContext {
+	t.Helper()
+	var found *ConnContext
+	Conns.Range(func(v *ConnContext) bool {
+		if v.Conn.PeerAddr() == c.conn.LocalAddr().String() {
+			found = v
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		t.Fatal("connection not registered")
+	}
+	return found
+}
+
+// 缓存满了之后不阻塞发布, 观战者先收到完整局面, 丢掉之前堆着的通知, 然后接着收到之后的通知
+func TestSpectatorResyncAfterGap(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+	c, err := dialBenchClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.conn.Close()
+		for range c.received {
+		}
+	})
+	connCtx := serverConnOf(t, c)
+
+	hub := newSpectatorHub()
+	gaps := 0
+	hub.onGap = func() { gaps++ }
+	// 先不启动分发协程, 发布的通知都堆在缓存里
+	hub.running = true
+	hub.Subscribe(connCtx.ID, connCtx.Conn, connCtx.Codec())
+	for i := 0; i < settings.SpectatorEventBufferSize+10; i++ {
+		hub.Publish(&packets.PacketServerSpectateDraw{GameID: int64(i), Offer: true})
+	}
+	if gaps != 1 {
+		t.Fatalf("onGap called %d times, want 1", gaps)
+	}
+
+	hub.Resync(func() packets.Packet {
+		return &packets.PacketServerSpectateResp{OK: true, GameID: 42}
+	})
+	hub.Resync(func() packets.Packet {
+		t.Error("resync without a gap")
+		return nil
+	})
+
+	go hub.run()
+	for i := 0; len(hub.events) > 0; i++ {
+		if i == 500 {
+			t.Fatal("spectator events not drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hub.Publish(&packets.PacketServerSpectateDraw{GameID: 1000})
+	hub.Close()
+
+	if resp, ok := expectBenchPacket[packets.Packet](t, c).(*packets.PacketServerSpectateResp); !ok || resp.GameID != 42 {
+		t.Fatalf("got %+v, want the resync position", resp)
+	}
+	if draw, ok := expectBenchPacket[packets.Packet](t, c).(*packets.PacketServerSpectateDraw); !ok || draw.GameID != 1000 {
+		t.Fatalf("got %+v, want the event published after the resync", draw)
+	}
+}
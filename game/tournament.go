@@ -0,0 +1,314 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/comm/settings"
+	"chess-backend/tournament"
+	"log/slog"
+	"time"
+)
+
+func sendTournamentResp(connCtx *ConnContext, resp packets.PacketServerTournamentResp) {
+	sendPacketTo(connCtx, &resp)
+}
+
+// 发给所有在线的参赛者, 包括已经退出的
+func broadcastToTournament(t *tournament.Tournament, packet packets.Packet) {
+	sp := newSharedPacket(packet)
+	for _, p := range t.Players {
+		if connCtx := onlineConnOf(p.ID); connCtx != nil {
+			sendSharedTo(connCtx, sp)
+		}
+	}
+}
+
+func tournamentInfoOf(t *tournament.Tournament) packets.TournamentInfo {
+	return packets.TournamentInfo{
+		TournamentID: t.ID,
+		Name:         t.Name,
+		Format:       packets.TournamentFormat(t.Format),
+		State:        packets.TournamentState(t.State),
+		TotalRounds:  t.TotalRounds,
+		CurrentRound: t.CurrentRound(),
+		Players:      len(t.Players),
+		Options:      t.Options,
+	}
+}
+
+func tournamentPairingInfoOf(t *tournament.Tournament, p *tournament.Pairing) packets.TournamentPairingInfo {
+	info := packets.TournamentPairingInfo{
+		White:     p.White,
+		WhiteName: t.Player(p.White).Name,
+		Black:     p.Black,
+		Result:    packets.TournamentResult(p.Result),
+		Forfeit:   p.Forfeit,
+	}
+	if p.Black != 0 {
+		info.BlackName = t.Player(p.Black).Name
+	}
+	return info
+}
+
+func handleCreateTournament(connCtx *ConnContext, packet *packets.PacketClientCreateTournament) {
+	// 协议判断
+	if packet.Format != packets.TournamentFormatSwiss && packet.Format != packets.TournamentFormatRoundRobin &&
+		packet.Format != packets.TournamentFormatArena || !checkGameOptionsValid(packet.Options) {
+		rejectPacket(connCtx, packets.PacketTypeClientCreateTournament, packets.ErrorCodeInvalidArgument, "invalid format or options")
+		return
+	}
+
+	if connCtx.Account == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "login required"})
+		return
+	}
+	if packet.Options.TimeControl.Correspondence() {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "correspondence is not supported"})
+		return
+	}
+	if len(packet.Name) == 0 || len(packet.Name) > settings.MaxTournamentNameLength {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "invalid name"})
+		return
+	}
+	if packet.Format == packets.TournamentFormatArena {
+		createArena(connCtx, packet)
+		return
+	}
+	if packet.Format == packets.TournamentFormatSwiss && (packet.Rounds < 1 || packet.Rounds > settings.MaxSwissRounds) {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "invalid rounds"})
+		return
+	}
+
+	t := tournament.New(
+		AtomicTournamentIDIncrease.Add(1),
+		packet.Name,
+		tournament.Format(packet.Format),
+		packet.Rounds,
+		packet.Options,
+		connCtx.Account.ID,
+	)
+	Tournaments[t.ID] = t
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: t.ID})
+}
+
+func handleJoinTournament(connCtx *ConnContext, packet *packets.PacketClientJoinTournament) {
+	if connCtx.Account == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "login required"})
+		return
+	}
+	if a := Arenas[packet.TournamentID]; a != nil {
+		joinArena(connCtx, a)
+		return
+	}
+	t := Tournaments[packet.TournamentID]
+	if t == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "tournament not found"})
+		return
+	}
+
+	err := t.Register(connCtx.Account.ID, connCtx.Account.Name, connCtx.Rating)
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: t.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: t.ID})
+}
+
+// 比赛中退出不影响正在下的这一局, 从下一轮开始不再编排
+func handleWithdrawTournament(connCtx *ConnContext, packet *packets.PacketClientWithdrawTournament) {
+	if connCtx.Account == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "login required"})
+		return
+	}
+	if a := Arenas[packet.TournamentID]; a != nil {
+		withdrawArena(connCtx, a)
+		return
+	}
+	t := Tournaments[packet.TournamentID]
+	if t == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "tournament not found"})
+		return
+	}
+	if t.State == tournament.StateFinished {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: t.ID, Message: "tournament is finished"})
+		return
+	}
+
+	err := t.Withdraw(connCtx.Account.ID)
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: t.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: t.ID})
+}
+
+// 只有组织者可以开始比赛
+func handleStartTournament(connCtx *ConnContext, packet *packets.PacketClientStartTournament) {
+	if a := Arenas[packet.TournamentID]; a != nil {
+		startArena(connCtx, a)
+		return
+	}
+	t := Tournaments[packet.TournamentID]
+	if t == nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, Message: "tournament not found"})
+		return
+	}
+	if connCtx.Account == nil || connCtx.Account.ID != t.OrganizerID {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: t.ID, Message: "not the organizer"})
+		return
+	}
+
+	pairings, err := t.Start()
+	if err != nil {
+		sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: false, TournamentID: t.ID, Message: err.Error()})
+		return
+	}
+	sendTournamentResp(connCtx, packets.PacketServerTournamentResp{OK: true, TournamentID: t.ID})
+	startTournamentRound(t, pairings)
+}
+
+func handleListTournaments(connCtx *ConnContext) {
+	listPacket := packets.PacketServerTournamentList{Tournaments: make([]packets.TournamentInfo, 0, len(Tournaments)+len(Arenas))}
+	for _, t := range Tournaments {
+		listPacket.Tournaments = append(listPacket.Tournaments, tournamentInfoOf(t))
+	}
+	now := time.Now()
+	for _, a := range Arenas {
+		listPacket.Tournaments = append(listPacket.Tournaments, arenaInfoOf(a, now))
+	}
+	sendPacketTo(connCtx, &listPacket)
+}
+
+// 让选手离开匹配, 房间, 观战或者约战, 正在下棋或者不在线的选手不能开始对局
+// 锦标赛开始一轮和继续重启之前的对局时用
+func takeIntoGame(connCtx *ConnContext) bool {
+	if connCtx == nil {
+		return false
+	}
+
+	switch connCtx.ConnState {
+	case ConnStateNone:
+	case ConnStateMatching:
+		setConnState(connCtx, ConnStateNone)
+	case ConnStateInRoom:
+		closeRoomOf(connCtx)
+	case ConnStateSpectating:
+		stopSpectating(connCtx)
+	case ConnStateSeeking:
+		removeSeekOf(connCtx)
+	default:
+		return false
+	}
+	return true
+}
+
+// 通知新一轮的编排, 然后开始每一局, 不能开始的一方判负
+func startTournamentRound(t *tournament.Tournament, pairings []*tournament.Pairing) {
+	roundPacket := packets.PacketServerTournamentRound{
+		TournamentID: t.ID,
+		Round:        t.CurrentRound(),
+		Pairings:     make([]packets.TournamentPairingInfo, 0, len(pairings)),
+	}
+	for _, p := range pairings {
+		roundPacket.Pairings = append(roundPacket.Pairings, tournamentPairingInfoOf(t, p))
+	}
+	broadcastToTournament(t, &roundPacket)
+
+	for _, p := range pairings {
+		if p.Result != tournament.ResultPending {
+			continue
+		}
+
+		white := onlineConnOf(p.White)
+		black := onlineConnOf(p.Black)
+		whiteReady := takeIntoGame(white)
+		blackReady := takeIntoGame(black)
+
+		var result tournament.Result
+		switch {
+		case whiteReady && blackReady:
+			gameContext, err := startGame(white, black, t.Options)
+			if err == nil {
+				gameContext.Tournament = t
+				gameContext.TournamentPairing = p
+				continue
+			}
+			// 没下成的对局不能一直等着, 算双方弃权
+			result = tournament.ResultDoubleForfeit
+		case whiteReady:
+			result = tournament.ResultWhiteWin
+		case blackReady:
+			result = tournament.ResultBlackWin
+		default:
+			result = tournament.ResultDoubleForfeit
+		}
+		if err := t.Report(p, result, true); err != nil {
+			slog.Error("report forfeit failed", "tournament", t.ID, "err", err)
+		}
+	}
+}
+
+// 对局结束之后把结果交给锦标赛, 作废的对局不算下过, 双方都不得分, 之后还可以再编排在一起
+func reportTournamentGame(gameContext *GameContext, winnerSide chess.Side, reason string) {
+	var result tournament.Result
+	switch {
+	case reason == GameEndReasonAborted:
+		result = tournament.ResultDoubleForfeit
+	case winnerSide == chess.SideWhite:
+		result = tournament.ResultWhiteWin
+	case winnerSide == chess.SideBlack:
+		result = tournament.ResultBlackWin
+	default:
+		result = tournament.ResultDraw
+	}
+
+	t := gameContext.Tournament
+	if err := t.Report(gameContext.TournamentPairing, result, false); err != nil {
+		gameContext.Log.Error("report game failed", "tournament", t.ID, "err", err)
+	}
+}
+
+// round为刚刚结束的一轮
+func broadcastStandings(t *tournament.Tournament, round int) {
+	standingsPacket := packets.PacketServerTournamentStandings{
+		TournamentID: t.ID,
+		Round:        round,
+		Finished:     t.State == tournament.StateFinished,
+		Standings:    make([]packets.TournamentStandingInfo, 0, len(t.Players)),
+	}
+	for _, s := range t.Standings() {
+		standingsPacket.Standings = append(standingsPacket.Standings, packets.TournamentStandingInfo{
+			Rank:            s.Rank,
+			AccountID:       s.Player.ID,
+			Name:            s.Player.Name,
+			Score:           s.Score,
+			Buchholz:        s.Buchholz,
+			SonnebornBerger: s.SonnebornBerger,
+			Withdrawn:       s.Player.Withdrawn,
+		})
+	}
+	broadcastToTournament(t, &standingsPacket)
+}
+
+// 在心跳里检查, 一轮全部结束之后公布排名并编排下一轮
+// 不在finishGame里直接编排, 因为那时候双方还处在游戏状态
+func progressTournaments() {
+	for _, t := range Tournaments {
+		if t.State != tournament.StateRunning || !t.RoundComplete() {
+			continue
+		}
+
+		round := t.CurrentRound()
+		pairings, err := t.NextRound()
+		if err != nil {
+			// 找不到合法的编排, 提前结束
+			slog.Error("pair next round failed", "tournament", t.ID, "err", err)
+			t.Finish()
+		}
+
+		broadcastStandings(t, round)
+		if pairings != nil {
+			startTournamentRound(t, pairings)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package game
+
+import (
+	"testing"
+	"time"
+
+	"chess-backend/comm/chess"
+	"chess-backend/tournament"
+)
+
+// 登录两个新账号, 返回双方的账号id
+func loginTournamentPlayers(t *testing.T, addr string, prefix string) (int64, int64) {
+	firstName, firstID := createTestAccount(t, prefix)
+	secondName, secondID := createTestAccount(t, prefix)
+	loginBenchClient(t, addr, firstName)
+	loginBenchClient(t, addr, secondName)
+	return firstID, secondID
+}
+
+// 账号正在下的对局
+func playingGameOf(t *testing.T, accountID int64) int64 {
+	t.Helper()
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	gameContext := onlineConnOf(accountID).Gcontext.Load()
+	if gameContext == nil {
+		t.Fatalf("account %d is not playing", accountID)
+	}
+	return gameContext.ID
+}
+
+// 管理员作废的锦标赛对局算双方弃权, 不算和棋
+func TestAbortTournamentGame(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+	firstID, secondID := loginTournamentPlayers(t, addr, "abort-swiss")
+
+	LobbyLock.Lock()
+	tt := tournament.New(AtomicTournamentIDIncrease.Add(1), "abort", tournament.FormatSwiss, 2, chess.GameOptions{}, firstID)
+	for _, id := range []int64{firstID, secondID} {
+		if err := tt.Register(id, "", onlineConnOf(id).Rating); err != nil {
+			LobbyLock.Unlock()
+			t.Fatal(err)
+		}
+	}
+	pairings, err := tt.Start()
+	if err != nil {
+		LobbyLock.Unlock()
+		t.Fatal(err)
+	}
+	Tournaments[tt.ID] = tt
+	startTournamentRound(tt, pairings)
+	LobbyLock.Unlock()
+	t.Cleanup(func() {
+		LobbyLock.Lock()
+		delete(Tournaments, tt.ID)
+		LobbyLock.Unlock()
+	})
+
+	if err := AdminEndGame(playingGameOf(t, firstID), chess.SideBoth, true); err != nil {
+		t.Fatal(err)
+	}
+
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	if p := pairings[0]; p.Result != tournament.ResultDoubleForfeit || !p.Forfeit {
+		t.Errorf("got result %v forfeit %v, want a double forfeit", p.Result, p.Forfeit)
+	}
+	for _, s := range tt.Standings() {
+		if s.Score != 0 {
+			t.Errorf("player %d scored %v for an aborted game", s.Player.ID, s.Score)
+		}
+	}
+}
+
+// 管理员作废的竞技场对局双方都不得分, 回到等待编排
+func TestAbortArenaGame(t *testing.T) {
+	addr := startTestServer(t, nil, false)
+	firstID, secondID := loginTournamentPlayers(t, addr, "abort-arena")
+
+	LobbyLock.Lock()
+	now := time.Now()
+	a := tournament.NewArena(AtomicTournamentIDIncrease.Add(1), "abort", chess.GameOptions{}, firstID, time.Hour)
+	for _, id := range []int64{firstID, secondID} {
+		if err := a.Register(id, "", onlineConnOf(id).Rating, now); err != nil {
+			LobbyLock.Unlock()
+			t.Fatal(err)
+		}
+	}
+	if err := a.Start(now); err != nil {
+		LobbyLock.Unlock()
+		t.Fatal(err)
+	}
+	Arenas[a.ID] = a
+	progressArenas()
+	LobbyLock.Unlock()
+	t.Cleanup(func() {
+		LobbyLock.Lock()
+		delete(Arenas, a.ID)
+		LobbyLock.Unlock()
+	})
+
+	if err := AdminEndGame(playingGameOf(t, firstID), chess.SideBoth, true); err != nil {
+		t.Fatal(err)
+	}
+
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	if len(a.Games) != 1 || a.Games[0].Result != tournament.ResultDoubleForfeit {
+		t.Fatalf("got games %+v, want one double forfeit", a.Games)
+	}
+	for _, p := range a.Players {
+		if p.Score != 0 || p.Playing {
+			t.Errorf("got player %+v after an aborted game", p)
+		}
+	}
+}
+
+// 找不到合法的编排时心跳里提前结束比赛
+func TestTournamentFinishesWithoutPairing(t *testing.T) {
+	// 选手都不在线, 只推进比赛
+	tt := tournament.New(AtomicTournamentIDIncrease.Add(1), "no pairing", tournament.FormatSwiss, 4, chess.GameOptions{}, 1)
+	for id := int64(-1); id >= -4; id-- {
+		if err := tt.Register(id, "", 1500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 4个人下完3轮之后所有人都互相下过了
+	pairings, err := tt.Start()
+	for round := 1; round <= 3; round++ {
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		for _, p := range pairings {
+			if err := tt.Report(p, tournament.ResultDraw, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round < 3 {
+			pairings, err = tt.NextRound()
+		}
+	}
+
+	LobbyLock.Lock()
+	defer LobbyLock.Unlock()
+	Tournaments[tt.ID] = tt
+	defer delete(Tournaments, tt.ID)
+	progressTournaments()
+	if tt.State != tournament.StateFinished || tt.CurrentRound() != 3 {
+		t.Errorf("got state %v after round %d, want finished after round 3", tt.State, tt.CurrentRound())
+	}
+}
@@ -0,0 +1,319 @@
+package game
+
+import (
+	"chess-backend/comm/chess"
+	"chess-backend/comm/packets"
+	"chess-backend/game/machine"
+
+	chesstool "chess-backend/tools/chess"
+	packtool "chess-backend/tools/packet"
+
+	"github.com/Allenxuxu/gev"
+)
+
+// 触发事件时由棋盘算出来的信息, 用来填写转移表里要发出的包
+type gameOutcome struct {
+	KingThreat bool
+	// 升变的棋子, 只有升变事件有意义
+	PieceType chess.ChessPieceType
+	// 下面两个只有对局结束的事件有意义
+	WinnerSide chess.Side
+	Reason     string
+	// 走棋和升变对棋盘的改动, 没有人协商增量着法时为nil
+	Delta *packets.MoveDelta
+}
+
+// 这个连接在对局里执哪一方
+func sideOf(gameContext *GameContext, connCtx *ConnContext) chess.Side {
+	if gameContext.BlackConnContext == connCtx {
+		return chess.SideBlack
+	}
+	return chess.SideWhite
+}
+
+// 按连接握手时协商的编码序列化之后发送
+func sendPacketTo(connCtx *ConnContext, p packets.Packet, opts ...gev.ConnectionOption) {
+	sendBytesTo(connCtx, packtool.DoPackWith4BytesHeader(connCtx.Codec().MustMarshal(p)), opts...)
+}
+
+// 发送已经带上长度头的包, bs必须是按连接的编码序列化的, 对局里发出的包都记到审计文件里
+func sendBytesTo(connCtx *ConnContext, bs []byte, opts ...gev.ConnectionOption) {
+	connCtx.audit.Load().record(connCtx, auditOut, bs[4:])
+	connCtx.Conn.Send(bs, opts...)
+}
+
+// 同一个包发给多个连接时用, 每种编码只序列化一次
+// 用到某种编码时才序列化, 所以发完之前不能修改包, 也不能在多个协程里同时使用
+type sharedPacket struct {
+	packet  packets.Packet
+	encoded [packets.CodecCount][]byte
+}
+
+func newSharedPacket(p packets.Packet) *sharedPacket {
+	return &sharedPacket{packet: p}
+}
+
+// 按codec序列化并带上长度头, 第一次用到某种编码时序列化
+func (sp *sharedPacket) bytesFor(codec packets.Codec) []byte {
+	if sp.encoded[codec] == nil {
+		sp.encoded[codec] = packtool.DoPackWith4BytesHeader(codec.MustMarshal(sp.packet))
+	}
+	return sp.encoded[codec]
+}
+
+func sendSharedTo(connCtx *ConnContext, sp *sharedPacket) {
+	sendBytesTo(connCtx, sp.bytesFor(connCtx.Codec()))
+}
+
+// side触发一个事件, 按转移表发出包, 对局结束的话保存对局并让双方回到空闲状态, 在对局协程里调用
+// 当前状态不接受这个事件时什么也不做, 返回false
+func fireGameEvent(gameContext *GameContext, side chess.Side, event machine.Event, outcome gameOutcome) bool {
+	from := gameContext.Machine.State()
+	emits, err := gameContext.Machine.Fire(side, event)
+	if err != nil {
+		return false
+	}
+	gameContext.Log.Debug("game state changed", "side", side, "event", event, "from", from, "to", gameContext.Machine.State())
+
+	selfContext, remoteContext := gameContext.WhiteConnContext, gameContext.BlackConnContext
+	if side == chess.SideBlack {
+		selfContext, remoteContext = remoteContext, selfContext
+	}
+
+	// 对局结束时先拿锁再发GameOver, 双方收到的时候已经回到空闲状态, 马上再来一局或者匹配不会被拒绝
+	over := gameContext.Machine.State() == machine.StateOver
+	if over {
+		LobbyLock.Lock()
+	}
+
+	table := gameContext.Table
+	for _, emit := range emits {
+		switch emit {
+		case machine.EmitMoveOK, machine.EmitMoveNeedUpgrade:
+			respType := packets.PacketTypeServerMoveRespTypeOK
+			if emit == machine.EmitMoveNeedUpgrade {
+				respType = packets.PacketTypeServerMoveRespTypePawnUpgrade
+			}
+			selfTable, selfDelta := tableOrDelta(selfContext, table, outcome.Delta)
+			sendPacketTo(selfContext, &packets.PacketServerMoveResp{
+				MoveRespType: respType,
+				TableOnOK:    selfTable,
+				KingThreat:   outcome.KingThreat,
+				Delta:        selfDelta,
+			})
+		case machine.EmitRemoteMove, machine.EmitRemoteMoveOfferDraw, machine.EmitRemoteMoveNeedUpgrade:
+			remoteTable, remoteDelta := tableOrDelta(remoteContext, table, outcome.Delta)
+			sendPacketTo(remoteContext, &packets.PacketServerNotifyRemoteMove{
+				Table:             remoteTable,
+				RemotePawnUpgrade: emit == machine.EmitRemoteMoveNeedUpgrade,
+				KingThreat:        outcome.KingThreat,
+				RemoteRequestDraw: emit == machine.EmitRemoteMoveOfferDraw,
+				Delta:             remoteDelta,
+			})
+		case machine.EmitUpgradeOK:
+			selfTable, selfDelta := tableOrDelta(selfContext, table, outcome.Delta)
+			sendPacketTo(selfContext, &packets.PacketServerUpgradeOK{Table: selfTable, Delta: selfDelta})
+		case machine.EmitRemoteUpgradeOK, machine.EmitRemoteUpgradeOKOfferDraw:
+			remoteTable, remoteDelta := tableOrDelta(remoteContext, table, outcome.Delta)
+			sendPacketTo(remoteContext, &packets.PacketServerRemoteUpgradeOK{
+				Table:             remoteTable,
+				RemoteRequestDraw: emit == machine.EmitRemoteUpgradeOKOfferDraw,
+				Delta:             remoteDelta,
+			})
+		case machine.EmitGameOver:
+			gameOverPacket := &packets.PacketServerGameOver{
+				Table:       table,
+				WinnerSide:  outcome.WinnerSide,
+				IsSurrender: outcome.Reason == GameEndReasonSurrender,
+				IsDraw:      outcome.Reason == GameEndReasonDrawAgreed,
+				IsTimeout:   outcome.Reason == GameEndReasonTimeout,
+				Reason:      outcome.Reason,
+			}
+			sendPacketTo(selfContext, gameOverPacket)
+			sendPacketTo(remoteContext, gameOverPacket)
+		case machine.EmitRemoteLoseConnection:
+			sendPacketTo(remoteContext, &packets.PacketServerRemoteLoseConnection{})
+		case machine.EmitPublishMove:
+			publishMove(gameContext, outcome.KingThreat, false)
+		case machine.EmitPublishMoveNeedUpgrade:
+			publishMove(gameContext, outcome.KingThreat, true)
+		case machine.EmitPublishUpgrade:
+			publishUpgrade(gameContext, side, outcome.PieceType)
+		case machine.EmitPublishDrawOffer:
+			publishDraw(gameContext, side, true)
+		case machine.EmitPublishDrawRefused:
+			publishDraw(gameContext, side, false)
+		}
+	}
+
+	if !over {
+		onGameStateChanged(gameContext)
+		return true
+	}
+
+	record := finishGame(gameContext, outcome.WinnerSide, outcome.Reason)
+	for _, v := range []*ConnContext{selfContext, remoteContext} {
+		v.Gcontext.Store(nil)
+		v.audit.Store(nil)
+		setConnState(v, ConnStateNone)
+	}
+	// 对局开始之前就有重启之前挂起的对局的话, 现在可以继续了; 锦标赛和竞技场的选手还要参加下一局
+	if gameContext.Tournament == nil && gameContext.Arena == nil {
+		for _, v := range []*ConnContext{selfContext, remoteContext} {
+			resumeSuspendedGamesOf(v)
+		}
+	}
+	LobbyLock.Unlock()
+
+	// 读写存储比较慢, 不占着LobbyLock
+	saveFinishedGame(gameContext, record)
+	return true
+}
+
+// 走棋或者升变之后将死或者逼和
+func boardGameOverOutcome(winnerSide chess.Side) gameOutcome {
+	if winnerSide == chess.SideBoth {
+		return gameOutcome{WinnerSide: winnerSide, Reason: GameEndReasonStalemate}
+	}
+	return gameOutcome{WinnerSide: winnerSide, Reason: GameEndReasonCheckmate}
+}
+
+// 兵只能升变成车, 象, 马, 后
+func checkUpgradePieceValid(pieceType chess.ChessPieceType) bool {
+	return pieceType == chess.ChessPieceTypeRook || pieceType == chess.ChessPieceTypeBishop ||
+		pieceType == chess.ChessPieceTypeKnight || pieceType == chess.ChessPieceTypeQueen
+}
+
+// 下面几个在对局协程里执行, 连接的状态已经在postToGame里检查过了
+func handleMove(gameContext *GameContext, connCtx *ConnContext, packet *packets.PacketClientMove) {
+	// 对局已经结束, 对手在结束之前发出的包直接忽略
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	selfSide := sideOf(gameContext, connCtx)
+
+	// 协议判断, 要求发送方确实是下棋的一方
+	if !gameContext.Machine.Can(selfSide, machine.EventMove) {
+		rejectPacket(connCtx, packets.PacketTypeClientMove, packets.ErrorCodeNotYourTurn, "not your turn to move")
+		return
+	}
+
+	// 协议判断, 输入格式判断, 要求输入格式确实正确
+	// 注意x,y两两相等的情况也是不合法的, 这点应该在客户端得到保障
+	if !chesstool.CheckChessPostsionVaild(packet.FromX, packet.FromY) ||
+		!chesstool.CheckChessPostsionVaild(packet.ToX, packet.ToY) ||
+		(packet.FromX == packet.ToX && packet.FromY == packet.ToY) {
+		rejectPacket(connCtx, packets.PacketTypeClientMove, packets.ErrorCodeInvalidArgument, "invalid coordinates")
+		return
+	}
+
+	// 增量着法要和走棋之前的局面比较
+	var before *chess.ChessTable
+	if wantsDelta(gameContext) {
+		before = gameContext.Table.Copy()
+	}
+
+	result := chesstool.DoMove(gameContext.Table, selfSide, packet.FromX, packet.FromY, packet.ToX, packet.ToY)
+	// result.OK 移动是否有效, 无效的移动不改变状态
+	if !result.OK {
+		metricIllegalMoves.Inc()
+		sendPacketTo(connCtx, &packets.PacketServerMoveResp{
+			MoveRespType: packets.PacketTypeServerMoveRespTypeFailed,
+			TableOnOK:    nil,
+		})
+		return
+	}
+	recordMove(gameContext, selfSide, packet.FromX, packet.FromY, packet.ToX, packet.ToY)
+
+	event := machine.EventMove
+	outcome := gameOutcome{KingThreat: result.KingThreat}
+	switch {
+	case result.GameOver:
+		event = machine.EventMoveGameOver
+		outcome = boardGameOverOutcome(result.GameWinner)
+		outcome.KingThreat = result.KingThreat
+	case result.PawnUpgrade && packet.DoDraw:
+		// 等升变完了再处理议和问题
+		event = machine.EventMoveNeedUpgradeOfferDraw
+	case result.PawnUpgrade:
+		event = machine.EventMoveNeedUpgrade
+	case packet.DoDraw:
+		event = machine.EventMoveOfferDraw
+	}
+	if before != nil {
+		outcome.Delta = moveDeltaOf(before, gameContext.Table, packet.FromX, packet.FromY, packet.ToX, packet.ToY)
+	}
+	fireGameEvent(gameContext, selfSide, event, outcome)
+}
+
+func handlePawnUpgrade(gameContext *GameContext, connCtx *ConnContext, packet *packets.PacketClientSendPawnUpgrade) {
+	// 对局已经结束, 对手在结束之前发出的包直接忽略
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	selfSide := sideOf(gameContext, connCtx)
+
+	// 协议判断, 检查是否在等待自己升变, 以及升变的棋子是否合法, 只允许以下4种棋子
+	if !gameContext.Machine.Can(selfSide, machine.EventUpgrade) {
+		rejectPacket(connCtx, packets.PacketTypeClientSendPawnUpgrade, packets.ErrorCodeNotYourTurn, "no pawn upgrade is pending")
+		return
+	}
+	if !checkUpgradePieceValid(packet.ChessPieceType) {
+		rejectPacket(connCtx, packets.PacketTypeClientSendPawnUpgrade, packets.ErrorCodeInvalidArgument, "invalid upgrade piece type")
+		return
+	}
+
+	result := chesstool.DoUpgrade(gameContext.Table, selfSide, otherSide(selfSide), packet.ChessPieceType)
+	recordUpgrade(gameContext, packet.ChessPieceType)
+
+	event := machine.EventUpgrade
+	outcome := gameOutcome{}
+	if result.GameOver {
+		event = machine.EventUpgradeGameOver
+		outcome = boardGameOverOutcome(result.WinnerSide)
+	}
+	outcome.PieceType = packet.ChessPieceType
+	if wantsDelta(gameContext) {
+		outcome.Delta = upgradeDeltaOf(gameContext, packet.ChessPieceType)
+	}
+	fireGameEvent(gameContext, selfSide, event, outcome)
+}
+
+func handleSurrender(gameContext *GameContext, connCtx *ConnContext) {
+	// 对局已经结束, 对手在结束之前发出的包直接忽略
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	selfSide := sideOf(gameContext, connCtx)
+	fireGameEvent(gameContext, selfSide, machine.EventSurrender, gameOutcome{
+		WinnerSide: otherSide(selfSide),
+		Reason:     GameEndReasonSurrender,
+	})
+}
+
+func handleAnswerDraw(gameContext *GameContext, connCtx *ConnContext, packet *packets.PacketClientWheatherAcceptDraw) {
+	// 对局已经结束, 对手在结束之前发出的包直接忽略
+	if gameContext.Machine.State() == machine.StateOver {
+		return
+	}
+
+	selfSide := sideOf(gameContext, connCtx)
+
+	// 协议判断, 要求对手确实提出了和棋
+	if !gameContext.Machine.Can(selfSide, machine.EventAcceptDraw) {
+		rejectPacket(connCtx, packets.PacketTypeClientWheatherAcceptDraw, packets.ErrorCodeNotYourTurn, "no draw offer to answer")
+		return
+	}
+
+	if packet.AcceptDraw {
+		fireGameEvent(gameContext, selfSide, machine.EventAcceptDraw, gameOutcome{
+			WinnerSide: chess.SideBoth,
+			Reason:     GameEndReasonDrawAgreed,
+		})
+	} else {
+		fireGameEvent(gameContext, selfSide, machine.EventRefuseDraw, gameOutcome{})
+	}
+}
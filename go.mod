@@ -1,14 +1,18 @@
 module chess-backend
 
-go 1.20
+go 1.21
 
-require github.com/Allenxuxu/gev v0.5.0
+require (
+	github.com/Allenxuxu/gev v0.5.0
+	github.com/Allenxuxu/ringbuffer v0.0.11
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.14.0
+)
 
 require (
-	github.com/Allenxuxu/ringbuffer v0.0.11 // indirect
 	github.com/Allenxuxu/toolkit v0.0.1 // indirect
 	github.com/RussellLuo/timingwheel v0.0.0-20220218152713-54845bda3108 // indirect
+	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee // indirect
 	github.com/libp2p/go-reuseport v0.3.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
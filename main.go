@@ -1,30 +1,192 @@
 package main
 
 import (
+	"chess-backend/admin"
 	"chess-backend/comm/settings"
 	"chess-backend/game"
+	"chess-backend/game/machine"
+	"chess-backend/storage"
+	"chess-backend/tools/chatfilter"
 	"chess-backend/tools/protocol"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/Allenxuxu/gev"
 )
 
 func main() {
-	server, err := gev.NewServer(&game.ConnHandler{},
+	dumpStateMachine := flag.Bool("dump-state-machine", false, "以Graphviz的dot格式输出对局状态机, 然后退出")
+	flag.Parse()
+	if *dumpStateMachine {
+		if err := machine.WriteDot(os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// 结构化日志, 输出到标准错误
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv(settings.LogLevelEnv))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	store, err := storage.OpenBoltStorage(settings.StoragePath)
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	game.Store = store
+
+	// 上次关闭时保存的对局, 等双方重新登录之后继续
+	if err := game.RestoreGames(); err != nil {
+		panic(err)
+	}
+	// 开始对局时拿着LobbyLock, 对局id从预留好的一段里取
+	if err := game.ReserveGameIDs(); err != nil {
+		panic(err)
+	}
+
+	// 通信棋的期限放在内存里, 之后检查超时不用再扫描存储
+	if err := game.LoadCorrespondenceDeadlines(); err != nil {
+		panic(err)
+	}
+
+	// 有屏蔽词表的话追加屏蔽词过滤
+	words, err := chatfilter.LoadWordlist(settings.ChatWordlistPath)
+	if err == nil {
+		game.ChatFilter = chatfilter.Chain{game.ChatFilter, chatfilter.NewWordlistFilter(words, false)}
+	} else if !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	// 两个端口共用同一个ConnHandler, 开启了TLS时在各自的协议外面套一层TLS
+	handler := &game.ConnHandler{}
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	withTLS := func(inner gev.Protocol) gev.Protocol {
+		if tlsConfig == nil {
+			return inner
+		}
+		return &protocol.TLSProtocol{Inner: inner, Config: tlsConfig, Handler: handler}
+	}
+
+	server, err := gev.NewServer(handler,
 		gev.Address(fmt.Sprintf("%s:%d", settings.ServerListenIP, settings.ServerListenPort)),
 		gev.Network("tcp"),
 		gev.LoadBalance(gev.RoundRobin()),
 		gev.NumLoops(runtime.NumCPU()),
-		gev.CustomProtocol(&protocol.Protocol{}),
+		gev.CustomProtocol(withTLS(&protocol.Protocol{
+			MaxFrameSize: settings.MaxFrameSize,
+			OnUnPacket:   game.ObservePacketReceived,
+			OnPacket:     game.ObservePacketSent,
+		})),
 	)
 	if err != nil {
 		panic(err)
 	}
 
-	// 这个是全局的心跳检测器
+	// WebSocket的连接也交给同一个ConnHandler, 两种连接共用连接表和匹配队列
+	var wsServer *gev.Server
+	if settings.WebSocketListenPort != 0 {
+		wsServer, err = gev.NewServer(handler,
+			gev.Address(fmt.Sprintf("%s:%d", settings.ServerListenIP, settings.WebSocketListenPort)),
+			gev.Network("tcp"),
+			gev.LoadBalance(gev.RoundRobin()),
+			gev.NumLoops(runtime.NumCPU()),
+			gev.CustomProtocol(withTLS(&protocol.WebSocketProtocol{
+				MaxFrameSize: settings.MaxFrameSize,
+				OnUnPacket:   game.ObservePacketReceived,
+				OnPacket:     game.ObservePacketSent,
+			})),
+		)
+		if err != nil {
+			panic(err)
+		}
+		go wsServer.Start()
+		slog.Info("websocket server started", "address", fmt.Sprintf("%s:%d", settings.ServerListenIP, settings.WebSocketListenPort))
+	}
+
+	// 设置了令牌才开启管理接口
+	if token := os.Getenv(settings.AdminTokenEnv); token != "" {
+		go func() {
+			if err := http.ListenAndServe(settings.AdminListenAddress, admin.NewHandler(token)); err != nil {
+				slog.Error("admin server stopped", "err", err)
+			}
+		}()
+	}
+
+	if settings.MetricsListenAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", game.Metrics)
+			if err := http.ListenAndServe(settings.MetricsListenAddress, mux); err != nil {
+				slog.Error("metrics server stopped", "err", err)
+			}
+		}()
+	}
+
+	// 这个是全局的心跳检测器, 遍历所有连接, 包括WebSocket的连接
 	server.RunEvery(time.Millisecond*settings.HeartbeatInterval, game.OnTimeout)
 
+	// 收到退出信号之后保存所有进行中的对局, 通知客户端, 然后关闭服务
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig)
+		game.Shutdown()
+		time.Sleep(time.Millisecond * settings.ShutdownFlushMilliseconds)
+		if wsServer != nil {
+			wsServer.Stop()
+		}
+		server.Stop()
+	}()
+
+	slog.Info("server started", "address", fmt.Sprintf("%s:%d", settings.ServerListenIP, settings.ServerListenPort), "tls", tlsConfig != nil)
 	server.Start()
 }
+
+// 没有配置证书时返回nil, 不开启TLS
+func loadTLSConfig() (*tls.Config, error) {
+	if settings.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := protocol.NewCertificateReloader(settings.TLSCertFile, settings.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader.OnReloadError = func(err error) {
+		slog.Error("reload tls certificate failed", "err", err)
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	// 客户端证书是可选的, 发送了的话必须能通过校验
+	if settings.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(settings.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", settings.TLSClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
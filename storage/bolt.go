@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 基于bbolt的实现, 所有数据都在一个文件里面
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// 打开数据库文件, 不存在则创建, 打开之后会自动执行migration
+func OpenBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func encodeID(id int64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(id))
+	return bs
+}
+
+func decodeID(bs []byte) int64 {
+	return int64(binary.BigEndian.Uint64(bs))
+}
+
+// 索引key为 账号id+对局id, 方便按账号前缀遍历
+func indexGame(index *bolt.Bucket, g *GameRecord) error {
+	for _, accountID := range []int64{g.WhiteAccountID, g.BlackAccountID} {
+		if accountID == 0 {
+			continue
+		}
+		key := append(encodeID(accountID), encodeID(g.ID)...)
+		if err := index.Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, bs)
+}
+
+func (bs *BoltStorage) CreateAccount(name string, passwordHash []byte) (*Account, error) {
+	var account *Account
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(bucketAccountNames)
+		if names.Get([]byte(name)) != nil {
+			return ErrAccountExists
+		}
+
+		accounts := tx.Bucket(bucketAccounts)
+		id, err := accounts.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		account = &Account{ID: int64(id), Name: name, PasswordHash: passwordHash, CreatedAt: time.Now()}
+		if err := putJSON(accounts, encodeID(account.ID), account); err != nil {
+			return err
+		}
+		return names.Put([]byte(name), encodeID(account.ID))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (bs *BoltStorage) GetAccount(id int64) (*Account, error) {
+	account := Account{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAccounts).Get(encodeID(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &account)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (bs *BoltStorage) GetAccountByName(name string) (*Account, error) {
+	account := Account{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketAccountNames).Get([]byte(name))
+		if id == nil {
+			return ErrNotFound
+		}
+		v := tx.Bucket(bucketAccounts).Get(id)
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &account)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (bs *BoltStorage) ReserveGameIDs(n int) (int64, error) {
+	var last int64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if v := meta.Get(keyGameSequence); v != nil {
+			last = decodeID(v)
+		}
+		return meta.Put(keyGameSequence, encodeID(last+int64(n)))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return last + 1, nil
+}
+
+func (bs *BoltStorage) SaveGame(g *GameRecord) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(bucketGames), encodeID(g.ID), g); err != nil {
+			return err
+		}
+		return indexGame(tx.Bucket(bucketAccountGames), g)
+	})
+}
+
+func (bs *BoltStorage) GetGame(id int64) (*GameRecord, error) {
+	g := GameRecord{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketGames).Get(encodeID(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &g)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (bs *BoltStorage) ListGamesByAccount(accountID int64, limit int) ([]*GameRecord, error) {
+	result := make([]*GameRecord, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		games := tx.Bucket(bucketGames)
+		prefix := encodeID(accountID)
+		c := tx.Bucket(bucketAccountGames).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			v := games.Get(k[8:])
+			if v == nil {
+				continue
+			}
+			g := GameRecord{}
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			result = append(result, &g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EndedAt.After(result[j].EndedAt)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (bs *BoltStorage) GetRating(accountID int64) (*Rating, error) {
+	r := Rating{AccountID: accountID, Rating: DefaultRating}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRatings).Get(encodeID(accountID))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (bs *BoltStorage) SaveRating(r *Rating) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketRatings), encodeID(r.AccountID), r)
+	})
+}
+
+// 快照由各个对局协程同时保存, 用Batch把同一时间的写合并成一个事务
+func (bs *BoltStorage) SaveSnapshot(s *GameSnapshot) error {
+	return bs.db.Batch(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketSnapshots), encodeID(s.GameID), s)
+	})
+}
+
+func (bs *BoltStorage) DeleteSnapshot(gameID int64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshots).Delete(encodeID(gameID))
+	})
+}
+
+func (bs *BoltStorage) ListSnapshots() ([]*GameSnapshot, error) {
+	result := make([]*GameSnapshot, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshots).ForEach(func(k, v []byte) error {
+			s := GameSnapshot{}
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			result = append(result, &s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (bs *BoltStorage) SaveCorrespondenceGame(g *CorrespondenceGame) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketCorrespondence), encodeID(g.ID), g)
+	})
+}
+
+func (bs *BoltStorage) GetCorrespondenceGame(id int64) (*CorrespondenceGame, error) {
+	g := CorrespondenceGame{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketCorrespondence).Get(encodeID(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, &g)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (bs *BoltStorage) DeleteCorrespondenceGame(id int64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCorrespondence).Delete(encodeID(id))
+	})
+}
+
+// 进行中的通信棋不会很多, 直接遍历
+func (bs *BoltStorage) ListCorrespondenceGames(accountID int64) ([]*CorrespondenceGame, error) {
+	result := make([]*CorrespondenceGame, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCorrespondence).ForEach(func(k, v []byte) error {
+			g := CorrespondenceGame{}
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			if accountID == 0 || g.WhiteAccountID == accountID || g.BlackAccountID == accountID {
+				result = append(result, &g)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 内存实现, 进程退出数据就没了, 用来做测试
+type MemoryStorage struct {
+	lock sync.Mutex
+
+	accounts       map[int64]*Account
+	accountsByKey  map[string]int64
+	games          map[int64]*GameRecord
+	ratings        map[int64]*Rating
+	snapshots      map[int64]*GameSnapshot
+	correspondence map[int64]*CorrespondenceGame
+
+	lastAccountID int64
+	lastGameID    int64
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		accounts:       make(map[int64]*Account),
+		accountsByKey:  make(map[string]int64),
+		games:          make(map[int64]*GameRecord),
+		ratings:        make(map[int64]*Rating),
+		snapshots:      make(map[int64]*GameSnapshot),
+		correspondence: make(map[int64]*CorrespondenceGame),
+	}
+}
+
+func (ms *MemoryStorage) CreateAccount(name string, passwordHash []byte) (*Account, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.accountsByKey[name]; ok {
+		return nil, ErrAccountExists
+	}
+
+	ms.lastAccountID++
+	account := &Account{ID: ms.lastAccountID, Name: name, PasswordHash: passwordHash, CreatedAt: time.Now()}
+	ms.accounts[account.ID] = account
+	ms.accountsByKey[name] = account.ID
+
+	copied := *account
+	return &copied, nil
+}
+
+func (ms *MemoryStorage) GetAccount(id int64) (*Account, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	account, ok := ms.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copied := *account
+	return &copied, nil
+}
+
+func (ms *MemoryStorage) GetAccountByName(name string) (*Account, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	id, ok := ms.accountsByKey[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copied := *ms.accounts[id]
+	return &copied, nil
+}
+
+func (ms *MemoryStorage) ReserveGameIDs(n int) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	first := ms.lastGameID + 1
+	ms.lastGameID += int64(n)
+	return first, nil
+}
+
+func (ms *MemoryStorage) SaveGame(g *GameRecord) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	copied := *g
+	copied.Moves = append([]MoveRecord(nil), g.Moves...)
+	if g.FinalTable != nil {
+		copied.FinalTable = g.FinalTable.Copy()
+	}
+	ms.games[g.ID] = &copied
+	return nil
+}
+
+func (ms *MemoryStorage) GetGame(id int64) (*GameRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	g, ok := ms.games[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copied := *g
+	copied.Moves = append([]MoveRecord(nil), g.Moves...)
+	return &copied, nil
+}
+
+func (ms *MemoryStorage) ListGamesByAccount(accountID int64, limit int) ([]*GameRecord, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	result := make([]*GameRecord, 0)
+	for _, g := range ms.games {
+		if g.WhiteAccountID == accountID || g.BlackAccountID == accountID {
+			copied := *g
+			result = append(result, &copied)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EndedAt.After(result[j].EndedAt)
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (ms *MemoryStorage) GetRating(accountID int64) (*Rating, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	r, ok := ms.ratings[accountID]
+	if !ok {
+		return &Rating{AccountID: accountID, Rating: DefaultRating}, nil
+	}
+
+	copied := *r
+	return &copied, nil
+}
+
+func (ms *MemoryStorage) SaveRating(r *Rating) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	copied := *r
+	ms.ratings[r.AccountID] = &copied
+	return nil
+}
+
+func (ms *MemoryStorage) SaveSnapshot(s *GameSnapshot) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	copied := *s
+	copied.Moves = append([]MoveRecord(nil), s.Moves...)
+	if s.Table != nil {
+		copied.Table = s.Table.Copy()
+	}
+	ms.snapshots[s.GameID] = &copied
+	return nil
+}
+
+func (ms *MemoryStorage) DeleteSnapshot(gameID int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.snapshots, gameID)
+	return nil
+}
+
+func (ms *MemoryStorage) ListSnapshots() ([]*GameSnapshot, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	result := make([]*GameSnapshot, 0, len(ms.snapshots))
+	for _, s := range ms.snapshots {
+		copied := *s
+		result = append(result, &copied)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GameID < result[j].GameID
+	})
+	return result, nil
+}
+
+func copyCorrespondenceGame(g *CorrespondenceGame) *CorrespondenceGame {
+	copied := *g
+	copied.Moves = append([]MoveRecord(nil), g.Moves...)
+	if g.Table != nil {
+		copied.Table = g.Table.Copy()
+	}
+	return &copied
+}
+
+func (ms *MemoryStorage) SaveCorrespondenceGame(g *CorrespondenceGame) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.correspondence[g.ID] = copyCorrespondenceGame(g)
+	return nil
+}
+
+func (ms *MemoryStorage) GetCorrespondenceGame(id int64) (*CorrespondenceGame, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	g, ok := ms.correspondence[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyCorrespondenceGame(g), nil
+}
+
+func (ms *MemoryStorage) DeleteCorrespondenceGame(id int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.correspondence, id)
+	return nil
+}
+
+func (ms *MemoryStorage) ListCorrespondenceGames(accountID int64) ([]*CorrespondenceGame, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	result := make([]*CorrespondenceGame, 0)
+	for _, g := range ms.correspondence {
+		if accountID == 0 || g.WhiteAccountID == accountID || g.BlackAccountID == accountID {
+			result = append(result, copyCorrespondenceGame(g))
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"chess-backend/comm/chess"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketMeta           = []byte("meta")
+	bucketAccounts       = []byte("accounts")
+	bucketAccountNames   = []byte("account_names")
+	bucketGames          = []byte("games")
+	bucketAccountGames   = []byte("account_games")
+	bucketRatings        = []byte("ratings")
+	bucketSnapshots      = []byte("snapshots")
+	bucketCorrespondence = []byte("correspondence")
+
+	keySchemaVersion = []byte("schema_version")
+	keyGameSequence  = []byte("game_sequence")
+)
+
+// 写这些migration时状态机的状态取值, 冻结在这里, 状态机以后调整了编号也不影响已经发布的migration
+const (
+	migrationStateWaitingWhitePut             = 0
+	migrationStateWaitingBlackPut             = 1
+	migrationStateWaitingBlackUpgrade         = 2
+	migrationStateWaitingWhiteUpgrade         = 3
+	migrationStateWaitingBlackAcceptDraw      = 4
+	migrationStateWaitingWhiteAcceptDraw      = 5
+	migrationStateWaitingWhiteUpgradeThenDraw = 6
+	migrationStateWaitingBlackUpgradeThenDraw = 7
+	migrationStateOver                        = 8
+)
+
+// 一次schema变更, version从1开始连续递增
+// 已经发布过的migration不能修改, 只能在末尾追加
+type migration struct {
+	version int
+	name    string
+	up      func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create base buckets",
+		up: func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{bucketAccounts, bucketAccountNames, bucketGames, bucketRatings, bucketSnapshots} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 2,
+		name:    "index games by account",
+		up: func(tx *bolt.Tx) error {
+			index, err := tx.CreateBucketIfNotExists(bucketAccountGames)
+			if err != nil {
+				return err
+			}
+
+			// 给已经存在的对局补上索引
+			return tx.Bucket(bucketGames).ForEach(func(k, v []byte) error {
+				g := GameRecord{}
+				if err := json.Unmarshal(v, &g); err != nil {
+					return err
+				}
+				return indexGame(index, &g)
+			})
+		},
+	},
+	{
+		version: 3,
+		name:    "create correspondence bucket",
+		up: func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(bucketCorrespondence)
+			return err
+		},
+	},
+	{
+		version: 4,
+		name:    "fold draw_after_upgrade into snapshot state",
+		up: func(tx *bolt.Tx) error {
+			// 旧版本的快照用draw_after_upgrade单独记录升变之后是否提出和棋, 改成状态机里的UpgradeThenDraw状态
+			// ForEach里面不能修改bucket, 先全部读出来
+			snapshots := tx.Bucket(bucketSnapshots)
+			legacy := make([]*GameSnapshot, 0)
+			err := snapshots.ForEach(func(k, v []byte) error {
+				s := struct {
+					GameSnapshot
+					DrawAfterUpgrade bool `json:"draw_after_upgrade"`
+				}{}
+				if err := json.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				if s.DrawAfterUpgrade {
+					switch s.State {
+					case migrationStateWaitingWhiteUpgrade:
+						s.State = migrationStateWaitingWhiteUpgradeThenDraw
+					case migrationStateWaitingBlackUpgrade:
+						s.State = migrationStateWaitingBlackUpgradeThenDraw
+					}
+				}
+				legacy = append(legacy, &s.GameSnapshot)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, s := range legacy {
+				if err := putJSON(snapshots, encodeID(s.GameID), s); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 5,
+		name:    "replace correspondence turn flags with machine state",
+		up: func(tx *bolt.Tx) error {
+			games := tx.Bucket(bucketCorrespondence)
+			converted := make([]*CorrespondenceGame, 0)
+			err := games.ForEach(func(k, v []byte) error {
+				g := struct {
+					CorrespondenceGame
+					ToMove           chess.Side `json:"to_move"`
+					PendingUpgrade   bool       `json:"pending_upgrade"`
+					DrawAfterUpgrade bool       `json:"draw_after_upgrade"`
+					DrawOffered      bool       `json:"draw_offered"`
+				}{}
+				if err := json.Unmarshal(v, &g); err != nil {
+					return err
+				}
+				white := g.ToMove == chess.SideWhite
+				var state int
+				switch {
+				case g.PendingUpgrade && g.DrawAfterUpgrade:
+					state = pickState(white, migrationStateWaitingWhiteUpgradeThenDraw, migrationStateWaitingBlackUpgradeThenDraw)
+				case g.PendingUpgrade:
+					state = pickState(white, migrationStateWaitingWhiteUpgrade, migrationStateWaitingBlackUpgrade)
+				case g.DrawOffered:
+					state = pickState(white, migrationStateWaitingWhiteAcceptDraw, migrationStateWaitingBlackAcceptDraw)
+				default:
+					state = pickState(white, migrationStateWaitingWhitePut, migrationStateWaitingBlackPut)
+				}
+				g.State = state
+				converted = append(converted, &g.CorrespondenceGame)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, g := range converted {
+				if err := putJSON(games, encodeID(g.ID), g); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// 按轮到的一方选择状态
+func pickState(white bool, whiteState, blackState int) int {
+	if white {
+		return whiteState
+	}
+	return blackState
+}
+
+// 把数据库升级到最新的schema, 每个migration在自己的事务里面执行
+func migrate(db *bolt.DB) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketMeta)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		err := db.Update(func(tx *bolt.Tx) error {
+			meta := tx.Bucket(bucketMeta)
+			current := 0
+			if v := meta.Get(keySchemaVersion); v != nil {
+				current = int(decodeID(v))
+			}
+
+			if m.version <= current {
+				return nil
+			}
+			if m.version != current+1 {
+				return fmt.Errorf("storage: migration %d (%s) skips version %d", m.version, m.name, current+1)
+			}
+
+			if err := m.up(tx); err != nil {
+				return fmt.Errorf("storage: migration %d (%s): %w", m.version, m.name, err)
+			}
+			return meta.Put(keySchemaVersion, encodeID(int64(m.version)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"chess-backend/comm/chess"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 建一个停在version 3的数据库, 写入旧格式的快照, 重新打开之后应该升级到最新版本
+func TestMigrateDrawAfterUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chess.db")
+	bs, err := OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := []struct {
+		gameID           int64
+		state            int
+		drawAfterUpgrade bool
+		want             int
+	}{
+		{1, migrationStateWaitingWhiteUpgrade, true, migrationStateWaitingWhiteUpgradeThenDraw},
+		{2, migrationStateWaitingBlackUpgrade, true, migrationStateWaitingBlackUpgradeThenDraw},
+		{3, migrationStateWaitingWhiteUpgrade, false, migrationStateWaitingWhiteUpgrade},
+		{4, migrationStateWaitingBlackPut, false, migrationStateWaitingBlackPut},
+		// 不是等待升变的状态, 旧字段没有意义
+		{5, migrationStateWaitingWhitePut, true, migrationStateWaitingWhitePut},
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		for _, l := range legacy {
+			v, err := json.Marshal(map[string]interface{}{
+				"game_id":            l.gameID,
+				"white_account_id":   l.gameID * 10,
+				"state":              l.state,
+				"draw_after_upgrade": l.drawAfterUpgrade,
+				"moves":              []MoveRecord{{FromX: 'e', FromY: 2, ToX: 'e', ToY: 4}},
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketSnapshots).Put(encodeID(l.gameID), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, encodeID(3))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+
+	bs, err = OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	bs.db.View(func(tx *bolt.Tx) error {
+		if version := decodeID(tx.Bucket(bucketMeta).Get(keySchemaVersion)); version != int64(len(migrations)) {
+			t.Errorf("schema version %d, want %d", version, len(migrations))
+		}
+		// 旧字段已经去掉了
+		return tx.Bucket(bucketSnapshots).ForEach(func(k, v []byte) error {
+			fields := map[string]json.RawMessage{}
+			if err := json.Unmarshal(v, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fields["draw_after_upgrade"]; ok {
+				t.Errorf("snapshot %d still has draw_after_upgrade", decodeID(k))
+			}
+			return nil
+		})
+	})
+
+	snapshots, err := bs.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != len(legacy) {
+		t.Fatalf("%d snapshots after migration, want %d", len(snapshots), len(legacy))
+	}
+	for i, s := range snapshots {
+		l := legacy[i]
+		if s.GameID != l.gameID || s.State != l.want {
+			t.Errorf("snapshot %d: state %v, want %v", s.GameID, s.State, l.want)
+		}
+		// 其他字段原样保留
+		if s.WhiteAccountID != l.gameID*10 || len(s.Moves) != 1 || s.Moves[0].ToY != 4 {
+			t.Errorf("snapshot %d: fields lost: %+v", s.GameID, s)
+		}
+	}
+}
+
+// 旧格式的通信棋用几个布尔字段记录轮到谁, 升级之后换成状态机的状态
+func TestMigrateCorrespondenceState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chess.db")
+	bs, err := OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := []struct {
+		gameID           int64
+		toMove           chess.Side
+		pendingUpgrade   bool
+		drawAfterUpgrade bool
+		drawOffered      bool
+		want             int
+	}{
+		{1, chess.SideWhite, false, false, false, migrationStateWaitingWhitePut},
+		{2, chess.SideBlack, false, false, false, migrationStateWaitingBlackPut},
+		{3, chess.SideWhite, true, false, false, migrationStateWaitingWhiteUpgrade},
+		{4, chess.SideBlack, true, true, false, migrationStateWaitingBlackUpgradeThenDraw},
+		{5, chess.SideBlack, false, false, true, migrationStateWaitingBlackAcceptDraw},
+		{6, chess.SideWhite, false, false, true, migrationStateWaitingWhiteAcceptDraw},
+	}
+	deadline := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		for _, l := range legacy {
+			v, err := json.Marshal(map[string]interface{}{
+				"id":                 l.gameID,
+				"white_account_id":   l.gameID * 10,
+				"to_move":            l.toMove,
+				"pending_upgrade":    l.pendingUpgrade,
+				"draw_after_upgrade": l.drawAfterUpgrade,
+				"draw_offered":       l.drawOffered,
+				"deadline":           deadline,
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketCorrespondence).Put(encodeID(l.gameID), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketMeta).Put(keySchemaVersion, encodeID(4))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+
+	bs, err = OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	bs.db.View(func(tx *bolt.Tx) error {
+		// 旧字段已经去掉了
+		return tx.Bucket(bucketCorrespondence).ForEach(func(k, v []byte) error {
+			fields := map[string]json.RawMessage{}
+			if err := json.Unmarshal(v, &fields); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"to_move", "pending_upgrade", "draw_after_upgrade", "draw_offered"} {
+				if _, ok := fields[name]; ok {
+					t.Errorf("correspondence game %d still has %s", decodeID(k), name)
+				}
+			}
+			return nil
+		})
+	})
+
+	for _, l := range legacy {
+		g, err := bs.GetCorrespondenceGame(l.gameID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.State != l.want {
+			t.Errorf("correspondence game %d: state %v, want %v", g.ID, g.State, l.want)
+		}
+		// 其他字段原样保留
+		if g.WhiteAccountID != l.gameID*10 || !g.Deadline.Equal(deadline) {
+			t.Errorf("correspondence game %d: fields lost: %+v", g.ID, g)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"chess-backend/comm/chess"
+	"errors"
+	"time"
+)
+
+var (
+	// 查找的记录不存在
+	ErrNotFound = errors.New("storage: not found")
+	// 账号名已经被占用
+	ErrAccountExists = errors.New("storage: account already exists")
+)
+
+// 新账号的初始分
+const DefaultRating = 1500
+
+// 账号
+type Account struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash []byte    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// 某个账号的等级分
+type Rating struct {
+	AccountID int64 `json:"account_id"`
+	Rating    int   `json:"rating"`
+	Games     int   `json:"games"`
+	Wins      int   `json:"wins"`
+	Losses    int   `json:"losses"`
+	Draws     int   `json:"draws"`
+}
+
+// 一步棋, Upgrade只有在兵升变的时候有意义
+type MoveRecord struct {
+	Side    chess.Side            `json:"side"`
+	FromX   rune                  `json:"from_x"`
+	FromY   int                   `json:"from_y"`
+	ToX     rune                  `json:"to_x"`
+	ToY     int                   `json:"to_y"`
+	Upgrade *chess.ChessPieceType `json:"upgrade,omitempty"`
+	At      time.Time             `json:"at"`
+}
+
+// 已经结束的对局
+type GameRecord struct {
+	ID int64 `json:"id"`
+	// 未登录的玩家为0
+	WhiteAccountID int64             `json:"white_account_id"`
+	BlackAccountID int64             `json:"black_account_id"`
+	Moves          []MoveRecord      `json:"moves"`
+	FinalTable     *chess.ChessTable `json:"final_table"`
+	Options        chess.GameOptions `json:"options"`
+	WinnerSide     chess.Side        `json:"winner_side"`
+	// 结束原因, 比如checkmate, surrender, draw, disconnect
+	Reason    string    `json:"reason"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+}
+
+// 进行中的对局的快照, 用来在重启之后恢复
+type GameSnapshot struct {
+	GameID         int64             `json:"game_id"`
+	WhiteAccountID int64             `json:"white_account_id"`
+	BlackAccountID int64             `json:"black_account_id"`
+	Table          *chess.ChessTable `json:"table"`
+	Moves          []MoveRecord      `json:"moves"`
+	State          int               `json:"state"`
+	Options        chess.GameOptions `json:"options"`
+	// 不限时的对局为0
+	WhiteRemainingMs int64     `json:"white_remaining_ms"`
+	BlackRemainingMs int64     `json:"black_remaining_ms"`
+	StartedAt        time.Time `json:"started_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// 进行中的通信棋对局, 不依赖连接, 完全保存在存储里
+// 结束之后删除, 转成GameRecord保存
+type CorrespondenceGame struct {
+	ID             int64             `json:"id"`
+	WhiteAccountID int64             `json:"white_account_id"`
+	BlackAccountID int64             `json:"black_account_id"`
+	Table          *chess.ChessTable `json:"table"`
+	Moves          []MoveRecord      `json:"moves"`
+	Options        chess.GameOptions `json:"options"`
+	// machine.State, 和实时对局共用状态机, 轮到哪一方, 是否在等升变, 是否有人提和都由状态决定
+	State int `json:"state"`
+	// 轮到的一方必须在这之前走棋, 否则判负
+	Deadline  time.Time `json:"deadline"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 存储层接口, 服务端所有需要持久化的数据都通过它读写
+type Storage interface {
+	// 账号
+	CreateAccount(name string, passwordHash []byte) (*Account, error)
+	GetAccount(id int64) (*Account, error)
+	GetAccountByName(name string) (*Account, error)
+
+	// 对局, ReserveGameIDs预留n个连续的, 在重启后也不会重复的对局id, 返回第一个
+	ReserveGameIDs(n int) (int64, error)
+	SaveGame(g *GameRecord) error
+	GetGame(id int64) (*GameRecord, error)
+	// 按结束时间倒序, limit<=0表示不限制
+	ListGamesByAccount(accountID int64, limit int) ([]*GameRecord, error)
+
+	// 等级分, 账号没有下过棋时返回DefaultRating
+	GetRating(accountID int64) (*Rating, error)
+	SaveRating(r *Rating) error
+
+	// 进行中对局的快照
+	SaveSnapshot(s *GameSnapshot) error
+	DeleteSnapshot(gameID int64) error
+	ListSnapshots() ([]*GameSnapshot, error)
+
+	// 进行中的通信棋对局
+	SaveCorrespondenceGame(g *CorrespondenceGame) error
+	GetCorrespondenceGame(id int64) (*CorrespondenceGame, error)
+	DeleteCorrespondenceGame(id int64) error
+	// accountID为0时返回所有对局, 按id排序
+	ListCorrespondenceGames(accountID int64) ([]*CorrespondenceGame, error)
+
+	Close() error
+}
@@ -0,0 +1,119 @@
+package chatfilter
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// 聊天过滤器, 返回处理之后的文本, ok为false表示整条消息被拒绝
+type Filter interface {
+	Filter(text string) (result string, ok bool)
+}
+
+// 依次执行多个过滤器, 任何一个拒绝就拒绝
+type Chain []Filter
+
+func (c Chain) Filter(text string) (string, bool) {
+	for _, f := range c {
+		var ok bool
+		text, ok = f.Filter(text)
+		if !ok {
+			return "", false
+		}
+	}
+	return text, true
+}
+
+// 基于词表的过滤器, 不区分大小写
+// Reject为false时把命中的词替换成*, 为true时直接拒绝整条消息
+type WordlistFilter struct {
+	Words  []string
+	Reject bool
+}
+
+func NewWordlistFilter(words []string, reject bool) *WordlistFilter {
+	lowered := make([]string, 0, len(words))
+	for _, w := range words {
+		w = strings.ToLower(strings.TrimSpace(w))
+		if w != "" {
+			lowered = append(lowered, w)
+		}
+	}
+	return &WordlistFilter{Words: lowered, Reject: reject}
+}
+
+// 从文件读取词表, 一行一个词, #开头的行是注释
+func LoadWordlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, scanner.Err()
+}
+
+func (wf *WordlistFilter) Filter(text string) (string, bool) {
+	runes := []rune(text)
+	lowered := []rune(strings.ToLower(text))
+	// ToLower可能改变长度, 这时候只能放弃替换, 按整条处理
+	sameLength := len(runes) == len(lowered)
+
+	hit := false
+	for _, w := range wf.Words {
+		word := []rune(w)
+		for i := 0; i+len(word) <= len(lowered); i++ {
+			if string(lowered[i:i+len(word)]) != w {
+				continue
+			}
+			hit = true
+			if wf.Reject || !sameLength {
+				return "", false
+			}
+			for j := i; j < i+len(word); j++ {
+				runes[j] = '*'
+			}
+		}
+	}
+
+	if !hit {
+		return text, true
+	}
+	return string(runes), true
+}
+
+// 拒绝刷屏式的消息, 比如同一个字符连续重复很多次
+type RepeatFilter struct {
+	MaxRepeat int
+}
+
+func (rf *RepeatFilter) Filter(text string) (string, bool) {
+	var last rune
+	count := 0
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		if r == last {
+			count++
+		} else {
+			last = r
+			count = 1
+		}
+		if count > rf.MaxRepeat {
+			return "", false
+		}
+	}
+	return text, true
+}
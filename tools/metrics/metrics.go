@@ -0,0 +1,345 @@
+// 简单的指标库, 按Prometheus的文本格式输出, 只实现了计数器, 仪表盘和直方图
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type collector interface {
+	writeTo(w *bufio.Writer)
+}
+
+// 指标的名字, 说明和标签名
+type desc struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.name + " " + strings.ReplaceAll(d.help, "\n", " ") + "\n")
+	w.WriteString("# TYPE " + d.name + " " + d.typ + "\n")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 拼出 {a="1",b="2"}, 没有标签时为空
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name + `="` + labelValueEscaper.Replace(values[i]) + `"`)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	w.WriteString(name + labels + " " + formatFloat(value) + "\n")
+}
+
+// 用原子操作累加的浮点数
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+type Histogram struct {
+	buckets []float64
+	// 每个桶各自的计数, 输出时再累加
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// 记录从start到现在的秒数
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) writeSamples(w *bufio.Writer, name string, names []string, values []string) {
+	bucketNames := append(append([]string(nil), names...), "le")
+	cumulative := uint64(0)
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i].Load()
+		writeSample(w, name+"_bucket", formatLabels(bucketNames, append(append([]string(nil), values...), formatFloat(upper))), float64(cumulative))
+	}
+	count := h.count.Load()
+	writeSample(w, name+"_bucket", formatLabels(bucketNames, append(append([]string(nil), values...), "+Inf")), float64(count))
+	labels := formatLabels(names, values)
+	writeSample(w, name+"_sum", labels, h.sum.Load())
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+// 默认的延迟桶, 从100微秒到10秒
+var DefaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// 带标签的指标, 每组标签值一个子指标, 第一次用到时创建
+type vec[T any] struct {
+	desc
+	lock     sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+	create   func() *T
+}
+
+func (v *vec[T]) With(labelValues ...string) *T {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metrics: wrong number of label values for " + v.name)
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.RLock()
+	child, ok := v.children[key]
+	v.lock.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	child = v.create()
+	v.children[key] = child
+	v.values[key] = append([]string(nil), labelValues...)
+	return child
+}
+
+// 按标签值排序遍历, 输出稳定
+func (v *vec[T]) each(fn func(values []string, child *T)) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+		values[i] = v.values[key]
+	}
+	v.lock.RUnlock()
+
+	for i := range keys {
+		fn(values[i], children[i])
+	}
+}
+
+func newVec[T any](d desc, create func() *T) vec[T] {
+	return vec[T]{desc: d, children: make(map[string]*T), values: make(map[string][]string), create: create}
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (v *CounterVec) writeTo(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, c *Counter) {
+		writeSample(w, v.name, formatLabels(v.labelNames, values), float64(c.value.Load()))
+	})
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+func (v *HistogramVec) writeTo(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, h *Histogram) {
+		h.writeSamples(w, v.name, v.labelNames, values)
+	})
+}
+
+type counterMetric struct {
+	desc
+	*Counter
+}
+
+func (m *counterMetric) writeTo(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.name, "", float64(m.value.Load()))
+}
+
+type gaugeMetric struct {
+	desc
+	*Gauge
+}
+
+func (m *gaugeMetric) writeTo(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.name, "", float64(m.value.Load()))
+}
+
+type gaugeFuncMetric struct {
+	desc
+	fn func() float64
+}
+
+func (m *gaugeFuncMetric) writeTo(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.name, "", m.fn())
+}
+
+type histogramMetric struct {
+	desc
+	*Histogram
+}
+
+func (m *histogramMetric) writeTo(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.writeSamples(w, m.name, nil, nil)
+}
+
+// 一组指标, 按注册的顺序输出
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, c)
+	r.lock.Unlock()
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	m := &counterMetric{desc: desc{name: name, help: help, typ: "counter"}, Counter: &Counter{}}
+	r.register(m)
+	return m.Counter
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newVec(desc{name: name, help: help, typ: "counter", labelNames: labelNames}, func() *Counter {
+		return &Counter{}
+	})}
+	r.register(v)
+	return v
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	m := &gaugeMetric{desc: desc{name: name, help: help, typ: "gauge"}, Gauge: &Gauge{}}
+	r.register(m)
+	return m.Gauge
+}
+
+// 输出时调用fn取值
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.register(&gaugeFuncMetric{desc: desc{name: name, help: help, typ: "gauge"}, fn: fn})
+}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	m := &histogramMetric{desc: desc{name: name, help: help, typ: "histogram"}, Histogram: newHistogram(buckets)}
+	r.register(m)
+	return m.Histogram
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	v := &HistogramVec{newVec(desc{name: name, help: help, typ: "histogram", labelNames: labelNames}, func() *Histogram {
+		return newHistogram(buckets)
+	})}
+	r.register(v)
+	return v
+}
+
+// 按Prometheus的文本格式输出所有指标
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
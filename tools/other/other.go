@@ -1,6 +1,8 @@
 package other
 
 import (
+	crand "crypto/rand"
+	"math/big"
 	"math/rand"
 	"time"
 )
@@ -9,6 +11,23 @@ func RandGetBool() bool {
 	return rand.New(rand.NewSource(time.Now().Unix())).Int()%2 == 0
 }
 
+// 去掉了容易看混的0O1I
+const inviteCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// 生成一个随机邀请码, 用crypto/rand防止被猜到
+func RandInviteCode(length int) string {
+	bs := make([]byte, length)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range bs {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		bs[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(bs)
+}
+
 func Ignore(i interface{}) {
 
 }
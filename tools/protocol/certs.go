@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// 从文件加载服务端证书, 文件被替换之后下一次握手时重新加载, 证书轮换时不需要重启服务
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+	// 可选的回调, 重新加载失败时调用, 这时继续使用之前的证书
+	OnReloadError func(err error)
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// 第一次加载证书, 文件不存在或者不合法时返回错误
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 用作tls.Config的GetCertificate
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.reloadIfChanged(); err != nil && r.OnReloadError != nil {
+		r.OnReloadError(err)
+	}
+	return r.cert, nil
+}
+
+func (r *CertificateReloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.reloadIfChanged()
+}
+
+// 证书和私钥的修改时间都没有变时不加载, 需要持有lock
+func (r *CertificateReloader) reloadIfChanged() error {
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return nil
+	}
+
+	// 证书和私钥可能只替换了一个, 对不上时等另一个也替换了再加载
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	return nil
+}
@@ -5,20 +5,58 @@ import (
 	"github.com/Allenxuxu/ringbuffer"
 )
 
-type Protocol struct{}
+// 没有设置MaxFrameSize时使用的最大包长度
+const DefaultMaxFrameSize = 64 * 1024
+
+type Protocol struct {
+	// 包本体的最大长度, 为0时使用DefaultMaxFrameSize
+	// 不完整的包最多在读缓冲区里攒这么多字节, 所以每个连接的读缓冲区最多占用MaxFrameSize加上4字节的长度头
+	MaxFrameSize int
+
+	// 下面两个是可选的回调, 用来做统计
+	// 拆出一个完整的包时调用, 参数为包的本体
+	OnUnPacket func(packetBytes []byte)
+	// 发出一个包时调用, 参数为带长度头的完整数据
+	OnPacket func(data []byte)
+}
+
+// 长度头不合法时作为UnPacket的ctx返回, 这时缓冲区里的数据已经全部丢掉了,
+// 之后的数据没法再分包, 收到之后应该断开连接
+type FrameError struct {
+	// 长度头里的长度
+	Length uint32
+	// 长度为0
+	Empty bool
+}
+
+func (e *FrameError) Error() string {
+	if e.Empty {
+		return "empty frame"
+	}
+	return "frame too large"
+}
+
+func (p *Protocol) maxFrameSize() int {
+	if p.MaxFrameSize > 0 {
+		return p.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
 
 func (p *Protocol) UnPacket(c *gev.Connection, buffer *ringbuffer.RingBuffer) (interface{}, []byte) {
 	if buffer.Length() < 4 {
 		return nil, nil
 	}
 
+	// 长度不合法的话后面的数据已经没法分包了, 全部丢掉, 由上层断开连接
 	packetLength := buffer.PeekUint32()
-	if packetLength == 0 {
-		return nil, []byte{}
+	if packetLength == 0 || packetLength > uint32(p.maxFrameSize()) {
+		buffer.RetrieveAll()
+		return &FrameError{Length: packetLength, Empty: packetLength == 0}, nil
 	}
 
 	if buffer.Length() < 4+int(packetLength) {
-		return nil, []byte{}
+		return nil, nil
 	}
 
 	buffer.Retrieve(4)
@@ -26,9 +64,16 @@ func (p *Protocol) UnPacket(c *gev.Connection, buffer *ringbuffer.RingBuffer) (i
 	copy(packetBytes, buffer.Bytes())
 	buffer.Retrieve(int(packetLength))
 
+	if p.OnUnPacket != nil {
+		p.OnUnPacket(packetBytes)
+	}
 	return nil, packetBytes
 }
 
 func (p *Protocol) Packet(c *gev.Connection, data interface{}) []byte {
-	return data.([]byte)
+	bs := data.([]byte)
+	if p.OnPacket != nil {
+		p.OnPacket(bs)
+	}
+	return bs
 }
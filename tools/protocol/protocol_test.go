@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Allenxuxu/ringbuffer"
+)
+
+// 和UnPacket一样按长度头分包, 但是直接在切片上做, 用来对照
+// 返回完整的包, 遇到不合法的长度头时返回对应的FrameError
+func referenceFrames(data []byte, maxFrameSize int) ([][]byte, *FrameError) {
+	frames := make([][]byte, 0)
+	for len(data) >= 4 {
+		length := binary.BigEndian.Uint32(data)
+		if length == 0 || length > uint32(maxFrameSize) {
+			return frames, &FrameError{Length: length, Empty: length == 0}
+		}
+		if len(data) < 4+int(length) {
+			break
+		}
+		frames = append(frames, data[4:4+length])
+		data = data[4+length:]
+	}
+	return frames, nil
+}
+
+func frame(payload []byte) []byte {
+	bs := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	return append(bs, payload...)
+}
+
+const fuzzRingSize = 64
+
+// 把data按chunk大小分几次写进环形缓冲区, 每次写完都像gev一样反复调用UnPacket
+// 写之前先让读写位置停在offset, 这样长度头和包本体会跨过缓冲区的末尾
+func unpackChunks(p *Protocol, data []byte, offset, chunk int) ([][]byte, *FrameError, *ringbuffer.RingBuffer) {
+	buffer := ringbuffer.New(fuzzRingSize)
+	if offset > 0 {
+		buffer.Write(make([]byte, offset))
+		buffer.Retrieve(offset)
+	}
+
+	frames := make([][]byte, 0)
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		buffer.Write(data[:n])
+		data = data[n:]
+
+		for {
+			ctx, packetBytes := p.UnPacket(nil, buffer)
+			if ctx != nil {
+				return frames, ctx.(*FrameError), buffer
+			}
+			if packetBytes == nil {
+				break
+			}
+			frames = append(frames, packetBytes)
+		}
+	}
+	return frames, nil, buffer
+}
+
+func TestUnPacketFrameErrors(t *testing.T) {
+	p := &Protocol{MaxFrameSize: 16}
+	cases := []struct {
+		name string
+		data []byte
+		want *FrameError
+	}{
+		{"empty", []byte{0, 0, 0, 0}, &FrameError{Length: 0, Empty: true}},
+		{"oversize", []byte{0, 0, 0, 17, 'x'}, &FrameError{Length: 17}},
+		{"4GB", []byte{0xff, 0xff, 0xff, 0xff}, &FrameError{Length: 0xffffffff}},
+		{"empty after frame", append(frame([]byte("ok")), 0, 0, 0, 0), &FrameError{Length: 0, Empty: true}},
+	}
+	for _, c := range cases {
+		for offset := 0; offset < fuzzRingSize; offset++ {
+			_, err, buffer := unpackChunks(p, c.data, offset, 1)
+			if err == nil || *err != *c.want {
+				t.Fatalf("%s offset %d: got %v, want %v", c.name, offset, err, c.want)
+			}
+			if buffer.Length() != 0 {
+				t.Fatalf("%s offset %d: %d bytes left after frame error", c.name, offset, buffer.Length())
+			}
+		}
+	}
+	if (&FrameError{Empty: true}).Error() != "empty frame" || (&FrameError{Length: 1 << 20}).Error() != "frame too large" {
+		t.Error("unexpected FrameError message")
+	}
+}
+
+// 长度头跨过环形缓冲区末尾的每一种位置
+func TestUnPacketHeaderAcrossBoundary(t *testing.T) {
+	p := &Protocol{MaxFrameSize: 32}
+	payload := []byte("0123456789abcdefghij")
+	data := append(frame(payload), frame([]byte("x"))...)
+	for offset := fuzzRingSize - 8; offset < fuzzRingSize; offset++ {
+		for chunk := 1; chunk <= len(data); chunk++ {
+			frames, err, _ := unpackChunks(p, data, offset, chunk)
+			if err != nil || len(frames) != 2 || !bytes.Equal(frames[0], payload) || string(frames[1]) != "x" {
+				t.Fatalf("offset %d chunk %d: %q %v", offset, chunk, frames, err)
+			}
+		}
+	}
+}
+
+func TestUnPacketDefaultMaxFrameSize(t *testing.T) {
+	p := &Protocol{}
+	_, err, _ := unpackChunks(p, binary.BigEndian.AppendUint32(nil, DefaultMaxFrameSize+1), 0, 4)
+	if err == nil || err.Length != DefaultMaxFrameSize+1 {
+		t.Errorf("got %v", err)
+	}
+	frames, err, buffer := unpackChunks(p, binary.BigEndian.AppendUint32(nil, DefaultMaxFrameSize), 0, 4)
+	if err != nil || len(frames) != 0 || buffer.Length() != 4 {
+		t.Errorf("max size frame header rejected: %v", err)
+	}
+}
+
+func FuzzUnPacket(f *testing.F) {
+	f.Add([]byte{}, uint8(0), uint8(1), uint16(16))
+	f.Add([]byte{0, 0, 0, 0}, uint8(62), uint8(1), uint16(16))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}, uint8(61), uint8(2), uint16(16))
+	f.Add([]byte{0, 0, 0, 17}, uint8(63), uint8(3), uint16(16))
+	f.Add(append(frame([]byte(`{"type":0}`)), frame([]byte(`{"type":4}`))...), uint8(60), uint8(5), uint16(16))
+	f.Add(append(frame([]byte("abc")), 0, 0), uint8(59), uint8(1), uint16(8))
+	f.Add(frame(bytes.Repeat([]byte{'a'}, 100)), uint8(30), uint8(7), uint16(200))
+
+	f.Fuzz(func(t *testing.T, data []byte, offset uint8, chunk uint8, maxFrameSize uint16) {
+		p := &Protocol{MaxFrameSize: int(maxFrameSize)}
+		wantFrames, wantErr := referenceFrames(data, p.maxFrameSize())
+		frames, err, buffer := unpackChunks(p, data, int(offset)%fuzzRingSize, int(chunk)%16+1)
+
+		if len(frames) != len(wantFrames) {
+			t.Fatalf("got %d frames, want %d", len(frames), len(wantFrames))
+		}
+		for i := range frames {
+			if !bytes.Equal(frames[i], wantFrames[i]) {
+				t.Fatalf("frame %d: got %q, want %q", i, frames[i], wantFrames[i])
+			}
+			if len(frames[i]) == 0 || len(frames[i]) > p.maxFrameSize() {
+				t.Fatalf("frame %d has invalid length %d", i, len(frames[i]))
+			}
+		}
+		if (err == nil) != (wantErr == nil) || (err != nil && *err != *wantErr) {
+			t.Fatalf("got frame error %v, want %v", err, wantErr)
+		}
+		if err != nil && buffer.Length() != 0 {
+			t.Fatalf("%d bytes left after frame error", buffer.Length())
+		}
+		// 没出错时缓冲区里只剩一个不完整的包
+		if err == nil && buffer.Length() >= 4 && buffer.Length() >= 4+int(buffer.PeekUint32()) {
+			t.Fatalf("complete frame of %d bytes left in buffer", buffer.PeekUint32())
+		}
+	})
+}
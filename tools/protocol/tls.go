@@ -0,0 +1,273 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Allenxuxu/gev"
+	"github.com/Allenxuxu/ringbuffer"
+)
+
+// TLS握手的超时时间, 超时之后断开连接
+const tlsHandshakeTimeout = 10 * time.Second
+
+// 握手期间最多缓存这么多还没有读的数据, 超过时断开
+const maxTLSHandshakeBuffer = 64 * 1024
+
+const tlsStateKey = "chess_tls_state"
+
+// 在另一个协议外面套一层TLS, Inner收发的都是解密之后的数据, 所以Protocol和WebSocketProtocol都可以套
+//
+// gev的连接不是net.Conn, crypto/tls没法直接用, 这里给每个连接接一个内存里的传输层:
+// 握手在单独的协程里阻塞地读, 握手完成之后在事件循环里读, 没有数据时返回临时错误, crypto/tls会保留读了一半的记录
+// 握手完成时已经收到的数据不会再触发UnPacket, 所以需要Handler, 在事件循环里把这些数据交给它处理
+type TLSProtocol struct {
+	Inner  gev.Protocol
+	Config *tls.Config
+	// 和传给gev.NewServer的是同一个
+	Handler gev.CallBack
+}
+
+// 每个连接上的TLS状态
+type tlsState struct {
+	transport *tlsTransport
+	conn      *tls.Conn
+	// 解密之后还没有被Inner拆成包的数据
+	plain *ringbuffer.RingBuffer
+	// 握手完成之后才能在事件循环里读写conn
+	handshaked atomic.Bool
+	// 出错或者关闭之后不再读取数据
+	closed bool
+	// 客户端证书通过了校验时为证书的CommonName
+	clientName string
+}
+
+// 直接写出去的数据, 不再加密
+type tlsRaw []byte
+
+// 内存里的传输层, 读的是从gev的读缓冲区里搬过来的密文, 写的数据发给gev的连接
+type tlsTransport struct {
+	c *gev.Connection
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	in     []byte
+	closed bool
+	// 握手期间没有数据时阻塞, 之后返回errWouldBlock
+	blocking bool
+	// 不为nil时写的数据追加到这里, 由Packet返回, 而不是再调用Send
+	capture *[]byte
+}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "tls transport: no data" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+var errWouldBlock net.Error = wouldBlockError{}
+
+type tlsAddr string
+
+func (a tlsAddr) Network() string { return "tcp" }
+func (a tlsAddr) String() string  { return string(a) }
+
+func newTLSTransport(c *gev.Connection) *tlsTransport {
+	t := &tlsTransport{c: c, blocking: true}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+func (t *tlsTransport) feed(bs []byte) {
+	t.lock.Lock()
+	t.in = append(t.in, bs...)
+	t.lock.Unlock()
+	t.cond.Broadcast()
+}
+
+func (t *tlsTransport) buffered() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.in)
+}
+
+func (t *tlsTransport) stopBlocking() {
+	t.lock.Lock()
+	t.blocking = false
+	t.lock.Unlock()
+}
+
+func (t *tlsTransport) Read(b []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for len(t.in) == 0 {
+		if t.closed {
+			return 0, io.EOF
+		}
+		if !t.blocking {
+			return 0, errWouldBlock
+		}
+		t.cond.Wait()
+	}
+	n := copy(b, t.in)
+	t.in = t.in[n:]
+	return n, nil
+}
+
+func (t *tlsTransport) Write(b []byte) (int, error) {
+	if t.capture != nil {
+		*t.capture = append(*t.capture, b...)
+		return len(b), nil
+	}
+	t.c.Send(tlsRaw(append([]byte{}, b...)))
+	return len(b), nil
+}
+
+func (t *tlsTransport) Close() error {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr              { return tlsAddr("") }
+func (t *tlsTransport) RemoteAddr() net.Addr             { return tlsAddr(t.c.PeerAddr()) }
+func (t *tlsTransport) SetDeadline(time.Time) error      { return nil }
+func (t *tlsTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsTransport) SetWriteDeadline(time.Time) error { return nil }
+
+func tlsStateOf(c *gev.Connection) *tlsState {
+	if state, ok := c.Get(tlsStateKey); ok {
+		return state.(*tlsState)
+	}
+	return nil
+}
+
+// 通过了校验的客户端证书的CommonName, 没有使用TLS, 没有发送证书或者还没有握手完成时为空
+func ClientCertName(c *gev.Connection) string {
+	state := tlsStateOf(c)
+	if state == nil || !state.handshaked.Load() {
+		return ""
+	}
+	return state.clientName
+}
+
+func (p *TLSProtocol) UnPacket(c *gev.Connection, buffer *ringbuffer.RingBuffer) (interface{}, []byte) {
+	state := tlsStateOf(c)
+	if state == nil {
+		state = p.startHandshake(c)
+	}
+	if state.closed {
+		buffer.RetrieveAll()
+		return nil, nil
+	}
+
+	if buffer.Length() > 0 {
+		first, end := buffer.PeekAll()
+		state.transport.feed(first)
+		state.transport.feed(end)
+		buffer.RetrieveAll()
+	}
+	if !state.handshaked.Load() {
+		if state.transport.buffered() > maxTLSHandshakeBuffer {
+			state.closed = true
+			state.transport.Close()
+			c.Close()
+		}
+		return nil, nil
+	}
+	return p.unpackPlain(c, state)
+}
+
+// 解密所有已经收到的完整记录, 然后交给Inner拆包
+func (p *TLSProtocol) unpackPlain(c *gev.Connection, state *tlsState) (interface{}, []byte) {
+	var bs [16 * 1024]byte
+	for {
+		n, err := state.conn.Read(bs[:])
+		if n > 0 {
+			_, _ = state.plain.Write(bs[:n])
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Temporary() {
+			break
+		}
+		if err != nil {
+			// 对方关闭或者数据不合法, crypto/tls已经写出了告警
+			state.closed = true
+			c.Send(tlsRaw(nil), gev.SendInLoop(func(interface{}) { c.Close() }))
+			return nil, nil
+		}
+	}
+	return p.Inner.UnPacket(c, state.plain)
+}
+
+func (p *TLSProtocol) startHandshake(c *gev.Connection) *tlsState {
+	transport := newTLSTransport(c)
+	state := &tlsState{
+		transport: transport,
+		conn:      tls.Server(transport, p.Config),
+		plain:     ringbuffer.New(1024),
+	}
+	c.Set(tlsStateKey, state)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		defer cancel()
+		if err := state.conn.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return
+		}
+
+		if chains := state.conn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			state.clientName = chains[0][0].Subject.CommonName
+		}
+		transport.stopBlocking()
+		state.handshaked.Store(true)
+
+		// 握手时已经收到的数据不会再触发UnPacket, 在事件循环里处理掉
+		c.Send(tlsRaw(nil), gev.SendInLoop(func(interface{}) { p.drain(c, state) }))
+	}()
+	return state
+}
+
+func (p *TLSProtocol) drain(c *gev.Connection, state *tlsState) {
+	for !state.closed {
+		ctx, data := p.unpackPlain(c, state)
+		if ctx == nil && len(data) == 0 {
+			return
+		}
+		if out := p.Handler.OnMessage(c, ctx, data); out != nil {
+			c.Send(out)
+		}
+	}
+}
+
+func (p *TLSProtocol) Packet(c *gev.Connection, data interface{}) []byte {
+	if raw, ok := data.(tlsRaw); ok {
+		return raw
+	}
+
+	// 握手完成之前的心跳这些直接丢掉
+	state := tlsStateOf(c)
+	if state == nil || !state.handshaked.Load() {
+		return nil
+	}
+	plain := p.Inner.Packet(c, data)
+	if len(plain) == 0 {
+		return nil
+	}
+
+	var out []byte
+	state.transport.capture = &out
+	_, _ = state.conn.Write(plain)
+	state.transport.capture = nil
+	return out
+}
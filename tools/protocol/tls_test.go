@@ -0,0 +1,286 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	testcerttool "chess-backend/tools/testcert"
+
+	"github.com/Allenxuxu/gev"
+)
+
+// 把收到的包原样发回去, 后面加上客户端证书的名字
+type echoHandler struct{}
+
+func (echoHandler) OnConnect(c *gev.Connection) {}
+func (echoHandler) OnClose(c *gev.Connection)   {}
+func (echoHandler) OnMessage(c *gev.Connection, ctx interface{}, data []byte) interface{} {
+	if data == nil {
+		return nil
+	}
+	return frame(append(append(data, '|'), ClientCertName(c)...))
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	addr := freeAddr(t)
+	handler := echoHandler{}
+	server, err := gev.NewServer(handler,
+		gev.Address(addr),
+		gev.Network("tcp"),
+		gev.NumLoops(1),
+		gev.CustomProtocol(&TLSProtocol{Inner: &Protocol{MaxFrameSize: 1024}, Config: config, Handler: handler}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(server.Stop)
+
+	// 等服务端开始监听
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return ""
+}
+
+// 握手, 发一个包, 返回服务端的证书和回复
+func echo(t *testing.T, addr string, config *tls.Config, payload string) (*tls.ConnectionState, string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(frame([]byte(payload))); err != nil {
+		return nil, "", err
+	}
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, "", err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, "", err
+	}
+	state := conn.ConnectionState()
+	return &state, string(body), nil
+}
+
+func newCA(t *testing.T, name string) *testcerttool.CA {
+	ca, err := testcerttool.NewCA(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func issue(t *testing.T, ca *testcerttool.CA, name string, server bool) *testcerttool.Leaf {
+	var leaf *testcerttool.Leaf
+	var err error
+	if server {
+		leaf, err = ca.IssueServer(name)
+	} else {
+		leaf, err = ca.IssueClient(name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// 写证书和私钥, 修改时间设成at, 避免文件系统的时间精度让两次写入的修改时间相同
+func writeLeaf(t *testing.T, leaf *testcerttool.Leaf, certFile, keyFile string, at time.Time) {
+	if err := os.WriteFile(certFile, leaf.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, leaf.KeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSHandshakeAndClientCert(t *testing.T) {
+	ca := newCA(t, "test ca")
+	serverLeaf := issue(t, ca, "localhost", true)
+	serverCert, err := serverLeaf.TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+
+	// 没有客户端证书
+	_, reply, err := echo(t, addr, &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"}, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello|" {
+		t.Errorf("reply without client cert: %q", reply)
+	}
+
+	// 用同一个CA签发的客户端证书, 服务端能拿到CommonName
+	botCert, err := issue(t, ca, "bot1", false).TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		_, reply, err = echo(t, addr, &tls.Config{
+			RootCAs:      ca.Pool(),
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{botCert},
+			MinVersion:   version,
+			MaxVersion:   version,
+		}, "move")
+		if err != nil {
+			t.Fatalf("version %x: %v", version, err)
+		}
+		if reply != "move|bot1" {
+			t.Errorf("version %x: reply with client cert: %q", version, reply)
+		}
+	}
+
+	// 其他CA签发的客户端证书不在服务端接受的CA里, 客户端不会发送, 当作没有证书
+	otherCert, err := issue(t, newCA(t, "other ca"), "bot1", false).TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reply, err = echo(t, addr, &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost", Certificates: []tls.Certificate{otherCert}}, "x")
+	if err != nil || reply != "x|" {
+		t.Errorf("unmatched client cert: reply %q, %v", reply, err)
+	}
+	// 强行发送的话握手失败
+	_, reply, err = echo(t, addr, &tls.Config{
+		RootCAs:    ca.Pool(),
+		ServerName: "localhost",
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &otherCert, nil
+		},
+	}, "x")
+	if err == nil {
+		t.Errorf("untrusted client cert accepted, reply %q", reply)
+	}
+
+	// 不信任服务端证书的客户端握手失败
+	if _, _, err := echo(t, addr, &tls.Config{RootCAs: newCA(t, "other ca").Pool(), ServerName: "localhost"}, "x"); err == nil {
+		t.Error("handshake succeeded with untrusted server cert")
+	}
+}
+
+// 握手期间发来的数据太多时断开
+func TestTLSHandshakeBufferLimit(t *testing.T) {
+	ca := newCA(t, "test ca")
+	serverCert, err := issue(t, ca, "localhost", true).TLSCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 一个永远不完整的握手记录
+	garbage := append([]byte{0x16, 0x03, 0x01, 0xff, 0xff}, bytes.Repeat([]byte{0}, maxTLSHandshakeBuffer*2)...)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(garbage)
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatal("connection not closed")
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	ca := newCA(t, "test ca")
+	first := issue(t, ca, "localhost", true)
+	now := time.Now()
+	writeLeaf(t, first, certFile, keyFile, now)
+
+	if _, err := NewCertificateReloader(certFile, filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("reloader created without key file")
+	}
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloadErrors atomic.Int32
+	reloader.OnReloadError = func(err error) {
+		reloadErrors.Add(1)
+	}
+	addr := startTLSServer(t, &tls.Config{GetCertificate: reloader.GetCertificate})
+	client := &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"}
+
+	serial := func() string {
+		state, _, err := echo(t, addr, client, "ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.PeerCertificates[0].SerialNumber.String()
+	}
+	if got := serial(); got != first.Serial.String() {
+		t.Fatalf("serving %s, want %s", got, first.Serial)
+	}
+
+	// 证书轮换之后下一次握手用新的证书, 不需要重启
+	second := issue(t, ca, "localhost", true)
+	writeLeaf(t, second, certFile, keyFile, now.Add(time.Minute))
+	if got := serial(); got != second.Serial.String() {
+		t.Fatalf("after rotation serving %s, want %s", got, second.Serial)
+	}
+
+	// 只替换了证书, 和私钥对不上, 继续用之前的证书
+	third := issue(t, ca, "localhost", true)
+	if err := os.WriteFile(certFile, third.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	if got := serial(); got != second.Serial.String() {
+		t.Fatalf("after half rotation serving %s, want %s", got, second.Serial)
+	}
+	if reloadErrors.Load() == 0 {
+		t.Error("mismatched key pair not reported")
+	}
+
+	// 私钥也替换了之后加载新的
+	writeLeaf(t, third, certFile, keyFile, now.Add(3*time.Minute))
+	if got := serial(); got != third.Serial.String() {
+		t.Fatalf("after completing rotation serving %s, want %s", got, third.Serial)
+	}
+}
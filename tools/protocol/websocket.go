@@ -0,0 +1,280 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/Allenxuxu/gev"
+	"github.com/Allenxuxu/gev/plugins/websocket/ws"
+	"github.com/Allenxuxu/ringbuffer"
+)
+
+// 握手请求的最大长度, 超过时还没有读到完整的请求头就断开
+const maxHandshakeSize = 8 * 1024
+
+// 控制帧的本体最多125字节
+const maxControlPayload = 125
+
+const webSocketStateKey = "chess_websocket_state"
+
+// 给浏览器用的WebSocket协议, 每条WebSocket消息对应一个包, 消息本体就是包的本体
+// 上层收发的数据和Protocol完全一样, 收到的是不带长度头的包本体, 发出的是DoPackWith4BytesHeader封好的包,
+// 由这里去掉长度头再写成一个WebSocket帧, 所以ConnHandler不需要知道连接用的是哪种传输
+//
+// json的包写成文本帧, 二进制编码的包写成二进制帧, 客户端发来的两种帧都可以
+// 握手, ping, pong和关闭都在这里处理, 不会交给上层
+type WebSocketProtocol struct {
+	// 和Protocol里的含义一样, 限制的是一条消息拼起来之后的长度
+	MaxFrameSize int
+
+	OnUnPacket func(packetBytes []byte)
+	// 和Protocol里的含义一样, 参数为写成WebSocket帧之前带长度头的完整数据, 握手的回复和控制帧不算
+	OnPacket func(data []byte)
+
+	upgrader ws.Upgrader
+}
+
+// 每个连接上的状态, 只在连接所在的事件循环里访问
+type webSocketState struct {
+	// 已经收到了握手请求
+	upgraded bool
+	// 握手的回复已经写出去了, 在这之前上层发的包都丢掉, 避免写在回复前面
+	open bool
+	// 出错或者关闭之后不再读取数据
+	closed bool
+
+	// 分片消息已经收到的部分
+	fragments []byte
+	// 分片消息的类型, 不在分片消息中间时为OpContinuation
+	fragmentOpCode ws.OpCode
+}
+
+// 直接写出去的数据, 不再封成WebSocket帧
+type webSocketRaw []byte
+
+func (p *WebSocketProtocol) maxFrameSize() int {
+	if p.MaxFrameSize > 0 {
+		return p.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+func stateOf(c *gev.Connection) *webSocketState {
+	if state, ok := c.Get(webSocketStateKey); ok {
+		return state.(*webSocketState)
+	}
+	state := &webSocketState{}
+	c.Set(webSocketStateKey, state)
+	return state
+}
+
+func (p *WebSocketProtocol) UnPacket(c *gev.Connection, buffer *ringbuffer.RingBuffer) (interface{}, []byte) {
+	state := stateOf(c)
+	if state.closed {
+		buffer.RetrieveAll()
+		return nil, nil
+	}
+
+	if !state.upgraded {
+		if !p.handshake(c, state, buffer) {
+			return nil, nil
+		}
+	}
+
+	// 控制帧和分片在这里处理掉, 直到拼出一条完整的消息或者数据不够
+	for {
+		header, headerLength, ok := peekFrameHeader(buffer)
+		if !ok {
+			return nil, nil
+		}
+
+		// 客户端发的帧必须有掩码, 没有协商扩展所以保留位必须为0
+		if !header.Masked || header.Rsv != 0 || header.OpCode.IsReserved() ||
+			(header.OpCode.IsControl() && (!header.Fin || header.Length > maxControlPayload)) {
+			p.fail(c, state, buffer, ws.StatusProtocolError, "invalid frame")
+			return nil, nil
+		}
+
+		// 超过上限的消息不等它收完, 和Protocol一样交给上层断开
+		messageLength := int64(len(state.fragments)) + header.Length
+		if header.OpCode.IsData() || header.OpCode == ws.OpContinuation {
+			if messageLength > int64(p.maxFrameSize()) {
+				state.closed = true
+				buffer.RetrieveAll()
+				return &FrameError{Length: uint32(min(messageLength, int64(^uint32(0))))}, nil
+			}
+		}
+
+		if int64(buffer.Length()) < int64(headerLength)+header.Length {
+			return nil, nil
+		}
+		buffer.Retrieve(headerLength)
+		payload := make([]byte, header.Length)
+		_, _ = buffer.Read(payload)
+		ws.Cipher(payload, header.Mask, 0)
+
+		switch header.OpCode {
+		case ws.OpPing:
+			p.sendFrame(c, ws.NewPongFrame(payload))
+			continue
+		case ws.OpPong:
+			continue
+		case ws.OpClose:
+			// 按对方的状态码回复关闭帧, 然后断开
+			code, _ := ws.ParseCloseFrameData(payload)
+			if code.Empty() {
+				code = ws.StatusNormalClosure
+			}
+			p.fail(c, state, buffer, code, "")
+			return nil, nil
+		case ws.OpContinuation:
+			if state.fragmentOpCode == ws.OpContinuation {
+				p.fail(c, state, buffer, ws.StatusProtocolError, "unexpected continuation frame")
+				return nil, nil
+			}
+			state.fragments = append(state.fragments, payload...)
+		default:
+			if state.fragmentOpCode != ws.OpContinuation {
+				p.fail(c, state, buffer, ws.StatusProtocolError, "expected continuation frame")
+				return nil, nil
+			}
+			if !header.Fin {
+				state.fragmentOpCode = header.OpCode
+				state.fragments = payload
+				continue
+			}
+			state.fragments = payload
+		}
+
+		if !header.Fin {
+			continue
+		}
+		packetBytes := state.fragments
+		state.fragments = nil
+		state.fragmentOpCode = ws.OpContinuation
+
+		if len(packetBytes) == 0 {
+			state.closed = true
+			buffer.RetrieveAll()
+			return &FrameError{Empty: true}, nil
+		}
+		if p.OnUnPacket != nil {
+			p.OnUnPacket(packetBytes)
+		}
+		return nil, packetBytes
+	}
+}
+
+// 读到完整的握手请求之后回复, 返回是否已经握手成功
+func (p *WebSocketProtocol) handshake(c *gev.Connection, state *webSocketState, buffer *ringbuffer.RingBuffer) bool {
+	first, end := buffer.PeekAll()
+	request := append(append([]byte{}, first...), end...)
+	index := bytes.Index(request, []byte("\r\n\r\n"))
+	if index == -1 {
+		if len(request) > maxHandshakeSize {
+			state.closed = true
+			buffer.RetrieveAll()
+			c.Send(webSocketRaw("HTTP/1.1 431 Request Header Fields Too Large\r\nConnection: close\r\n\r\n"),
+				gev.SendInLoop(func(interface{}) { c.Close() }))
+		}
+		return false
+	}
+
+	// Upgrade只在PeekAll的两段里分别找请求头的结尾, 请求跨过缓冲区末尾时会找不到, 所以拷贝出来再交给它
+	in := ringbuffer.New(index + 4)
+	_, _ = in.Write(request[:index+4])
+	buffer.Retrieve(index + 4)
+
+	// 请求不合法时out是错误的http回复
+	out, _, err := p.upgrader.Upgrade(c, in)
+	if err != nil {
+		state.closed = true
+		buffer.RetrieveAll()
+		c.Send(webSocketRaw(out), gev.SendInLoop(func(interface{}) { c.Close() }))
+		return false
+	}
+	state.upgraded = true
+	c.Send(webSocketRaw(out))
+	return true
+}
+
+// 回复关闭帧之后断开, 之后收到的数据都丢掉
+func (p *WebSocketProtocol) fail(c *gev.Connection, state *webSocketState, buffer *ringbuffer.RingBuffer, code ws.StatusCode, reason string) {
+	state.closed = true
+	buffer.RetrieveAll()
+	bs, _ := ws.FrameToBytes(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	c.Send(webSocketRaw(bs), gev.SendInLoop(func(interface{}) { c.Close() }))
+}
+
+func (p *WebSocketProtocol) sendFrame(c *gev.Connection, frame *ws.Frame) {
+	bs, _ := ws.FrameToBytes(frame)
+	c.Send(webSocketRaw(bs))
+}
+
+// 看一下缓冲区开头的帧头, 不移动读指针, 帧头还没收完时ok为false
+func peekFrameHeader(buffer *ringbuffer.RingBuffer) (header ws.Header, headerLength int, ok bool) {
+	var bs [ws.MaxHeaderSize]byte
+	first, end := buffer.Peek(ws.MaxHeaderSize)
+	n := copy(bs[:], first)
+	n += copy(bs[n:], end)
+	if n < 2 {
+		return
+	}
+
+	header.Fin = bs[0]&0x80 != 0
+	header.Rsv = (bs[0] & 0x70) >> 4
+	header.OpCode = ws.OpCode(bs[0] & 0x0f)
+	header.Masked = bs[1]&0x80 != 0
+
+	headerLength = 2
+	switch length := bs[1] & 0x7f; length {
+	case 126:
+		headerLength += 2
+		if n < headerLength {
+			return
+		}
+		header.Length = int64(binary.BigEndian.Uint16(bs[2:4]))
+	case 127:
+		headerLength += 8
+		if n < headerLength {
+			return
+		}
+		// 最高位必须为0, 当成超长的消息处理
+		header.Length = int64(binary.BigEndian.Uint64(bs[2:10]) & (1<<63 - 1))
+	default:
+		header.Length = int64(length)
+	}
+
+	if header.Masked {
+		if n < headerLength+4 {
+			return
+		}
+		copy(header.Mask[:], bs[headerLength:headerLength+4])
+		headerLength += 4
+	}
+	return header, headerLength, true
+}
+
+func (p *WebSocketProtocol) Packet(c *gev.Connection, data interface{}) []byte {
+	// 握手的回复和控制帧不算发出的包
+	var bs []byte
+	if raw, ok := data.(webSocketRaw); ok {
+		bs = raw
+		stateOf(c).open = true
+	} else {
+		// 握手之前的心跳这些直接丢掉
+		if !stateOf(c).open {
+			return nil
+		}
+		if p.OnPacket != nil {
+			p.OnPacket(data.([]byte))
+		}
+		payload := data.([]byte)[4:]
+		frame := ws.NewBinaryFrame(payload)
+		if len(payload) > 0 && payload[0] == '{' {
+			frame = ws.NewTextFrame(payload)
+		}
+		bs, _ = ws.FrameToBytes(frame)
+	}
+	return bs
+}
@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Allenxuxu/gev"
+	"github.com/Allenxuxu/gev/plugins/websocket/ws"
+)
+
+// OnPacket拿到的和Protocol一样是带长度头的包, 不是写成WebSocket帧之后的数据
+func TestWebSocketOnPacket(t *testing.T) {
+	var lock sync.Mutex
+	sent := make([][]byte, 0)
+	protocol := &WebSocketProtocol{
+		MaxFrameSize: 1024,
+		OnPacket: func(data []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			sent = append(sent, append([]byte(nil), data...))
+		},
+	}
+
+	addr := freeAddr(t)
+	server, err := gev.NewServer(echoHandler{},
+		gev.Address(addr),
+		gev.Network("tcp"),
+		gev.NumLoops(1),
+		gev.CustomProtocol(protocol),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(server.Stop)
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", resp.StatusCode)
+	}
+
+	// 客户端发的帧要加掩码
+	f := ws.NewBinaryFrame([]byte("hello"))
+	f.Header.Masked = true
+	f.Header.Mask = [4]byte{1, 2, 3, 4}
+	ws.Cipher(f.Payload, f.Header.Mask, 0)
+	bs, err := ws.FrameToBytes(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回复是不加掩码的短二进制帧
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	want := frame([]byte("hello|"))
+	if !bytes.Equal(payload, want[4:]) {
+		t.Fatalf("got reply %q", payload)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sent) != 1 || !bytes.Equal(sent[0], want) {
+		t.Errorf("OnPacket got %q, want %q", sent, want)
+	}
+}
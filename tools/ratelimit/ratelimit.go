@@ -0,0 +1,36 @@
+package ratelimit
+
+import "time"
+
+// 令牌桶, 不是并发安全的, 需要调用方自己加锁
+type TokenBucket struct {
+	capacity   float64
+	perSecond  float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// 桶一开始是满的
+func NewTokenBucket(capacity int, perSecond float64) *TokenBucket {
+	return &TokenBucket{
+		capacity:   float64(capacity),
+		perSecond:  perSecond,
+		tokens:     float64(capacity),
+		lastRefill: time.Now(),
+	}
+}
+
+// 尝试拿一个令牌, 拿不到返回false
+func (tb *TokenBucket) Allow(now time.Time) bool {
+	tb.tokens += now.Sub(tb.lastRefill).Seconds() * tb.perSecond
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.lastRefill = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
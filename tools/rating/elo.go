@@ -0,0 +1,13 @@
+package rating
+
+import "math"
+
+// Elo的K值
+const EloK = 32
+
+// 计算一局之后双方的新分数, scoreA为A方得分: 赢1, 平0.5, 输0
+func Elo(ratingA int, ratingB int, scoreA float64) (int, int) {
+	expectA := 1 / (1 + math.Pow(10, float64(ratingB-ratingA)/400))
+	delta := int(math.Round(EloK * (scoreA - expectA)))
+	return ratingA + delta, ratingB - delta
+}
@@ -0,0 +1,370 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNotArenaPlayer   = errors.New("tournament: not playing in this game")
+	ErrAlreadyBerserked = errors.New("tournament: already berserked")
+)
+
+// 竞技场积分
+const (
+	ArenaWinPoints  = 2
+	ArenaDrawPoints = 1
+	// 连胜两局之后进入连胜状态, 之后的胜和积分翻倍, 直到没有赢为止
+	ArenaStreakLength = 2
+	// 狂暴之后赢棋额外加的分
+	ArenaBerserkBonus = 1
+	// 狂暴的一方至少要走这么多步, 赢了才有额外加分
+	ArenaBerserkMinMoves = 7
+)
+
+// 只有两个人在等待并且上一局就是彼此时, 至少等这么久才会再编排到一起
+const ArenaRepairDelay = 10 * time.Second
+
+// 竞技场成绩单上的一局
+type ArenaSheetEntry struct {
+	Opponent int64
+	Result   Result
+	Side     chess.Side
+	Points   int
+	Berserk  bool
+}
+
+type ArenaPlayer struct {
+	ID     int64
+	Name   string
+	Rating int
+	Score  int
+	// 当前连胜局数
+	Streak int
+	Sheet  []ArenaSheetEntry
+	// 暂停的选手不再参加编排, 重新报名可以继续
+	Withdrawn bool
+	// 正在下竞技场的对局
+	Playing bool
+
+	// 开始等待编排的时间
+	waitingSince time.Time
+	lastOpponent int64
+	// 执白次数减执黑次数
+	colorBalance int
+}
+
+// 连胜状态
+func (p *ArenaPlayer) OnFire() bool {
+	return p.Streak >= ArenaStreakLength
+}
+
+// 竞技场的一局
+type ArenaGame struct {
+	White        int64
+	Black        int64
+	WhiteBerserk bool
+	BlackBerserk bool
+	Result       Result
+}
+
+// 竞技场, 在规定时间内一局结束马上编排下一局
+type Arena struct {
+	ID          int64
+	Name        string
+	Options     chess.GameOptions
+	OrganizerID int64
+	Duration    time.Duration
+	State       State
+	StartedAt   time.Time
+	EndsAt      time.Time
+
+	Players []*ArenaPlayer
+	// 所有编排过的对局
+	Games []*ArenaGame
+}
+
+func NewArena(id int64, name string, options chess.GameOptions, organizerID int64, duration time.Duration) *Arena {
+	return &Arena{
+		ID:          id,
+		Name:        name,
+		Options:     options,
+		OrganizerID: organizerID,
+		Duration:    duration,
+		State:       StateRegistering,
+		Players:     make([]*ArenaPlayer, 0),
+		Games:       make([]*ArenaGame, 0),
+	}
+}
+
+func (a *Arena) Player(id int64) *ArenaPlayer {
+	for _, p := range a.Players {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// 比赛进行中也可以报名, 暂停的选手重新报名之后继续参加编排
+func (a *Arena) Register(id int64, name string, rating int, now time.Time) error {
+	if a.State == StateFinished {
+		return ErrNotRegistering
+	}
+
+	if p := a.Player(id); p != nil {
+		if !p.Withdrawn {
+			return ErrAlreadyRegistered
+		}
+		p.Withdrawn = false
+		p.waitingSince = now
+		return nil
+	}
+
+	a.Players = append(a.Players, &ArenaPlayer{ID: id, Name: name, Rating: rating, waitingSince: now})
+	return nil
+}
+
+// 报名阶段退出直接删除, 比赛中退出则暂停, 已经得到的积分保留
+func (a *Arena) Withdraw(id int64) error {
+	for i, p := range a.Players {
+		if p.ID != id {
+			continue
+		}
+		if a.State == StateRegistering {
+			a.Players = append(a.Players[:i], a.Players[i+1:]...)
+		} else {
+			p.Withdrawn = true
+		}
+		return nil
+	}
+	return ErrNotRegistered
+}
+
+func (a *Arena) Start(now time.Time) error {
+	if a.State != StateRegistering {
+		return ErrNotRegistering
+	}
+
+	a.State = StateRunning
+	a.StartedAt = now
+	a.EndsAt = now.Add(a.Duration)
+	for _, p := range a.Players {
+		p.waitingSince = now
+	}
+	return nil
+}
+
+// 时间到了之后不再编排新的对局, 正在下的对局还会计分
+func (a *Arena) Ended(now time.Time) bool {
+	return a.State == StateRunning && !now.Before(a.EndsAt)
+}
+
+func (a *Arena) Remaining(now time.Time) time.Duration {
+	switch a.State {
+	case StateRegistering:
+		return a.Duration
+	case StateRunning:
+		if now.Before(a.EndsAt) {
+			return a.EndsAt.Sub(now)
+		}
+	}
+	return 0
+}
+
+// 正在进行的对局数
+func (a *Arena) PlayingGames() int {
+	count := 0
+	for _, g := range a.Games {
+		if g.Result == ResultPending {
+			count++
+		}
+	}
+	return count
+}
+
+// 时间到了并且所有对局都结束之后调用
+func (a *Arena) Finish() {
+	a.State = StateFinished
+}
+
+// 比较两个选手的排名, 积分相同时按等级分
+func arenaRankedBefore(a *ArenaPlayer, b *ArenaPlayer) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.Rating > b.Rating
+}
+
+// 上一局就是彼此时, 两个人都等了足够久才允许再编排到一起
+func (a *Arena) canPair(x *ArenaPlayer, y *ArenaPlayer, now time.Time) bool {
+	if x.lastOpponent != y.ID && y.lastOpponent != x.ID {
+		return true
+	}
+	return now.Sub(x.waitingSince) >= ArenaRepairDelay && now.Sub(y.waitingSince) >= ArenaRepairDelay
+}
+
+// 编排所有正在等待的选手, available判断选手现在能不能开始对局(在线并且空闲)
+// 按排名从高到低, 每个人和排名最接近的能编排的人下
+func (a *Arena) Pair(now time.Time, available func(id int64) bool) []*ArenaGame {
+	if a.State != StateRunning || a.Ended(now) {
+		return nil
+	}
+
+	pool := make([]*ArenaPlayer, 0)
+	for _, p := range a.Players {
+		if !p.Withdrawn && !p.Playing && available(p.ID) {
+			pool = append(pool, p)
+		}
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		return arenaRankedBefore(pool[i], pool[j])
+	})
+
+	// 人数为奇数时, 等得最短的人这次不编排, 一样久时排名低的不编排
+	if len(pool)%2 == 1 {
+		latest := len(pool) - 1
+		for i := len(pool) - 2; i >= 0; i-- {
+			if pool[i].waitingSince.After(pool[latest].waitingSince) {
+				latest = i
+			}
+		}
+		pool = append(pool[:latest], pool[latest+1:]...)
+	}
+
+	games := make([]*ArenaGame, 0, len(pool)/2)
+	paired := make([]bool, len(pool))
+	for i := range pool {
+		if paired[i] {
+			continue
+		}
+		for j := i + 1; j < len(pool); j++ {
+			if paired[j] || !a.canPair(pool[i], pool[j], now) {
+				continue
+			}
+
+			paired[i], paired[j] = true, true
+			games = append(games, a.newGame(pool[i], pool[j]))
+			break
+		}
+	}
+	return games
+}
+
+// 执白次数多的一方执黑, 一样多时排名低的执白
+func (a *Arena) newGame(x *ArenaPlayer, y *ArenaPlayer) *ArenaGame {
+	white, black := y, x
+	if x.colorBalance < y.colorBalance {
+		white, black = x, y
+	}
+	white.colorBalance++
+	black.colorBalance--
+
+	white.Playing = true
+	black.Playing = true
+	white.lastOpponent = black.ID
+	black.lastOpponent = white.ID
+
+	game := &ArenaGame{White: white.ID, Black: black.ID}
+	a.Games = append(a.Games, game)
+	return game
+}
+
+// 在走第一步之前狂暴, 自己的时间减半并且没有加秒, 赢了多得分, 时间的处理由调用方负责
+func (a *Arena) Berserk(game *ArenaGame, id int64) error {
+	if game.Result != ResultPending {
+		return ErrResultReported
+	}
+
+	switch id {
+	case game.White:
+		if game.WhiteBerserk {
+			return ErrAlreadyBerserked
+		}
+		game.WhiteBerserk = true
+	case game.Black:
+		if game.BlackBerserk {
+			return ErrAlreadyBerserked
+		}
+		game.BlackBerserk = true
+	default:
+		return ErrNotArenaPlayer
+	}
+	return nil
+}
+
+// 计算这一局的得分并更新连胜状态
+func (p *ArenaPlayer) addResult(entry ArenaSheetEntry, won bool, drawn bool, moves int) {
+	points := 0
+	switch {
+	case won:
+		points = ArenaWinPoints
+	case drawn:
+		points = ArenaDrawPoints
+	}
+	if p.OnFire() {
+		points *= 2
+	}
+	if won && entry.Berserk && moves >= ArenaBerserkMinMoves {
+		points += ArenaBerserkBonus
+	}
+
+	if won {
+		p.Streak++
+	} else {
+		p.Streak = 0
+	}
+
+	entry.Points = points
+	p.Score += points
+	p.Sheet = append(p.Sheet, entry)
+	p.Playing = false
+}
+
+// 记录一局的结果, plies为双方一共走的步数
+func (a *Arena) Report(game *ArenaGame, result Result, plies int, now time.Time) error {
+	if a.State != StateRunning {
+		return ErrNotRunning
+	}
+	if game.Result != ResultPending {
+		return ErrResultReported
+	}
+	game.Result = result
+
+	white := a.Player(game.White)
+	black := a.Player(game.Black)
+	drawn := result == ResultDraw
+	white.addResult(
+		ArenaSheetEntry{Opponent: black.ID, Result: result, Side: chess.SideWhite, Berserk: game.WhiteBerserk},
+		result == ResultWhiteWin, drawn, (plies+1)/2,
+	)
+	black.addResult(
+		ArenaSheetEntry{Opponent: white.ID, Result: result, Side: chess.SideBlack, Berserk: game.BlackBerserk},
+		result == ResultBlackWin, drawn, plies/2,
+	)
+	white.waitingSince = now
+	black.waitingSince = now
+	return nil
+}
+
+type ArenaStanding struct {
+	Rank   int
+	Player *ArenaPlayer
+}
+
+// 实时排行榜, 按积分和等级分排序
+func (a *Arena) Leaderboard() []ArenaStanding {
+	players := make([]*ArenaPlayer, len(a.Players))
+	copy(players, a.Players)
+	sort.SliceStable(players, func(i, j int) bool {
+		return arenaRankedBefore(players[i], players[j])
+	})
+
+	standings := make([]ArenaStanding, 0, len(players))
+	for i, p := range players {
+		standings = append(standings, ArenaStanding{Rank: i + 1, Player: p})
+	}
+	return standings
+}
@@ -0,0 +1,269 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var arenaStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// 报名n个选手并开始, id为1到n, 等级分按id从高到低
+func newTestArena(t *testing.T, n int) *Arena {
+	t.Helper()
+	a := NewArena(1, "test", chess.GameOptions{}, 1, time.Hour)
+	for id := int64(1); id <= int64(n); id++ {
+		if err := a.Register(id, fmt.Sprint(id), 2000-int(id)*10, arenaStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Start(arenaStart); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func everyoneAvailable(id int64) bool {
+	return true
+}
+
+// 编排出来的对局, 每局是[白方, 黑方]
+func pairedIDs(games []*ArenaGame) [][2]int64 {
+	ids := make([][2]int64, 0, len(games))
+	for _, g := range games {
+		ids = append(ids, [2]int64{g.White, g.Black})
+	}
+	return ids
+}
+
+// 连胜第三局开始积分翻倍, 狂暴赢棋并且自己走够步数才有额外加分
+func TestArenaAddResult(t *testing.T) {
+	tests := []struct {
+		name       string
+		streak     int
+		won        bool
+		drawn      bool
+		berserk    bool
+		moves      int
+		wantPoints int
+		wantStreak int
+	}{
+		{"first win", 0, true, false, false, 20, ArenaWinPoints, 1},
+		{"second win", 1, true, false, false, 20, ArenaWinPoints, 2},
+		{"third win on fire", 2, true, false, false, 20, 2 * ArenaWinPoints, 3},
+		{"draw", 0, false, true, false, 20, ArenaDrawPoints, 0},
+		{"draw on fire ends the streak", 3, false, true, false, 20, 2 * ArenaDrawPoints, 0},
+		{"loss on fire", 2, false, false, false, 20, 0, 0},
+		{"berserk win", 0, true, false, true, ArenaBerserkMinMoves, ArenaWinPoints + ArenaBerserkBonus, 1},
+		{"berserk win too short", 0, true, false, true, ArenaBerserkMinMoves - 1, ArenaWinPoints, 1},
+		{"berserk win on fire", 2, true, false, true, ArenaBerserkMinMoves, 2*ArenaWinPoints + ArenaBerserkBonus, 3},
+		{"berserk draw", 0, false, true, true, 20, ArenaDrawPoints, 0},
+		{"berserk loss", 1, false, false, true, 20, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ArenaPlayer{ID: 1, Score: 10, Streak: tt.streak, Playing: true}
+			p.addResult(ArenaSheetEntry{Opponent: 2, Berserk: tt.berserk}, tt.won, tt.drawn, tt.moves)
+
+			if p.Score != 10+tt.wantPoints || p.Streak != tt.wantStreak || p.Playing {
+				t.Errorf("got score %d streak %d playing %v, want score %d streak %d",
+					p.Score, p.Streak, p.Playing, 10+tt.wantPoints, tt.wantStreak)
+			}
+			if len(p.Sheet) != 1 || p.Sheet[0].Points != tt.wantPoints || p.Sheet[0].Opponent != 2 {
+				t.Errorf("got sheet %+v", p.Sheet)
+			}
+		})
+	}
+}
+
+// 通过Report一局一局地报结果, 连胜状态从第三局开始, 输一局之后重新计算
+func TestArenaStreak(t *testing.T) {
+	a := newTestArena(t, 2)
+	results := []struct {
+		result Result
+		want   int
+	}{
+		{ResultWhiteWin, ArenaWinPoints},
+		{ResultWhiteWin, ArenaWinPoints},
+		{ResultWhiteWin, 2 * ArenaWinPoints},
+		{ResultWhiteWin, 2 * ArenaWinPoints},
+		{ResultBlackWin, 0},
+		{ResultWhiteWin, ArenaWinPoints},
+	}
+	winner := a.Player(1)
+	for i, r := range results {
+		// 直接建对局, 每局都让1执白
+		game := &ArenaGame{White: 1, Black: 2}
+		a.Games = append(a.Games, game)
+		if err := a.Report(game, r.result, 40, arenaStart); err != nil {
+			t.Fatal(err)
+		}
+		if got := winner.Sheet[i].Points; got != r.want {
+			t.Errorf("game %d: got %d points, want %d", i+1, got, r.want)
+		}
+	}
+	if winner.OnFire() {
+		t.Error("still on fire after a loss and a single win")
+	}
+	if err := a.Report(a.Games[0], ResultDraw, 40, arenaStart); err != ErrResultReported {
+		t.Errorf("reported twice: %v", err)
+	}
+}
+
+// 狂暴的一方按自己走的步数判断是否加分, 白方比黑方多走一步
+func TestArenaBerserk(t *testing.T) {
+	tests := []struct {
+		name      string
+		berserker int64
+		result    Result
+		plies     int
+		wantBonus bool
+	}{
+		{"white enough moves", 1, ResultWhiteWin, 2*ArenaBerserkMinMoves - 1, true},
+		{"white too few moves", 1, ResultWhiteWin, 2*ArenaBerserkMinMoves - 2, false},
+		{"black enough moves", 2, ResultBlackWin, 2 * ArenaBerserkMinMoves, true},
+		{"black too few moves", 2, ResultBlackWin, 2*ArenaBerserkMinMoves - 1, false},
+		{"berserker lost", 1, ResultBlackWin, 40, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestArena(t, 2)
+			game := &ArenaGame{White: 1, Black: 2}
+			a.Games = append(a.Games, game)
+			if err := a.Berserk(game, tt.berserker); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Report(game, tt.result, tt.plies, arenaStart); err != nil {
+				t.Fatal(err)
+			}
+
+			entry := a.Player(tt.berserker).Sheet[0]
+			won := (tt.berserker == 1) == (tt.result == ResultWhiteWin)
+			want := 0
+			if won {
+				want = ArenaWinPoints
+			}
+			if tt.wantBonus {
+				want += ArenaBerserkBonus
+			}
+			if !entry.Berserk || entry.Points != want {
+				t.Errorf("got %+v, want %d points", entry, want)
+			}
+			other := a.Player(3 - tt.berserker).Sheet[0]
+			if other.Berserk {
+				t.Errorf("opponent marked as berserk: %+v", other)
+			}
+		})
+	}
+}
+
+func TestArenaBerserkErrors(t *testing.T) {
+	a := newTestArena(t, 2)
+	game := &ArenaGame{White: 1, Black: 2}
+	a.Games = append(a.Games, game)
+
+	if err := a.Berserk(game, 3); err != ErrNotArenaPlayer {
+		t.Errorf("outsider: got %v", err)
+	}
+	if err := a.Berserk(game, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Berserk(game, 2); err != ErrAlreadyBerserked {
+		t.Errorf("twice: got %v", err)
+	}
+	if err := a.Report(game, ResultDraw, 10, arenaStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Berserk(game, 1); err != ErrResultReported {
+		t.Errorf("after the result: got %v", err)
+	}
+}
+
+// 人数为奇数时等得最短的人这次不编排, 一样久时排名低的不编排
+func TestArenaPairOddPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiting map[int64]time.Duration
+		want    [][2]int64
+	}{
+		// 都是开始时进来的, 排名最低的3不编排, 2执白
+		{"same wait", nil, [][2]int64{{2, 1}}},
+		// 1刚下完一局
+		{"latest sits out", map[int64]time.Duration{1: 5 * time.Second}, [][2]int64{{3, 2}}},
+		{"latest in the middle", map[int64]time.Duration{2: 5 * time.Second, 3: time.Second}, [][2]int64{{3, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestArena(t, 3)
+			for id, d := range tt.waiting {
+				a.Player(id).waitingSince = arenaStart.Add(d)
+			}
+			got := pairedIDs(a.Pair(arenaStart.Add(time.Minute), everyoneAvailable))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 在下棋, 暂停, 不在线的选手不编排, 时间到了之后不再编排
+func TestArenaPairSkipsUnavailable(t *testing.T) {
+	a := newTestArena(t, 6)
+	a.Player(1).Playing = true
+	a.Player(2).Withdrawn = true
+	offline := func(id int64) bool { return id != 3 }
+
+	got := pairedIDs(a.Pair(arenaStart, offline))
+	if want := [][2]int64{{5, 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if games := a.Pair(a.EndsAt, everyoneAvailable); len(games) != 0 {
+		t.Errorf("paired after the end: %v", pairedIDs(games))
+	}
+}
+
+// 上一局就是彼此的两个人, 都等够ArenaRepairDelay之前不会再编排到一起, 有别人可以编排时先和别人下
+func TestArenaRepairDelay(t *testing.T) {
+	a := newTestArena(t, 2)
+	first := a.Pair(arenaStart, everyoneAvailable)
+	if len(first) != 1 {
+		t.Fatalf("got %v", pairedIDs(first))
+	}
+	ended := arenaStart.Add(time.Minute)
+	if err := a.Report(first[0], ResultDraw, 20, ended); err != nil {
+		t.Fatal(err)
+	}
+
+	if games := a.Pair(ended.Add(ArenaRepairDelay-time.Second), everyoneAvailable); len(games) != 0 {
+		t.Errorf("rematched too early: %v", pairedIDs(games))
+	}
+	again := a.Pair(ended.Add(ArenaRepairDelay), everyoneAvailable)
+	if len(again) != 1 {
+		t.Fatalf("not rematched after the delay")
+	}
+	// 颜色交替
+	if again[0].White != first[0].Black {
+		t.Errorf("got %v after %v, want colors swapped", pairedIDs(again), pairedIDs(first))
+	}
+
+	// 新来的两个人, 1和2刚下完, 各自和新来的下
+	if err := a.Report(again[0], ResultDraw, 20, ended); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{3, 4} {
+		if err := a.Register(id, fmt.Sprint(id), 1000, ended); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := a.Pair(ended, everyoneAvailable)
+	for _, g := range got {
+		if (g.White == 1 && g.Black == 2) || (g.White == 2 && g.Black == 1) {
+			t.Errorf("1 and 2 rematched without waiting: %v", pairedIDs(got))
+		}
+	}
+	if len(got) != 2 {
+		t.Errorf("got %v, want two games", pairedIDs(got))
+	}
+}
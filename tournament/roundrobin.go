@@ -0,0 +1,77 @@
+package tournament
+
+// 伯格编排, 人数为奇数时补一个0号选手表示轮空
+// 用轮转法, 每轮转动n/2个位置, 这样每个选手的颜色基本交替, 最多连续一次同色
+func bergerSchedule(players []*Player) [][]*Pairing {
+	ids := make([]int64, 0, len(players)+1)
+	for _, p := range players {
+		ids = append(ids, p.ID)
+	}
+	if len(ids)%2 == 1 {
+		ids = append(ids, 0)
+	}
+
+	n := len(ids)
+	m := n - 1
+	half := n / 2
+	fixed := ids[m]
+
+	schedule := make([][]*Pairing, 0, m)
+	for r := 0; r < m; r++ {
+		round := r + 1
+		s := (r * half) % m
+		pairings := make([]*Pairing, 0, half)
+
+		// 固定选手的颜色每轮交替
+		if r%2 == 0 {
+			pairings = append(pairings, newScheduledPairing(round, ids[s], fixed))
+		} else {
+			pairings = append(pairings, newScheduledPairing(round, fixed, ids[s]))
+		}
+
+		for i := 1; i < half; i++ {
+			white := ids[(s+i)%m]
+			black := ids[(s-i+m)%m]
+			pairings = append(pairings, newScheduledPairing(round, white, black))
+		}
+		schedule = append(schedule, pairings)
+	}
+	return schedule
+}
+
+// 轮空的一方总是放在白方
+func newScheduledPairing(round int, white int64, black int64) *Pairing {
+	if white == 0 {
+		white, black = black, white
+	}
+	return &Pairing{Round: round, White: white, Black: black}
+}
+
+// 取出排好的一轮, 已经退出的选手的对局直接判对手弃权胜
+func (t *Tournament) roundRobinRound(round int) []*Pairing {
+	pairings := make([]*Pairing, 0, len(t.schedule[round-1]))
+	for _, scheduled := range t.schedule[round-1] {
+		p := *scheduled
+		if p.Black != 0 {
+			whiteGone := t.Player(p.White).Withdrawn
+			blackGone := t.Player(p.Black).Withdrawn
+			switch {
+			case whiteGone && blackGone:
+				p.Result = ResultDoubleForfeit
+				p.Forfeit = true
+			case whiteGone:
+				p.Result = ResultBlackWin
+				p.Forfeit = true
+			case blackGone:
+				p.Result = ResultWhiteWin
+				p.Forfeit = true
+			}
+		} else if t.Player(p.White).Withdrawn {
+			// 退出的选手轮空也不得分
+			p.Result = ResultDoubleForfeit
+			p.Forfeit = true
+		}
+		pairings = append(pairings, &p)
+	}
+	return pairings
+}
@@ -0,0 +1,108 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"testing"
+)
+
+// 每两个人正好相遇一次, 每轮每人正好出现一次, 轮空总是白方, 不会连续三轮同色
+func TestBergerSchedule(t *testing.T) {
+	for n := 2; n <= 10; n++ {
+		players := make([]*Player, 0, n)
+		for id := int64(1); id <= int64(n); id++ {
+			players = append(players, &Player{ID: id})
+		}
+		schedule := bergerSchedule(players)
+
+		wantRounds := n - 1
+		if n%2 == 1 {
+			wantRounds = n
+		}
+		if len(schedule) != wantRounds {
+			t.Errorf("n=%d: %d rounds, want %d", n, len(schedule), wantRounds)
+			continue
+		}
+
+		met := make(map[[2]int64]bool)
+		colors := make(map[int64][]bool)
+		for r, round := range schedule {
+			seen := make(map[int64]bool)
+			for _, p := range round {
+				if p.Round != r+1 {
+					t.Errorf("n=%d: pairing %+v in round %d", n, p, r+1)
+				}
+				if p.White == 0 {
+					t.Errorf("n=%d round %d: bye on the black side", n, r+1)
+				}
+				for _, id := range []int64{p.White, p.Black} {
+					if id != 0 && seen[id] {
+						t.Errorf("n=%d round %d: %d plays twice", n, r+1, id)
+					}
+					seen[id] = true
+				}
+				if p.Black == 0 {
+					continue
+				}
+				key := [2]int64{min(p.White, p.Black), max(p.White, p.Black)}
+				if met[key] {
+					t.Errorf("n=%d: %d and %d meet twice", n, key[0], key[1])
+				}
+				met[key] = true
+				colors[p.White] = append(colors[p.White], true)
+				colors[p.Black] = append(colors[p.Black], false)
+			}
+			for _, p := range players {
+				if !seen[p.ID] {
+					t.Errorf("n=%d round %d: %d missing", n, r+1, p.ID)
+				}
+			}
+		}
+		if len(met) != n*(n-1)/2 {
+			t.Errorf("n=%d: %d pairs met, want %d", n, len(met), n*(n-1)/2)
+		}
+		for id, c := range colors {
+			for i := 2; i < len(c); i++ {
+				if c[i] == c[i-1] && c[i] == c[i-2] {
+					t.Errorf("n=%d: %d has the same color three times in a row", n, id)
+				}
+			}
+		}
+	}
+}
+
+// 退出的选手的对局直接判弃权, 退出的选手轮空也不得分
+func TestRoundRobinWithdrawn(t *testing.T) {
+	tests := []struct {
+		name      string
+		white     int64
+		black     int64
+		withdrawn []int64
+		want      Result
+	}{
+		{"both present", 1, 2, nil, ResultPending},
+		{"white gone", 1, 2, []int64{1}, ResultBlackWin},
+		{"black gone", 1, 2, []int64{2}, ResultWhiteWin},
+		{"both gone", 1, 2, []int64{1, 2}, ResultDoubleForfeit},
+		{"bye", 1, 0, nil, ResultPending},
+		{"bye gone", 1, 0, []int64{1}, ResultDoubleForfeit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tour := New(1, "test", FormatRoundRobin, 0, chess.GameOptions{}, 1)
+			tour.Players = []*Player{{ID: 1}, {ID: 2}}
+			for _, id := range tt.withdrawn {
+				tour.Player(id).Withdrawn = true
+			}
+			scheduled := &Pairing{Round: 1, White: tt.white, Black: tt.black}
+			tour.schedule = [][]*Pairing{{scheduled}}
+
+			p := tour.roundRobinRound(1)[0]
+			if p.Result != tt.want || p.Forfeit != (tt.want != ResultPending) {
+				t.Errorf("got %v forfeit %v, want %v", p.Result, p.Forfeit, tt.want)
+			}
+			if scheduled.Result != ResultPending {
+				t.Error("the schedule was modified")
+			}
+		})
+	}
+}
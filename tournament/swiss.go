@@ -0,0 +1,230 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"sort"
+)
+
+// 回溯搜索最多尝试多少次, 防止人数很多时搜索时间爆炸
+const swissSearchBudget = 100000
+
+type swissEntry struct {
+	player *Player
+	rec    *record
+}
+
+// 颜色偏好的强度
+const (
+	colorPrefNone = iota
+	// 上一轮的颜色和这一轮相反即可
+	colorPrefMild
+	// 白黑次数差1
+	colorPrefStrong
+	// 白黑次数差2或者连续两轮同色, 必须满足
+	colorPrefAbsolute
+)
+
+func opposite(side chess.Side) chess.Side {
+	if side == chess.SideWhite {
+		return chess.SideBlack
+	}
+	return chess.SideWhite
+}
+
+func colorPreference(rec *record) (chess.Side, int) {
+	n := len(rec.colors)
+	if n == 0 {
+		return chess.SideBoth, colorPrefNone
+	}
+
+	diff := 0
+	for _, c := range rec.colors {
+		if c == chess.SideWhite {
+			diff++
+		} else {
+			diff--
+		}
+	}
+
+	last := rec.colors[n-1]
+	sameTwice := n >= 2 && rec.colors[n-2] == last
+	switch {
+	case diff > 1 || (sameTwice && last == chess.SideWhite):
+		return chess.SideBlack, colorPrefAbsolute
+	case diff < -1 || (sameTwice && last == chess.SideBlack):
+		return chess.SideWhite, colorPrefAbsolute
+	case diff == 1:
+		return chess.SideBlack, colorPrefStrong
+	case diff == -1:
+		return chess.SideWhite, colorPrefStrong
+	default:
+		return opposite(last), colorPrefMild
+	}
+}
+
+// 双方都必须执同一种颜色时不能编排在一起
+func colorsCompatible(a *swissEntry, b *swissEntry) bool {
+	sideA, strengthA := colorPreference(a.rec)
+	sideB, strengthB := colorPreference(b.rec)
+	return !(strengthA == colorPrefAbsolute && strengthB == colorPrefAbsolute && sideA == sideB)
+}
+
+// 分配颜色, a的排名比b高, board为台次(从0开始)
+func allocateColors(a *swissEntry, b *swissEntry, board int) (*swissEntry, *swissEntry) {
+	sideA, strengthA := colorPreference(a.rec)
+	sideB, strengthB := colorPreference(b.rec)
+
+	// 双方都没有偏好(第一轮), 台次为偶数时排名高的执白, 奇数时执黑
+	if strengthA == colorPrefNone && strengthB == colorPrefNone {
+		if board%2 == 0 {
+			return a, b
+		}
+		return b, a
+	}
+
+	// 偏好不冲突, 或者只有一方有偏好
+	if strengthB == colorPrefNone || (strengthA != colorPrefNone && sideA != sideB) {
+		if sideA == chess.SideWhite {
+			return a, b
+		}
+		return b, a
+	}
+	if strengthA == colorPrefNone {
+		if sideB == chess.SideWhite {
+			return b, a
+		}
+		return a, b
+	}
+
+	// 偏好冲突, 强的一方优先, 一样强时排名高的优先
+	if strengthB > strengthA {
+		if sideB == chess.SideWhite {
+			return b, a
+		}
+		return a, b
+	}
+	if sideA == chess.SideWhite {
+		return a, b
+	}
+	return b, a
+}
+
+// 荷兰系统的候选对手顺序
+// 同分组内上半区对下半区, 第一顺位是下半区的第一个, 然后依次往后, 再往上半区找,
+// 同分组内找不到时降级到下一个分组, 按排名顺序
+func dutchCandidates(entries []*swissEntry, used []bool, top int) []int {
+	score := entries[top].rec.score
+	group := make([]int, 0)
+	lower := make([]int, 0)
+	for j := range entries {
+		if used[j] || j == top {
+			continue
+		}
+		if entries[j].rec.score == score {
+			group = append(group, j)
+		} else {
+			lower = append(lower, j)
+		}
+	}
+
+	// top是分组内剩下的第一个, 分组大小为len(group)+1
+	half := (len(group) + 1) / 2
+	candidates := make([]int, 0, len(group)+len(lower))
+	for k := half - 1; k < len(group); k++ {
+		if k >= 0 {
+			candidates = append(candidates, group[k])
+		}
+	}
+	for k := half - 2; k >= 0; k-- {
+		candidates = append(candidates, group[k])
+	}
+	return append(candidates, lower...)
+}
+
+func searchSwissPairs(entries []*swissEntry, used []bool, strictColors bool, budget *int) ([][2]int, bool) {
+	top := -1
+	for i := range entries {
+		if !used[i] {
+			top = i
+			break
+		}
+	}
+	if top == -1 {
+		return [][2]int{}, true
+	}
+
+	used[top] = true
+	for _, c := range dutchCandidates(entries, used, top) {
+		if *budget <= 0 {
+			break
+		}
+		*budget--
+
+		if entries[top].rec.opponents[entries[c].player.ID] {
+			continue
+		}
+		if strictColors && !colorsCompatible(entries[top], entries[c]) {
+			continue
+		}
+
+		used[c] = true
+		rest, ok := searchSwissPairs(entries, used, strictColors, budget)
+		if ok {
+			return append([][2]int{{top, c}}, rest...), true
+		}
+		used[c] = false
+	}
+	used[top] = false
+	return nil, false
+}
+
+func (t *Tournament) swissRound(round int) ([]*Pairing, error) {
+	records := t.records()
+	entries := make([]*swissEntry, 0, len(t.Players))
+	for _, p := range t.activePlayers() {
+		entries = append(entries, &swissEntry{player: p, rec: records[p.ID]})
+	}
+
+	// 按分数, 等级分排名
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].rec.score != entries[j].rec.score {
+			return entries[i].rec.score > entries[j].rec.score
+		}
+		return entries[i].player.Rating > entries[j].player.Rating
+	})
+
+	pairings := make([]*Pairing, 0, len(entries)/2+1)
+
+	// 人数为奇数时, 排名最低的还没有轮空过的选手轮空
+	if len(entries)%2 == 1 {
+		bye := len(entries) - 1
+		for i := len(entries) - 1; i >= 0; i-- {
+			if !entries[i].rec.hadBye {
+				bye = i
+				break
+			}
+		}
+		pairings = append(pairings, &Pairing{Round: round, White: entries[bye].player.ID})
+		entries = append(entries[:bye], entries[bye+1:]...)
+	}
+
+	// 先要求颜色规则, 找不到的话放宽颜色规则, 永远不允许重复对局
+	var pairs [][2]int
+	ok := false
+	for _, strict := range []bool{true, false} {
+		budget := swissSearchBudget
+		pairs, ok = searchSwissPairs(entries, make([]bool, len(entries)), strict, &budget)
+		if ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, ErrNoPairing
+	}
+
+	for board, pair := range pairs {
+		white, black := allocateColors(entries[pair[0]], entries[pair[1]], board)
+		pairings = append(pairings, &Pairing{Round: round, White: white.player.ID, Black: black.player.ID})
+	}
+	return pairings, nil
+}
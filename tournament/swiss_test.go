@@ -0,0 +1,244 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// 报名n个选手, id为1到n, 等级分按id从高到低
+func newTestTournament(t *testing.T, format Format, rounds int, n int) *Tournament {
+	t.Helper()
+	tt := New(1, "test", format, rounds, chess.GameOptions{}, 1)
+	for id := int64(1); id <= int64(n); id++ {
+		if err := tt.Register(id, fmt.Sprint(id), 2000-int(id)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tt
+}
+
+// 当前轮的对局都按id小的一方赢来报告
+func reportHigherSeedWins(t *testing.T, tt *Tournament, pairings []*Pairing) {
+	t.Helper()
+	for _, p := range pairings {
+		if p.Result != ResultPending {
+			continue
+		}
+		result := ResultWhiteWin
+		if p.Black < p.White {
+			result = ResultBlackWin
+		}
+		if err := tt.Report(p, result, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testSwissEntries(scores ...float64) []*swissEntry {
+	entries := make([]*swissEntry, 0, len(scores))
+	for i, score := range scores {
+		entries = append(entries, &swissEntry{
+			player: &Player{ID: int64(i + 1)},
+			rec:    &record{score: score, opponents: make(map[int64]bool)},
+		})
+	}
+	return entries
+}
+
+// 同分组内上半区对下半区, 然后往上半区找, 最后降级到下一个分组
+func TestDutchCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []float64
+		used   []int
+		top    int
+		want   []int
+	}{
+		{"one group", []float64{0, 0, 0, 0, 0, 0}, nil, 0, []int{3, 4, 5, 2, 1}},
+		{"odd group", []float64{1, 1, 1, 0}, nil, 0, []int{1, 2, 3}},
+		{"group then lower", []float64{1, 1, 1, 1, 0, 0}, nil, 0, []int{2, 3, 1, 4, 5}},
+		{"skip used", []float64{0, 0, 0, 0}, []int{0, 1}, 2, []int{3}},
+		{"alone in group", []float64{2, 1, 1, 0}, nil, 0, []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := testSwissEntries(tt.scores...)
+			used := make([]bool, len(entries))
+			for _, i := range tt.used {
+				used[i] = true
+			}
+			got := dutchCandidates(entries, used, tt.top)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 第一轮按种子顺序上半区对下半区, 台次为偶数时种子靠前的执白
+func TestSwissFirstRound(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 3, 6)
+	pairings, err := tt.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([][2]int64, 0, len(pairings))
+	for _, p := range pairings {
+		got = append(got, [2]int64{p.White, p.Black})
+	}
+	want := [][2]int64{{1, 4}, {5, 2}, {3, 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllocateColors(t *testing.T) {
+	const W, B = chess.SideWhite, chess.SideBlack
+	tests := []struct {
+		name    string
+		aColors []chess.Side
+		bColors []chess.Side
+		board   int
+		// 执白的一方, true为a
+		wantA bool
+	}{
+		{"no preference even board", nil, nil, 0, true},
+		{"no preference odd board", nil, nil, 1, false},
+		{"only a has preference", []chess.Side{W}, nil, 0, false},
+		{"only b has preference", nil, []chess.Side{W}, 1, true},
+		{"preferences agree", []chess.Side{W}, []chess.Side{B}, 0, false},
+		{"stronger preference wins", []chess.Side{W, B}, []chess.Side{B, W, B}, 0, false},
+		{"equal preference goes to higher rank", []chess.Side{B}, []chess.Side{B}, 1, true},
+		{"absolute beats mild", []chess.Side{W, W}, []chess.Side{W}, 0, false},
+		{"absolute by color difference", []chess.Side{B, W, B, B}, []chess.Side{B, W, B}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &swissEntry{player: &Player{ID: 1}, rec: &record{colors: tt.aColors}}
+			b := &swissEntry{player: &Player{ID: 2}, rec: &record{colors: tt.bColors}}
+			white, black := allocateColors(a, b, tt.board)
+			if (white == a) != tt.wantA || white == black {
+				t.Errorf("white is %d, want a: %v", white.player.ID, tt.wantA)
+			}
+		})
+	}
+}
+
+// 不会重复对局, 颜色差不超过2, 不会连续三轮同色
+func TestSwissNoRepeatPairings(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 5, 8)
+	pairings, err := tt.Start()
+	for err == nil && pairings != nil {
+		reportHigherSeedWins(t, tt, pairings)
+		pairings, err = tt.NextRound()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tt.Rounds) != 5 {
+		t.Fatalf("played %d rounds, want 5", len(tt.Rounds))
+	}
+
+	met := make(map[[2]int64]int)
+	for _, round := range tt.Rounds {
+		for _, p := range round {
+			key := [2]int64{min(p.White, p.Black), max(p.White, p.Black)}
+			if prev, ok := met[key]; ok {
+				t.Errorf("%d and %d met in rounds %d and %d", key[0], key[1], prev, p.Round)
+			}
+			met[key] = p.Round
+		}
+	}
+	for id, rec := range tt.records() {
+		diff := 0
+		for i, c := range rec.colors {
+			if c == chess.SideWhite {
+				diff++
+			} else {
+				diff--
+			}
+			if i >= 2 && rec.colors[i-1] == c && rec.colors[i-2] == c {
+				t.Errorf("player %d had the same color three times in a row: %v", id, rec.colors)
+			}
+		}
+		if diff > 2 || diff < -2 {
+			t.Errorf("player %d colors %v", id, rec.colors)
+		}
+	}
+}
+
+// 人数为奇数时排名最低并且还没有轮空过的选手轮空, 轮空得分, 没有人轮空两次
+func TestSwissBye(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 4, 5)
+	// 编排这一轮之前的成绩, 编排时轮空已经计分了
+	standings := tt.records()
+	pairings, err := tt.Start()
+	byes := make([]int64, 0)
+	for err == nil && pairings != nil {
+		round := len(tt.Rounds)
+		var bye *Pairing
+		for _, p := range pairings {
+			if p.Black == 0 {
+				if bye != nil {
+					t.Fatalf("round %d has two byes", round)
+				}
+				bye = p
+			}
+		}
+		if bye == nil || bye.Result != ResultBye {
+			t.Fatalf("round %d: got bye %+v", round, bye)
+		}
+
+		// 没有轮空过的选手里, 轮空的一方排名最低
+		for _, p := range tt.Players {
+			rec := standings[p.ID]
+			if p.ID == bye.White || rec.hadBye {
+				continue
+			}
+			byeRec := standings[bye.White]
+			if rec.score < byeRec.score || (rec.score == byeRec.score && p.Rating < tt.Player(bye.White).Rating) {
+				t.Errorf("round %d: %d got the bye but %d ranks lower", round, bye.White, p.ID)
+			}
+		}
+		byes = append(byes, bye.White)
+
+		reportHigherSeedWins(t, tt, pairings)
+		standings = tt.records()
+		pairings, err = tt.NextRound()
+	}
+	if err != nil && err != ErrNoPairing {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int64]bool)
+	for _, id := range byes {
+		if seen[id] {
+			t.Errorf("%d got a second bye: %v", id, byes)
+		}
+		seen[id] = true
+	}
+	if byes[0] != 5 {
+		t.Errorf("first bye went to %d, want the lowest seed", byes[0])
+	}
+}
+
+// 所有人都已经互相下过之后找不到编排, 不会重复对局
+func TestSwissNoPairing(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 4, 4)
+	pairings, err := tt.Start()
+	for i := 0; i < 3; i++ {
+		if err != nil {
+			t.Fatalf("round %d: %v", i+1, err)
+		}
+		reportHigherSeedWins(t, tt, pairings)
+		pairings, err = tt.NextRound()
+	}
+	if err != ErrNoPairing || pairings != nil {
+		t.Fatalf("got %v, %v, want ErrNoPairing", pairings, err)
+	}
+	if len(tt.Rounds) != 3 || tt.State != StateRunning {
+		t.Errorf("got %d rounds in state %v", len(tt.Rounds), tt.State)
+	}
+}
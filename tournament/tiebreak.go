@@ -0,0 +1,64 @@
+package tournament
+
+import "sort"
+
+type Standing struct {
+	Rank     int
+	Player   *Player
+	Score    float64
+	Buchholz float64
+	// 索内本-伯格分
+	SonnebornBerger float64
+}
+
+// 当前排名, 依次按积分, 布赫霍尔茨分, 索内本-伯格分, 等级分排序
+// 轮空和弃权不算真正下过, 不计入小分
+func (t *Tournament) Standings() []Standing {
+	records := t.records()
+
+	buchholz := make(map[int64]float64)
+	sonnebornBerger := make(map[int64]float64)
+	for _, round := range t.Rounds {
+		for _, p := range round {
+			if p.Result == ResultPending || p.Black == 0 || p.Forfeit {
+				continue
+			}
+
+			whitePoints, blackPoints := pairingPoints(p)
+			whiteScore := records[p.White].score
+			blackScore := records[p.Black].score
+			buchholz[p.White] += blackScore
+			buchholz[p.Black] += whiteScore
+			sonnebornBerger[p.White] += whitePoints * blackScore
+			sonnebornBerger[p.Black] += blackPoints * whiteScore
+		}
+	}
+
+	standings := make([]Standing, 0, len(t.Players))
+	for _, p := range t.Players {
+		standings = append(standings, Standing{
+			Player:          p,
+			Score:           records[p.ID].score,
+			Buchholz:        buchholz[p.ID],
+			SonnebornBerger: sonnebornBerger[p.ID],
+		})
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Buchholz != b.Buchholz {
+			return a.Buchholz > b.Buchholz
+		}
+		if a.SonnebornBerger != b.SonnebornBerger {
+			return a.SonnebornBerger > b.SonnebornBerger
+		}
+		return a.Player.Rating > b.Player.Rating
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+	}
+	return standings
+}
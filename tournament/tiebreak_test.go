@@ -0,0 +1,65 @@
+package tournament
+
+import "testing"
+
+// 小分只算真正下过的对局, 轮空和弃权不计入, 同分时依次比较布赫霍尔茨分, 索内本-伯格分
+func TestStandingsTiebreaks(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 2, 5)
+	tt.State = StateRunning
+	tt.Player(5).Withdrawn = true
+	tt.Rounds = [][]*Pairing{
+		{
+			{Round: 1, White: 1, Black: 2, Result: ResultWhiteWin},
+			{Round: 1, White: 3, Black: 4, Result: ResultDraw},
+			{Round: 1, White: 5, Result: ResultBye},
+		},
+		{
+			// 3没有出现, 1弃权胜
+			{Round: 2, White: 1, Black: 3, Result: ResultWhiteWin, Forfeit: true},
+			{Round: 2, White: 4, Black: 2, Result: ResultBlackWin},
+		},
+	}
+
+	want := []struct {
+		id              int64
+		score           float64
+		buchholz        float64
+		sonnebornBerger float64
+	}{
+		{1, 2, 1, 1},
+		// 2和5同分, 5的分全是轮空得的, 没有小分
+		{2, 1, 2.5, 0.5},
+		{5, 1, 0, 0},
+		// 3和4同分, 3和1的对局是弃权, 不算1的分
+		{4, 0.5, 1.5, 0.25},
+		{3, 0.5, 0.5, 0.25},
+	}
+	standings := tt.Standings()
+	if len(standings) != len(want) {
+		t.Fatalf("got %d standings, want %d", len(standings), len(want))
+	}
+	for i, w := range want {
+		s := standings[i]
+		if s.Rank != i+1 || s.Player.ID != w.id || s.Score != w.score || s.Buchholz != w.buchholz || s.SonnebornBerger != w.sonnebornBerger {
+			t.Errorf("rank %d: got %d with %v/%v/%v, want %d with %v/%v/%v",
+				i+1, s.Player.ID, s.Score, s.Buchholz, s.SonnebornBerger, w.id, w.score, w.buchholz, w.sonnebornBerger)
+		}
+	}
+}
+
+// 积分和小分都相同时按等级分排
+func TestStandingsRatingTiebreak(t *testing.T) {
+	tt := newTestTournament(t, FormatSwiss, 1, 4)
+	tt.State = StateRunning
+	tt.Rounds = [][]*Pairing{{
+		{Round: 1, White: 4, Black: 1, Result: ResultDraw},
+		{Round: 1, White: 2, Black: 3, Result: ResultDraw},
+	}}
+
+	standings := tt.Standings()
+	for i, s := range standings {
+		if s.Player.ID != int64(i+1) {
+			t.Errorf("rank %d: got %d, want %d", i+1, s.Player.ID, i+1)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package tournament
+
+import (
+	"chess-backend/comm/chess"
+	"errors"
+	"sort"
+)
+
+var (
+	ErrNotRegistering    = errors.New("tournament: registration is closed")
+	ErrAlreadyRegistered = errors.New("tournament: already registered")
+	ErrNotRegistered     = errors.New("tournament: not registered")
+	ErrNotEnoughPlayers  = errors.New("tournament: not enough players")
+	ErrNotRunning        = errors.New("tournament: not running")
+	ErrRoundNotComplete  = errors.New("tournament: current round is not complete")
+	ErrNoPairing         = errors.New("tournament: no valid pairing")
+	ErrResultReported    = errors.New("tournament: result already reported")
+)
+
+type Format int
+
+const (
+	// 瑞士制, 荷兰系统编排
+	FormatSwiss Format = iota
+	// 单循环, 伯格编排
+	FormatRoundRobin
+)
+
+type State int
+
+const (
+	StateRegistering State = iota
+	StateRunning
+	StateFinished
+)
+
+type Result int
+
+const (
+	ResultPending Result = iota
+	ResultWhiteWin
+	ResultBlackWin
+	ResultDraw
+	// 双方都弃权, 都不得分
+	ResultDoubleForfeit
+	// 轮空, 只有白方
+	ResultBye
+)
+
+// 轮空得分
+const ByePoints = 1.0
+
+type Player struct {
+	ID     int64
+	Name   string
+	Rating int
+	// 中途退出的选手不再参加编排, 已经下完的对局仍然计分
+	Withdrawn bool
+}
+
+type Pairing struct {
+	Round int
+	// 轮空时Black为0
+	White  int64
+	Black  int64
+	Result Result
+	// 一方没有出现而判负, 不算真正下过, 不影响颜色和对手的统计
+	Forfeit bool
+}
+
+// 选手的比赛记录, 从所有已经出结果的对局中统计出来
+type record struct {
+	score     float64
+	colors    []chess.Side
+	opponents map[int64]bool
+	hadBye    bool
+}
+
+type Tournament struct {
+	ID          int64
+	Name        string
+	Format      Format
+	TotalRounds int
+	Options     chess.GameOptions
+	OrganizerID int64
+	State       State
+
+	Players []*Player
+	// Rounds[i]为第i+1轮的所有对局
+	Rounds [][]*Pairing
+
+	// 单循环在开始时就排好了所有轮次
+	schedule [][]*Pairing
+}
+
+// 瑞士制需要指定轮数, 单循环的轮数在开始时根据人数决定
+func New(id int64, name string, format Format, totalRounds int, options chess.GameOptions, organizerID int64) *Tournament {
+	return &Tournament{
+		ID:          id,
+		Name:        name,
+		Format:      format,
+		TotalRounds: totalRounds,
+		Options:     options,
+		OrganizerID: organizerID,
+		State:       StateRegistering,
+		Players:     make([]*Player, 0),
+		Rounds:      make([][]*Pairing, 0),
+	}
+}
+
+func (t *Tournament) Player(id int64) *Player {
+	for _, p := range t.Players {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (t *Tournament) Register(id int64, name string, rating int) error {
+	if t.State != StateRegistering {
+		return ErrNotRegistering
+	}
+	if t.Player(id) != nil {
+		return ErrAlreadyRegistered
+	}
+
+	t.Players = append(t.Players, &Player{ID: id, Name: name, Rating: rating})
+	return nil
+}
+
+// 报名阶段退出直接删除, 比赛中退出则不再参加之后的编排
+func (t *Tournament) Withdraw(id int64) error {
+	for i, p := range t.Players {
+		if p.ID != id {
+			continue
+		}
+		if t.State == StateRegistering {
+			t.Players = append(t.Players[:i], t.Players[i+1:]...)
+		} else {
+			p.Withdrawn = true
+		}
+		return nil
+	}
+	return ErrNotRegistered
+}
+
+func (t *Tournament) CurrentRound() int {
+	return len(t.Rounds)
+}
+
+func (t *Tournament) activePlayers() []*Player {
+	result := make([]*Player, 0, len(t.Players))
+	for _, p := range t.Players {
+		if !p.Withdrawn {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// 开始比赛并编排第一轮
+func (t *Tournament) Start() ([]*Pairing, error) {
+	if t.State != StateRegistering {
+		return nil, ErrNotRegistering
+	}
+	if len(t.Players) < 2 {
+		return nil, ErrNotEnoughPlayers
+	}
+
+	// 按等级分排定种子顺序
+	sort.SliceStable(t.Players, func(i, j int) bool {
+		return t.Players[i].Rating > t.Players[j].Rating
+	})
+
+	if t.Format == FormatRoundRobin {
+		t.schedule = bergerSchedule(t.Players)
+		t.TotalRounds = len(t.schedule)
+	}
+	if t.TotalRounds < 1 {
+		return nil, ErrNotEnoughPlayers
+	}
+
+	t.State = StateRunning
+	return t.pairNextRound()
+}
+
+func (t *Tournament) RoundComplete() bool {
+	if len(t.Rounds) == 0 {
+		return false
+	}
+	for _, p := range t.Rounds[len(t.Rounds)-1] {
+		if p.Result == ResultPending {
+			return false
+		}
+	}
+	return true
+}
+
+// 当前轮结束之后调用, 编排下一轮, 所有轮次都结束时返回nil并结束比赛
+func (t *Tournament) NextRound() ([]*Pairing, error) {
+	if t.State != StateRunning {
+		return nil, ErrNotRunning
+	}
+	if !t.RoundComplete() {
+		return nil, ErrRoundNotComplete
+	}
+
+	if len(t.Rounds) >= t.TotalRounds || len(t.activePlayers()) < 2 {
+		t.State = StateFinished
+		return nil, nil
+	}
+	return t.pairNextRound()
+}
+
+// 提前结束比赛, 比如找不到合法的编排时
+func (t *Tournament) Finish() {
+	t.State = StateFinished
+}
+
+func (t *Tournament) pairNextRound() ([]*Pairing, error) {
+	round := len(t.Rounds) + 1
+
+	var pairings []*Pairing
+	var err error
+	if t.Format == FormatRoundRobin {
+		pairings = t.roundRobinRound(round)
+	} else {
+		pairings, err = t.swissRound(round)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 轮空直接出结果
+	for _, p := range pairings {
+		if p.Black == 0 && p.Result == ResultPending {
+			p.Result = ResultBye
+		}
+	}
+
+	t.Rounds = append(t.Rounds, pairings)
+	return pairings, nil
+}
+
+// 记录一局的结果, forfeit表示有一方没有出现
+func (t *Tournament) Report(pairing *Pairing, result Result, forfeit bool) error {
+	if t.State != StateRunning {
+		return ErrNotRunning
+	}
+	if pairing.Result != ResultPending {
+		return ErrResultReported
+	}
+
+	pairing.Result = result
+	pairing.Forfeit = forfeit || result == ResultDoubleForfeit
+	return nil
+}
+
+// 双方各自的得分
+func pairingPoints(p *Pairing) (float64, float64) {
+	switch p.Result {
+	case ResultWhiteWin:
+		return 1, 0
+	case ResultBlackWin:
+		return 0, 1
+	case ResultDraw:
+		return 0.5, 0.5
+	case ResultBye:
+		return ByePoints, 0
+	default:
+		return 0, 0
+	}
+}
+
+func (t *Tournament) records() map[int64]*record {
+	records := make(map[int64]*record)
+	for _, p := range t.Players {
+		records[p.ID] = &record{opponents: make(map[int64]bool)}
+	}
+
+	for _, round := range t.Rounds {
+		for _, p := range round {
+			if p.Result == ResultPending {
+				continue
+			}
+
+			whitePoints, blackPoints := pairingPoints(p)
+			records[p.White].score += whitePoints
+			if p.Black == 0 {
+				records[p.White].hadBye = true
+				continue
+			}
+			records[p.Black].score += blackPoints
+
+			// 弃权的对局不算下过, 之后还可以再编排在一起
+			if !p.Forfeit {
+				records[p.White].colors = append(records[p.White].colors, chess.SideWhite)
+				records[p.Black].colors = append(records[p.Black].colors, chess.SideBlack)
+				records[p.White].opponents[p.Black] = true
+				records[p.Black].opponents[p.White] = true
+			}
+		}
+	}
+	return records
+}